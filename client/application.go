@@ -1,39 +1,29 @@
 package client
 
+import "github.com/numercfd/registro/model"
+
+// AllGroups selects the instances of every deployment group.
+const AllGroups = model.AllGroups
+
 // NewApplication return a new Application object the specified name.
 func NewApplication(name string) *Application {
-	return &Application{
-		Name:      name,
-		Instances: make([]*Instance, 0),
-	}
+	return model.NewApplication(name)
 }
 
 // Application represents an app registered to the server.
-type Application struct {
-	// Name specifies a name to diferentiate apps.
-	Name string `json:"name"`
+type Application = model.Application
 
-	// Instances holds a list of instances running this app.
-	Instances []*Instance `json:"instances"`
-}
+// HashRing maps keys to the UP instances of an app by consistent hashing,
+// see PickForKey.
+type HashRing = model.HashRing
 
-// GetInstance return the instance with the specified id.
-func (a *Application) GetInstance(id string) *Instance {
-	for _, inst := range a.Instances {
-		if inst.Id == id {
-			return inst
-		}
-	}
-	return nil
+// NewHashRing returns the hash ring of the UP instances of the app, with
+// vnodes points each (model.DefaultVirtualNodes if zero), the same as the
+// one returned by the SR for the same instances. Clients watching the app
+// may build it themselves rather than calling GetHashRing.
+func NewHashRing(app *Application, vnodes int) *HashRing {
+	return model.NewHashRing(app, vnodes)
 }
 
-// GetAvailableInstances returns all instances with status UP.
-func (a *Application) GetAvailableInstances() []*Instance {
-	instances := make([]*Instance, 0)
-	for _, inst := range a.Instances {
-		if inst.Status == UP {
-			instances = append(instances, inst)
-		}
-	}
-	return instances
-}
+// Rollout gradually shifts traffic from a deployment group to another.
+type Rollout = model.Rollout
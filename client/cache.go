@@ -0,0 +1,191 @@
+package client
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// NewCache returns a Cache fetching applications with c.
+func NewCache(c *Client) *Cache {
+	return &Cache{
+		client: c,
+		apps:   make(map[string]cachedApp),
+	}
+}
+
+// Cache keeps the applications fetched from the SR, reusing them for as
+// long as the SR allows in the Cache-Control header of its responses (see
+// the app TTL). It is safe for concurrent use.
+type Cache struct {
+	// Path, if set, is the file where the apps fetched are saved, to be
+	// loaded with Load when the program restarts. With Path set, the last
+	// known copy of an app is also returned while the SR cannot be
+	// reached, so a service restarting during an outage still finds its
+	// peers.
+	Path string
+
+	client *Client
+
+	// mu protects apps.
+	mu sync.Mutex
+
+	// apps holds the applications fetched, by name.
+	apps map[string]cachedApp
+
+	// saving is held while apps are saved, so an older copy never
+	// replaces a newer one.
+	saving sync.Mutex
+}
+
+// cachedApp is an application kept by a Cache.
+type cachedApp struct {
+	app     *Application
+	expires time.Time
+}
+
+// GetApp returns the application with the specified name, fetching it from
+// the SR if it is not cached or has expired. The application returned is
+// shared with other callers and must not be modified.
+// It returns ErrAppNotExist if the application is not registered.
+func (c *Cache) GetApp(name string) (*Application, error) {
+	c.mu.Lock()
+	cached, ok := c.apps[name]
+	c.mu.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.app, nil
+	}
+
+	body, header, err := c.client.fetch("/apps/"+name, 200)
+	if e, ok := err.(*UnexpectedCodeError); ok && e.Code == 404 {
+		c.Invalidate(name)
+		return nil, ErrAppNotExist
+	}
+	if err != nil {
+		if ok && c.Path != "" {
+			log.Printf("using the last known copy of app %s: %s", name, err)
+			return cached.app, nil
+		}
+		return nil, err
+	}
+
+	app := new(Application)
+	if err := json.Unmarshal(body, app); err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.apps[name] = cachedApp{app: app, expires: time.Now().Add(maxAge(header))}
+	c.mu.Unlock()
+	c.save()
+	return app, nil
+}
+
+// Invalidate drops the application from the cache, so it is fetched again
+// on the next GetApp.
+func (c *Cache) Invalidate(name string) {
+	c.mu.Lock()
+	delete(c.apps, name)
+	c.mu.Unlock()
+	c.save()
+}
+
+// Load reads the apps saved in Path. They are expired, so GetApp fetches
+// them again, falling back on them if the SR cannot be reached. A missing
+// file is not an error.
+func (c *Cache) Load() error {
+	data, err := ioutil.ReadFile(c.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var l model.AppList
+	if err := json.Unmarshal(data, &l); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, app := range l.Apps {
+		if _, found := c.apps[app.Name]; !found {
+			c.apps[app.Name] = cachedApp{app: app}
+		}
+	}
+	return nil
+}
+
+// save writes the apps cached to Path, if set. The file is replaced
+// atomically, so a crash never leaves a partial copy. Failures are only
+// logged, the cache keeps working from memory.
+func (c *Cache) save() {
+	if c.Path == "" {
+		return
+	}
+	c.saving.Lock()
+	defer c.saving.Unlock()
+
+	c.mu.Lock()
+	l := model.AppList{Apps: make([]*Application, 0, len(c.apps))}
+	for _, cached := range c.apps {
+		l.Apps = append(l.Apps, cached.app)
+	}
+	data, err := json.Marshal(l)
+	c.mu.Unlock()
+	if err == nil {
+		err = writeFile(c.Path, data)
+	}
+	if err != nil {
+		log.Printf("cache save error: %s", err)
+	}
+}
+
+// writeFile replaces the file at path with data, through a temporary file
+// renamed over it.
+func writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// maxAge returns how long a response may be reused according to its
+// Cache-Control header. It returns zero if the header is missing or
+// forbids reuse.
+func maxAge(h http.Header) time.Duration {
+	var age time.Duration
+	for _, directive := range strings.Split(h.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		switch {
+		case directive == "no-cache" || directive == "no-store":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			n, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil && n > 0 {
+				age = time.Duration(n) * time.Second
+			}
+		}
+	}
+	return age
+}
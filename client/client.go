@@ -20,54 +20,235 @@ package client
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numercfd/registro/model"
 )
 
 // NewClient returns a Client with the specified ServiceUrl.
-func NewClient(url string) *Client {
-	return &Client{
+func NewClient(url string, opts ...Option) *Client {
+	c := &Client{
 		ServiceUrl: url,
+		HTTPClient: &http.Client{Transport: newTransport()},
+	}
+	for _, opt := range opts {
+		opt(c)
 	}
+	if c.Verifier != nil && c.Verifier.HTTPClient == nil {
+		c.Verifier.HTTPClient = c.HTTPClient
+	}
+
+	if path := strings.TrimPrefix(url, unixPrefix); path != url {
+		if t, ok := c.HTTPClient.Transport.(*http.Transport); ok {
+			t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			}
+		}
+	}
+	return c
+}
+
+// unixPrefix starts the ServiceUrl of a SR listening on a unix domain
+// socket, followed by the socket path (e.g. unix:///var/run/registro.sock).
+const unixPrefix = "unix://"
+
+// root returns the root URL of the SR API. Requests to a unix socket are
+// sent to a placeholder host, as the transport dials the socket instead.
+func (c *Client) root() string {
+	if strings.HasPrefix(c.ServiceUrl, unixPrefix) {
+		return "http://unix/registro"
+	}
+	return strings.TrimSuffix(c.ServiceUrl, "/")
 }
 
 // Client represents a connection to the SR REST server.
 type Client struct {
-	// Root URL to SR server.
+	// Root URL to SR server. It may have any path, such as the one of a
+	// gateway in front of the SR (e.g. http://gateway/infra/registry/registro),
+	// or be the path of a unix socket (e.g. unix:///var/run/registro.sock).
 	ServiceUrl string
+
+	// Rewrite, if set, may change the URL of every request before it is
+	// sent, e.g. to route it through a proxy with a different layout.
+	Rewrite func(u *url.URL)
+
+	// HTTPClient is used for every request to the SR. Its connections are
+	// kept alive and reused between heartbeats.
+	HTTPClient *http.Client
+
+	// HeartbeatAddr, if set, is the UDP address of the SR receiving
+	// heartbeats. RenewInstance then sends a signed packet instead of an
+	// HTTP request.
+	HeartbeatAddr string
+
+	// Token, if set, is the API token presented to the SR.
+	Token string
+
+	// Environment, if set, is the environment of the client, e.g. prod:
+	// the SR only shows it the apps of that environment, and creates its
+	// apps there.
+	Environment string
+
+	// Verifier, if set, verifies the signatures of the catalog responses
+	// and watch events, see WithServerPublicKey and WithJWKSURL.
+	Verifier *Verifier
+
+	// mu protects udp.
+	mu sync.Mutex
+
+	// udp is the socket heartbeats are sent from.
+	udp net.Conn
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the http.Client used for requests to the SR.
+func WithHTTPClient(cli *http.Client) Option {
+	return func(c *Client) {
+		c.HTTPClient = cli
+	}
+}
+
+// WithRewrite sets a function changing the URL of every request to the SR.
+func WithRewrite(fn func(u *url.URL)) Option {
+	return func(c *Client) {
+		c.Rewrite = fn
+	}
+}
+
+// WithToken makes the client present an API token to the SR, which must
+// grant the scopes of the requests sent: "discover" to read and watch the
+// catalog, "register" to change it too.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.Token = token
+	}
+}
+
+// WithEnvironment makes the client name its environment to the SR, e.g.
+// prod, so it never discovers the instances of the apps of another one,
+// such as staging.
+func WithEnvironment(env string) Option {
+	return func(c *Client) {
+		c.Environment = env
+	}
+}
+
+// WithUDPHeartbeat makes RenewInstance send heartbeats to the UDP address
+// of the SR (e.g. registry:8081), which must be started with an
+// HeartbeatAddr. Lost packets are tolerated by the lease, like missed
+// renewals, but they are not acknowledged: revoked leases are not reported.
+func WithUDPHeartbeat(addr string) Option {
+	return func(c *Client) {
+		c.HeartbeatAddr = addr
+	}
+}
+
+// WithMaxIdleConns sets how many idle connections are kept open to the SR.
+// It has no effect if the http.Client transport is not an *http.Transport.
+func WithMaxIdleConns(n int) Option {
+	return func(c *Client) {
+		if t, ok := c.HTTPClient.Transport.(*http.Transport); ok {
+			t.MaxIdleConns = n
+			t.MaxIdleConnsPerHost = n
+		}
+	}
+}
+
+// WithH2C makes the client talk HTTP/2 without TLS (h2c) to the SR, so all
+// requests are multiplexed over a single connection.
+// It has no effect if the http.Client transport is not an *http.Transport.
+func WithH2C() Option {
+	return func(c *Client) {
+		if t, ok := c.HTTPClient.Transport.(*http.Transport); ok {
+			t.Protocols = new(http.Protocols)
+			t.Protocols.SetUnencryptedHTTP2(true)
+		}
+	}
+}
+
+// WithTLSConfig sets the TLS configuration of the connections to the SR,
+// e.g. its minimum version and cipher suites for compliance requirements.
+// It has no effect if the http.Client transport is not an *http.Transport.
+func WithTLSConfig(cfg *tls.Config) Option {
+	return func(c *Client) {
+		if t, ok := c.HTTPClient.Transport.(*http.Transport); ok {
+			t.TLSClientConfig = cfg
+		}
+	}
+}
+
+// newTransport returns the default transport used by clients.
+// Unlike http.DefaultTransport it keeps enough idle connections to the SR
+// for heartbeats not to open a new connection each time.
+func newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = 16
+	t.IdleConnTimeout = 5 * time.Minute
+	return t
 }
 
 // RegisterService register the application and an instance to the SR.
 func (c *Client) RegisterService(id, appName, ip string, port int) (*Application, *Instance, error) {
+	inst := NewInstance(id, ip, port)
+	app, err := c.Register(appName, inst)
+	if err != nil {
+		return nil, nil, err
+	}
+	return app, inst, nil
+}
+
+// Register registers the application, if it does not exist, and the
+// instance to the SR.
+func (c *Client) Register(appName string, inst *Instance) (*Application, error) {
 	app, err := c.GetApp(appName)
 	if err != nil {
 		log.Printf("app %s not found. registering.", appName)
 		if app, err = c.NewApp(appName); err != nil {
-			return nil, nil, err
+			return nil, err
 		}
 	}
 
-	inst, err := c.NewInstance(app, id, ip, port)
-	if err != nil {
-		return nil, nil, err
+	if err := c.RegisterInstance(app, inst); err != nil {
+		return nil, err
 	}
-	return app, inst, nil
+	return app, nil
 }
 
 // GetApps makes a request to SR and return the list of registered apps.
+// Only the instances of the active deployment group of each app are returned.
 func (c *Client) GetApps() ([]*Application, error) {
-	body, err := c.get("/apps", 200)
+	return c.GetAppsInGroup("")
+}
+
+// GetAppsInGroup makes a request to SR and return the list of registered
+// apps with the instances of the deployment group. An empty group selects
+// the active group of each app, and AllGroups every instance.
+func (c *Client) GetAppsInGroup(group string) ([]*Application, error) {
+	path := "/apps"
+	if group != "" {
+		path += "?group=" + url.QueryEscape(group)
+	}
+	body, err := c.get(path, 200)
 	if err != nil {
 		return nil, err
 	}
 
-	var r struct {
-		Apps []*Application `json:"applications"`
-	}
+	var r model.AppList
 	if err := json.Unmarshal(body, &r); err != nil {
 		return nil, err
 	}
@@ -87,10 +268,28 @@ func (c *Client) GetApp(name string) (*Application, error) {
 			return app, nil
 		}
 	}
-	return nil, errors.New(fmt.Sprintf("Application %s not found.", name))
+	return nil, ErrAppNotExist
+}
+
+// GetHashRing makes a request to SR and return the consistent hash ring of
+// the available instances of the app, with the SR default of points per
+// instance. Its PickForKey returns the instance of a key, the same for
+// every client of the ring.
+func (c *Client) GetHashRing(appName string) (*HashRing, error) {
+	body, err := c.get("/apps/"+appName+"/hashring", 200)
+	if err != nil {
+		return nil, err
+	}
+
+	var ring HashRing
+	if err := json.Unmarshal(body, &ring); err != nil {
+		return nil, err
+	}
+	return &ring, nil
 }
 
 // UpdateApplication makes a request to SR and update the app list of Instances.
+// The list is replaced, see MergeApplication to keep the instances held.
 func (c *Client) UpdateApplication(app *Application) error {
 	body, err := c.get("/apps/"+app.Name, 200)
 	if err != nil {
@@ -107,6 +306,88 @@ func (c *Client) UpdateApplication(app *Application) error {
 	return nil
 }
 
+// GetInstance makes a request to SR and return the Instance of the app with
+// the specified id. It returns ErrInstNotExist if there is no such instance.
+func (c *Client) GetInstance(app *Application, id string) (*Instance, error) {
+	body, err := c.get("/apps/"+app.Name+"/"+id, 200)
+	if e, ok := err.(*UnexpectedCodeError); ok && e.Code == 404 {
+		return nil, ErrInstNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	inst := new(Instance)
+	if err := json.Unmarshal(body, inst); err != nil {
+		return nil, err
+	}
+	return inst, nil
+}
+
+// InstanceFilter selects the instances returned by ListInstances.
+type InstanceFilter struct {
+	// Group is the deployment group of the instances. Empty selects the app
+	// active group, and AllGroups every instance.
+	Group string
+
+	// Status, if set, only selects the instances with this status.
+	Status StatusType
+
+	// Metadata, if set, only selects the instances with all of these
+	// metadata values.
+	Metadata map[string]string
+}
+
+// ListInstances makes a request to SR and return the instances of the app
+// selected by filter, which may be nil. The group is selected by the SR,
+// the other fields are applied to its response.
+func (c *Client) ListInstances(app *Application, filter *InstanceFilter) ([]*Instance, error) {
+	if filter == nil {
+		filter = new(InstanceFilter)
+	}
+
+	path := "/apps/" + app.Name
+	if filter.Group != "" {
+		path += "?group=" + url.QueryEscape(filter.Group)
+	}
+	body, err := c.get(path, 200)
+	if e, ok := err.(*UnexpectedCodeError); ok && e.Code == 404 {
+		return nil, ErrAppNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var r struct {
+		Instances []*Instance `json:"instances"`
+	}
+	if err := json.Unmarshal(body, &r); err != nil {
+		return nil, err
+	}
+
+	instances := make([]*Instance, 0, len(r.Instances))
+	for _, inst := range r.Instances {
+		if filter.match(inst) {
+			instances = append(instances, inst)
+		}
+	}
+	return instances, nil
+}
+
+// match reports whether the instance is selected by the filter, apart from
+// its group.
+func (f *InstanceFilter) match(inst *Instance) bool {
+	if f.Status != "" && inst.Status != f.Status {
+		return false
+	}
+	for k, v := range f.Metadata {
+		if inst.Metadata[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
 // NewApp makes a request to SR and create a new Application.
 func (c *Client) NewApp(name string) (*Application, error) {
 	app := NewApplication(name)
@@ -122,98 +403,255 @@ func (c *Client) NewApp(name string) (*Application, error) {
 	return app, nil
 }
 
+// NewEphemeralApp makes a request to SR and create a new Application,
+// removed along with its instances once lifetime has elapsed, e.g. for the
+// preview environment of a pull request.
+func (c *Client) NewEphemeralApp(name string, lifetime time.Duration) (*Application, error) {
+	r, err := json.Marshal(struct {
+		Name      string  `json:"name"`
+		ExpiresIn float64 `json:"expiresIn"`
+	}{name, lifetime.Seconds()})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := c.post("/apps", r, 201); err != nil {
+		return nil, err
+	}
+	app := NewApplication(name)
+	expiresAt := time.Now().Add(lifetime)
+	app.ExpiresAt = &expiresAt
+	return app, nil
+}
+
 // NewInstance makes a request to SR and create a new app Instance.
+// If id is empty, the SR generates one and it is set in the Instance.
 func (c *Client) NewInstance(app *Application, id, ip string, port int) (*Instance, error) {
 	inst := NewInstance(id, ip, port)
-	r, err := json.MarshalIndent(inst, "", "  ")
-	if err != nil {
+	if err := c.RegisterInstance(app, inst); err != nil {
 		return nil, err
 	}
+	return inst, nil
+}
 
-	_, err = c.post("/apps/"+app.Name, r, 201)
+// RegisterInstance makes a request to SR and register the Instance to the
+// app. The Instance is updated with the record kept by the SR (e.g. its
+// generated id and normalized address) and the lease given.
+func (c *Client) RegisterInstance(app *Application, inst *Instance) error {
+	r, err := json.MarshalIndent(model.NewRegistration(inst), "", "  ")
 	if err != nil {
-		return nil, err
+		return err
 	}
-	return inst, nil
+
+	body, err := c.post("/apps/"+app.Name, r, 201)
+	if err != nil {
+		return err
+	}
+
+	lease := model.Lease{Instance: new(Instance)}
+	if err := json.Unmarshal(body, &lease); err != nil {
+		return err
+	}
+	*inst = *lease.Instance
+	inst.LeaseId = lease.LeaseId
+	inst.LeaseDuration = lease.LeaseDuration
+	return nil
 }
 
 // RenewInstance makes a request to SR and update Instance heartbeat.
+// It returns an UnexpectedCodeError with code 409 if the instance has been
+// registered again by someone else. With an HeartbeatAddr, it sends a UDP
+// heartbeat instead, and only returns errors sending it.
 func (c *Client) RenewInstance(app *Application, inst *Instance) error {
-	_, err := c.do(http.MethodPut, "/apps/"+app.Name+"/"+inst.Id, 204)
+	if c.HeartbeatAddr != "" {
+		return c.sendHeartbeat(app, inst)
+	}
+	_, err := c.do(http.MethodPut, "/apps/"+app.Name+"/"+inst.Id, renewalHeader(inst), nil, 204)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// DeleteInstance makes a request to SR and delete instance.
-func (c *Client) DeleteInstance(app *Application, inst *Instance) error {
-	_, err := c.do(http.MethodDelete, "/apps/"+app.Name+"/"+inst.Id, 204)
+// RenewInstanceWithVitals renews the Instance like RenewInstance, reporting
+// its runtime vitals to the SR.
+func (c *Client) RenewInstanceWithVitals(app *Application, inst *Instance, vitals *Vitals) error {
+	r, err := json.Marshal(vitals)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.do(http.MethodPut, "/apps/"+app.Name+"/"+inst.Id, renewalHeader(inst), r, 204)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-// get makes a GET request to the SR.
-func (c *Client) get(url string, expectedCode int) ([]byte, error) {
-	r, err := http.Get(c.ServiceUrl + "/1.0" + url)
+// sendHeartbeat sends a UDP heartbeat renewing the instance.
+func (c *Client) sendHeartbeat(app *Application, inst *Instance) error {
+	h := model.Heartbeat{App: app.Name, Id: inst.Id, Generation: inst.Generation, Time: time.Now().UnixMilli()}
+	packet, err := h.Marshal(inst.LeaseId)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer r.Body.Close()
 
-	if r.StatusCode != expectedCode {
-		return nil, &UnexpectedCodeError{Code: r.StatusCode}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.udp == nil {
+		if c.udp, err = net.Dial("udp", c.HeartbeatAddr); err != nil {
+			return err
+		}
 	}
+	if _, err := c.udp.Write(packet); err != nil {
+		// The socket is dialed again on the next heartbeat.
+		c.udp.Close()
+		c.udp = nil
+		return err
+	}
+	return nil
+}
 
-	body, err := ioutil.ReadAll(r.Body)
+// SetActiveGroup makes a request to SR and switch the deployment group
+// served by discovery for the app.
+func (c *Client) SetActiveGroup(app *Application, group string) error {
+	r, err := json.Marshal(map[string]string{"activeGroup": group})
 	if err != nil {
-		return nil, err
+		return err
+	}
+
+	_, err = c.do(http.MethodPut, "/apps/"+app.Name+":activeGroup", nil, r, 204)
+	if err != nil {
+		return err
 	}
-	return body, nil
+	app.ActiveGroup = group
+	return nil
 }
 
-// post makes a POST request to the SR.
-func (c *Client) post(url string, postdata []byte, expectedCode int) ([]byte, error) {
-	buf := bytes.NewBuffer(postdata)
-	r, err := http.Post(c.ServiceUrl+"/1.0"+url, "application/json", buf)
+// DeleteInstance makes a request to SR and delete instance.
+func (c *Client) DeleteInstance(app *Application, inst *Instance) error {
+	_, err := c.do(http.MethodDelete, "/apps/"+app.Name+"/"+inst.Id, leaseHeader(inst), nil, 204)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return nil
+}
 
-	if r.StatusCode != expectedCode {
-		return nil, &UnexpectedCodeError{Code: r.StatusCode}
+// UpdateMetadata makes a request to SR and replace the Instance metadata.
+// The update only succeeds if the instance has not changed since it was
+// fetched, otherwise an UnexpectedCodeError with code 412 is returned and
+// the instance must be fetched again.
+func (c *Client) UpdateMetadata(app *Application, inst *Instance, metadata map[string]string) error {
+	r, err := json.Marshal(metadata)
+	if err != nil {
+		return err
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	h := make(http.Header)
+	h.Set("If-Match", fmt.Sprintf(`"%d.%d"`, inst.Generation, inst.Version))
+	_, err = c.do(http.MethodPut, "/apps/"+app.Name+"/"+inst.Id+"/metadata", h, r, 204)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	inst.Metadata = metadata
+	inst.Version++
+	return nil
+}
+
+// leaseHeader returns the headers presenting the instance lease and
+// generation to the SR.
+func leaseHeader(inst *Instance) http.Header {
+	h := make(http.Header)
+	if inst.LeaseId != "" {
+		h.Set("Registro-Lease", inst.LeaseId)
+	}
+	if inst.Generation != 0 {
+		h.Set("Registro-Generation", strconv.FormatUint(inst.Generation, 10))
+	}
+	return h
+}
+
+// renewalHeader returns the headers of a renewal of the instance: its lease,
+// and the current time so the SR measures the clock skew.
+func renewalHeader(inst *Instance) http.Header {
+	h := leaseHeader(inst)
+	h.Set("Registro-Client-Time", time.Now().Format(time.RFC3339Nano))
+	return h
+}
+
+// authorize adds the API token and the environment of the client, if
+// any, to req.
+func (c *Client) authorize(req *http.Request) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if c.Environment != "" {
+		req.Header.Set("Registro-Environment", c.Environment)
 	}
-	return body, nil
 }
 
-// do makes an HTTP request to the SR with the specified method.
-func (c *Client) do(method, url string, expectedCode int) ([]byte, error) {
-	cli := &http.Client{}
-	req, err := http.NewRequest(method, c.ServiceUrl+"/1.0"+url, nil)
+// get makes a GET request to the SR.
+func (c *Client) get(url string, expectedCode int) ([]byte, error) {
+	body, _, err := c.send(http.MethodGet, url, nil, nil, expectedCode)
+	return body, err
+}
+
+// fetch makes a GET request to the SR, returning the response headers
+// along with the body.
+func (c *Client) fetch(url string, expectedCode int) ([]byte, http.Header, error) {
+	return c.send(http.MethodGet, url, nil, nil, expectedCode)
+}
+
+// post makes a POST request to the SR.
+func (c *Client) post(url string, postdata []byte, expectedCode int) ([]byte, error) {
+	body, _, err := c.send(http.MethodPost, url, nil, postdata, expectedCode)
+	return body, err
+}
+
+// do makes an HTTP request to the SR with the specified method, headers
+// and body. The body may be nil.
+func (c *Client) do(method, url string, header http.Header, body []byte, expectedCode int) ([]byte, error) {
+	data, _, err := c.send(method, url, header, body, expectedCode)
+	return data, err
+}
+
+// send makes an HTTP request to the SR through c.HTTPClient, returning the
+// response body and headers. The response body is always read to the end
+// and closed, even on errors, so the connection is kept alive and reused by
+// the next request.
+func (c *Client) send(method, path string, header http.Header, body []byte, expectedCode int) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(method, c.root()+"/1.0"+path, bytes.NewReader(body))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if c.Rewrite != nil {
+		c.Rewrite(req.URL)
+	}
+	c.authorize(req)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
 	}
 
-	r, err := cli.Do(req)
+	r, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer r.Body.Close()
 
+	data, err := ioutil.ReadAll(r.Body)
 	if r.StatusCode != expectedCode {
-		return nil, &UnexpectedCodeError{Code: r.StatusCode}
+		return nil, nil, &UnexpectedCodeError{Code: r.StatusCode}
 	}
-
-	body, err := ioutil.ReadAll(r.Body)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	if c.Verifier != nil && method == http.MethodGet && signedPath(path) {
+		if err := c.Verifier.Verify(method, req.URL.RequestURI(), 0, data, r.Header.Get(SignatureHeader)); err != nil {
+			return nil, nil, &SignatureError{Path: path, Reason: err.Error()}
+		}
 	}
-	return body, nil
+	return data, r.Header, nil
 }
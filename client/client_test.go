@@ -0,0 +1,145 @@
+package client
+
+import (
+	"bytes"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// newConnCounter returns a test server answering with handler, and the
+// number of connections clients opened to it.
+func newConnCounter(t *testing.T, handler http.HandlerFunc) (*httptest.Server, *int64) {
+	var conns int64
+	srv := httptest.NewUnstartedServer(handler)
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv, &conns
+}
+
+func TestConnectionReuse(t *testing.T) {
+	// Error responses have bodies larger than the transport drains by
+	// itself, so the connection is only reused if the client reads them.
+	large := bytes.Repeat([]byte("x"), 1<<20)
+	srv, conns := newConnCounter(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /registro/1.0/apps":
+			w.Write([]byte(`{"applications": [{"name": "web", "instances": [{"id": "i-1", "ip": "10.0.0.1", "port": 8080, "status": "up"}]}]}`))
+		case "GET /registro/1.0/apps/web/hashring":
+			w.WriteHeader(500)
+			w.Write(large)
+		case "PUT /registro/1.0/apps/web/i-1":
+			w.WriteHeader(204)
+		case "DELETE /registro/1.0/apps/web/i-1":
+			w.WriteHeader(409)
+			w.Write(large)
+		default:
+			w.WriteHeader(404)
+			w.Write(large)
+		}
+	})
+	c := NewClient(srv.URL + "/registro")
+
+	for i := 0; i < 20; i++ {
+		app, err := c.GetApp("web")
+		if err != nil {
+			t.Fatal(err)
+		}
+		inst := app.Instances[0]
+		if err := c.RenewInstance(app, inst); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.GetHashRing("web"); !isCode(err, 500) {
+			t.Fatalf("got %v, want status 500", err)
+		}
+		if err := c.DeleteInstance(app, inst); !isCode(err, 409) {
+			t.Fatalf("got %v, want status 409", err)
+		}
+		if _, err := c.GetInstance(app, "i-2"); err != ErrInstNotExist {
+			t.Fatalf("got %v, want ErrInstNotExist", err)
+		}
+		if _, err := c.NewApp("api"); !isCode(err, 404) {
+			t.Fatalf("got %v, want status 404", err)
+		}
+	}
+	if n := atomic.LoadInt64(conns); n != 1 {
+		t.Errorf("%d connections opened for sequential requests, want 1", n)
+	}
+}
+
+func TestConnectionReuseAcrossClients(t *testing.T) {
+	srv, conns := newConnCounter(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(204)
+	})
+
+	// Clients sharing an http.Client share its connections.
+	shared := &http.Client{Transport: newTransport()}
+	app, inst := NewApplication("web"), NewInstance("i-1", "10.0.0.1", 8080)
+	for i := 0; i < 10; i++ {
+		c := NewClient(srv.URL+"/registro", WithHTTPClient(shared))
+		if err := c.RenewInstance(app, inst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt64(conns); n != 1 {
+		t.Errorf("%d connections opened, want 1", n)
+	}
+}
+
+func TestH2CConnections(t *testing.T) {
+	srv := httptest.NewUnstartedServer(nil)
+	var conns int64
+	srv.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("%s %s sent over %s, want HTTP/2", r.Method, r.URL.Path, r.Proto)
+		}
+		w.WriteHeader(204)
+	})
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt64(&conns, 1)
+		}
+	}
+	// Like the registry server, which serves h2c.
+	srv.Config.Protocols = new(http.Protocols)
+	srv.Config.Protocols.SetHTTP1(true)
+	srv.Config.Protocols.SetUnencryptedHTTP2(true)
+	srv.Start()
+	defer srv.Close()
+
+	// Heartbeats sent at once by the instances of a host share the
+	// connection of the first one.
+	c := NewClient(srv.URL+"/registro", WithH2C())
+	app, inst := NewApplication("web"), NewInstance("i-1", "10.0.0.1", 8080)
+	if err := c.RenewInstance(app, inst); err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.RenewInstance(app, inst); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := atomic.LoadInt64(&conns); n != 1 {
+		t.Errorf("%d connections opened for concurrent requests, want 1", n)
+	}
+}
+
+// isCode reports whether err is an UnexpectedCodeError with the code.
+func isCode(err error, code int) bool {
+	e, ok := err.(*UnexpectedCodeError)
+	return ok && e.Code == code
+}
@@ -1,52 +1,37 @@
 package client
 
-import (
-	"time"
-)
+import "github.com/numercfd/registro/model"
 
 // NewInstance return a new Instance object with the specified data.
 func NewInstance(id, ip string, port int) *Instance {
-	return &Instance{
-		Id:          id,
-		IPAddr:      ip,
-		Port:        port,
-		Status:      STARTING,
-		LastRenewal: time.Now().Unix(),
-	}
+	return model.NewInstance(id, ip, port)
 }
 
 // Instance represents a service running an application.
-type Instance struct {
-	// Id is a unique identifier for an Instance.
-	Id string `json:"id"`
-
-	// IPAddr is the newowrk address where the instance is located.
-	IPAddr string `json:"ip"`
+type Instance = model.Instance
 
-	// Port is the network port where the instance is located.
-	Port int `json:"port"`
-
-	// Status provide information of the operational status of the instance.
-	Status StatusType `json:"status"`
-
-	// LastRenewal holds the timestamp when the instance last contacted the SR.
-	LastRenewal int64 `json:"lastRenewal"`
-}
+// Vitals holds runtime measurements reported by an instance on renewals.
+type Vitals = model.Vitals
 
 // StatusType represents an instance status
-type StatusType string
+type StatusType = model.StatusType
 
 const (
 	// UP represents an instance receiving requests.
-	UP StatusType = "up"
+	UP = model.UP
 
 	// DOWN representes an instance that has not sent heartbeats after some time.
-	DOWN StatusType = "down"
+	DOWN = model.DOWN
 
 	// STARTING represents an instance that has registered, but has not yet send any heartbeats.
-	STARTING StatusType = "starting"
+	STARTING = model.STARTING
 
 	// OUTOFSERVICE represents an instance that has been deliberately deleted.
-	// It may be down for maintainance or shutting down.
-	OUTOFSERVICE StatusType = "out-of-service"
+	OUTOFSERVICE = model.OUTOFSERVICE
+
+	// MAINTENANCE represents an instance under a maintenance window.
+	MAINTENANCE = model.MAINTENANCE
+
+	// DRAINING represents an instance about to reach its planned termination.
+	DRAINING = model.DRAINING
 )
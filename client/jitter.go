@@ -0,0 +1,32 @@
+package client
+
+import (
+	"math/rand"
+	"time"
+)
+
+// DefaultJitter is the fraction of the renewal interval randomized by
+// default, see Registration.Jitter.
+const DefaultJitter = 0.1
+
+// Jittered returns d changed by a random amount of up to fraction of it,
+// either way. Instances started together, e.g. by a deploy, thus spread
+// their renewals over time rather than reaching the SR at once.
+func Jittered(d time.Duration, fraction float64) time.Duration {
+	if fraction <= 0 || d <= 0 {
+		return d
+	}
+	if fraction > 1 {
+		fraction = 1
+	}
+	return d + time.Duration((2*rand.Float64()-1)*fraction*float64(d))
+}
+
+// Splay returns a random delay from zero up to max, to wait before a
+// registration so instances started together register at different times.
+func Splay(max time.Duration) time.Duration {
+	if max <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
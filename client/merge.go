@@ -0,0 +1,86 @@
+package client
+
+import (
+	"encoding/json"
+)
+
+// AppChanges summarizes the changes merged into an Application.
+type AppChanges struct {
+	// Added holds the instances registered since the last update.
+	Added []*Instance
+
+	// Removed holds the instances no longer registered. They are not in
+	// the Application anymore.
+	Removed []*Instance
+
+	// Updated holds the instances whose status, address, group,
+	// generation or metadata changed.
+	Updated []*Instance
+}
+
+// Empty reports whether nothing changed.
+func (c *AppChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Updated) == 0
+}
+
+// MergeApplication makes a request to SR and merges the app state into
+// app. Unlike UpdateApplication, instances still registered keep their
+// identity: they are updated in place, so pointers held by the caller (such
+// as the instance it registered, with its lease) remain valid.
+func (c *Client) MergeApplication(app *Application) (*AppChanges, error) {
+	body, err := c.get("/apps/"+app.Name, 200)
+	if err != nil {
+		return nil, err
+	}
+
+	fresh := NewApplication(app.Name)
+	if err := json.Unmarshal(body, fresh); err != nil {
+		return nil, err
+	}
+	return mergeApplication(app, fresh), nil
+}
+
+// mergeApplication merges fresh into app, reusing the instances of app.
+func mergeApplication(app, fresh *Application) *AppChanges {
+	changes := new(AppChanges)
+	seen := make(map[string]bool, len(fresh.Instances))
+	instances := make([]*Instance, 0, len(fresh.Instances))
+	for _, f := range fresh.Instances {
+		seen[f.Id] = true
+		inst := app.GetInstance(f.Id)
+		if inst == nil {
+			changes.Added = append(changes.Added, f)
+			instances = append(instances, f)
+			continue
+		}
+
+		if changed(inst, f) {
+			changes.Updated = append(changes.Updated, inst)
+		}
+		// The lease is only known by the registrant.
+		leaseId, leaseDuration := inst.LeaseId, inst.LeaseDuration
+		*inst = *f
+		inst.LeaseId, inst.LeaseDuration = leaseId, leaseDuration
+		instances = append(instances, inst)
+	}
+	for _, inst := range app.Instances {
+		if !seen[inst.Id] {
+			changes.Removed = append(changes.Removed, inst)
+		}
+	}
+
+	*app = *fresh
+	app.Instances = instances
+	return changes
+}
+
+// changed reports whether the instance changed in a way its consumers care
+// about. Renewals alone are not changes.
+func changed(old, new *Instance) bool {
+	return old.Status != new.Status ||
+		old.IPAddr != new.IPAddr ||
+		old.Port != new.Port ||
+		old.DeploymentGroup != new.DeploymentGroup ||
+		old.Generation != new.Generation ||
+		old.Version != new.Version
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"math"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// Picker chooses which instance of an application to send a request to.
+// Implementations must be safe for concurrent use.
+type Picker interface {
+	// Pick returns one of the instances, or nil if it is empty.
+	Pick(instances []*Instance) *Instance
+}
+
+// Pick returns an available instance of the application chosen by p.
+// While a rollout is active, the instances of one of its groups are given
+// to p according to the rollout weight.
+// It returns nil if no instance is available.
+func Pick(a *Application, p Picker) *Instance {
+	instances := a.GetAvailableInstances()
+	if r := a.Rollout; r.Active() {
+		group := r.PickGroup()
+		inGroup := make([]*Instance, 0, len(instances))
+		for _, inst := range instances {
+			if inst.DeploymentGroup == "" || inst.DeploymentGroup == group {
+				inGroup = append(inGroup, inst)
+			}
+		}
+		instances = inGroup
+	}
+	return p.Pick(instances)
+}
+
+// RoundRobin picks every instance in turn.
+type RoundRobin struct {
+	next uint64
+}
+
+// Pick implements Picker.
+func (p *RoundRobin) Pick(instances []*Instance) *Instance {
+	if len(instances) == 0 {
+		return nil
+	}
+	n := atomic.AddUint64(&p.next, 1) - 1
+	return instances[n%uint64(len(instances))]
+}
+
+// Affinity picks the instance a consumer sticks to, the same as the pick
+// endpoint of the SR with the affinity strategy: consumers sharing an
+// Identity, e.g. the clients of a cache shard, always pick the same
+// instance while it is available, and instances joining or leaving only
+// move their share of the consumers.
+type Affinity struct {
+	// Identity identifies the consumer, e.g. a user id or a shard key.
+	Identity string
+
+	// Zone, if set, is the zone of the consumer: the instances with this
+	// zone metadata are preferred, if any is available.
+	Zone string
+}
+
+// Pick implements Picker.
+func (p *Affinity) Pick(instances []*Instance) *Instance {
+	if len(instances) == 0 {
+		return nil
+	}
+	sorted := append([]*Instance(nil), instances...)
+	model.SortByAffinity(sorted, p.Identity, p.Zone)
+	return sorted[0]
+}
+
+// LoadMetadataKey is the metadata key holding the load score of an instance
+// which does not report vitals.
+const LoadMetadataKey = "load"
+
+// LeastLoaded picks the instance with the lowest load, as reported through
+// vitals or the LoadMetadataKey metadata.
+type LeastLoaded struct {
+	// HalfLife is the age after which reported vitals count for half of
+	// their value. Stale vitals decay towards zero, so instances which have
+	// not reported for a while get a chance to take new requests.
+	// Zero disables the decay.
+	HalfLife time.Duration
+
+	// Load returns the load of an instance. If nil, Load is used.
+	Load func(inst *Instance) float64
+}
+
+// Pick implements Picker.
+func (p *LeastLoaded) Pick(instances []*Instance) *Instance {
+	load := p.Load
+	if load == nil {
+		load = Load
+	}
+
+	var best *Instance
+	min := math.Inf(1)
+	for _, inst := range instances {
+		l := load(inst)
+		if v := inst.Vitals; v != nil && p.HalfLife > 0 {
+			age := time.Since(time.Unix(v.ReportedAt, 0))
+			l *= math.Pow(0.5, age.Seconds()/p.HalfLife.Seconds())
+		}
+		if l < min {
+			best, min = inst, l
+		}
+	}
+	return best
+}
+
+// Load returns the load of an instance: its in-flight requests plus the
+// fraction of CPU in use, so CPU breaks ties. Instances without vitals use
+// the score in their LoadMetadataKey metadata, or zero.
+func Load(inst *Instance) float64 {
+	if v := inst.Vitals; v != nil {
+		return float64(v.InFlight) + v.CPU
+	}
+	if s, ok := inst.Metadata[LoadMetadataKey]; ok {
+		if l, err := strconv.ParseFloat(s, 64); err == nil {
+			return l
+		}
+	}
+	return 0
+}
@@ -0,0 +1,457 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// HealthPath is the path Registration.Mount serves the status of the
+// registration at, in the registrant's own HTTP server.
+const HealthPath = "/registro-health"
+
+// RegistrationState is the state of a Registration.
+type RegistrationState string
+
+const (
+	// Registering is the state of a Registration registering the instance,
+	// until it succeeds.
+	Registering RegistrationState = "REGISTERING"
+
+	// Registered is the state of a Registration whose instance is
+	// registered, and its lease renewed.
+	Registered RegistrationState = "REGISTERED"
+
+	// RenewFailing is the state of a Registration whose last renewal
+	// failed. The instance stays discoverable until its lease expires.
+	RenewFailing RegistrationState = "RENEW_FAILING"
+
+	// Deregistered is the state of a Registration whose instance is not
+	// registered: before Run, and after it.
+	Deregistered RegistrationState = "DEREGISTERED"
+)
+
+// RegistrationStatus is the status of a Registration, as seen from the
+// instance.
+type RegistrationStatus struct {
+	// App is the name of the application.
+	App string `json:"app"`
+
+	// Instance is the id of the instance, empty until it is registered if
+	// the SR generates it.
+	Instance string `json:"instance"`
+
+	// Registry is the root URL of the SR.
+	Registry string `json:"registry"`
+
+	// State is the state of the registration.
+	State RegistrationState `json:"state"`
+
+	// Since holds when the registration entered its State.
+	Since time.Time `json:"since"`
+
+	// RegisteredAt holds when the instance was last registered.
+	RegisteredAt *time.Time `json:"registeredAt,omitempty"`
+
+	// LastRenewal holds when the lease was last renewed, or given on
+	// registration.
+	LastRenewal *time.Time `json:"lastRenewal,omitempty"`
+
+	// LeaseRemaining holds the seconds left before the lease expires, if
+	// not renewed.
+	LeaseRemaining float64 `json:"leaseRemaining"`
+
+	// LastError is the last registration or renewal error, if any.
+	LastError string `json:"lastError,omitempty"`
+
+	// LastErrorAt holds when LastError happened.
+	LastErrorAt *time.Time `json:"lastErrorAt,omitempty"`
+
+	// Reregistrations is the number of times the instance was registered
+	// again, as the SR no longer knew it.
+	Reregistrations int `json:"reregistrations"`
+}
+
+// Discoverable reports whether consumers may find the instance: it is
+// registered, and its lease has not expired.
+func (s RegistrationStatus) Discoverable() bool {
+	switch s.State {
+	case Registered:
+		return true
+	case RenewFailing:
+		return s.LeaseRemaining > 0
+	}
+	return false
+}
+
+// NewRegistration returns a Registration of the instance to the app,
+// started with Run.
+func (c *Client) NewRegistration(appName string, inst *Instance) *Registration {
+	return &Registration{Jitter: DefaultJitter, client: c, appName: appName, inst: inst, op: make(chan struct{}, 1), state: Deregistered, since: time.Now()}
+}
+
+// Registration keeps an instance registered to the SR: Run registers it,
+// renews its lease, and deregisters it when done. Its Status may be served
+// by the instance itself, see Mount, giving operators a uniform way to
+// debug registrations from the instance side, or surfaced in the health
+// checks of the instance.
+//
+//	reg := c.NewRegistration("app-name", client.NewInstance("", "10.0.0.1", 8080))
+//	reg.Mount(http.DefaultServeMux)
+//	go reg.Run(ctx)
+type Registration struct {
+	// Interval is the time between renewals. Zero renews at a third of the
+	// lease duration, or every 30 seconds.
+	Interval time.Duration
+
+	// Jitter is the fraction of the Interval randomized on every renewal,
+	// DefaultJitter unless changed. Zero renews at a fixed Interval.
+	Jitter float64
+
+	// Splay, if set, delays the first registration by a random time up to
+	// it, so instances started together do not register at once.
+	Splay time.Duration
+
+	// OnStateChange, if set, is called on every change of the State, from
+	// the goroutine of Run.
+	OnStateChange func(old, new RegistrationState)
+
+	// OnError, if set, is called on every registration or renewal error,
+	// from the goroutine of Run.
+	OnError func(err error)
+
+	client  *Client
+	appName string
+	inst    *Instance
+
+	// op is held by the requests about the instance to the SR, one at a
+	// time.
+	op chan struct{}
+
+	// mu protects the fields below.
+	mu           sync.Mutex
+	app          *Application
+	state        RegistrationState
+	since        time.Time
+	registeredAt time.Time
+	lastRenewal  time.Time
+	lease        time.Duration
+	lastError    error
+	lastErrorAt  time.Time
+
+	reregistrations int
+}
+
+// Run registers the instance, retrying until it succeeds, then renews its
+// lease until ctx is done, and deregisters it. Renewal failures are logged
+// and retried on the next renewal. An instance the SR no longer knows,
+// e.g. after an outage, is registered again with the same id and
+// generation. It returns the deregistration error, if any.
+func (r *Registration) Run(ctx context.Context) error {
+	r.setState(Registering, nil)
+	if !wait(ctx, Splay(r.Splay)) {
+		r.setState(Deregistered, nil)
+		return nil
+	}
+	registered := r.register()
+	for r.sleep(ctx) {
+		if registered {
+			registered = r.renew()
+		}
+		if !registered {
+			registered = r.register()
+		}
+	}
+	if !registered {
+		r.setState(Deregistered, nil)
+		return nil
+	}
+	return r.deregister()
+}
+
+// register registers the instance, and reports whether it succeeded.
+func (r *Registration) register() bool {
+	r.lock(context.Background())
+	r.mu.Lock()
+	inst := *r.inst
+	r.mu.Unlock()
+	app, err := r.client.Register(r.appName, &inst)
+	if err == nil {
+		r.registered(app, &inst)
+	}
+	r.unlock()
+
+	if err != nil {
+		log.Printf("registration of app %s error: %s", r.appName, err)
+		r.setState(Registering, err)
+		return false
+	}
+	r.setState(Registered, nil)
+	return true
+}
+
+// registered records the registration of inst to app. It must be called
+// with op held.
+func (r *Registration) registered(app *Application, inst *Instance) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	*r.inst = *inst
+	r.app = app
+	r.registeredAt = time.Now()
+	r.lastRenewal = r.registeredAt
+	r.lease = time.Duration(inst.LeaseDuration * float64(time.Second))
+}
+
+// renew renews the lease of the instance, and reports whether it is still
+// registered: renewals answered with 404 mean the SR forgot the instance,
+// which must be registered again.
+func (r *Registration) renew() bool {
+	r.lock(context.Background())
+	r.mu.Lock()
+	app := r.app
+	r.mu.Unlock()
+	err := r.client.RenewInstance(app, r.inst)
+	id := r.inst.Id
+	r.unlock()
+
+	if e, ok := err.(*UnexpectedCodeError); ok && e.Code == 404 {
+		log.Printf("instance %s of app %s is unknown to the registry, registering it again", id, r.appName)
+		r.mu.Lock()
+		r.reregistrations++
+		r.mu.Unlock()
+		r.setState(Registering, ErrInstNotExist)
+		return false
+	}
+	if err != nil {
+		log.Printf("renewal of instance %s of app %s error: %s", id, r.appName, err)
+		r.setState(RenewFailing, err)
+		return true
+	}
+	r.mu.Lock()
+	r.lastRenewal = time.Now()
+	r.mu.Unlock()
+	r.setState(Registered, nil)
+	return true
+}
+
+// deregister deletes the instance from the SR.
+func (r *Registration) deregister() error {
+	r.lock(context.Background())
+	r.mu.Lock()
+	app := r.app
+	r.mu.Unlock()
+	err := r.client.DeleteInstance(app, r.inst)
+	r.unlock()
+	r.setState(Deregistered, err)
+	return err
+}
+
+// RegistrationUpdate is a change of the address or metadata advertised by
+// an instance, see UpdateRegistration. Zero fields are left unchanged.
+type RegistrationUpdate struct {
+	// IPAddr is the new address of the instance.
+	IPAddr string
+
+	// Port is the new port of the instance.
+	Port int
+
+	// Metadata replaces the metadata of the instance.
+	Metadata map[string]string
+}
+
+// UpdateRegistration changes the address or metadata advertised by the
+// instance at runtime (e.g. a port reassigned, or feature flags), keeping
+// its id. Metadata changes are sent in place. Address changes, or metadata
+// changes conflicting with another one, register the instance again, which
+// replaces its previous registration at once. Until the instance is
+// registered, the changes are only applied to the next registration. ctx
+// bounds the wait for a request about the instance in flight.
+func (r *Registration) UpdateRegistration(ctx context.Context, u RegistrationUpdate) error {
+	if err := r.lock(ctx); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	inst := *r.inst
+	app, state := r.app, r.state
+	r.mu.Unlock()
+
+	moved := u.IPAddr != "" && u.IPAddr != inst.IPAddr || u.Port != 0 && u.Port != inst.Port
+	if u.IPAddr != "" {
+		inst.IPAddr = u.IPAddr
+	}
+	if u.Port != 0 {
+		inst.Port = u.Port
+	}
+	if state == Registering || state == Deregistered {
+		if u.Metadata != nil {
+			inst.Metadata = u.Metadata
+		}
+		r.mu.Lock()
+		*r.inst = inst
+		r.mu.Unlock()
+		r.unlock()
+		return nil
+	}
+
+	if !moved {
+		if u.Metadata == nil {
+			r.unlock()
+			return nil
+		}
+		err := r.client.UpdateMetadata(app, &inst, u.Metadata)
+		if err == nil {
+			r.mu.Lock()
+			*r.inst = inst
+			r.mu.Unlock()
+			r.unlock()
+			return nil
+		}
+		if e, ok := err.(*UnexpectedCodeError); !ok || (e.Code != 412 && e.Code != 404) {
+			r.unlock()
+			return err
+		}
+		// Changed by another client, or forgotten by the SR.
+	}
+	if u.Metadata != nil {
+		inst.Metadata = u.Metadata
+	}
+	err := r.client.RegisterInstance(app, &inst)
+	if err == nil {
+		r.registered(app, &inst)
+	}
+	r.unlock()
+
+	if err != nil {
+		return err
+	}
+	log.Printf("instance %s of app %s registered again at %s:%d", inst.Id, r.appName, inst.IPAddr, inst.Port)
+	r.setState(Registered, nil)
+	return nil
+}
+
+// lock holds op, unless ctx is done first.
+func (r *Registration) lock(ctx context.Context) error {
+	select {
+	case r.op <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// unlock releases op.
+func (r *Registration) unlock() {
+	<-r.op
+}
+
+// setState changes the State, recording err as the last error if not nil,
+// and calls the callbacks.
+func (r *Registration) setState(state RegistrationState, err error) {
+	r.mu.Lock()
+	old := r.state
+	if state != old {
+		r.state = state
+		r.since = time.Now()
+	}
+	if err != nil {
+		r.lastError = err
+		r.lastErrorAt = time.Now()
+	}
+	r.mu.Unlock()
+
+	if err != nil && r.OnError != nil {
+		r.OnError(err)
+	}
+	if state != old && r.OnStateChange != nil {
+		r.OnStateChange(old, state)
+	}
+}
+
+// sleep waits for the next renewal, and reports whether ctx is still
+// running.
+func (r *Registration) sleep(ctx context.Context) bool {
+	interval := r.Interval
+	if interval <= 0 {
+		r.mu.Lock()
+		interval = r.lease / 3
+		r.mu.Unlock()
+		if interval <= 0 {
+			interval = 30 * time.Second
+		}
+	}
+	return wait(ctx, Jittered(interval, r.Jitter))
+}
+
+// wait waits for d, and reports whether ctx is still running.
+func wait(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Status returns the status of the registration.
+func (r *Registration) Status() RegistrationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	st := RegistrationStatus{
+		App:          r.appName,
+		Instance:     r.inst.Id,
+		Registry:     r.client.ServiceUrl,
+		State:        r.state,
+		Since:        r.since,
+		RegisteredAt: timeRef(r.registeredAt),
+		LastRenewal:  timeRef(r.lastRenewal),
+		LastErrorAt:  timeRef(r.lastErrorAt),
+
+		Reregistrations: r.reregistrations,
+	}
+	if r.lastError != nil {
+		st.LastError = r.lastError.Error()
+	}
+	if r.state == Registered || r.state == RenewFailing {
+		if remaining := r.lease - time.Since(r.lastRenewal); remaining > 0 {
+			st.LeaseRemaining = remaining.Seconds()
+		}
+	}
+	return st
+}
+
+// timeRef returns a reference to t, nil if it is zero.
+func timeRef(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// ServeHTTP serves the Status of the registration as JSON, with 200 while
+// the instance is discoverable, and 503 otherwise.
+func (r *Registration) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	st := r.Status()
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if st.Discoverable() {
+		w.WriteHeader(200)
+	} else {
+		w.WriteHeader(503)
+	}
+	w.Write(append(data, '\n'))
+}
+
+// Mount serves the Status of the registration at HealthPath on mux.
+func (r *Registration) Mount(mux *http.ServeMux) {
+	mux.Handle(HealthPath, r)
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver finds the instances of an application. Client and Cache are
+// Resolvers asking the SR, DNS and Static do without it.
+type Resolver interface {
+	// GetApp returns the application with the specified name, or
+	// ErrAppNotExist if the resolver does not know it.
+	GetApp(name string) (*Application, error)
+}
+
+// DNS resolves applications through DNS: the SRV records of
+// _<app>._tcp.<Suffix>, or the A and AAAA records of <app>.<Suffix> with
+// Port if there are none. Every address found is an UP instance.
+type DNS struct {
+	// Suffix is the domain applications are looked up under, e.g.
+	// service.consul or svc.cluster.local.
+	Suffix string
+
+	// Port is the port of the instances found through A and AAAA records.
+	Port int
+
+	// Resolver is the DNS resolver used. If nil, net.DefaultResolver is.
+	Resolver *net.Resolver
+
+	// Timeout bounds each lookup. Zero sets no deadline.
+	Timeout time.Duration
+}
+
+// GetApp implements Resolver.
+func (d *DNS) GetApp(name string) (*Application, error) {
+	r := d.Resolver
+	if r == nil {
+		r = net.DefaultResolver
+	}
+	ctx := context.Background()
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	suffix := strings.Trim(d.Suffix, ".")
+
+	app := NewApplication(name)
+	_, srvs, err := r.LookupSRV(ctx, name, "tcp", suffix)
+	if err == nil {
+		for _, srv := range srvs {
+			ips, err := r.LookupHost(ctx, srv.Target)
+			if err != nil {
+				return nil, err
+			}
+			for _, ip := range ips {
+				app.Instances = append(app.Instances, staticInstance(ip, int(srv.Port)))
+			}
+		}
+		return app, nil
+	}
+
+	ips, err := r.LookupHost(ctx, name+"."+suffix)
+	if e, ok := err.(*net.DNSError); ok && e.IsNotFound {
+		return nil, ErrAppNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		app.Instances = append(app.Instances, staticInstance(ip, d.Port))
+	}
+	return app, nil
+}
+
+// Static resolves applications from a fixed list of addresses (ip:port)
+// per application name, e.g. read from a configuration file. Every address
+// is an UP instance.
+type Static map[string][]string
+
+// GetApp implements Resolver.
+func (s Static) GetApp(name string) (*Application, error) {
+	addrs, ok := s[name]
+	if !ok {
+		return nil, ErrAppNotExist
+	}
+	app := NewApplication(name)
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		p, err := strconv.Atoi(port)
+		if err != nil {
+			return nil, err
+		}
+		app.Instances = append(app.Instances, staticInstance(host, p))
+	}
+	return app, nil
+}
+
+// staticInstance returns an UP instance found without the SR, identified
+// by its address.
+func staticInstance(ip string, port int) *Instance {
+	inst := NewInstance(net.JoinHostPort(ip, strconv.Itoa(port)), ip, port)
+	inst.Status = UP
+	return inst
+}
+
+// NewChain returns a Chain of the resolvers, in order of preference,
+// demoting the ones failing 3 times in a row for 30 seconds.
+func NewChain(resolvers ...Resolver) *Chain {
+	return &Chain{
+		Resolvers:        resolvers,
+		FailureThreshold: 3,
+		Cooldown:         30 * time.Second,
+		failures:         make([]int, len(resolvers)),
+		demoted:          make([]time.Time, len(resolvers)),
+	}
+}
+
+// Chain resolves applications through several resolvers in turn, e.g. the
+// SR, then DNS, then a static list, so discovery keeps working when some of
+// them are down. The first application with an available instance is
+// returned.
+//
+// Resolvers failing FailureThreshold times in a row are demoted for
+// Cooldown: they are only tried after the others, so every lookup does not
+// wait for a resolver known to be down. It is safe for concurrent use.
+type Chain struct {
+	// Resolvers holds the resolvers, in order of preference.
+	Resolvers []Resolver
+
+	// FailureThreshold is the number of consecutive failures demoting a
+	// resolver. Not knowing the application is not a failure.
+	FailureThreshold int
+
+	// Cooldown is the time a resolver stays demoted.
+	Cooldown time.Duration
+
+	// mu protects failures and demoted.
+	mu sync.Mutex
+
+	// failures holds the consecutive failures of each resolver.
+	failures []int
+
+	// demoted holds when each resolver stops being demoted.
+	demoted []time.Time
+}
+
+// GetApp implements Resolver. It returns the last error if every resolver
+// failed, ErrAppNotExist if none knows the application, or an application
+// without available instances if that is all that was found.
+func (c *Chain) GetApp(name string) (*Application, error) {
+	var found *Application
+	err := ErrAppNotExist
+	for _, i := range c.order() {
+		app, rerr := c.Resolvers[i].GetApp(name)
+		c.report(i, rerr)
+		switch {
+		case rerr == ErrAppNotExist:
+		case rerr != nil:
+			err = rerr
+		case len(app.GetAvailableInstances()) > 0:
+			return app, nil
+		case found == nil:
+			found = app
+		}
+	}
+	if found != nil {
+		return found, nil
+	}
+	return nil, err
+}
+
+// order returns the indexes of the resolvers to try, the demoted ones last.
+func (c *Chain) order() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.grow()
+
+	now := time.Now()
+	healthy := make([]int, 0, len(c.Resolvers))
+	var demoted []int
+	for i := range c.Resolvers {
+		if now.Before(c.demoted[i]) {
+			demoted = append(demoted, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	return append(healthy, demoted...)
+}
+
+// report records the outcome of a lookup through resolver i.
+func (c *Chain) report(i int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err != nil && err != ErrAppNotExist {
+		c.failures[i]++
+		if c.FailureThreshold > 0 && c.failures[i] >= c.FailureThreshold {
+			c.demoted[i] = time.Now().Add(c.Cooldown)
+		}
+		return
+	}
+	c.failures[i] = 0
+	c.demoted[i] = time.Time{}
+}
+
+// grow sizes the health records to the Resolvers, which may have been
+// changed since the Chain was created. It must be called with c.mu held.
+func (c *Chain) grow() {
+	for len(c.failures) < len(c.Resolvers) {
+		c.failures = append(c.failures, 0)
+		c.demoted = append(c.demoted, time.Time{})
+	}
+}
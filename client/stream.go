@@ -0,0 +1,145 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// StreamError is sent by the SR when a frame of a Stream fails.
+type StreamError = model.StreamError
+
+// Stream is an agent stream to the SR: a single long lived request
+// multiplexing the renewals, status changes and watches of every instance
+// of a host, instead of one HTTP request each. With WithH2C, it shares the
+// HTTP/2 connection of the client.
+//
+// Frames are not acknowledged: failures are reported on Errors.
+type Stream struct {
+	w       *io.PipeWriter
+	body    io.ReadCloser
+	updates chan *Application
+	errors  chan *StreamError
+}
+
+// OpenStream opens an agent stream to the SR. The stream must be closed
+// with Close.
+func (c *Client) OpenStream() (*Stream, error) {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest(http.MethodPost, c.root()+"/1.0/stream", pr)
+	if err != nil {
+		return nil, err
+	}
+	if c.Rewrite != nil {
+		c.Rewrite(req.URL)
+	}
+	c.authorize(req)
+	req.Header.Set("Content-Type", model.StreamContentType)
+
+	r, err := c.HTTPClient.Do(req)
+	if err != nil {
+		pw.Close()
+		return nil, err
+	}
+	if r.StatusCode != 200 {
+		r.Body.Close()
+		pw.Close()
+		return nil, &UnexpectedCodeError{Code: r.StatusCode}
+	}
+
+	s := &Stream{
+		w:       pw,
+		body:    r.Body,
+		updates: make(chan *Application, 16),
+		errors:  make(chan *StreamError, 16),
+	}
+	go s.read()
+	return s, nil
+}
+
+// Renew renews the instance, like RenewInstance.
+func (s *Stream) Renew(app *Application, inst *Instance) error {
+	h := model.Heartbeat{App: app.Name, Id: inst.Id, Generation: inst.Generation, Time: time.Now().UnixMilli()}
+	packet, err := h.Marshal(inst.LeaseId)
+	if err != nil {
+		return err
+	}
+	return model.WriteFrame(s.w, model.HeartbeatFrame, packet)
+}
+
+// Delete puts the instance out-of-service, like DeleteInstance.
+func (s *Stream) Delete(app *Application, inst *Instance) error {
+	data, err := json.Marshal(model.StatusChange{
+		App:        app.Name,
+		Id:         inst.Id,
+		LeaseId:    inst.LeaseId,
+		Generation: inst.Generation,
+		Status:     OUTOFSERVICE,
+	})
+	if err != nil {
+		return err
+	}
+	return model.WriteFrame(s.w, model.StatusFrame, data)
+}
+
+// Watch subscribes to the changes of the app, sent on Updates as soon as
+// the watch starts and whenever the app changes.
+func (s *Stream) Watch(name string) error {
+	return model.WriteFrame(s.w, model.WatchFrame, []byte(name))
+}
+
+// Updates returns the channel receiving the apps watched. It must be
+// drained while apps are watched, and is closed with the stream.
+func (s *Stream) Updates() <-chan *Application {
+	return s.updates
+}
+
+// Errors returns the channel receiving the frames which failed. Errors are
+// dropped if it is not drained.
+func (s *Stream) Errors() <-chan *StreamError {
+	return s.errors
+}
+
+// Close closes the stream.
+func (s *Stream) Close() error {
+	s.w.Close()
+	return s.body.Close()
+}
+
+// read dispatches the frames sent by the SR until the stream is closed.
+func (s *Stream) read() {
+	defer close(s.updates)
+	defer close(s.errors)
+
+	br := bufio.NewReader(s.body)
+	for {
+		typ, payload, err := model.ReadFrame(br)
+		if err != nil {
+			return
+		}
+		switch typ {
+		case model.AppFrame:
+			app := new(Application)
+			if err := json.Unmarshal(payload, app); err != nil {
+				log.Printf("stream error: %s", err)
+				continue
+			}
+			s.updates <- app
+		case model.ErrorFrame:
+			serr := new(StreamError)
+			if err := json.Unmarshal(payload, serr); err != nil {
+				log.Printf("stream error: %s", err)
+				continue
+			}
+			select {
+			case s.errors <- serr:
+			default:
+			}
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package client
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// SignatureHeader is the response header carrying the signature of a
+// catalog response.
+const SignatureHeader = "Registro-Signature"
+
+// DefaultMaxSignatureAge is the MaxAge of a Verifier left zero.
+const DefaultMaxSignatureAge = 5 * time.Minute
+
+// signatureLeeway is how far the clocks of the SR and the client may be
+// apart when checking the times of signatures.
+const signatureLeeway = 30 * time.Second
+
+// jwksRefresh bounds how often the JWK set is fetched again for a key it
+// lacks, e.g. after a key rotation on the SR.
+const jwksRefresh = time.Minute
+
+// SignatureError is returned for catalog responses whose signature is
+// missing or invalid: they may have been tampered with by an intermediary,
+// and are rejected.
+type SignatureError struct {
+	// Path is the path of the request.
+	Path string
+
+	// Reason tells what failed.
+	Reason string
+}
+
+func (e *SignatureError) Error() string {
+	return "invalid catalog signature for " + e.Path + ": " + e.Reason
+}
+
+// VerifyStats counts the catalog responses verified by a Verifier.
+type VerifyStats struct {
+	// Verified is the number of responses whose signature was valid.
+	Verified uint64
+
+	// Failed is the number of responses rejected.
+	Failed uint64
+}
+
+// Verifier checks the signatures of the catalog responses, with the
+// public keys of the SR given or fetched from its JWK set. It is safe for
+// concurrent use.
+type Verifier struct {
+	// JWKSURL, if set, is the URL of the JWK set of the SR, e.g.
+	// http://localhost:8080/registro/1.0/keys. It is fetched on the first
+	// verification, and again for keys it lacks.
+	JWKSURL string
+
+	// HTTPClient fetches the JWK set. NewClient sets it to the Client one.
+	HTTPClient *http.Client
+
+	// MaxAge is the age beyond which signatures are rejected, even before
+	// their expiry, DefaultMaxSignatureAge if zero. It bounds how stale a
+	// response replayed by an intermediary may be.
+	MaxAge time.Duration
+
+	// mu protects keys and fetched.
+	mu sync.Mutex
+
+	// keys holds the public keys by id. The key given without id
+	// verifies signatures of any id.
+	keys map[string]crypto.PublicKey
+
+	fetched time.Time
+
+	verified, failed uint64
+}
+
+// WithServerPublicKey makes the client verify the catalog responses with
+// the public key of the SR, an *ecdsa.PublicKey (P-256) or an
+// ed25519.PublicKey. Responses without a valid signature are rejected with
+// a *SignatureError.
+func WithServerPublicKey(key crypto.PublicKey) Option {
+	return func(c *Client) {
+		v := c.verifier()
+		v.mu.Lock()
+		v.keys[""] = key
+		v.mu.Unlock()
+	}
+}
+
+// WithJWKSURL makes the client verify the catalog responses with the keys
+// of the JWK set at url, e.g. http://localhost:8080/registro/1.0/keys.
+// Responses without a valid signature are rejected with a *SignatureError.
+func WithJWKSURL(url string) Option {
+	return func(c *Client) {
+		c.verifier().JWKSURL = url
+	}
+}
+
+// verifier returns the Verifier of the client, adding it if needed.
+func (c *Client) verifier() *Verifier {
+	if c.Verifier == nil {
+		c.Verifier = &Verifier{keys: make(map[string]crypto.PublicKey)}
+	}
+	return c.Verifier
+}
+
+// VerifyStats returns the number of responses verified and rejected.
+func (v *Verifier) VerifyStats() VerifyStats {
+	return VerifyStats{Verified: atomic.LoadUint64(&v.verified), Failed: atomic.LoadUint64(&v.failed)}
+}
+
+// Verify checks that signature is a valid detached JWS of payload, signed
+// as the answer to a request of method to path, with its query, and of the
+// catalog version, neither expired nor older than MaxAge. A zero version is
+// not checked, as responses only tell the version of the catalog when the
+// request was received: their age bounds how stale they may be instead.
+func (v *Verifier) Verify(method, path string, version uint64, payload []byte, signature string) error {
+	err := v.verify(method, path, version, payload, signature)
+	if err != nil {
+		atomic.AddUint64(&v.failed, 1)
+		return err
+	}
+	atomic.AddUint64(&v.verified, 1)
+	return nil
+}
+
+// verify implements Verify.
+func (v *Verifier) verify(method, path string, version uint64, payload []byte, signature string) error {
+	parts := strings.Split(signature, ".")
+	if signature == "" {
+		return fmt.Errorf("no signature")
+	}
+	if len(parts) != 3 || parts[1] != "" {
+		return fmt.Errorf("not a detached JWS")
+	}
+	enc := base64.RawURLEncoding
+	data, err := enc.DecodeString(parts[0])
+	if err != nil {
+		return err
+	}
+	var header model.JWSHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		return err
+	}
+	switch {
+	case header.Method != method || header.Path != path:
+		return fmt.Errorf("signed for %s %s", header.Method, header.Path)
+	case version != 0 && header.Version != version:
+		return fmt.Errorf("signed for catalog version %d", header.Version)
+	}
+	if err := v.checkTimes(header, time.Now()); err != nil {
+		return err
+	}
+	sig, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return err
+	}
+
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return err
+	}
+	input := []byte(parts[0] + "." + enc.EncodeToString(payload))
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		digest := sha256.Sum256(input)
+		if header.Alg != "ES256" || len(sig) != 64 ||
+			!ecdsa.Verify(k, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+			return fmt.Errorf("signature mismatch")
+		}
+	case ed25519.PublicKey:
+		if header.Alg != "EdDSA" || !ed25519.Verify(k, input, sig) {
+			return fmt.Errorf("signature mismatch")
+		}
+	default:
+		return fmt.Errorf("unsupported public key %T", key)
+	}
+	return nil
+}
+
+// checkTimes checks the signature of header is valid at now.
+func (v *Verifier) checkTimes(header model.JWSHeader, now time.Time) error {
+	maxAge := v.MaxAge
+	if maxAge == 0 {
+		maxAge = DefaultMaxSignatureAge
+	}
+	issued, expires := time.Unix(header.IssuedAt, 0), time.Unix(header.Expires, 0)
+	switch {
+	case header.IssuedAt == 0 || header.Expires == 0:
+		return fmt.Errorf("no validity period")
+	case issued.After(now.Add(signatureLeeway)):
+		return fmt.Errorf("issued in the future, at %s", issued.UTC().Format(time.RFC3339))
+	case now.Sub(issued) > maxAge+signatureLeeway:
+		return fmt.Errorf("issued %s ago", now.Sub(issued).Round(time.Second))
+	case now.After(expires.Add(signatureLeeway)):
+		return fmt.Errorf("expired at %s", expires.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// key returns the public key of id, fetching the JWK set if it lacks it.
+func (v *Verifier) key(id string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if k, ok := v.keys[id]; ok {
+		return k, nil
+	}
+	if v.JWKSURL != "" && time.Since(v.fetched) >= jwksRefresh {
+		v.fetched = time.Now()
+		if err := v.fetchKeys(); err != nil {
+			return nil, fmt.Errorf("fetching keys: %s", err)
+		}
+		if k, ok := v.keys[id]; ok {
+			return k, nil
+		}
+	}
+	if k, ok := v.keys[""]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("unknown key %q", id)
+}
+
+// fetchKeys adds the keys of the JWK set. It must be called with v.mu
+// held.
+func (v *Verifier) fetchKeys() error {
+	client := v.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	r, err := client.Get(v.JWKSURL)
+	if err != nil {
+		return err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != 200 {
+		return &UnexpectedCodeError{Code: r.StatusCode}
+	}
+	var set model.JWKSet
+	if err := json.NewDecoder(r.Body).Decode(&set); err != nil {
+		return err
+	}
+	for _, jwk := range set.Keys {
+		key, err := publicKey(jwk)
+		if err != nil {
+			return err
+		}
+		v.keys[jwk.Kid] = key
+	}
+	return nil
+}
+
+// publicKey returns the public key of a JWK.
+func publicKey(jwk model.JWK) (crypto.PublicKey, error) {
+	enc := base64.RawURLEncoding
+	x, err := enc.DecodeString(jwk.X)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case jwk.Kty == "EC" && jwk.Crv == "P-256":
+		y, err := enc.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case jwk.Kty == "OKP" && jwk.Crv == "Ed25519" && len(x) == ed25519.PublicKeySize:
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key %s %s", jwk.Kty, jwk.Crv)
+	}
+}
+
+// signedPath reports whether the responses to GET requests to path are
+// signed by the SR: the catalog ones, except streamed app lists.
+func signedPath(path string) bool {
+	return strings.HasPrefix(path, "/apps") && !strings.Contains(path, "stream=true")
+}
@@ -0,0 +1,174 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/numercfd/registro/model"
+)
+
+// ErrEvicted is returned by Watch.Err when the SR dropped the watch for
+// not receiving its deltas fast enough.
+var ErrEvicted = errors.New("watch evicted for falling behind")
+
+// Snapshot is the first message of a watch: the apps watched as of a
+// catalog version.
+type Snapshot = model.Snapshot
+
+// Delta is a change of an app watched, sent after the Snapshot.
+type Delta = model.Delta
+
+// Watch follows the changes of apps through the SR /watch endpoint. It
+// starts with a Snapshot of the apps, followed by the Deltas after it
+// without gaps, so applying them in order keeps a copy of the apps
+// consistent.
+type Watch struct {
+	// Snapshot holds the apps watched when the watch started.
+	Snapshot *Snapshot
+
+	client *Client
+	path   string
+	body   io.ReadCloser
+	deltas chan *Delta
+	err    error
+}
+
+// Watch starts watching the apps specified, or every app if none is. The
+// watch must be closed with Close.
+func (c *Client) Watch(apps ...string) (*Watch, error) {
+	q := url.Values{"app": apps}
+	req, err := http.NewRequest(http.MethodGet, c.root()+"/1.0/watch?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.Rewrite != nil {
+		c.Rewrite(req.URL)
+	}
+	c.authorize(req)
+	req.Header.Set("Accept", "text/event-stream")
+
+	r, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if r.StatusCode != 200 {
+		r.Body.Close()
+		return nil, &UnexpectedCodeError{Code: r.StatusCode}
+	}
+
+	w := &Watch{client: c, path: req.URL.RequestURI(), body: r.Body, deltas: make(chan *Delta, 16)}
+	br := bufio.NewReader(r.Body)
+	event, data, sig, err := readEvent(br)
+	if err == nil && event != "snapshot" {
+		err = errors.New("watch did not start with a snapshot")
+	}
+	if err == nil {
+		w.Snapshot = new(Snapshot)
+		err = json.Unmarshal(data, w.Snapshot)
+	}
+	if err == nil {
+		err = c.verifyEvent(w.path, w.Snapshot.Version, data, sig)
+	}
+	if err != nil {
+		r.Body.Close()
+		return nil, err
+	}
+
+	go w.read(br)
+	return w, nil
+}
+
+// Deltas returns the channel receiving the deltas, in order. It is closed
+// when the watch ends, see Err. A watch whose deltas are not received is
+// eventually evicted by the SR.
+func (w *Watch) Deltas() <-chan *Delta {
+	return w.deltas
+}
+
+// Err returns why the watch ended, once Deltas is closed.
+func (w *Watch) Err() error {
+	return w.err
+}
+
+// Close ends the watch.
+func (w *Watch) Close() error {
+	return w.body.Close()
+}
+
+// read sends the deltas received to w.deltas until the watch ends.
+func (w *Watch) read(br *bufio.Reader) {
+	defer close(w.deltas)
+	for {
+		event, data, sig, err := readEvent(br)
+		if err != nil {
+			w.err = err
+			return
+		}
+		switch event {
+		case "delta":
+			d := new(Delta)
+			if err := json.Unmarshal(data, d); err != nil {
+				w.err = err
+				return
+			}
+			if err := w.client.verifyEvent(w.path, d.Version, data, sig); err != nil {
+				w.err = err
+				return
+			}
+			w.deltas <- d
+		case "evicted":
+			w.err = ErrEvicted
+			return
+		}
+	}
+}
+
+// verifyEvent verifies the signature of the data of a watch event of the
+// catalog version, sent to the watch request to path, if the client has a
+// Verifier.
+func (c *Client) verifyEvent(path string, version uint64, data []byte, sig string) error {
+	if c.Verifier == nil {
+		return nil
+	}
+	if err := c.Verifier.Verify(http.MethodGet, path, version, data, sig); err != nil {
+		return &SignatureError{Path: "/watch", Reason: err.Error()}
+	}
+	return nil
+}
+
+// readEvent reads the next server-sent event, returning its name, data and
+// signature. Comments and ids are skipped.
+func readEvent(br *bufio.Reader) (string, []byte, string, error) {
+	var event, sig string
+	var data []byte
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", nil, "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			if event != "" || data != nil {
+				return event, data, sig, nil
+			}
+		case strings.HasPrefix(line, "signature:"):
+			sig = strings.TrimSpace(strings.TrimPrefix(line, "signature:"))
+		case strings.HasPrefix(line, "event:"):
+			event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			if data != nil {
+				data = append(data, '\n')
+			}
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " ")...)
+		}
+	}
+}
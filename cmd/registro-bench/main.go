@@ -0,0 +1,235 @@
+/*
+	Registro-bench is a load generator for the registro server.
+
+	It simulates a fleet of apps and instances registering and renewing their
+	heartbeats, plus clients polling the catalog, and reports the latency
+	percentiles of each kind of request and the server resource use.
+
+	Usage:
+
+		registro-bench --registry http://localhost:8080/registro --apps 10 --instances 100
+*/
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/numercfd/registro/client"
+)
+
+func main() {
+	registry := flag.String("registry", "http://localhost:8080/registro", "registry root URL")
+	apps := flag.Int("apps", 10, "number of applications")
+	instances := flag.Int("instances", 100, "number of instances per application")
+	interval := flag.Duration("interval", 30*time.Second, "time between heartbeats of each instance")
+	pollers := flag.Int("pollers", 10, "number of clients polling the catalog")
+	pollInterval := flag.Duration("poll-interval", time.Second, "time between catalog polls of each client")
+	duration := flag.Duration("duration", time.Minute, "duration of the benchmark")
+	flag.Parse()
+
+	c := client.NewClient(*registry, client.WithMaxIdleConns(*apps**instances+*pollers))
+	before, err := readVars(*registry)
+	if err != nil {
+		log.Printf("server resource use not available: %s", err)
+	}
+
+	b := &bench{stats: make(map[string]*stat)}
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+
+	log.Printf("registering %d instances in %d apps", *apps**instances, *apps)
+	for a := 0; a < *apps; a++ {
+		name := fmt.Sprintf("bench-app-%d", a)
+		app, err := c.NewApp(name)
+		if isConflict(err) {
+			app, err = client.NewApplication(name), nil
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for i := 0; i < *instances; i++ {
+			id := fmt.Sprintf("bench-%d-%d", a, i)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b.runInstance(c, app, id, *interval, stop)
+			}()
+		}
+	}
+	for p := 0; p < *pollers; p++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.runPoller(c, *pollInterval, stop)
+		}()
+	}
+
+	<-time.After(*duration)
+	close(stop)
+	wg.Wait()
+
+	b.report()
+	if after, err := readVars(*registry); err == nil && before != nil {
+		reportVars(before, after)
+	}
+}
+
+// bench collects the latency of every request made.
+type bench struct {
+	mu    sync.Mutex
+	stats map[string]*stat
+}
+
+// stat holds the latencies and errors of a kind of request.
+type stat struct {
+	latencies []time.Duration
+	errors    int
+}
+
+// observe records the latency of a request, or its error.
+func (b *bench) observe(op string, start time.Time, err error) {
+	d := time.Since(start)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.stats[op]
+	if !ok {
+		st = &stat{}
+		b.stats[op] = st
+	}
+	if err != nil {
+		st.errors++
+		return
+	}
+	st.latencies = append(st.latencies, d)
+}
+
+// runInstance registers an instance and renews it every interval until
+// stop is closed. The first renewal is randomly delayed to spread the load.
+func (b *bench) runInstance(c *client.Client, app *client.Application, id string, interval time.Duration, stop chan struct{}) {
+	start := time.Now()
+	inst, err := c.NewInstance(app, id, "127.0.0.1", 8000)
+	b.observe("register", start, err)
+	if err != nil {
+		return
+	}
+
+	wait := time.Duration(rand.Int63n(int64(interval)))
+	for {
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			c.DeleteInstance(app, inst)
+			return
+		}
+		wait = interval
+
+		start := time.Now()
+		b.observe("renew", start, c.RenewInstance(app, inst))
+	}
+}
+
+// runPoller lists the catalog every interval until stop is closed.
+func (b *bench) runPoller(c *client.Client, interval time.Duration, stop chan struct{}) {
+	for {
+		start := time.Now()
+		_, err := c.GetApps()
+		b.observe("poll", start, err)
+
+		select {
+		case <-time.After(interval):
+		case <-stop:
+			return
+		}
+	}
+}
+
+// report prints the latency percentiles of each kind of request.
+func (b *bench) report() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ops := make([]string, 0, len(b.stats))
+	for op := range b.stats {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	fmt.Printf("%-10s %8s %8s %10s %10s %10s %10s\n", "op", "count", "errors", "p50", "p90", "p99", "max")
+	for _, op := range ops {
+		st := b.stats[op]
+		l := st.latencies
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Printf("%-10s %8d %8d %10s %10s %10s %10s\n", op, len(l), st.errors,
+			percentile(l, 50), percentile(l, 90), percentile(l, 99), percentile(l, 100))
+	}
+}
+
+// percentile returns the p-th percentile of the sorted latencies.
+func percentile(l []time.Duration, p int) time.Duration {
+	if len(l) == 0 {
+		return 0
+	}
+	i := (len(l)*p+99)/100 - 1
+	if i < 0 {
+		i = 0
+	}
+	return l[i].Round(time.Microsecond)
+}
+
+// serverVars holds the server resource use published in /debug/vars.
+type serverVars struct {
+	Goroutines int `json:"goroutines"`
+	Memstats   struct {
+		HeapAlloc    uint64 `json:"HeapAlloc"`
+		Sys          uint64 `json:"Sys"`
+		NumGC        uint32 `json:"NumGC"`
+		PauseTotalNs uint64 `json:"PauseTotalNs"`
+	} `json:"memstats"`
+}
+
+// readVars reads the server resource use.
+func readVars(registry string) (*serverVars, error) {
+	url := strings.TrimSuffix(registry, "/registro") + "/debug/vars"
+	r, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Body.Close()
+	if r.StatusCode != 200 {
+		return nil, &client.UnexpectedCodeError{Code: r.StatusCode}
+	}
+
+	var v serverVars
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// reportVars prints the server resource use during the benchmark.
+func reportVars(before, after *serverVars) {
+	fmt.Printf("\nserver heap: %d MB, sys: %d MB, goroutines: %d\n",
+		after.Memstats.HeapAlloc>>20, after.Memstats.Sys>>20, after.Goroutines)
+	fmt.Printf("server gc: %d cycles, %s paused\n",
+		after.Memstats.NumGC-before.Memstats.NumGC,
+		time.Duration(after.Memstats.PauseTotalNs-before.Memstats.PauseTotalNs))
+}
+
+// isConflict reports whether err is a 409 response from the registry.
+func isConflict(err error) bool {
+	var codeErr *client.UnexpectedCodeError
+	return errors.As(err, &codeErr) && codeErr.Code == 409
+}
@@ -0,0 +1,40 @@
+/*
+	Registro-openapi writes the OpenAPI document of the registro REST API.
+
+	It is run by go generate in the server package, keeping openapi.json in
+	the repository root in sync with the routes.
+
+	Usage:
+
+		registro-openapi [-out openapi.json]
+*/
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/numercfd/registro/internal/server"
+)
+
+func main() {
+	out := flag.String("out", "-", "output file (- for stdout)")
+	flag.Parse()
+
+	data, err := server.OpenAPI()
+	if err != nil {
+		log.Fatal(err)
+	}
+	data = append(data, '\n')
+
+	if *out == "-" {
+		_, err = os.Stdout.Write(data)
+	} else {
+		err = ioutil.WriteFile(*out, data, 0644)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
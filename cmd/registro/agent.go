@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/numercfd/registro/client"
+)
+
+// runAgent registers a service to the registry and renews its heartbeat
+// until the process is interrupted. The instance is deleted on exit.
+func runAgent(args []string) error {
+	fs := flag.NewFlagSet("agent", flag.ExitOnError)
+	cfg, err := loadConfig(fs, args, func(cfg *Config) {
+		fs.StringVar(&cfg.Registry, "registry", cfg.Registry, "registry root URL")
+		tlsFlags(fs, &cfg.TLS)
+		fs.StringVar(&cfg.Token, "token", cfg.Token, "API token presented to the registry")
+		fs.StringVar(&cfg.Environment, "environment", cfg.Environment, "environment of the client, e.g. prod: only the apps of that environment are seen")
+		fs.StringVar(&cfg.Agent.App, "app", cfg.Agent.App, "application name")
+		fs.StringVar(&cfg.Agent.Id, "id", cfg.Agent.Id, "instance id (generated by the registry if empty)")
+		fs.StringVar(&cfg.Agent.IPAddr, "ip", cfg.Agent.IPAddr, "advertised ip address")
+		fs.IntVar(&cfg.Agent.Port, "port", cfg.Agent.Port, "advertised port")
+		fs.StringVar(&cfg.Agent.Group, "group", cfg.Agent.Group, "deployment group (e.g. blue or green)")
+		durationFlag(fs, &cfg.Agent.Interval, "interval", "time between heartbeats")
+		fs.Float64Var(&cfg.Agent.Jitter, "jitter", cfg.Agent.Jitter, "fraction of the interval randomized on every heartbeat (0 disables)")
+		durationFlag(fs, &cfg.Agent.Splay, "splay", "maximum random delay before registering (0 disables)")
+		fs.BoolVar(&cfg.Agent.H2C, "h2c", cfg.Agent.H2C, "use HTTP/2 without TLS")
+		fs.BoolVar(&cfg.Agent.Stream, "stream", cfg.Agent.Stream, "renew through a single long lived stream")
+		fs.StringVar(&cfg.Agent.HeartbeatAddr, "heartbeat-addr", cfg.Agent.HeartbeatAddr, "udp address of the registry receiving heartbeats (empty uses HTTP)")
+	})
+	if err != nil {
+		return err
+	}
+
+	a := cfg.Agent
+	if a.App == "" || a.Port == 0 {
+		return errors.New("app and port are required")
+	}
+
+	opts, err := cfg.clientOptions()
+	if err != nil {
+		return err
+	}
+	if a.H2C {
+		opts = append(opts, client.WithH2C())
+	}
+	if a.HeartbeatAddr != "" {
+		opts = append(opts, client.WithUDPHeartbeat(a.HeartbeatAddr))
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	select {
+	case <-time.After(client.Splay(time.Duration(a.Splay))):
+	case <-stop:
+		return nil
+	}
+
+	c := client.NewClient(cfg.Registry, opts...)
+	inst := client.NewInstance(a.Id, a.IPAddr, a.Port)
+	inst.DeploymentGroup = a.Group
+	app, err := c.Register(a.App, inst)
+	if err != nil {
+		return err
+	}
+	log.Printf("instance %s registered to app %s", inst.Id, app.Name)
+
+	renew, remove := c.RenewInstance, c.DeleteInstance
+	if a.Stream {
+		st, err := c.OpenStream()
+		if err != nil {
+			return err
+		}
+		defer st.Close()
+		go func() {
+			for serr := range st.Errors() {
+				log.Printf("service renew error: %s", serr.Error)
+			}
+		}()
+		renew, remove = st.Renew, st.Delete
+	}
+
+	for {
+		if err := renew(app, inst); err != nil {
+			log.Printf("service renew error: %s", err)
+		}
+
+		select {
+		case <-time.After(client.Jittered(time.Duration(a.Interval), a.Jitter)):
+		case <-stop:
+			log.Printf("deleting instance %s", inst.Id)
+			return remove(app, inst)
+		}
+	}
+}
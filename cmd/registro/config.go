@@ -0,0 +1,804 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/numercfd/registro/client"
+	"github.com/numercfd/registro/internal/server"
+	"github.com/numercfd/registro/model"
+	"github.com/numercfd/registro/notify"
+)
+
+// Config holds the configuration shared by every registro command.
+type Config struct {
+	// Registry is the root URL of the registry used by client commands.
+	Registry string `json:"registry"`
+
+	// TLS holds the TLS settings of client commands connecting to an
+	// HTTPS Registry.
+	TLS TLSConfig `json:"tls"`
+
+	// Token is the API token presented by client commands, if the
+	// Registry requires one.
+	Token string `json:"token"`
+
+	// Environment is the environment of client commands, e.g. prod.
+	Environment string `json:"environment"`
+
+	// Server holds the configuration for the serve command.
+	Server ServerConfig `json:"server"`
+
+	// Agent holds the configuration for the agent command.
+	Agent AgentConfig `json:"agent"`
+}
+
+// ServerConfig holds the configuration of the registry server.
+type ServerConfig struct {
+	// Addr is the listen address for the REST server.
+	Addr string `json:"addr"`
+
+	// Listeners holds other addresses served along with Addr.
+	Listeners []ListenerConfig `json:"listeners"`
+
+	// TLS holds the TLS settings of the listeners serving HTTPS.
+	TLS TLSConfig `json:"tls"`
+
+	// HeartbeatAddr is the UDP address accepting heartbeat packets. Empty
+	// disables it.
+	HeartbeatAddr string `json:"heartbeatAddr"`
+
+	// RenewalTimeout is the time without heartbeats before an instance is DOWN.
+	RenewalTimeout Duration `json:"renewalTimeout"`
+
+	// EvictionTimeout is the time without heartbeats before an instance is removed.
+	EvictionTimeout Duration `json:"evictionTimeout"`
+
+	// TombstoneTimeout is the time deleted apps and instances may be restored.
+	TombstoneTimeout Duration `json:"tombstoneTimeout"`
+
+	// DrainLead is the time before their planned termination when
+	// instances are draining.
+	DrainLead Duration `json:"drainLead"`
+
+	// IdleTimeout is how long idle keep-alive connections are kept open.
+	IdleTimeout Duration `json:"idleTimeout"`
+
+	// RequestTimeout is how long a request may take before it is answered
+	// with 503. Zero disables it.
+	RequestTimeout Duration `json:"requestTimeout"`
+
+	// ArchiveAfter is the time an app may have no instances before it is
+	// archived. Zero disables archival.
+	ArchiveAfter Duration `json:"archiveAfter"`
+
+	// PurgeAfter is the time an app may have no instances before it is
+	// removed. Zero disables it.
+	PurgeAfter Duration `json:"purgeAfter"`
+
+	// DiscoveryTTL is how long clients may reuse discovery responses.
+	DiscoveryTTL Duration `json:"discoveryTtl"`
+
+	// VirtualNodes is the default number of points of every instance on
+	// the hash rings of the apps.
+	VirtualNodes int `json:"virtualNodes"`
+
+	// RenewalInterval is the time between renewals expected from each
+	// instance.
+	RenewalInterval Duration `json:"renewalInterval"`
+
+	// WarmUp is the time after start during which instances are neither
+	// expired nor evicted. Zero disables it.
+	WarmUp Duration `json:"warmUp"`
+
+	// WarmUpThreshold is the fraction of restored instances which must
+	// renew to end the warm-up early.
+	WarmUpThreshold float64 `json:"warmUpThreshold"`
+
+	// EvictionStormThreshold is the number of evictions within a minute
+	// notified as an eviction storm. Zero disables it.
+	EvictionStormThreshold int `json:"evictionStormThreshold"`
+
+	// MaxEvents is the number of events kept in the history. Zero disables
+	// the history.
+	MaxEvents int `json:"maxEvents"`
+
+	// EventMaxAge is the time events are kept in the history.
+	EventMaxAge Duration `json:"eventMaxAge"`
+
+	// WatchQueue is the number of changes queued for each watcher before
+	// it is evicted for falling behind.
+	WatchQueue int `json:"watchQueue"`
+
+	// MaxClockSkew is the clock skew above which instances are reported.
+	// Zero disables the report.
+	MaxClockSkew Duration `json:"maxClockSkew"`
+
+	// IdempotencyWindow is the time the responses to changes with an
+	// Idempotency-Key are replayed to retries. Zero disables it.
+	IdempotencyWindow Duration `json:"idempotencyWindow"`
+
+	// Duplicates is "warn" or "reject", applied to instances registering
+	// with the address of another instance of the same app.
+	Duplicates string `json:"duplicates"`
+
+	// TrustedProxies holds the CIDRs of the reverse proxies trusted to
+	// report the client address.
+	TrustedProxies []string `json:"trustedProxies"`
+
+	// MaxConcurrent is the number of catalog reads handled at once. Zero
+	// disables load shedding.
+	MaxConcurrent int `json:"maxConcurrent"`
+
+	// MaxRegistrations is the number of registrations and other changes
+	// handled at once, besides the free read slots. It must be positive
+	// when MaxConcurrent is.
+	MaxRegistrations int `json:"maxRegistrations"`
+
+	// MaxRenewals is the number of renewals handled at once, besides the
+	// free registration and read slots. It must be positive when
+	// MaxConcurrent is.
+	MaxRenewals int `json:"maxRenewals"`
+
+	// MaxQueue is the number of requests of each kind waiting when their
+	// budget is exhausted. Others are answered with 503.
+	MaxQueue int `json:"maxQueue"`
+
+	// QueueTimeout is the longest time a request waits in the queue.
+	QueueTimeout Duration `json:"queueTimeout"`
+
+	// AccessLog writes a log line for every request.
+	AccessLog bool `json:"accessLog"`
+
+	// Tokens holds the API tokens accepted. If set, every request must
+	// present one granting the scope of its operation.
+	Tokens []TokenConfig `json:"tokens"`
+
+	// AuthMaxFailures is the number of authentication failures within 15
+	// minutes banning a client. Zero disables bans.
+	AuthMaxFailures int `json:"authMaxFailures"`
+
+	// AuthBanTime is the length of the first ban of a client, doubled on
+	// every further ban up to an hour.
+	AuthBanTime Duration `json:"authBanTime"`
+
+	// StrictEnvironments requires every request to the catalog to have an
+	// environment, and hides the apps without one from them.
+	StrictEnvironments bool `json:"strictEnvironments"`
+
+	// Policy holds the policy deciding whether requests are allowed.
+	Policy PolicyConfig `json:"policy"`
+
+	// Secrets holds the secret stores resolving the secret references of
+	// the configuration, e.g. "vault:secret/data/registro#pagerduty".
+	Secrets SecretsConfig `json:"secrets"`
+
+	// Signing holds the key signing the catalog responses.
+	Signing SigningConfig `json:"signing"`
+
+	// SIEM holds the destinations of the security events.
+	SIEM SIEMConfig `json:"siem"`
+
+	// Shards holds the nodes of a sharded registry.
+	Shards ShardConfig `json:"shards"`
+
+	// UsageHeader is the request header identifying clients in the usage
+	// accounting, e.g. Authorization or X-Tenant. Empty identifies them by
+	// address.
+	UsageHeader string `json:"usageHeader"`
+
+	// Storage holds the configuration of the persistent storage.
+	Storage StorageConfig `json:"storage"`
+
+	// Notify holds the destinations of the event notifications.
+	Notify NotifyConfig `json:"notify"`
+
+	// Static holds the apps whose instances are declared here rather than
+	// registered, such as external databases.
+	Static []StaticAppConfig `json:"static"`
+}
+
+// StaticAppConfig declares the instances of an app, never expiring. They
+// are UP, or checked by a probe.
+type StaticAppConfig struct {
+	Name string `json:"name"`
+
+	// Probe checks the instances without a probe of their own.
+	Probe *ProbeConfig `json:"probe"`
+
+	Instances []StaticInstanceConfig `json:"instances"`
+}
+
+// StaticInstanceConfig declares an instance of a static app.
+type StaticInstanceConfig struct {
+	model.Registration
+
+	// Probe, if set, checks the instance health.
+	Probe *ProbeConfig `json:"probe"`
+}
+
+// ProbeConfig configures the health checks of static instances.
+type ProbeConfig struct {
+	// Type is "tcp" or "http".
+	Type string `json:"type"`
+
+	// Path is the path requested by HTTP probes.
+	Path string `json:"path"`
+
+	Interval Duration `json:"interval"`
+	Timeout  Duration `json:"timeout"`
+
+	// HealthyThreshold and UnhealthyThreshold are the checks in a row
+	// which must succeed or fail to change the instance status.
+	HealthyThreshold   int `json:"healthyThreshold"`
+	UnhealthyThreshold int `json:"unhealthyThreshold"`
+}
+
+// probe returns the server Probe configured, nil if none is.
+func (p *ProbeConfig) probe() *server.Probe {
+	if p == nil {
+		return nil
+	}
+	return &server.Probe{
+		Type:               server.ProbeType(p.Type),
+		Path:               p.Path,
+		Interval:           time.Duration(p.Interval),
+		Timeout:            time.Duration(p.Timeout),
+		HealthyThreshold:   p.HealthyThreshold,
+		UnhealthyThreshold: p.UnhealthyThreshold,
+	}
+}
+
+// NotifyConfig holds the destinations of the event notifications.
+type NotifyConfig struct {
+	// Chat holds the Slack or Mattermost webhooks notified.
+	Chat []notify.ChatRoute `json:"chat"`
+
+	// Alerts holds the alert rules and the services receiving the alerts.
+	Alerts AlertsConfig `json:"alerts"`
+}
+
+// AlertsConfig holds the alert rules and the services receiving the alerts.
+type AlertsConfig struct {
+	// Rules holds the alert rules, applied by every sink.
+	Rules []AlertRuleConfig `json:"rules"`
+
+	// PagerDuty holds the PagerDuty services opening incidents.
+	PagerDuty []PagerDutyConfig `json:"pagerDuty"`
+
+	// Opsgenie holds the Opsgenie integrations creating alerts.
+	Opsgenie []OpsgenieConfig `json:"opsgenie"`
+
+	// Email holds the SMTP servers sending alert emails.
+	Email []EmailConfig `json:"email"`
+}
+
+// AlertRuleConfig holds the configuration of an alert rule.
+type AlertRuleConfig struct {
+	// Name identifies the rule in the deduplication keys.
+	Name string `json:"name"`
+
+	// Apps holds the patterns of the apps watched. Empty watches every app.
+	Apps []string `json:"apps"`
+
+	// Event is the type of the event starting the condition, e.g. app-down.
+	Event string `json:"event"`
+
+	// For is the time the condition must last before the alert fires.
+	For Duration `json:"for"`
+}
+
+// PagerDutyConfig holds the configuration of a PagerDuty service.
+type PagerDutyConfig struct {
+	// RoutingKey is the integration key of an Events API v2 integration.
+	RoutingKey string `json:"routingKey"`
+
+	// Severity is one of critical (default), error, warning or info.
+	Severity string `json:"severity"`
+
+	// URL is the Events API endpoint, for EU accounts.
+	URL string `json:"url"`
+}
+
+// EmailConfig holds the configuration of alert emails.
+type EmailConfig struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string `json:"addr"`
+
+	// Username and Password authenticate to the SMTP server, if set.
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// From is the sender address.
+	From string `json:"from"`
+
+	// Subject and Body override the templates of the emails.
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+
+	// Routes holds the recipients by app.
+	Routes []notify.EmailRoute `json:"routes"`
+}
+
+// OpsgenieConfig holds the configuration of an Opsgenie integration.
+type OpsgenieConfig struct {
+	// APIKey is the key of an API integration.
+	APIKey string `json:"apiKey"`
+
+	// Priority is one of P1 (default) to P5.
+	Priority string `json:"priority"`
+
+	// URL is the API endpoint, for EU accounts.
+	URL string `json:"url"`
+}
+
+// SIEMConfig holds the destinations of the security events, such as the
+// authentication failures and the admin actions.
+type SIEMConfig struct {
+	// Format is cef or json (default).
+	Format string `json:"format"`
+
+	// Syslog is the address of a syslog receiver, as udp://host:514 or
+	// tcp://host:601.
+	Syslog string `json:"syslog"`
+
+	// URL receives the events, one per POST request.
+	URL string `json:"url"`
+
+	// Headers holds the headers of the POST requests, such as
+	// Authorization. Their values may be secret references.
+	Headers map[string]string `json:"headers"`
+}
+
+// ShardConfig holds the nodes of a registry partitioning its catalog
+// across them.
+type ShardConfig struct {
+	// Self is the URL of this node, as listed in Nodes. Empty disables
+	// sharding.
+	Self string `json:"self"`
+
+	// Nodes holds the URL of every node, e.g. http://10.0.0.1:8080.
+	Nodes []string `json:"nodes"`
+
+	// Token is the token presented to the other nodes, granting the admin
+	// scope, if they require one. It may be a secret reference.
+	Token string `json:"token"`
+}
+
+// ListenerConfig holds the configuration of an additional listener.
+type ListenerConfig struct {
+	// Addr is the listen address, a TCP address or unix:// socket.
+	Addr string `json:"addr"`
+
+	// CertFile and KeyFile enable TLS on the listener.
+	CertFile string `json:"certFile"`
+	KeyFile  string `json:"keyFile"`
+
+	// CertSecret references a secret holding the certificate and key in
+	// its "certificate" and "private_key" fields, e.g.
+	// "vault:secret/data/registro/tls". It replaces CertFile and KeyFile.
+	CertSecret string `json:"certSecret"`
+
+	// Admin makes the listener the only one serving /registro/admin.
+	Admin bool `json:"admin"`
+}
+
+// TokenConfig holds an API token.
+type TokenConfig struct {
+	// Name identifies the token in logs and policies.
+	Name string `json:"name"`
+
+	// Secret is the token, or a secret reference to it.
+	Secret string `json:"secret"`
+
+	// Scopes holds the scopes granted: "discover" to read and watch the
+	// catalog, "register" to change it too, "admin" for everything.
+	Scopes []string `json:"scopes"`
+
+	// Environment, if set, restricts the token to the apps of an
+	// environment, e.g. prod.
+	Environment string `json:"environment"`
+}
+
+// PolicyConfig holds the configuration of the server Policy.
+type PolicyConfig struct {
+	// URL is the data API URL of an OPA decision, e.g.
+	// http://localhost:8181/v1/data/registro/allow. Empty disables it.
+	URL string `json:"url"`
+
+	// Timeout bounds each decision.
+	Timeout Duration `json:"timeout"`
+
+	// FailOpen allows the requests the policy fails to decide.
+	FailOpen bool `json:"failOpen"`
+}
+
+// TLSConfig holds TLS settings, for environments with compliance
+// requirements such as FIPS 140. Empty fields keep the secure defaults.
+type TLSConfig struct {
+	// MinVersion is the minimum TLS version, "1.2" or "1.3".
+	MinVersion string `json:"minVersion"`
+
+	// CipherSuites holds the TLS 1.2 cipher suites allowed, by name, e.g.
+	// TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256. TLS 1.3 suites cannot be
+	// chosen.
+	CipherSuites []string `json:"cipherSuites"`
+
+	// Curves holds the key exchange curves, in order of preference:
+	// X25519MLKEM768, X25519, P-256, P-384 or P-521.
+	Curves []string `json:"curves"`
+}
+
+// tlsCurves holds the key exchange curves by name.
+var tlsCurves = map[string]tls.CurveID{
+	"X25519MLKEM768": tls.X25519MLKEM768,
+	"X25519":         tls.X25519,
+	"P-256":          tls.CurveP256,
+	"P-384":          tls.CurveP384,
+	"P-521":          tls.CurveP521,
+}
+
+// isZero reports whether no setting is changed.
+func (c TLSConfig) isZero() bool {
+	return c.MinVersion == "" && len(c.CipherSuites) == 0 && len(c.Curves) == 0
+}
+
+// apply returns base with the settings changed. Insecure cipher suites are
+// refused.
+func (c TLSConfig) apply(base *tls.Config) (*tls.Config, error) {
+	cfg := base.Clone()
+	switch c.MinVersion {
+	case "":
+	case "1.2":
+		cfg.MinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.MinVersion = tls.VersionTLS13
+	default:
+		return nil, fmt.Errorf("invalid TLS version %q, 1.2 or 1.3", c.MinVersion)
+	}
+
+	if len(c.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, cs := range tls.CipherSuites() {
+			suites[cs.Name] = cs.ID
+		}
+		cfg.CipherSuites = nil
+		for _, name := range c.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			cfg.CipherSuites = append(cfg.CipherSuites, id)
+		}
+	}
+
+	if len(c.Curves) > 0 {
+		cfg.CurvePreferences = nil
+		for _, name := range c.Curves {
+			id, ok := tlsCurves[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown curve %q", name)
+			}
+			cfg.CurvePreferences = append(cfg.CurvePreferences, id)
+		}
+	}
+	return cfg, nil
+}
+
+// clientOptions returns the client options applying the settings, if any.
+func (c TLSConfig) clientOptions() ([]client.Option, error) {
+	if c.isZero() {
+		return nil, nil
+	}
+	cfg, err := c.apply(&tls.Config{})
+	if err != nil {
+		return nil, err
+	}
+	return []client.Option{client.WithTLSConfig(cfg)}, nil
+}
+
+// clientOptions returns the options of the clients of client commands.
+func (c *Config) clientOptions() ([]client.Option, error) {
+	opts, err := c.TLS.clientOptions()
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		opts = append(opts, client.WithToken(c.Token))
+	}
+	if c.Environment != "" {
+		opts = append(opts, client.WithEnvironment(c.Environment))
+	}
+	return opts, nil
+}
+
+// SigningConfig holds the key signing the catalog responses.
+type SigningConfig struct {
+	// Key is the path of the PEM private key, ECDSA P-256 or Ed25519, or
+	// a secret reference to it. Empty disables signing.
+	Key string `json:"key"`
+
+	// KeyID identifies the key in the signatures, derived from the key if
+	// empty.
+	KeyID string `json:"keyId"`
+}
+
+// SecretsConfig holds the configuration of the secret stores.
+type SecretsConfig struct {
+	// Vault holds the Vault server, enabling "vault:" references.
+	Vault VaultConfig `json:"vault"`
+
+	// RefreshInterval is the time between fetches of the listener
+	// certificates, so rotated ones are served.
+	RefreshInterval Duration `json:"refreshInterval"`
+}
+
+// VaultConfig holds the configuration of a HashiCorp Vault server.
+type VaultConfig struct {
+	// Addr is the server URL, VAULT_ADDR if empty. Vault is disabled if
+	// both are empty.
+	Addr string `json:"addr"`
+
+	// Token is the Vault token, VAULT_TOKEN if empty. It is renewed while
+	// the server runs.
+	Token string `json:"token"`
+
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string `json:"namespace"`
+}
+
+// StorageConfig holds the configuration of the server persistent storage.
+type StorageConfig struct {
+	// Path is the file where the registry is saved. Empty disables storage.
+	Path string `json:"path"`
+
+	// Durability is one of "sync", "batch" or "async".
+	Durability string `json:"durability"`
+
+	// FlushInterval is the time between writes of buffered changes.
+	FlushInterval Duration `json:"flushInterval"`
+
+	// Migrate migrates the saved registry to the latest schema version on
+	// start. Without it, a registry saved with an older version fails to
+	// load.
+	Migrate bool `json:"migrate"`
+
+	// MigrateTo, if set, is the schema version to migrate to on start,
+	// e.g. before a downgrade. The server exits once migrated.
+	MigrateTo int `json:"migrateTo"`
+
+	// Keys, if set, encrypt the saved registry with AES-GCM. The first key
+	// encrypts, the others only decrypt the data encrypted before a key
+	// rotation, which is encrypted again on start.
+	Keys []StorageKeyConfig `json:"keys"`
+}
+
+// StorageKeyConfig holds a key encrypting the saved registry.
+type StorageKeyConfig struct {
+	// ID identifies the key in the data it encrypted.
+	ID string `json:"id"`
+
+	// Key is the base64 encoded AES key, 16, 24 or 32 bytes long, or a
+	// secret reference to it, e.g. "env:REGISTRO_STORAGE_KEY".
+	Key string `json:"key"`
+}
+
+// AgentConfig holds the configuration of the registration agent.
+type AgentConfig struct {
+	// App is the name of the application the service belongs to.
+	App string `json:"app"`
+
+	// Id is the instance id registered to the registry.
+	Id string `json:"id"`
+
+	// IPAddr is the network address advertised for the service.
+	IPAddr string `json:"ip"`
+
+	// Port is the network port advertised for the service.
+	Port int `json:"port"`
+
+	// Group is the deployment group of the instance (e.g. blue or green).
+	Group string `json:"group"`
+
+	// Interval is the time between heartbeats.
+	Interval Duration `json:"interval"`
+
+	// Jitter is the fraction of the Interval randomized on every heartbeat,
+	// so instances started together do not renew at once.
+	Jitter float64 `json:"jitter"`
+
+	// Splay, if set, delays the registration by a random time up to it.
+	Splay Duration `json:"splay"`
+
+	// H2C makes the agent talk HTTP/2 without TLS to the registry.
+	H2C bool `json:"h2c"`
+
+	// HeartbeatAddr, if set, is the UDP address of the registry receiving
+	// heartbeats, sent instead of HTTP renewals.
+	HeartbeatAddr string `json:"heartbeatAddr"`
+
+	// Stream makes the agent renew through a single long lived stream.
+	Stream bool `json:"stream"`
+}
+
+// defaultConfig returns the configuration used when no file is provided.
+func defaultConfig() *Config {
+	return &Config{
+		Registry: "http://localhost:8080/registro",
+		Server: ServerConfig{
+			Addr:                   ":8080",
+			RenewalTimeout:         Duration(90 * time.Second),
+			RenewalInterval:        Duration(30 * time.Second),
+			EvictionTimeout:        Duration(10 * time.Minute),
+			TombstoneTimeout:       Duration(10 * time.Minute),
+			DrainLead:              Duration(2 * time.Minute),
+			IdleTimeout:            Duration(2 * time.Minute),
+			RequestTimeout:         Duration(30 * time.Second),
+			DiscoveryTTL:           Duration(30 * time.Second),
+			VirtualNodes:           model.DefaultVirtualNodes,
+			WarmUpThreshold:        0.85,
+			EvictionStormThreshold: 10,
+			MaxEvents:              10000,
+			EventMaxAge:            Duration(7 * 24 * time.Hour),
+			WatchQueue:             256,
+			IdempotencyWindow:      Duration(10 * time.Minute),
+			MaxClockSkew:           Duration(5 * time.Second),
+			MaxRegistrations:       16,
+			MaxRenewals:            64,
+			MaxQueue:               1000,
+			QueueTimeout:           Duration(time.Second),
+			Duplicates:             "warn",
+			Policy:                 PolicyConfig{Timeout: Duration(time.Second)},
+			Secrets:                SecretsConfig{RefreshInterval: Duration(time.Hour)},
+			AuthMaxFailures:        5,
+			AuthBanTime:            Duration(time.Minute),
+			Storage: StorageConfig{
+				Durability:    "batch",
+				FlushInterval: Duration(5 * time.Second),
+			},
+		},
+		Agent: AgentConfig{
+			IPAddr:   "127.0.0.1",
+			Interval: Duration(30 * time.Second),
+			Jitter:   client.DefaultJitter,
+		},
+	}
+}
+
+// loadConfig parses args into fs and returns the resulting configuration.
+// Values are read from the file given by --config (if any) and flags
+// explicitly set in args take precedence. bind is called to register the
+// command flags using the loaded values as defaults.
+func loadConfig(fs *flag.FlagSet, args []string, bind func(*Config)) (*Config, error) {
+	cfg := defaultConfig()
+	if path := configPath(args); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	fs.String("config", "", "path to a JSON configuration file")
+	bind(cfg)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if err := cfg.Server.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// validate checks the timeouts of the leases: an instance must be DOWN
+// before it is evicted. With load shedding, every kind of request must have
+// a slot of its own.
+func (c *ServerConfig) validate() error {
+	renewal, eviction, tombstone := time.Duration(c.RenewalTimeout), time.Duration(c.EvictionTimeout), time.Duration(c.TombstoneTimeout)
+	switch {
+	case renewal <= 0:
+		return fmt.Errorf("invalid renewal timeout %s, it must be positive", renewal)
+	case eviction <= renewal:
+		return fmt.Errorf("invalid eviction timeout %s, it must be longer than the renewal timeout %s", eviction, renewal)
+	case tombstone <= 0:
+		return fmt.Errorf("invalid tombstone timeout %s, it must be positive", tombstone)
+	case c.MaxConcurrent > 0 && c.MaxRegistrations <= 0:
+		return fmt.Errorf("invalid max registrations %d, it must be positive with load shedding", c.MaxRegistrations)
+	case c.MaxConcurrent > 0 && c.MaxRenewals <= 0:
+		return fmt.Errorf("invalid max renewals %d, it must be positive with load shedding", c.MaxRenewals)
+	}
+	return nil
+}
+
+// configPath looks for the --config flag in args.
+// It returns an empty string if the flag is not set.
+func configPath(args []string) string {
+	for i, arg := range args {
+		if arg == "--" || !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		name := strings.TrimLeft(arg, "-")
+		if name == "config" && i+1 < len(args) {
+			return args[i+1]
+		}
+		if strings.HasPrefix(name, "config=") {
+			return strings.TrimPrefix(name, "config=")
+		}
+	}
+	return ""
+}
+
+// Duration is a time.Duration that marshals to JSON as a string ("30s").
+type Duration time.Duration
+
+// MarshalJSON implements json.Marshaler.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// durationFlag binds a Duration to a command line flag.
+func durationFlag(fs *flag.FlagSet, d *Duration, name, usage string) {
+	fs.Var((*durationValue)(d), name, usage)
+}
+
+// durationValue is a flag.Value for Duration.
+type durationValue Duration
+
+func (d *durationValue) String() string { return time.Duration(*d).String() }
+
+func (d *durationValue) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = durationValue(v)
+	return nil
+}
+
+// listFlag binds a list of strings to a comma separated command line flag.
+func listFlag(fs *flag.FlagSet, l *[]string, name, usage string) {
+	fs.Var((*listValue)(l), name, usage)
+}
+
+// tlsFlags binds the TLS settings to command line flags.
+func tlsFlags(fs *flag.FlagSet, c *TLSConfig) {
+	fs.StringVar(&c.MinVersion, "tls-min-version", c.MinVersion, "minimum TLS version, 1.2 or 1.3")
+	listFlag(fs, &c.CipherSuites, "tls-cipher-suites", "comma separated TLS 1.2 cipher suites allowed")
+	listFlag(fs, &c.Curves, "tls-curves", "comma separated key exchange curves, in order of preference")
+}
+
+// listValue is a flag.Value for a list of strings.
+type listValue []string
+
+func (l *listValue) String() string { return strings.Join(*l, ",") }
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
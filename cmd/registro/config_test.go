@@ -0,0 +1,42 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigTimeouts(t *testing.T) {
+	tests := []struct {
+		args []string
+		err  string
+	}{
+		{nil, ""},
+		{[]string{"--renewal-timeout", "30s", "--eviction-timeout", "1m"}, ""},
+		{[]string{"--renewal-timeout", "0s"}, "invalid renewal timeout"},
+		{[]string{"--renewal-timeout", "-1s"}, "invalid renewal timeout"},
+		{[]string{"--renewal-timeout", "2m", "--eviction-timeout", "2m"}, "invalid eviction timeout"},
+		{[]string{"--eviction-timeout", "1m"}, "invalid eviction timeout"},
+		{[]string{"--tombstone-timeout", "0s"}, "invalid tombstone timeout"},
+		{[]string{"--max-concurrent", "256", "--max-registrations", "0"}, "invalid max registrations"},
+		{[]string{"--max-concurrent", "256", "--max-renewals", "-1"}, "invalid max renewals"},
+		{[]string{"--max-concurrent", "0", "--max-registrations", "0", "--max-renewals", "0"}, ""},
+	}
+	for _, test := range tests {
+		fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+		_, err := loadConfig(fs, test.args, func(cfg *Config) {
+			durationFlag(fs, &cfg.Server.RenewalTimeout, "renewal-timeout", "")
+			durationFlag(fs, &cfg.Server.EvictionTimeout, "eviction-timeout", "")
+			durationFlag(fs, &cfg.Server.TombstoneTimeout, "tombstone-timeout", "")
+			fs.IntVar(&cfg.Server.MaxConcurrent, "max-concurrent", cfg.Server.MaxConcurrent, "")
+			fs.IntVar(&cfg.Server.MaxRegistrations, "max-registrations", cfg.Server.MaxRegistrations, "")
+			fs.IntVar(&cfg.Server.MaxRenewals, "max-renewals", cfg.Server.MaxRenewals, "")
+		})
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%v: %s", test.args, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%v: got error %v, want %q", test.args, err, test.err)
+		}
+	}
+}
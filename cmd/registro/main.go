@@ -0,0 +1,91 @@
+/*
+	Registro is a simple service registry written in Go.
+
+	It provides a client to be used inside any Go application and a REST
+	server that handles registration and service state management.
+
+	Usage:
+
+		registro <command> [flags]
+
+	The commands are:
+
+		serve     run the registry REST server
+		agent     register a local service and keep its heartbeat
+		snapshot  dump the catalog of a running registry to a file
+		restore   load a catalog dump into a running registry
+		version   print the registro version
+
+	Every command accepts a --config flag pointing to a JSON configuration
+	file. Flags explicitly set in the command line override the file.
+*/
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// version is the registro version. It is set at build time with
+// -ldflags "-X main.version=<version>".
+var version = "dev"
+
+// command represents a registro subcommand.
+type command struct {
+	// Usage is a one line description of the command.
+	Usage string
+
+	// Run executes the command with the remaining command line args.
+	Run func(args []string) error
+}
+
+// commands holds all subcommands available in the binary.
+var commands = map[string]*command{
+	"serve":    {Usage: "run the registry REST server", Run: runServe},
+	"agent":    {Usage: "register a local service and keep its heartbeat", Run: runAgent},
+	"snapshot": {Usage: "dump the catalog of a running registry to a file", Run: runSnapshot},
+	"restore":  {Usage: "load a catalog dump into a running registry", Run: runRestore},
+	"version":  {Usage: "print the registro version", Run: runVersion},
+}
+
+func main() {
+	name, args := "serve", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		// Flags without a command keep the old behaviour of running the server.
+		name, args = args[0], args[1:]
+	}
+
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "registro: unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+
+	if err := cmd.Run(args); err != nil {
+		fmt.Fprintf(os.Stderr, "registro %s: %s\n", name, err)
+		os.Exit(1)
+	}
+}
+
+// usage writes the list of available commands to stderr.
+func usage() {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "Usage: registro <command> [flags]\n\nCommands:\n")
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-10s %s\n", name, commands[name].Usage)
+	}
+}
+
+// runVersion prints the registro version.
+func runVersion(args []string) error {
+	fmt.Printf("registro %s\n", version)
+	return nil
+}
@@ -0,0 +1,437 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"text/template"
+	"time"
+
+	"github.com/numercfd/registro/internal/server"
+	"github.com/numercfd/registro/notify"
+	"github.com/numercfd/registro/secrets"
+)
+
+// runServe runs the registry REST server until it is interrupted.
+func runServe(args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	var dryRun bool
+	cfg, err := loadConfig(fs, args, func(cfg *Config) {
+		fs.StringVar(&cfg.Server.Addr, "addr", cfg.Server.Addr, "listen address")
+		fs.StringVar(&cfg.Server.HeartbeatAddr, "heartbeat-addr", cfg.Server.HeartbeatAddr, "udp address accepting heartbeat packets (empty disables)")
+		durationFlag(fs, &cfg.Server.RenewalTimeout, "renewal-timeout", "time without heartbeats before an instance is down")
+		durationFlag(fs, &cfg.Server.EvictionTimeout, "eviction-timeout", "time without heartbeats before an instance is removed")
+		durationFlag(fs, &cfg.Server.TombstoneTimeout, "tombstone-timeout", "time deleted apps and instances may be restored")
+		durationFlag(fs, &cfg.Server.DrainLead, "drain-lead", "time before their planned termination when instances are draining")
+		durationFlag(fs, &cfg.Server.IdleTimeout, "idle-timeout", "time idle keep-alive connections are kept open")
+		durationFlag(fs, &cfg.Server.RequestTimeout, "request-timeout", "time a request may take before it is answered with 503 (0 disables)")
+		durationFlag(fs, &cfg.Server.ArchiveAfter, "archive-after", "time an app may have no instances before it is archived (0 disables)")
+		durationFlag(fs, &cfg.Server.PurgeAfter, "purge-after", "time an app may have no instances before it is removed (0 disables)")
+		durationFlag(fs, &cfg.Server.RenewalInterval, "renewal-interval", "time between renewals expected from each instance")
+		durationFlag(fs, &cfg.Server.WarmUp, "warm-up", "time after start without expirations, waiting for renewals (0 disables)")
+		fs.Float64Var(&cfg.Server.WarmUpThreshold, "warm-up-threshold", cfg.Server.WarmUpThreshold, "fraction of restored instances renewing which ends the warm-up")
+		fs.IntVar(&cfg.Server.EvictionStormThreshold, "eviction-storm-threshold", cfg.Server.EvictionStormThreshold, "evictions within a minute notified as a storm (0 disables)")
+		fs.IntVar(&cfg.Server.MaxEvents, "max-events", cfg.Server.MaxEvents, "events kept in the history (0 disables)")
+		durationFlag(fs, &cfg.Server.EventMaxAge, "event-max-age", "time events are kept in the history (0 keeps them)")
+		fs.IntVar(&cfg.Server.WatchQueue, "watch-queue", cfg.Server.WatchQueue, "changes queued for each watcher before it is evicted")
+		durationFlag(fs, &cfg.Server.MaxClockSkew, "max-clock-skew", "clock skew above which instances are reported (0 disables)")
+		durationFlag(fs, &cfg.Server.IdempotencyWindow, "idempotency-window", "time responses to changes with an Idempotency-Key are replayed (0 disables)")
+		durationFlag(fs, &cfg.Server.DiscoveryTTL, "discovery-ttl", "time clients may reuse discovery responses")
+		fs.IntVar(&cfg.Server.VirtualNodes, "hashring-vnodes", cfg.Server.VirtualNodes, "default points of every instance on the hash rings of the apps")
+		listFlag(fs, &cfg.Server.TrustedProxies, "trusted-proxies", "comma separated CIDRs of proxies trusted to report the client address")
+		fs.IntVar(&cfg.Server.MaxConcurrent, "max-concurrent", cfg.Server.MaxConcurrent, "reads handled at once, others are queued (0 disables load shedding)")
+		fs.IntVar(&cfg.Server.MaxRegistrations, "max-registrations", cfg.Server.MaxRegistrations, "registrations and changes handled at once")
+		fs.IntVar(&cfg.Server.MaxRenewals, "max-renewals", cfg.Server.MaxRenewals, "renewals handled at once")
+		fs.IntVar(&cfg.Server.MaxQueue, "max-queue", cfg.Server.MaxQueue, "requests of each kind queued before answering 503")
+		durationFlag(fs, &cfg.Server.QueueTimeout, "queue-timeout", "time a request may wait in the queue")
+		fs.BoolVar(&cfg.Server.AccessLog, "access-log", cfg.Server.AccessLog, "log every request")
+		fs.BoolVar(&cfg.Server.StrictEnvironments, "strict-environments", cfg.Server.StrictEnvironments, "require an environment from the clients of the catalog, and hide the apps without one from them")
+		fs.StringVar(&cfg.Server.Policy.URL, "policy-url", cfg.Server.Policy.URL, "OPA data API URL deciding whether requests are allowed, e.g. http://localhost:8181/v1/data/registro/allow")
+		fs.BoolVar(&cfg.Server.Policy.FailOpen, "policy-fail-open", cfg.Server.Policy.FailOpen, "allow requests when the policy cannot be reached")
+		tlsFlags(fs, &cfg.Server.TLS)
+		fs.IntVar(&cfg.Server.AuthMaxFailures, "auth-max-failures", cfg.Server.AuthMaxFailures, "authentication failures within 15 minutes banning a client (0 disables)")
+		durationFlag(fs, &cfg.Server.AuthBanTime, "auth-ban-time", "length of the first ban of a client failing to authenticate, doubled on every further ban")
+		fs.StringVar(&cfg.Server.Signing.Key, "signing-key", cfg.Server.Signing.Key, "PEM private key (ECDSA P-256 or Ed25519) signing the catalog responses, or a secret reference to it")
+		fs.StringVar(&cfg.Server.SIEM.Syslog, "siem-syslog", cfg.Server.SIEM.Syslog, "syslog receiver of the security events, as udp://host:514 or tcp://host:601")
+		fs.StringVar(&cfg.Server.SIEM.URL, "siem-url", cfg.Server.SIEM.URL, "URL receiving the security events, one per POST request")
+		fs.StringVar(&cfg.Server.SIEM.Format, "siem-format", cfg.Server.SIEM.Format, "format of the security events: cef or json")
+		fs.StringVar(&cfg.Server.Shards.Self, "shard-self", cfg.Server.Shards.Self, "URL of this node in a sharded registry, as listed in --shard-nodes (empty disables sharding)")
+		listFlag(fs, &cfg.Server.Shards.Nodes, "shard-nodes", "comma separated URLs of the nodes of a sharded registry")
+		fs.StringVar(&cfg.Server.Secrets.Vault.Addr, "vault-addr", cfg.Server.Secrets.Vault.Addr, "Vault server resolving vault: secret references (VAULT_ADDR if empty)")
+		fs.StringVar(&cfg.Server.UsageHeader, "usage-header", cfg.Server.UsageHeader, "request header identifying clients in the usage accounting, e.g. Authorization (the client address if empty)")
+		fs.StringVar(&cfg.Server.Duplicates, "duplicates", cfg.Server.Duplicates, "instances registering with a duplicate address: warn or reject")
+		fs.StringVar(&cfg.Server.Storage.Path, "data", cfg.Server.Storage.Path, "file where the registry is saved")
+		fs.StringVar(&cfg.Server.Storage.Durability, "durability", cfg.Server.Storage.Durability, "storage durability: sync, batch or async")
+		durationFlag(fs, &cfg.Server.Storage.FlushInterval, "flush-interval", "time between writes of buffered changes")
+		fs.BoolVar(&cfg.Server.Storage.Migrate, "migrate", cfg.Server.Storage.Migrate, "migrate the saved registry to the storage schema of this binary before serving")
+		fs.IntVar(&cfg.Server.Storage.MigrateTo, "migrate-to", cfg.Server.Storage.MigrateTo, "storage schema version to migrate to, and exit (0 migrates to the latest and serves)")
+		fs.BoolVar(&dryRun, "migrate-dry-run", false, "log the storage migrations to apply, without saving them, and exit")
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	resolver := secretResolver(ctx, cfg.Server.Secrets)
+
+	s := server.NewServer(cfg.Server.Addr)
+	if s.TLSConfig, err = cfg.Server.TLS.apply(server.DefaultTLSConfig()); err != nil {
+		return err
+	}
+	for _, l := range cfg.Server.Listeners {
+		listener := server.Listener{Addr: l.Addr, CertFile: l.CertFile, KeyFile: l.KeyFile, Admin: l.Admin}
+		if l.CertSecret != "" {
+			cert, err := secrets.NewCertificate(ctx, resolver, l.CertSecret)
+			if err != nil {
+				return err
+			}
+			if interval := time.Duration(cfg.Server.Secrets.RefreshInterval); interval > 0 {
+				go cert.Run(ctx, interval)
+			}
+			listener.GetCertificate = cert.GetCertificate
+		}
+		s.Listeners = append(s.Listeners, listener)
+	}
+	s.States.RenewalTimeout = time.Duration(cfg.Server.RenewalTimeout)
+	s.States.EvictionTimeout = time.Duration(cfg.Server.EvictionTimeout)
+	s.States.TombstoneTimeout = time.Duration(cfg.Server.TombstoneTimeout)
+	s.States.DrainLead = time.Duration(cfg.Server.DrainLead)
+	s.HeartbeatAddr = cfg.Server.HeartbeatAddr
+	s.IdleTimeout = time.Duration(cfg.Server.IdleTimeout)
+	s.RequestTimeout = time.Duration(cfg.Server.RequestTimeout)
+	s.ArchiveAfter = time.Duration(cfg.Server.ArchiveAfter)
+	s.PurgeAfter = time.Duration(cfg.Server.PurgeAfter)
+	s.DiscoveryTTL = time.Duration(cfg.Server.DiscoveryTTL)
+	s.VirtualNodes = cfg.Server.VirtualNodes
+	s.RenewalInterval = time.Duration(cfg.Server.RenewalInterval)
+	s.EvictionStormThreshold = cfg.Server.EvictionStormThreshold
+	s.MaxEvents = cfg.Server.MaxEvents
+	s.EventMaxAge = time.Duration(cfg.Server.EventMaxAge)
+	s.WatchQueue = cfg.Server.WatchQueue
+	s.IdempotencyWindow = time.Duration(cfg.Server.IdempotencyWindow)
+	s.MaxClockSkew = time.Duration(cfg.Server.MaxClockSkew)
+	for _, sa := range cfg.Server.Static {
+		app := server.StaticApp{Name: sa.Name, Probe: sa.Probe.probe()}
+		for _, si := range sa.Instances {
+			app.Instances = append(app.Instances, server.StaticInstance{Registration: si.Registration, Probe: si.Probe.probe()})
+		}
+		s.Static = append(s.Static, app)
+	}
+	s.WarmUp = time.Duration(cfg.Server.WarmUp)
+	s.WarmUpThreshold = cfg.Server.WarmUpThreshold
+	if s.TrustedProxies, err = server.ParseTrustedProxies(cfg.Server.TrustedProxies); err != nil {
+		return err
+	}
+	if cfg.Server.MaxConcurrent > 0 {
+		budgets := map[server.TrafficClass]int{
+			server.ReadTraffic:         cfg.Server.MaxConcurrent,
+			server.RegistrationTraffic: cfg.Server.MaxRegistrations,
+			server.RenewalTraffic:      cfg.Server.MaxRenewals,
+		}
+		s.Shedder = server.NewLoadShedder(budgets, cfg.Server.MaxQueue, time.Duration(cfg.Server.QueueTimeout))
+	}
+	if err := resolveNotifySecrets(ctx, resolver, &cfg.Server.Notify); err != nil {
+		return err
+	}
+	listeners, err := notifiers(cfg.Server.Notify)
+	if err != nil {
+		return err
+	}
+	s.States.Listeners = append(s.States.Listeners, listeners...)
+	if p := cfg.Server.Policy; p.URL != "" {
+		s.Policy = &server.OPAPolicy{URL: p.URL, Client: &http.Client{Timeout: time.Duration(p.Timeout)}}
+		s.PolicyFailOpen = p.FailOpen
+	}
+	if s.Tokens, err = tokens(ctx, resolver, cfg.Server.Tokens); err != nil {
+		return err
+	}
+	s.StrictEnvironments = cfg.Server.StrictEnvironments
+	s.Lockout.MaxFailures = cfg.Server.AuthMaxFailures
+	s.Lockout.BanTime = time.Duration(cfg.Server.AuthBanTime)
+	if s.Lockout.BanTime > s.Lockout.MaxBanTime {
+		s.Lockout.MaxBanTime = s.Lockout.BanTime
+	}
+	if c := cfg.Server.SIEM; c.Syslog != "" || c.URL != "" {
+		siem, err := siemExporter(ctx, resolver, c)
+		if err != nil {
+			return err
+		}
+		s.SecurityListeners = append(s.SecurityListeners, siem.Listen)
+	}
+	if c := cfg.Server.Shards; c.Self != "" {
+		if s.Shards, err = server.NewShards(c.Self, c.Nodes); err != nil {
+			return err
+		}
+		if s.Shards.Token, err = resolver.Resolve(ctx, c.Token); err != nil {
+			return err
+		}
+	}
+	if cfg.Server.Signing.Key != "" {
+		if s.Signer, err = signer(ctx, resolver, cfg.Server.Signing); err != nil {
+			return err
+		}
+	}
+	if cfg.Server.UsageHeader != "" {
+		s.Usage.Key = server.HeaderKey(cfg.Server.UsageHeader)
+	}
+	if cfg.Server.AccessLog {
+		s.Middleware = append([]server.Middleware{server.LogRequests}, s.Middleware...)
+	}
+
+	switch d := server.DuplicatePolicy(cfg.Server.Duplicates); d {
+	case server.WarnDuplicates, server.RejectDuplicates:
+		s.Duplicates = d
+	default:
+		return fmt.Errorf("invalid duplicates policy %q", cfg.Server.Duplicates)
+	}
+
+	if st := cfg.Server.Storage; st.Path != "" {
+		switch d := server.Durability(st.Durability); d {
+		case server.SyncDurability, server.BatchDurability, server.AsyncDurability:
+			s.Durability = d
+		default:
+			return fmt.Errorf("invalid durability %q", st.Durability)
+		}
+		store := server.NewFileStore(st.Path)
+		if len(st.Keys) > 0 {
+			if store.Keys, err = storageKeys(ctx, resolver, st.Keys); err != nil {
+				return err
+			}
+		}
+		if st.Migrate || st.MigrateTo != 0 || dryRun {
+			to := st.MigrateTo
+			if to == 0 {
+				to = server.SchemaVersion(server.FileBackend)
+			}
+			if err := store.Migrate(to, dryRun); err != nil {
+				return err
+			}
+			if dryRun || st.MigrateTo != 0 {
+				return nil
+			}
+		}
+		if err := store.Reseal(); err != nil {
+			return err
+		}
+		s.Store = store
+		s.FlushInterval = time.Duration(st.FlushInterval)
+	} else if dryRun || cfg.Server.Storage.MigrateTo != 0 {
+		return fmt.Errorf("no storage to migrate")
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	done := make(chan error, 1)
+	go func() {
+		<-stop
+		log.Printf("shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+
+	if err := s.Serve(); err != http.ErrServerClosed {
+		return err
+	}
+	return <-done
+}
+
+// secretResolver returns the resolver of the secret references of the
+// configuration. The Vault token, if any, is renewed until ctx is done.
+func secretResolver(ctx context.Context, cfg SecretsConfig) *secrets.Resolver {
+	r := secrets.NewResolver()
+	if v := secrets.NewVault(cfg.Vault.Addr, cfg.Vault.Token); v.Addr != "" {
+		v.Namespace = cfg.Vault.Namespace
+		r.Providers["vault"] = v
+		go v.KeepTokenAlive(ctx)
+	}
+	return r
+}
+
+// resolveNotifySecrets replaces the secret references of the notifiers
+// configured by their secrets. They are read once, on start.
+func resolveNotifySecrets(ctx context.Context, r *secrets.Resolver, cfg *NotifyConfig) error {
+	var values []*string
+	for i := range cfg.Chat {
+		values = append(values, &cfg.Chat[i].URL)
+	}
+	for i := range cfg.Alerts.PagerDuty {
+		values = append(values, &cfg.Alerts.PagerDuty[i].RoutingKey)
+	}
+	for i := range cfg.Alerts.Opsgenie {
+		values = append(values, &cfg.Alerts.Opsgenie[i].APIKey)
+	}
+	for i := range cfg.Alerts.Email {
+		values = append(values, &cfg.Alerts.Email[i].Password)
+	}
+	return r.ResolveAll(ctx, values...)
+}
+
+// storageKeys returns the Keyring of the storage keys configured, the
+// first one encrypting.
+func storageKeys(ctx context.Context, r *secrets.Resolver, cfg []StorageKeyConfig) (*server.Keyring, error) {
+	keys := make([]server.Key, 0, len(cfg))
+	for _, k := range cfg {
+		v, err := r.Resolve(ctx, k.Key)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			return nil, fmt.Errorf("storage key %q is not base64: %s", k.ID, err)
+		}
+		keys = append(keys, server.Key{ID: k.ID, Secret: secret})
+	}
+	return server.NewKeyring(keys[0], keys[1:]...)
+}
+
+// tokens returns the API tokens configured, resolving their secrets.
+func tokens(ctx context.Context, r *secrets.Resolver, cfg []TokenConfig) ([]server.Token, error) {
+	var tokens []server.Token
+	for _, c := range cfg {
+		secret, err := r.Resolve(ctx, c.Secret)
+		if err != nil {
+			return nil, err
+		}
+		if c.Name == "" || secret == "" {
+			return nil, fmt.Errorf("tokens require a name and a secret")
+		}
+		t := server.Token{Name: c.Name, Secret: secret, Environment: c.Environment}
+		for _, sc := range c.Scopes {
+			switch scope := server.Scope(sc); scope {
+			case server.DiscoverScope, server.RegisterScope, server.AdminScope:
+				t.Scopes = append(t.Scopes, scope)
+			default:
+				return nil, fmt.Errorf("token %s has invalid scope %q", c.Name, sc)
+			}
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, nil
+}
+
+// siemExporter returns the SIEM exporter of the security events
+// configured, resolving the secrets of its URL and headers.
+func siemExporter(ctx context.Context, r *secrets.Resolver, cfg SIEMConfig) (*notify.SIEM, error) {
+	format := notify.SIEMFormat(cfg.Format)
+	switch format {
+	case "":
+		format = notify.JSONFormat
+	case notify.JSONFormat, notify.CEFFormat:
+	default:
+		return nil, fmt.Errorf("invalid siem format %q", cfg.Format)
+	}
+	if cfg.Syslog != "" && !strings.HasPrefix(cfg.Syslog, "udp://") && !strings.HasPrefix(cfg.Syslog, "tcp://") {
+		return nil, fmt.Errorf("invalid siem syslog address %q", cfg.Syslog)
+	}
+	siem := notify.NewSIEM(format)
+	siem.Version = version
+	siem.Syslog = cfg.Syslog
+	var err error
+	if siem.URL, err = r.Resolve(ctx, cfg.URL); err != nil {
+		return nil, err
+	}
+	siem.Headers = make(map[string]string, len(cfg.Headers))
+	for k, v := range cfg.Headers {
+		if siem.Headers[k], err = r.Resolve(ctx, v); err != nil {
+			return nil, err
+		}
+	}
+	return siem, nil
+}
+
+// signer returns the Signer of the signing key configured, read from a
+// file or a secret.
+func signer(ctx context.Context, r *secrets.Resolver, cfg SigningConfig) (*server.Signer, error) {
+	var data []byte
+	if _, ok := r.Parse(cfg.Key); ok {
+		v, err := r.Resolve(ctx, cfg.Key)
+		if err != nil {
+			return nil, err
+		}
+		data = []byte(v)
+	} else {
+		var err error
+		if data, err = ioutil.ReadFile(cfg.Key); err != nil {
+			return nil, err
+		}
+	}
+	key, err := server.ParseSigningKey(data)
+	if err != nil {
+		return nil, err
+	}
+	return server.NewSigner(cfg.KeyID, key)
+}
+
+// notifiers returns the event listeners delivering the notifications
+// configured.
+func notifiers(cfg NotifyConfig) ([]func(server.Event), error) {
+	var listeners []func(server.Event)
+	if len(cfg.Chat) > 0 {
+		listeners = append(listeners, notify.NewChat(cfg.Chat).Listen)
+	}
+
+	var sinks []notify.AlertSink
+	for _, c := range cfg.Alerts.PagerDuty {
+		p := notify.NewPagerDuty(c.RoutingKey)
+		if c.Severity != "" {
+			p.Severity = c.Severity
+		}
+		if c.URL != "" {
+			p.URL = c.URL
+		}
+		sinks = append(sinks, p)
+	}
+	for _, c := range cfg.Alerts.Opsgenie {
+		o := notify.NewOpsgenie(c.APIKey)
+		if c.Priority != "" {
+			o.Priority = c.Priority
+		}
+		if c.URL != "" {
+			o.URL = c.URL
+		}
+		sinks = append(sinks, o)
+	}
+	for _, c := range cfg.Alerts.Email {
+		m := notify.NewEmail(c.Addr, c.From, c.Routes)
+		if c.Username != "" {
+			m.Auth = notify.PlainAuth(c.Addr, c.Username, c.Password)
+		}
+		if c.Subject != "" {
+			t, err := template.New("subject").Parse(c.Subject)
+			if err != nil {
+				return nil, err
+			}
+			m.Subject = t
+		}
+		if c.Body != "" {
+			t, err := template.New("body").Parse(c.Body)
+			if err != nil {
+				return nil, err
+			}
+			m.Body = t
+		}
+		sinks = append(sinks, m)
+	}
+	if len(sinks) == 0 || len(cfg.Alerts.Rules) == 0 {
+		return listeners, nil
+	}
+
+	rules := make([]notify.AlertRule, 0, len(cfg.Alerts.Rules))
+	for _, r := range cfg.Alerts.Rules {
+		if r.Name == "" || r.Event == "" {
+			return nil, fmt.Errorf("alert rules require a name and an event")
+		}
+		rules = append(rules, notify.AlertRule{Name: r.Name, Apps: r.Apps, Event: server.EventType(r.Event), For: time.Duration(r.For)})
+	}
+	return append(listeners, notify.NewAlerter(rules, sinks...).Listen), nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"github.com/numercfd/registro/client"
+)
+
+// snapshot is the file format written by the snapshot command.
+type snapshot struct {
+	// Apps holds every application, including its instances.
+	Apps []*client.Application `json:"applications"`
+}
+
+// runSnapshot dumps the catalog of a running registry to a file.
+func runSnapshot(args []string) error {
+	fs := flag.NewFlagSet("snapshot", flag.ExitOnError)
+	out := fs.String("out", "-", "output file (- for stdout)")
+	cfg, err := loadConfig(fs, args, func(cfg *Config) {
+		fs.StringVar(&cfg.Registry, "registry", cfg.Registry, "registry root URL")
+		tlsFlags(fs, &cfg.TLS)
+		fs.StringVar(&cfg.Token, "token", cfg.Token, "API token presented to the registry")
+		fs.StringVar(&cfg.Environment, "environment", cfg.Environment, "environment of the client, e.g. prod: only the apps of that environment are seen")
+	})
+	if err != nil {
+		return err
+	}
+
+	opts, err := cfg.clientOptions()
+	if err != nil {
+		return err
+	}
+	c := client.NewClient(cfg.Registry, opts...)
+	apps, err := c.GetAppsInGroup(client.AllGroups)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(snapshot{Apps: apps}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if *out == "-" {
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	return ioutil.WriteFile(*out, data, 0644)
+}
+
+// runRestore loads a snapshot file into a running registry.
+// Applications and instances that already exist are left untouched.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	in := fs.String("in", "-", "input file (- for stdin)")
+	cfg, err := loadConfig(fs, args, func(cfg *Config) {
+		fs.StringVar(&cfg.Registry, "registry", cfg.Registry, "registry root URL")
+		tlsFlags(fs, &cfg.TLS)
+		fs.StringVar(&cfg.Token, "token", cfg.Token, "API token presented to the registry")
+		fs.StringVar(&cfg.Environment, "environment", cfg.Environment, "environment of the client, e.g. prod: only the apps of that environment are seen")
+	})
+	if err != nil {
+		return err
+	}
+
+	var data []byte
+	if *in == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*in)
+	}
+	if err != nil {
+		return err
+	}
+
+	var snap snapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return err
+	}
+
+	opts, err := cfg.clientOptions()
+	if err != nil {
+		return err
+	}
+	c := client.NewClient(cfg.Registry, opts...)
+	existing, err := c.GetAppsInGroup(client.AllGroups)
+	if err != nil {
+		return err
+	}
+	for _, app := range snap.Apps {
+		// Registering an existing instance would revoke its lease, so only
+		// the instances missing from the registry are registered.
+		current := client.NewApplication(app.Name)
+		for _, a := range existing {
+			if a.Name == app.Name {
+				current = a
+			}
+		}
+		var err error
+		if app.ExpiresAt != nil {
+			// Ephemeral apps expired since the snapshot are not restored.
+			lifetime := time.Until(*app.ExpiresAt)
+			if lifetime <= 0 {
+				log.Printf("app %s expired, not restored", app.Name)
+				continue
+			}
+			_, err = c.NewEphemeralApp(app.Name, lifetime)
+		} else {
+			_, err = c.NewApp(app.Name)
+		}
+		if err != nil && !isConflict(err) {
+			return err
+		}
+		restored := 0
+		for _, i := range app.Instances {
+			if current.GetInstance(i.Id) != nil {
+				continue
+			}
+			inst := client.NewInstance(i.Id, i.IPAddr, i.Port)
+			inst.Metadata = i.Metadata
+			inst.DeploymentGroup = i.DeploymentGroup
+			if err := c.RegisterInstance(app, inst); err != nil {
+				return err
+			}
+			restored++
+		}
+		if app.ActiveGroup != "" && current.ActiveGroup == "" {
+			if err := c.SetActiveGroup(app, app.ActiveGroup); err != nil {
+				return err
+			}
+		}
+		log.Printf("restored app %s with %d instances", app.Name, restored)
+	}
+	return nil
+}
+
+// isConflict reports whether err is a 409 response from the registry.
+func isConflict(err error) bool {
+	var codeErr *client.UnexpectedCodeError
+	return errors.As(err, &codeErr) && codeErr.Code == 409
+}
@@ -0,0 +1,165 @@
+package server
+
+import (
+	"fmt"
+	"time"
+)
+
+// NewApplication return a new Application object the specified name.
+func NewApplication(name string) *Application {
+	return &Application{
+		Name:        name,
+		Instances:   make([]*Instance, 0),
+		generations: make(map[string]uint64),
+		vacated:     make(map[string]time.Time),
+	}
+}
+
+// Application represents an app registered to the server. It holds the
+// runtime state of the app, responses show its view instead.
+type Application struct {
+	// Name specifies a name to diferentiate apps.
+	Name string
+
+	// Instances holds a list of instances running this app.
+	Instances []*Instance
+
+	// ActiveGroup is the deployment group served by discovery. Empty
+	// serves every instance.
+	ActiveGroup string
+
+	// MinHealthy is the number of UP instances the app must keep. Admin
+	// operations dropping the app below it are rejected unless forced, and
+	// events are emitted when it is breached.
+	MinHealthy int
+
+	// TTL overrides the server DiscoveryTTL for the app. Zero uses the
+	// default.
+	TTL time.Duration
+
+	// Archived is set for apps hidden from the default listing for having
+	// no instances for a while. It is cleared when an instance registers.
+	Archived bool
+
+	// Environment is the environment of the app, e.g. staging or prod. Its
+	// instances are only discovered by the clients of that environment.
+	Environment string
+
+	// ExpiresAt, if set, is when the app and its instances are removed,
+	// e.g. for the preview environment of a pull request.
+	ExpiresAt time.Time
+
+	// Rollout holds the last rollout between deployment groups, if any.
+	// While it is active, discovery serves both of its groups.
+	Rollout *Rollout
+
+	// Maintenance holds the maintenance windows declared for the app.
+	Maintenance []*Maintenance
+
+	// generations holds the last generation of every instance id registered,
+	// including the ones removed for less than the generation window.
+	generations map[string]uint64
+
+	// vacated holds when the ids of generations were first seen without an
+	// instance.
+	vacated map[string]time.Time
+
+	// deletedAt holds when the application was deleted, if it was.
+	deletedAt time.Time
+
+	// purgeTimer purges the application once deleted, unless restored.
+	purgeTimer *time.Timer
+
+	// breached is set while the app is below MinHealthy.
+	breached bool
+
+	// down is set while the app has no UP instance, after losing them.
+	down bool
+
+	// emptySince holds since when the app has no instances, if it has none.
+	emptySince time.Time
+}
+
+// GetInstance return the instance with the specified id.
+func (a *Application) GetInstance(id string) *Instance {
+	for _, inst := range a.Instances {
+		if inst.Id == id {
+			return inst
+		}
+	}
+	return nil
+}
+
+// GetAvailableInstances returns all instances with status UP.
+func (a *Application) GetAvailableInstances() []*Instance {
+	instances := make([]*Instance, 0)
+	for _, inst := range a.Instances {
+		if inst.Status == UP {
+			instances = append(instances, inst)
+		}
+	}
+	return instances
+}
+
+// maxGenerationJump is how far ahead of the last one a registrant may ask
+// for a generation, so generations cannot be exhausted.
+const maxGenerationJump = 1 << 16
+
+// nextGeneration returns the generation for a new registration of the
+// instance id. Generations only move forward, so a registrant asking for an
+// older generation than the last one registered is stale and rejected.
+func (a *Application) nextGeneration(id string, requested uint64) (uint64, error) {
+	last := a.generations[id]
+	if requested != 0 && requested < last {
+		return 0, &StaleGenerationError{Id: id, Generation: requested, Current: last}
+	}
+	if requested > last+maxGenerationJump {
+		return 0, fmt.Errorf("instance %s generation %d is too far ahead of %d", id, requested, last)
+	}
+	if requested > last {
+		return requested, nil
+	}
+	return last + 1, nil
+}
+
+// pruneGenerations forgets the generations of the ids without an instance
+// since window before now.
+func (a *Application) pruneGenerations(now time.Time, window time.Duration) {
+	registered := make(map[string]bool, len(a.Instances))
+	for _, inst := range a.Instances {
+		registered[inst.Id] = true
+	}
+	for id := range a.generations {
+		switch since, ok := a.vacated[id]; {
+		case registered[id]:
+			delete(a.vacated, id)
+		case !ok:
+			a.vacated[id] = now
+		case now.Sub(since) >= window:
+			delete(a.generations, id)
+			delete(a.vacated, id)
+		}
+	}
+}
+
+// removeInstance deletes the instance for the Application list.
+func (a *Application) removeInstance(instance *Instance) {
+	instList := make([]*Instance, 0)
+	for _, inst := range a.Instances {
+		if inst != instance {
+			instList = append(instList, inst)
+		}
+	}
+	a.Instances = instList
+}
+
+// StaleGenerationError is returned when registering an instance with an
+// older generation than the current one.
+type StaleGenerationError struct {
+	Id                  string
+	Generation, Current uint64
+}
+
+func (e *StaleGenerationError) Error() string {
+	return fmt.Sprintf("instance %s generation %d is older than %d", e.Id, e.Generation, e.Current)
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextGeneration(t *testing.T) {
+	app := NewApplication("app0")
+	app.generations["i-1"] = 5
+	tests := []struct {
+		requested, want uint64
+		err             bool
+	}{
+		{0, 6, false},
+		{5, 6, false},
+		{9, 9, false},
+		{4, 0, true},
+		{5 + maxGenerationJump, 5 + maxGenerationJump, false},
+		{6 + maxGenerationJump, 0, true},
+		{^uint64(0), 0, true},
+	}
+	for _, test := range tests {
+		got, err := app.nextGeneration("i-1", test.requested)
+		if (err != nil) != test.err || got != test.want {
+			t.Errorf("nextGeneration(%d) = %d, %v, want %d (error %t)", test.requested, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestPruneGenerations(t *testing.T) {
+	now := time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)
+	app := NewApplication("app0")
+	app.Instances = append(app.Instances, NewInstance("i-1", "10.0.0.1", 8080))
+	app.generations["i-1"] = 3
+	app.generations["i-2"] = 7
+
+	app.pruneGenerations(now, time.Minute)
+	app.pruneGenerations(now.Add(59*time.Second), time.Minute)
+	if app.generations["i-2"] != 7 {
+		t.Fatalf("generation of i-2 pruned within the window")
+	}
+	app.pruneGenerations(now.Add(time.Minute), time.Minute)
+	if _, ok := app.generations["i-2"]; ok {
+		t.Errorf("generation of i-2 kept after the window")
+	}
+	if app.generations["i-1"] != 3 {
+		t.Errorf("generation of registered i-1 pruned")
+	}
+	if len(app.vacated) != 0 {
+		t.Errorf("vacated ids left: %v", app.vacated)
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// janitorInterval is the time between checks for empty applications.
+const janitorInterval = time.Minute
+
+// checkEmpty tracks since when the app has no instances. An archived app
+// getting an instance is brought back. It must be called with s.mu held.
+func (s *Server) checkEmpty(app *Application) {
+	if len(app.Instances) > 0 {
+		app.emptySince = time.Time{}
+		if app.Archived {
+			app.Archived = false
+			s.record(PutApplication, app, nil)
+			log.Printf("application %s unarchived", app.Name)
+		}
+		return
+	}
+	if app.emptySince.IsZero() {
+		app.emptySince = s.now()
+	}
+}
+
+// runJanitor archives and purges the applications which have had no
+// instances for longer than ArchiveAfter and PurgeAfter, and removes the
+// expired ones. In a sharded registry, it retries handing off the apps
+// owned by other nodes.
+func (s *Server) runJanitor() {
+	ticker := time.NewTicker(janitorInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+
+		if s.ReadOnly().Enabled {
+			continue
+		}
+
+		s.mu.Lock()
+		s.sweep(s.now())
+		s.mu.Unlock()
+		s.rebalance()
+	}
+}
+
+// sweep removes the apps expired by now, archives and purges the ones
+// empty for too long, and forgets the generations of the instances removed
+// for longer than the eviction and tombstone timeouts, when a registrant of
+// an older generation would have been evicted anyway. It must be called
+// with s.mu held.
+func (s *Server) sweep(now time.Time) {
+	s.expireApps(now)
+	window := s.States.EvictionTimeout
+	if s.States.TombstoneTimeout > window {
+		window = s.States.TombstoneTimeout
+	}
+	for _, app := range s.Applications {
+		app.pruneGenerations(now, window)
+		if len(app.Instances) > 0 || app.emptySince.IsZero() {
+			continue
+		}
+		empty := now.Sub(app.emptySince)
+		switch {
+		case s.PurgeAfter > 0 && empty >= s.PurgeAfter:
+			s.purgeApp(app)
+		case s.ArchiveAfter > 0 && empty >= s.ArchiveAfter && !app.Archived:
+			app.Archived = true
+			s.record(PutApplication, app, nil)
+			s.publish(app)
+			s.States.emit(Event{Type: AppArchived, App: app.Name})
+		}
+	}
+}
+
+// purgeApp permanently removes an application, without a tombstone.
+// It must be called with s.mu held.
+func (s *Server) purgeApp(app *Application) {
+	s.removeApp(app)
+	s.States.emit(Event{Type: AppPurged, App: app.Name})
+}
+
+// expireApps removes the applications whose ExpiresAt is past, along with
+// their instances, without a tombstone. It must be called with s.mu held.
+func (s *Server) expireApps(now time.Time) {
+	for _, app := range s.Applications {
+		if app.ExpiresAt.IsZero() || now.Before(app.ExpiresAt) {
+			continue
+		}
+		// Instances of expired apps are neither renewed nor evicted.
+		for _, inst := range app.Instances {
+			s.unschedule(inst)
+		}
+		s.removeApp(app)
+		s.States.emit(Event{Type: AppExpired, App: app.Name, Count: len(app.Instances)})
+	}
+}
+
+// removeApp removes an application from the catalog and the Store.
+// It must be called with s.mu held.
+func (s *Server) removeApp(app *Application) {
+	apps := make([]*Application, 0, len(s.Applications))
+	for _, a := range s.Applications {
+		if a != app {
+			apps = append(apps, a)
+		}
+	}
+	s.Applications = apps
+	s.record(DeleteApplication, app, nil)
+	s.unpublish(app)
+}
+
+// expiryTime returns when an app created or updated with expiresAt or
+// expiresIn (seconds) expires, zero if neither is set.
+func expiryTime(expiresAt *time.Time, expiresIn float64) (time.Time, error) {
+	switch {
+	case expiresIn < 0:
+		return time.Time{}, fmt.Errorf("invalid expiresIn %g", expiresIn)
+	case expiresIn > 0:
+		return time.Now().Add(time.Duration(expiresIn * float64(time.Second))), nil
+	case expiresAt != nil:
+		return *expiresAt, nil
+	}
+	return time.Time{}, nil
+}
+
+// archivedHandler is the HTTP handler for /registro/admin/archived.
+// It lists the archived applications.
+func (s *Server) archivedHandler(w http.ResponseWriter, r *http.Request) {
+	c := s.snapshot()
+	apps := make([]*Application, 0)
+	for _, app := range c.Applications {
+		if app.Archived {
+			apps = append(apps, app)
+		}
+	}
+	data, err := encodeJSON(appList(apps), isPretty(r))
+	writeBody(w, 200, data, err)
+}
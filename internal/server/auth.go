@@ -0,0 +1,149 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// authVars counts the requests authenticated and refused, by outcome.
+var authVars = expvar.NewMap("auth")
+
+// Token is an API token and the scopes it grants.
+type Token struct {
+	// Name identifies the token in logs and policies, never its secret.
+	Name string
+
+	// Secret is the value sent by clients, as "Authorization: Bearer
+	// <secret>".
+	Secret string
+
+	// Scopes holds the scopes granted. AdminScope grants every scope, and
+	// RegisterScope grants DiscoverScope too.
+	Scopes []Scope
+
+	// Environment, if set, restricts the token to the apps of an
+	// environment, see Server.StrictEnvironments.
+	Environment string
+}
+
+// Grants reports whether the token grants scope.
+func (t *Token) Grants(scope Scope) bool {
+	for _, s := range t.Scopes {
+		switch {
+		case s == scope, s == AdminScope:
+			return true
+		case s == RegisterScope && scope == DiscoverScope:
+			return true
+		}
+	}
+	return false
+}
+
+// tokenKey is the context key of the Token of a request.
+type tokenKey struct{}
+
+// RequestToken returns the token the request was authenticated with, nil
+// if the server has no Tokens or the route is public.
+func RequestToken(r *http.Request) *Token {
+	t, _ := r.Context().Value(tokenKey{}).(*Token)
+	return t
+}
+
+// bearerToken returns the token of the Authorization header, if any.
+func bearerToken(r *http.Request) string {
+	v := r.Header.Get("Authorization")
+	if len(v) < 7 || !strings.EqualFold(v[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(v[7:])
+}
+
+// lookupToken returns the token whose secret is secret, comparing them in
+// constant time.
+func (s *Server) lookupToken(secret string) *Token {
+	sum := sha256.Sum256([]byte(secret))
+	var found *Token
+	for i := range s.Tokens {
+		t := &s.Tokens[i]
+		other := sha256.Sum256([]byte(t.Secret))
+		if subtle.ConstantTimeCompare(sum[:], other[:]) == 1 {
+			found = t
+		}
+	}
+	return found
+}
+
+// authFailed counts an authentication failure of keys, emitting a
+// ClientBanned event for the ones banned.
+func (s *Server) authFailed(r *http.Request, keys []string) {
+	if s.Lockout == nil {
+		return
+	}
+	banned := s.Lockout.fail(keys, time.Now())
+	for _, k := range banned {
+		s.States.emit(Event{Type: ClientBanned, Client: k, Count: s.Lockout.MaxFailures})
+		s.securityEvent(r, SecurityEvent{Type: ClientBanned, Client: k, Status: 401, Reason: "too many authentication failures"})
+	}
+}
+
+// authenticate is a Middleware requiring a token granting the scope of the
+// operation, if the server has Tokens. Requests without a valid token are
+// answered with 401, and the ones whose token lacks the scope with 403.
+// Clients failing too often are banned by the server Lockout, and their
+// requests without a valid token answered with 429 until the ban ends.
+// Public routes and OPTIONS are served to anyone.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := RequestRoute(r)
+		if len(s.Tokens) == 0 || route.Public || route.Scope == "" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Valid tokens are checked first, so they are never refused by a
+		// ban of their address.
+		secret := bearerToken(r)
+		t := s.lookupToken(secret)
+		if t == nil {
+			keys := lockoutKeys(ClientIP(r), secret)
+			if l := s.Lockout; l != nil {
+				if until := l.banned(keys, time.Now()); !until.IsZero() {
+					authVars.Add("banned", 1)
+					w.Header().Set("Retry-After", strconv.Itoa(int(time.Until(until)/time.Second)+1))
+					data, err := encodeJSON(errorBody{Error: "too many authentication failures, retry later"}, false)
+					writeBody(w, 429, data, err)
+					return
+				}
+			}
+
+			reason := "invalid token"
+			if secret == "" {
+				reason = "no token"
+			}
+			s.securityEvent(r, SecurityEvent{Type: AuthFailed, Status: 401, Reason: reason})
+			s.authFailed(r, keys)
+			authVars.Add("unauthorized", 1)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="registro"`)
+			data, err := encodeJSON(errorBody{Error: "a valid token is required"}, false)
+			writeBody(w, 401, data, err)
+			return
+		}
+		if !t.Grants(route.Scope) {
+			authVars.Add("forbidden", 1)
+			reason := fmt.Sprintf("token %s lacks the %s scope", t.Name, route.Scope)
+			s.securityEvent(r, SecurityEvent{Type: TokenMisused, Token: t.Name, Status: 403, Reason: reason})
+			data, err := encodeJSON(errorBody{Error: reason}, false)
+			writeBody(w, 403, data, err)
+			return
+		}
+		authVars.Add("authenticated", 1)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenKey{}, t)))
+	})
+}
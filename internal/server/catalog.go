@@ -0,0 +1,165 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// cacheTTL bounds how long an encoded catalog response is reused. Cached
+// responses are dropped on every change, but time dependent fields (such as
+// leaseRemaining) would never be refreshed in a quiet registry otherwise.
+const cacheTTL = time.Second
+
+// catalog is an immutable copy of the registered applications.
+// Readers use it without locking, while writers replace it atomically
+// after every change, so heavy read load never contends with heartbeats.
+type catalog struct {
+	// Version is incremented on every change.
+	Version uint64
+
+	// Applications holds copies of the registered apps.
+	// They must never be modified.
+	Applications []*Application
+
+	// mu protects encoded.
+	mu sync.Mutex
+
+	// encoded caches the serialized responses for this version.
+	encoded map[string]encodedResponse
+}
+
+// encodedResponse is a response body cached by the catalog.
+type encodedResponse struct {
+	data []byte
+	at   time.Time
+}
+
+// encode returns the JSON encoding of the value returned by fn, reusing a
+// previous encoding stored under key if it is still fresh.
+func (c *catalog) encode(key string, pretty bool, fn func() interface{}) ([]byte, error) {
+	if pretty {
+		key += "?pretty"
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.encoded[key]; ok && time.Since(e.at) < cacheTTL {
+		return e.data, nil
+	}
+
+	data, err := encodeJSON(fn(), pretty)
+	if err != nil {
+		return nil, err
+	}
+	if c.encoded == nil {
+		c.encoded = make(map[string]encodedResponse)
+	}
+	c.encoded[key] = encodedResponse{data: data, at: time.Now()}
+	return data, nil
+}
+
+// GetApplication return the Application which has the coresponding name.
+// Return nil if no Application with this name has been found.
+func (c *catalog) GetApplication(name string) *Application {
+	for _, app := range c.Applications {
+		if app.Name == name {
+			return app
+		}
+	}
+	return nil
+}
+
+// snapshot returns the current catalog.
+func (s *Server) snapshot() *catalog {
+	return s.catalog.Load().(*catalog)
+}
+
+// Apps returns the registered applications, as in API responses, ordered
+// as registered. Unlike Applications, it is safe for concurrent use.
+func (s *Server) Apps() []*model.Application {
+	return appList(s.snapshot().Applications).Apps
+}
+
+// App returns the application, as in API responses, nil if it is not
+// registered. It is safe for concurrent use.
+func (s *Server) App(name string) *model.Application {
+	if app := s.snapshot().GetApplication(name); app != nil {
+		return app.view()
+	}
+	return nil
+}
+
+// publish replaces the copy of app in the catalog with its current state.
+// Only the changed app is copied, the others are shared with the previous
+// catalog. As it follows every change, it also checks the app MinHealthy
+// and whether it is empty. It must be called with s.mu held.
+func (s *Server) publish(app *Application) {
+	s.checkBreach(app)
+	s.checkDown(app)
+	s.checkEmpty(app)
+
+	old := s.snapshot()
+	c := &catalog{
+		Version:      old.Version + 1,
+		Applications: make([]*Application, 0, len(old.Applications)+1),
+	}
+
+	cp, found := app.copy(), false
+	for _, a := range old.Applications {
+		if a.Name == app.Name {
+			a, found = cp, true
+		}
+		c.Applications = append(c.Applications, a)
+	}
+	if !found {
+		c.Applications = append(c.Applications, cp)
+	}
+	s.catalog.Store(c)
+	s.watchers.publish(change{App: app.Name, Copy: cp, Version: c.Version})
+}
+
+// unpublish removes app from the catalog.
+// It must be called with s.mu held.
+func (s *Server) unpublish(app *Application) {
+	old := s.snapshot()
+	c := &catalog{
+		Version:      old.Version + 1,
+		Applications: make([]*Application, 0, len(old.Applications)),
+	}
+	for _, a := range old.Applications {
+		if a.Name != app.Name {
+			c.Applications = append(c.Applications, a)
+		}
+	}
+	s.catalog.Store(c)
+	s.watchers.publish(change{App: app.Name, Version: c.Version})
+}
+
+// copy returns a deep copy of the application and its instances.
+// Instances under maintenance are shown as MAINTENANCE. The copies share
+// the state changed by renewals with the instances.
+func (a *Application) copy() *Application {
+	cp := NewApplication(a.Name)
+	cp.ActiveGroup = a.ActiveGroup
+	cp.MinHealthy = a.MinHealthy
+	cp.TTL = a.TTL
+	cp.Archived = a.Archived
+	cp.Environment = a.Environment
+	cp.ExpiresAt = a.ExpiresAt
+	cp.Rollout = a.Rollout
+	cp.Maintenance = a.Maintenance
+	now := time.Now()
+	for _, inst := range a.Instances {
+		inst.shareRenewal()
+		i := *inst
+		i.expiry, i.copied = nil, true
+		if !a.maintenanceEnd(inst, now).IsZero() {
+			i.Status = MAINTENANCE
+		}
+		cp.Instances = append(cp.Instances, &i)
+	}
+	return cp
+}
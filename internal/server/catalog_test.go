@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRenewalDoesNotPublish(t *testing.T) {
+	s := NewServer("")
+	populate(s, 1, 10)
+
+	// The lease of the instance is about to expire in the catalog.
+	s.mu.Lock()
+	app := s.GetApplication("app0")
+	inst := app.GetInstance("i-3")
+	inst.LastRenewal -= 60
+	inst.leaseExpires = time.Now().Add(time.Second)
+	s.publish(app)
+	version := s.snapshot().Version
+	s.mu.Unlock()
+
+	expect(t, do(s.Handler(), "PUT", "/apps/app0/i-3", `{"cpu": 0.5}`, LeaseHeader, inst.LeaseId), 204)
+	c := s.snapshot()
+	if c.Version != version {
+		t.Errorf("renewal published version %d, want %d", c.Version, version)
+	}
+	v := c.GetApplication("app0").GetInstance("i-3").view()
+	if v.LastRenewal != inst.LastRenewal {
+		t.Errorf("catalog shows last renewal %d, want %d", v.LastRenewal, inst.LastRenewal)
+	}
+	if v.Vitals == nil || v.Vitals.CPU != 0.5 {
+		t.Errorf("catalog shows vitals %+v, want the renewed ones", v.Vitals)
+	}
+	if d := time.Duration(v.LeaseRemaining) * time.Second; d < s.States.RenewalTimeout-time.Minute {
+		t.Errorf("catalog shows a lease of %s, want the renewed one", d)
+	}
+	if v.Status != UP {
+		t.Errorf("catalog shows status %s, want %s", v.Status, UP)
+	}
+}
+
+func BenchmarkRenew(b *testing.B) {
+	for _, n := range []int{100, 5000, 20000} {
+		b.Run(fmt.Sprintf("instances=%d", n), func(b *testing.B) {
+			s := NewServer("")
+			populate(s, 1, n)
+			h := s.Handler()
+			app := s.GetApplication("app0")
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				inst := app.Instances[i%n]
+				expect(b, do(h, "PUT", "/apps/app0/"+inst.Id, "", LeaseHeader, inst.LeaseId), 204)
+			}
+		})
+	}
+}
+
+func BenchmarkListApps(b *testing.B) {
+	for _, n := range []int{100, 5000, 20000} {
+		b.Run(fmt.Sprintf("instances=%d", n), func(b *testing.B) {
+			s := NewServer("")
+			populate(s, 1, n)
+			h := s.Handler()
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				expect(b, do(h, "GET", "/apps", ""), 200)
+			}
+		})
+	}
+}
+
+// BenchmarkEncodeApps lists the apps with and without the encoding cache,
+// which is dropped before every request when disabled.
+func BenchmarkEncodeApps(b *testing.B) {
+	for _, pretty := range []bool{false, true} {
+		for _, cached := range []bool{true, false} {
+			b.Run(fmt.Sprintf("pretty=%t/cached=%t", pretty, cached), func(b *testing.B) {
+				s := NewServer("")
+				populate(s, 10, 100)
+				h := s.Handler()
+				c := s.snapshot()
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					if !cached {
+						c.mu.Lock()
+						c.encoded = nil
+						c.mu.Unlock()
+					}
+					expect(b, do(h, "GET", fmt.Sprintf("/apps?pretty=%t", pretty), ""), 200)
+				}
+			})
+		}
+	}
+}
+
+// BenchmarkMixed serves reads and renewals at once, one renewal every
+// readsPerRenewal requests: reads must not slow down with renewals.
+func BenchmarkMixed(b *testing.B) {
+	const n = 1000
+	for _, readsPerRenewal := range []int{1, 10, 100} {
+		b.Run(fmt.Sprintf("readsPerRenewal=%d", readsPerRenewal), func(b *testing.B) {
+			s := NewServer("")
+			populate(s, 1, n)
+			h := s.Handler()
+			app := s.GetApplication("app0")
+			var requests int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					i := atomic.AddInt64(&requests, 1)
+					if i%int64(readsPerRenewal+1) == 0 {
+						inst := app.Instances[i%n]
+						expect(b, do(h, "PUT", "/apps/app0/"+inst.Id, "", LeaseHeader, inst.LeaseId), 204)
+					} else {
+						expect(b, do(h, "GET", "/apps/app0", ""), 200)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,161 @@
+//go:build chaos
+
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Fault describes a failure injected into the requests matching it.
+// It is only available in binaries built with the chaos tag, to test client
+// retry and failover end-to-end.
+type Fault struct {
+	// Path is a regular expression matched against the request path.
+	// An empty Path matches every request.
+	Path string `json:"path,omitempty"`
+
+	// Method restricts the fault to a request method. Empty matches all.
+	Method string `json:"method,omitempty"`
+
+	// Percent is the percentage of matching requests affected (0-100).
+	Percent float64 `json:"percent"`
+
+	// LatencyMs is added to the request before it is handled.
+	LatencyMs int `json:"latencyMs,omitempty"`
+
+	// Status, if set, is returned instead of handling the request.
+	Status int `json:"status,omitempty"`
+
+	// Drop replies 204 without handling the request, as if a heartbeat was
+	// accepted but lost.
+	Drop bool `json:"drop,omitempty"`
+
+	// Partition aborts the connection without any reply.
+	Partition bool `json:"partition,omitempty"`
+
+	path *regexp.Regexp
+}
+
+// chaos holds the faults currently injected.
+type chaos struct {
+	mu     sync.Mutex
+	faults []*Fault
+}
+
+func init() {
+	// The admin endpoint controlling the faults is only served with the
+	// chaos tag.
+	routes = append(routes, route{
+		Path:    "/registro/admin/chaos",
+		Handler: func(s *Server, w http.ResponseWriter, r *http.Request) { s.chaos.adminHandler(w, r) },
+		Operations: []operation{
+			{Method: "GET", Summary: "List the faults injected", Status: 200, Response: []*Fault{}},
+			{Method: "PUT", Summary: "Replace the faults injected", Request: []*Fault{}, Status: 204},
+			{Method: "DELETE", Summary: "Remove every fault injected", Status: 204},
+		},
+	})
+}
+
+// withChaos wraps router with the fault injection middleware.
+func (s *Server) withChaos(router *mux.Router) http.Handler {
+	c := &s.chaos
+	log.Printf("chaos fault injection enabled")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f := c.match(r); f != nil {
+			if f.LatencyMs > 0 {
+				<-time.After(time.Duration(f.LatencyMs) * time.Millisecond)
+			}
+			switch {
+			case f.Partition:
+				panic(http.ErrAbortHandler)
+			case f.Drop:
+				w.WriteHeader(204)
+				return
+			case f.Status != 0:
+				w.WriteHeader(f.Status)
+				return
+			}
+		}
+		router.ServeHTTP(w, r)
+	})
+}
+
+// match returns the first fault affecting the request, if any.
+// The admin endpoint is never affected.
+func (c *chaos) match(r *http.Request) *Fault {
+	if r.URL.Path == "/registro/admin/chaos" {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, f := range c.faults {
+		if f.Method != "" && f.Method != r.Method {
+			continue
+		}
+		if f.path != nil && !f.path.MatchString(r.URL.Path) {
+			continue
+		}
+		if rand.Float64()*100 < f.Percent {
+			return f
+		}
+	}
+	return nil
+}
+
+// adminHandler is the HTTP handler for /admin/chaos.
+// GET lists the faults, PUT replaces them and DELETE removes them all.
+func (c *chaos) adminHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		c.mu.Lock()
+		data, err := encodeJSON(c.faults, isPretty(r))
+		c.mu.Unlock()
+		writeBody(w, 200, data, err)
+	case "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		faults := make([]*Fault, 0)
+		if err := json.Unmarshal(body, &faults); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		for _, f := range faults {
+			if f.Path == "" {
+				continue
+			}
+			if f.path, err = regexp.Compile(f.Path); err != nil {
+				w.WriteHeader(400)
+				return
+			}
+		}
+
+		c.mu.Lock()
+		c.faults = faults
+		c.mu.Unlock()
+		log.Printf("chaos: %d faults injected", len(faults))
+		w.WriteHeader(204)
+	case "DELETE":
+		c.mu.Lock()
+		c.faults = nil
+		c.mu.Unlock()
+		log.Printf("chaos: faults removed")
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(405)
+	}
+}
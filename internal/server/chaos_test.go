@@ -0,0 +1,41 @@
+//go:build chaos
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestChaosFaults(t *testing.T) {
+	s := NewServer("")
+	populate(s, 1, 1)
+	h := s.Handler()
+	faults := `[{"path":"/apps$","percent":100,"status":503}]`
+
+	expect(t, do(h, "PUT", "/registro/admin/chaos", faults), 204)
+	expect(t, do(h, "GET", "/apps", ""), 503)
+	expect(t, do(h, "GET", "/apps/app0", ""), 200)
+	if rec := do(h, "GET", "/registro/admin/chaos", ""); rec.Code != 200 || !json.Valid(rec.Body.Bytes()) {
+		t.Errorf("got faults %d %s", rec.Code, rec.Body)
+	}
+	expect(t, do(h, "DELETE", "/registro/admin/chaos", ""), 204)
+	expect(t, do(h, "GET", "/apps", ""), 200)
+}
+
+func TestChaosRequiresAdmin(t *testing.T) {
+	s := NewServer("")
+	s.Tokens = []Token{
+		{Name: "admin", Secret: "admin-secret", Scopes: []Scope{AdminScope}},
+		{Name: "service", Secret: "service-secret", Scopes: []Scope{RegisterScope}},
+	}
+	h := s.Handler()
+	faults := `[{"path":"/apps","percent":100,"status":503}]`
+
+	expect(t, do(h, "PUT", "/registro/admin/chaos", faults), 401)
+	expect(t, do(h, "PUT", "/registro/admin/chaos", faults, "Authorization", "Bearer service-secret"), 403)
+	expect(t, do(h, "PUT", "/registro/admin/chaos", faults, "Authorization", "Bearer admin-secret"), 204)
+	expect(t, do(h, "GET", "/apps", "", "Authorization", "Bearer service-secret"), 503)
+	expect(t, do(h, "DELETE", "/registro/admin/chaos", "", "Authorization", "Bearer admin-secret"), 204)
+	expect(t, do(h, "GET", "/apps", "", "Authorization", "Bearer service-secret"), 200)
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/numercfd/registro/model"
+)
+
+// DuplicatePolicy controls what happens when an instance registers with
+// the address of another instance of the same app.
+type DuplicatePolicy string
+
+const (
+	// WarnDuplicates logs a warning and accepts the registration.
+	WarnDuplicates DuplicatePolicy = "warn"
+
+	// RejectDuplicates refuses the registration with 409.
+	RejectDuplicates DuplicatePolicy = "reject"
+)
+
+// address returns the ip:port of the instance.
+func (i *Instance) address() string {
+	return net.JoinHostPort(i.IPAddr, strconv.Itoa(i.Port))
+}
+
+// duplicateOf returns another instance of the app registered with the same
+// address as inst. Out-of-service instances are ignored.
+func (a *Application) duplicateOf(inst *Instance) *Instance {
+	for _, i := range a.Instances {
+		if i.Id != inst.Id && i.Status != OUTOFSERVICE && i.address() == inst.address() {
+			return i
+		}
+	}
+	return nil
+}
+
+// checkDuplicate applies the Duplicates policy to a registering instance.
+// It reports whether the registration may go on.
+func (s *Server) checkDuplicate(app *Application, inst *Instance) bool {
+	dup := app.duplicateOf(inst)
+	if dup == nil {
+		return true
+	}
+	log.Printf("instance %s of app %s has the same address %s as instance %s", inst.Id, app.Name, inst.address(), dup.Id)
+	return s.Duplicates != RejectDuplicates
+}
+
+// Conflict is an address shared by more than one instance.
+type Conflict = model.Conflict
+
+// ConflictInstance identifies an instance in a Conflict.
+type ConflictInstance = model.ConflictInstance
+
+// findConflicts returns the addresses shared by more than one instance in
+// the catalog, across every app, sorted by address.
+func findConflicts(c *catalog) []*Conflict {
+	byAddr := make(map[string]*Conflict)
+	for _, app := range c.Applications {
+		for _, inst := range app.Instances {
+			if inst.Status == OUTOFSERVICE {
+				continue
+			}
+			addr := inst.address()
+			if byAddr[addr] == nil {
+				byAddr[addr] = &Conflict{Address: addr}
+			}
+			byAddr[addr].Instances = append(byAddr[addr].Instances, ConflictInstance{App: app.Name, Id: inst.Id})
+		}
+	}
+
+	conflicts := make([]*Conflict, 0)
+	for _, conflict := range byAddr {
+		if len(conflict.Instances) > 1 {
+			conflicts = append(conflicts, conflict)
+		}
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Address < conflicts[j].Address
+	})
+	return conflicts
+}
+
+// conflictsHandler is the HTTP handler for /conflicts.
+func (s *Server) conflictsHandler(w http.ResponseWriter, r *http.Request) {
+	c := s.snapshot()
+	data, err := c.encode("conflicts", isPretty(r), func() interface{} {
+		var response struct {
+			Conflicts []*Conflict `json:"conflicts"`
+		}
+		response.Conflicts = findConflicts(c)
+		return response
+	})
+	writeBody(w, 200, data, err)
+}
@@ -0,0 +1,265 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// everyApp is the app the listings of every app are accounted to.
+const everyApp = "*"
+
+// ConsumerStats is the consumption of an app by a consumer.
+type ConsumerStats struct {
+	// Polls is the number of reads of the app.
+	Polls int64 `json:"polls"`
+
+	// Watches is the number of watches of the app opened.
+	Watches int64 `json:"watches"`
+
+	// Watching is the number of watches of the app open.
+	Watching int `json:"watching"`
+
+	// LastSeen holds when the consumer last read or watched the app.
+	LastSeen time.Time `json:"lastSeen"`
+}
+
+// AppConsumers is the consumption of an app, and its consumers.
+type AppConsumers struct {
+	// App is the name of the application, "*" for the listings of every
+	// app.
+	App string `json:"app"`
+
+	// Polls is the number of reads of the app.
+	Polls int64 `json:"polls"`
+
+	// PollsLastMinute is the number of reads of the app in the last minute.
+	PollsLastMinute int `json:"pollsLastMinute"`
+
+	// Watches is the number of watches of the app opened.
+	Watches int64 `json:"watches"`
+
+	// Watching is the number of watches of the app open, its fan-out.
+	Watching int `json:"watching"`
+
+	// Consumers holds the consumption by consumer: the name of its token,
+	// or the client as identified by the server Usage.
+	Consumers map[string]ConsumerStats `json:"consumers"`
+}
+
+// ConsumersReport is the consumption of the apps since the server started,
+// the most polled first.
+type ConsumersReport struct {
+	// Since holds when the accounting started.
+	Since time.Time `json:"since"`
+
+	// Apps holds the consumption by app.
+	Apps []AppConsumers `json:"applications"`
+}
+
+// NewConsumers returns an empty Consumers.
+func NewConsumers() *Consumers {
+	return &Consumers{
+		MaxApps:      1000,
+		MaxConsumers: 100,
+		since:        time.Now(),
+		apps:         make(map[string]*appConsumers),
+	}
+}
+
+// Consumers accounts the reads and watches of every app by consumer, to
+// find the most watched or polled apps and the consumers polling too often.
+// It is safe for concurrent use.
+type Consumers struct {
+	// MaxApps is the number of apps accounted separately. Further apps are
+	// accounted together as "other".
+	MaxApps int
+
+	// MaxConsumers is the number of consumers of an app accounted
+	// separately. Further consumers are accounted together as "other".
+	MaxConsumers int
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	since time.Time
+	apps  map[string]*appConsumers
+}
+
+// appConsumers is the consumption of an app.
+type appConsumers struct {
+	polls     int64
+	watches   int64
+	watching  int
+	rate      rateCounter
+	consumers map[string]*ConsumerStats
+}
+
+// consumer returns the stats of the consumer of the app, adding them if
+// needed. It must be called with c.mu held.
+func (c *Consumers) consumer(app, consumer string) (*appConsumers, *ConsumerStats) {
+	a := c.apps[app]
+	if a == nil {
+		if len(c.apps) >= c.MaxApps {
+			app = otherClients
+			a = c.apps[app]
+		}
+		if a == nil {
+			a = &appConsumers{consumers: make(map[string]*ConsumerStats)}
+			c.apps[app] = a
+		}
+	}
+	st := a.consumers[consumer]
+	if st == nil {
+		if len(a.consumers) >= c.MaxConsumers {
+			consumer = otherClients
+			st = a.consumers[consumer]
+		}
+		if st == nil {
+			st = new(ConsumerStats)
+			a.consumers[consumer] = st
+		}
+	}
+	return a, st
+}
+
+// poll accounts a read of the app by the consumer.
+func (c *Consumers) poll(app, consumer string) {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	a, st := c.consumer(app, consumer)
+	a.polls++
+	a.rate.add(now)
+	st.Polls++
+	st.LastSeen = now
+}
+
+// watch accounts a watch of the apps by the consumer opened, and returns
+// the function accounting it closed.
+func (c *Consumers) watch(apps []string, consumer string) func() {
+	if len(apps) == 0 {
+		apps = []string{everyApp}
+	}
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var stats []*ConsumerStats
+	var watched []*appConsumers
+	for _, app := range apps {
+		a, st := c.consumer(app, consumer)
+		a.watches++
+		a.watching++
+		st.Watches++
+		st.Watching++
+		st.LastSeen = now
+		watched = append(watched, a)
+		stats = append(stats, st)
+	}
+	return func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		for i, a := range watched {
+			a.watching--
+			stats[i].Watching--
+		}
+	}
+}
+
+// Report returns the consumption accounted so far, the apps polled most in
+// the last minute first, then the most watched.
+func (c *Consumers) Report() ConsumersReport {
+	now := time.Now()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	report := ConsumersReport{Since: c.since, Apps: make([]AppConsumers, 0, len(c.apps))}
+	for name, a := range c.apps {
+		ac := AppConsumers{
+			App:             name,
+			Polls:           a.polls,
+			PollsLastMinute: a.rate.lastMinute(now),
+			Watches:         a.watches,
+			Watching:        a.watching,
+			Consumers:       make(map[string]ConsumerStats, len(a.consumers)),
+		}
+		for k, st := range a.consumers {
+			ac.Consumers[k] = *st
+		}
+		report.Apps = append(report.Apps, ac)
+	}
+	sort.Slice(report.Apps, func(i, j int) bool {
+		a, b := report.Apps[i], report.Apps[j]
+		switch {
+		case a.PollsLastMinute != b.PollsLastMinute:
+			return a.PollsLastMinute > b.PollsLastMinute
+		case a.Watching != b.Watching:
+			return a.Watching > b.Watching
+		case a.Polls != b.Polls:
+			return a.Polls > b.Polls
+		}
+		return a.App < b.App
+	})
+	return report
+}
+
+// consumerOf returns the consumer of the request: the name of its token,
+// or the client as identified by the server Usage.
+func (s *Server) consumerOf(r *http.Request) string {
+	if t := RequestToken(r); t != nil {
+		return t.Name
+	}
+	return s.clientKey(r)
+}
+
+// accountConsumers is a Middleware accounting the reads of the catalog to
+// the server Consumers, if any: the reads of an app, and the listings of
+// every app. Watches are accounted by the watch handler.
+func (s *Server) accountConsumers(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r)
+
+		c, route := s.Consumers, RequestRoute(r)
+		if c == nil || (r.Method != "GET" && r.Method != "HEAD") || route.Scope != DiscoverScope || route.Stream {
+			return
+		}
+		if name, ok := mux.Vars(r)["appName"]; ok {
+			c.poll(name, s.consumerOf(r))
+		} else if route.Path == "/registro/1.0/apps" {
+			c.poll(everyApp, s.consumerOf(r))
+		}
+	})
+}
+
+// consumersHandler is the HTTP handler for /registro/admin/consumers.
+func (s *Server) consumersHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Consumers == nil {
+		w.WriteHeader(404)
+		return
+	}
+	report := s.Consumers.Report()
+	if app := r.URL.Query().Get("app"); app != "" {
+		apps := report.Apps[:0]
+		for _, a := range report.Apps {
+			if a.App == app {
+				apps = append(apps, a)
+			}
+		}
+		report.Apps = apps
+	}
+	if v := r.URL.Query().Get("top"); v != "" {
+		top, err := strconv.Atoi(v)
+		if err != nil || top < 0 {
+			w.WriteHeader(400)
+			return
+		}
+		if top < len(report.Apps) {
+			report.Apps = report.Apps[:top]
+		}
+	}
+	data, err := encodeJSON(report, isPretty(r))
+	writeBody(w, 200, data, err)
+}
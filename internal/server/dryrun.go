@@ -0,0 +1,25 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/numercfd/registro/model"
+)
+
+// DryRun is the response to a change requested with ?dryRun=true.
+type DryRun = model.DryRun
+
+// isDryRun reports whether r only asks what its change would do. Dry runs
+// are validated as any other request, up to the minimum of healthy
+// instances and the leases, but change nothing, so they are also served
+// while the registry is read-only.
+func isDryRun(r *http.Request) bool {
+	return r.URL.Query().Get("dryRun") == "true"
+}
+
+// writeDryRun answers a dry run with the resource before and after the
+// change, either of them untyped nil if it would be created or removed.
+func writeDryRun(w http.ResponseWriter, r *http.Request, action string, before, after interface{}) {
+	data, err := encodeJSON(DryRun{Action: action, Before: before, After: after}, isPretty(r))
+	writeBody(w, 200, data, err)
+}
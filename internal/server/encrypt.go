@@ -0,0 +1,160 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// sealedPrefix starts the files sealed by a Keyring.
+var sealedPrefix = []byte(`{"sealed":`)
+
+// ErrEncrypted is returned when reading an encrypted file without a
+// Keyring.
+var ErrEncrypted = errors.New("storage is encrypted, but no key is configured")
+
+// Key is an AES key of a Keyring.
+type Key struct {
+	// ID identifies the key in the files it encrypted.
+	ID string
+
+	// Secret is the AES key, 16, 24 or 32 bytes long.
+	Secret []byte
+}
+
+// Keyring encrypts the files of a FileStore with AES-GCM, since the
+// catalog reveals the network topology. Files are encrypted with the
+// primary key, the others only decrypt the files encrypted before a key
+// rotation, until they are encrypted again.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring returns a Keyring encrypting with primary, and decrypting
+// with primary or any of the keys rotated out.
+func NewKeyring(primary Key, rotated ...Key) (*Keyring, error) {
+	k := &Keyring{primary: primary.ID, keys: make(map[string]cipher.AEAD)}
+	for _, key := range append([]Key{primary}, rotated...) {
+		if key.ID == "" {
+			return nil, fmt.Errorf("storage keys require an id")
+		}
+		if _, ok := k.keys[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate storage key %q", key.ID)
+		}
+		block, err := aes.NewCipher(key.Secret)
+		if err != nil {
+			return nil, fmt.Errorf("storage key %q: %s", key.ID, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[key.ID] = aead
+	}
+	return k, nil
+}
+
+// sealedFile is the content of an encrypted file.
+type sealedFile struct {
+	Sealed struct {
+		Key        string `json:"key"`
+		Nonce      []byte `json:"nonce"`
+		Ciphertext []byte `json:"ciphertext"`
+	} `json:"sealed"`
+}
+
+// seal encrypts data with the primary key. A nil Keyring leaves it
+// unencrypted.
+func (k *Keyring) seal(data []byte) ([]byte, error) {
+	if k == nil {
+		return data, nil
+	}
+	aead := k.keys[k.primary]
+	var f sealedFile
+	f.Sealed.Key = k.primary
+	f.Sealed.Nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, f.Sealed.Nonce); err != nil {
+		return nil, err
+	}
+	f.Sealed.Ciphertext = aead.Seal(nil, f.Sealed.Nonce, data, nil)
+	return json.Marshal(f)
+}
+
+// open decrypts data if it is sealed, returning the key used. Unencrypted
+// data is returned as is, so enabling encryption needs no migration.
+func (k *Keyring) open(data []byte) ([]byte, string, error) {
+	if !bytes.HasPrefix(data, sealedPrefix) {
+		return data, "", nil
+	}
+	if k == nil {
+		return nil, "", ErrEncrypted
+	}
+	var f sealedFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, "", err
+	}
+	aead, ok := k.keys[f.Sealed.Key]
+	if !ok {
+		return nil, "", fmt.Errorf("storage is encrypted with unknown key %q", f.Sealed.Key)
+	}
+	plain, err := aead.Open(nil, f.Sealed.Nonce, f.Sealed.Ciphertext, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("storage key %q: %s", f.Sealed.Key, err)
+	}
+	return plain, f.Sealed.Key, nil
+}
+
+// readFile returns the content of the file at path, decrypted.
+func (f *FileStore) readFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err = f.Keys.open(data)
+	return data, err
+}
+
+// writeFile replaces the file at path with data, encrypted.
+func (f *FileStore) writeFile(path string, data []byte) error {
+	data, err := f.Keys.seal(data)
+	if err != nil {
+		return err
+	}
+	return writeFile(path, data)
+}
+
+// Reseal encrypts the files of the store again with the primary key of its
+// Keys, if they are not yet, e.g. after a key rotation or once encryption
+// is enabled. The keys rotated out may then be removed.
+func (f *FileStore) Reseal() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, path := range []string{f.Path, f.eventsPath()} {
+		data, err := ioutil.ReadFile(path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		plain, key, err := f.Keys.open(data)
+		if err != nil {
+			return err
+		}
+		if f.Keys == nil || key == f.Keys.primary {
+			continue
+		}
+		if err := f.writeFile(path, plain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// EnvironmentHeader is the request header naming the environment of the
+// client, e.g. prod. The environment query parameter may be used instead.
+const EnvironmentHeader = "Registro-Environment"
+
+// requestEnv is the environment of a request.
+type requestEnv struct {
+	// Name is the environment, empty for clients of every environment.
+	Name string
+
+	// Strict hides the apps without an environment from the clients of
+	// one, see Server.StrictEnvironments.
+	Strict bool
+}
+
+// sees reports whether the app is visible to the request: the clients of
+// an environment only see the apps of that environment, and the ones
+// without an environment unless Strict.
+func (e requestEnv) sees(app *Application) bool {
+	switch {
+	case e.Name == "" || app.Environment == e.Name:
+		return true
+	case app.Environment == "":
+		return !e.Strict
+	}
+	return false
+}
+
+// envKey is the context key of the requestEnv of a request.
+type envKey struct{}
+
+// RequestEnvironment returns the environment of the request, pinned by
+// its token or named by the client, empty if it has none.
+func RequestEnvironment(r *http.Request) string {
+	return environmentOf(r).Name
+}
+
+// environmentOf returns the environment of the request.
+func environmentOf(r *http.Request) requestEnv {
+	e, _ := r.Context().Value(envKey{}).(requestEnv)
+	return e
+}
+
+// isolateEnvironment is a Middleware keeping the clients of an
+// environment, named in the Registro-Environment header or pinned by their
+// token, away from the apps of the others: they are answered with 404, and
+// left out of listings and watches. Tokens of an environment naming another
+// are answered with 403. With StrictEnvironments, requests other than the
+// admin and public ones, or the ones of admin tokens, must have an
+// environment, or are answered with 400.
+func (s *Server) isolateEnvironment(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := RequestRoute(r)
+		env := requestEnv{Name: r.Header.Get(EnvironmentHeader), Strict: s.StrictEnvironments}
+		if env.Name == "" {
+			env.Name = r.URL.Query().Get("environment")
+		}
+		if t := RequestToken(r); t != nil && t.Environment != "" {
+			if env.Name != "" && env.Name != t.Environment {
+				data, err := encodeJSON(errorBody{Error: fmt.Sprintf("token %s is restricted to the %s environment", t.Name, t.Environment)}, false)
+				writeBody(w, 403, data, err)
+				return
+			}
+			env.Name = t.Environment
+		}
+
+		exempt := route.Public || route.Scope == "" || route.Scope == AdminScope || r.Method == "OPTIONS"
+		if t := RequestToken(r); t != nil && t.Grants(AdminScope) {
+			exempt = true
+		}
+		if env.Name == "" && s.StrictEnvironments && !exempt {
+			data, err := encodeJSON(errorBody{Error: "an environment is required, see the " + EnvironmentHeader + " header"}, false)
+			writeBody(w, 400, data, err)
+			return
+		}
+		if name, ok := mux.Vars(r)["appName"]; ok && env.Name != "" {
+			if app := s.snapshot().GetApplication(name); app != nil && !env.sees(app) {
+				w.WriteHeader(404)
+				return
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), envKey{}, env)))
+	})
+}
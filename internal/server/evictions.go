@@ -0,0 +1,160 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// EvictionPreview lists the instances which would be evicted within a time
+// if none of them renewed, e.g. during a network partition, so operators
+// can assess the blast radius before it happens or before tightening the
+// eviction timeout.
+type EvictionPreview struct {
+	// Within is the time covered by the preview, in seconds.
+	Within float64 `json:"within"`
+
+	// EvictionTimeout is the eviction timeout assumed, in seconds.
+	EvictionTimeout float64 `json:"evictionTimeout"`
+
+	// Paused tells why evictions are paused, if they are: instances are
+	// then only evicted once the pause ends.
+	Paused string `json:"paused,omitempty"`
+
+	// Instances holds the instances evicted, in order of eviction.
+	Instances []PendingEviction `json:"instances"`
+
+	// Apps holds the apps losing instances.
+	Apps []AppEvictions `json:"apps"`
+}
+
+// PendingEviction is an instance of an EvictionPreview.
+type PendingEviction struct {
+	App         string     `json:"app"`
+	Instance    string     `json:"instance"`
+	Status      StatusType `json:"status"`
+	LastRenewal time.Time  `json:"lastRenewal"`
+	EvictAt     time.Time  `json:"evictAt"`
+}
+
+// AppEvictions is the impact of an EvictionPreview on an app.
+type AppEvictions struct {
+	App string `json:"app"`
+
+	// Evicted is the number of instances evicted.
+	Evicted int `json:"evicted"`
+
+	// Remaining is the number of instances left, out-of-service ones
+	// excluded.
+	Remaining int `json:"remaining"`
+
+	// BelowMinHealthy is set if Remaining is below the app MinHealthy.
+	BelowMinHealthy bool `json:"belowMinHealthy,omitempty"`
+}
+
+// previewEvictions returns the instances evicted by at if none renewed,
+// with eviction timeout of the instances not out-of-service replaced by
+// timeout. It must be called with s.mu held.
+func (s *Server) previewEvictions(at time.Time, timeout time.Duration) EvictionPreview {
+	preview := EvictionPreview{
+		EvictionTimeout: timeout.Seconds(),
+		Instances:       make([]PendingEviction, 0),
+		Apps:            make([]AppEvictions, 0),
+	}
+	var resume time.Time
+	readOnly := s.ReadOnly().Enabled
+	switch {
+	case readOnly:
+		// Evictions resume once an operator leaves the mode.
+		preview.Paused = "registry is read-only"
+	case s.warmingUp():
+		preview.Paused = "warming up"
+		resume = s.warm.until
+	}
+
+	for _, app := range s.Applications {
+		impact := AppEvictions{App: app.Name}
+		for _, inst := range app.Instances {
+			if inst.static {
+				continue
+			}
+			evictAt := inst.renewedAt.Add(s.States.evictionTimeout(inst))
+			if inst.Status != OUTOFSERVICE {
+				evictAt = inst.renewedAt.Add(timeout)
+			}
+			if evictAt.Before(resume) {
+				evictAt = resume
+			}
+			if end := app.maintenanceEnd(inst, evictAt); !end.IsZero() {
+				// Instances are checked again once their maintenance ends.
+				evictAt = end
+			}
+
+			if readOnly || evictAt.After(at) {
+				if inst.Status != OUTOFSERVICE {
+					impact.Remaining++
+				}
+				continue
+			}
+			impact.Evicted++
+			preview.Instances = append(preview.Instances, PendingEviction{
+				App:         app.Name,
+				Instance:    inst.Id,
+				Status:      inst.Status,
+				LastRenewal: inst.renewedAt,
+				EvictAt:     evictAt,
+			})
+		}
+		if impact.Evicted > 0 {
+			impact.BelowMinHealthy = impact.Remaining < app.MinHealthy
+			preview.Apps = append(preview.Apps, impact)
+		}
+	}
+
+	sort.SliceStable(preview.Instances, func(i, j int) bool {
+		return preview.Instances[i].EvictAt.Before(preview.Instances[j].EvictAt)
+	})
+	return preview
+}
+
+// evictionPreviewHandler is the HTTP handler for /admin/evictions/preview.
+// ?within= is the time covered, in seconds (60 by default), and
+// ?evictionTimeout= the eviction timeout to assume, in seconds (the server
+// one by default).
+func (s *Server) evictionPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	within, ok := parseSeconds(q.Get("within"), time.Minute)
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+	timeout, ok := parseSeconds(q.Get("evictionTimeout"), s.States.EvictionTimeout)
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+
+	s.mu.Lock()
+	preview := s.previewEvictions(time.Now().Add(within), timeout)
+	s.mu.Unlock()
+
+	preview.Within = within.Seconds()
+	data, err := encodeJSON(preview, isPretty(r))
+	writeBody(w, 200, data, err)
+}
+
+// parseSeconds parses a query parameter holding a number of seconds,
+// returning def if it is empty. Negative values, and those too large for a
+// time.Duration, are invalid.
+func parseSeconds(v string, def time.Duration) (time.Duration, bool) {
+	if v == "" {
+		return def, true
+	}
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil || !(secs >= 0 && secs < math.MaxInt64/float64(time.Second)) {
+		return 0, false
+	}
+	return time.Duration(secs * float64(time.Second)), true
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func FuzzNewInstance(f *testing.F) {
+	f.Add(`{"id": "i-1", "ip": "10.0.0.1", "port": 8080}`)
+	f.Add(`{"ip": "::ffff:10.0.0.1", "port": 65535, "generation": 3}`)
+	f.Add(`{"ip": "host.example", "port": 1, "metadata": {"zone": "a"}, "deploymentGroup": "blue", "plannedTerminationTime": "2026-01-01T12:00:00Z"}`)
+	f.Add(`{"ip": "10.0.0.1", "port": 0}`)
+	f.Add(`{"ip": 1}`)
+
+	f.Fuzz(func(t *testing.T, body string) {
+		rec := httptest.NewRecorder()
+		inst, err := newInstance(rec, httptest.NewRequest("POST", basePrefix+"apps/web", strings.NewReader(body)))
+		if err != nil {
+			if inst != nil || rec.Code != 400 {
+				t.Fatalf("got instance %v and status %d with error %v", inst, rec.Code, err)
+			}
+			return
+		}
+		if inst.Id == "" || inst.IPAddr == "" || inst.Port <= 0 || inst.Port > 65535 {
+			t.Fatalf("instance %+v registered from %q", inst, body)
+		}
+		if ip := net.ParseIP(inst.IPAddr); ip != nil && ip.String() != inst.IPAddr {
+			t.Fatalf("address %s is not normalized", inst.IPAddr)
+		}
+		if inst.Status != STARTING {
+			t.Fatalf("instance registered %s, want %s", inst.Status, STARTING)
+		}
+	})
+}
+
+func FuzzParseSeconds(f *testing.F) {
+	for _, v := range []string{"", "0", "30", "0.5", "-1", "1e300", "NaN", "Inf", "0x1p-2"} {
+		f.Add(v)
+	}
+
+	f.Fuzz(func(t *testing.T, v string) {
+		d, ok := parseSeconds(v, time.Minute)
+		if ok && d < 0 {
+			t.Fatalf("%q parsed as %s", v, d)
+		}
+	})
+}
+
+func FuzzParseSince(f *testing.F) {
+	for _, v := range []string{"", "2026-01-01T12:00:00Z", "2026-01-01T12:00:00+02:00", "1700000000", "-1", "9223372036854775807", "yesterday"} {
+		f.Add(v)
+	}
+
+	f.Fuzz(func(t *testing.T, v string) {
+		since, ok := parseSince(v)
+		if !ok && !since.IsZero() {
+			t.Fatalf("%q rejected as %s", v, since)
+		}
+	})
+}
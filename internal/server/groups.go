@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// AllGroups selects the instances of every deployment group.
+const AllGroups = "*"
+
+// inGroup returns a copy of the app holding only the instances of the
+// deployment group, plus the ones without a group. An empty group selects
+// both groups of an active rollout, or the app ActiveGroup. If the app has
+// no active group, or group is AllGroups, the app is returned as is.
+func (a *Application) inGroup(group string) *Application {
+	from, to := group, group
+	if group == "" {
+		from, to = a.ActiveGroup, a.ActiveGroup
+		if a.Rollout.Active() {
+			from, to = a.Rollout.From, a.Rollout.To
+		}
+	}
+	if from == "" || from == AllGroups {
+		return a
+	}
+
+	cp := *a
+	cp.Instances = make([]*Instance, 0, len(a.Instances))
+	for _, inst := range a.Instances {
+		if g := inst.DeploymentGroup; g == "" || g == from || g == to {
+			cp.Instances = append(cp.Instances, inst)
+		}
+	}
+	return &cp
+}
+
+// activeGroup is the request and response body of activeGroupHandler.
+type activeGroup struct {
+	ActiveGroup string `json:"activeGroup"`
+}
+
+// activeGroupHandler is the HTTP handler for /apps/{appName}:activeGroup.
+// PUT switches the deployment group served by discovery.
+func (s *Server) activeGroupHandler(w http.ResponseWriter, r *http.Request) {
+	var request activeGroup
+
+	name := mux.Vars(r)["appName"]
+	switch r.Method {
+	case "GET":
+		app := s.snapshot().GetApplication(name)
+		if app == nil {
+			w.WriteHeader(404)
+			return
+		}
+		request.ActiveGroup = app.ActiveGroup
+		data, err := encodeJSON(request, isPretty(r))
+		writeBody(w, 200, data, err)
+	case "PUT":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		if err := json.Unmarshal(body, &request); err != nil || request.ActiveGroup == AllGroups {
+			w.WriteHeader(400)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		app := s.GetApplication(name)
+		if app == nil {
+			w.WriteHeader(404)
+			return
+		}
+		app.ActiveGroup = request.ActiveGroup
+		s.record(PutApplication, app, nil)
+		s.publish(app)
+		w.WriteHeader(204)
+		log.Printf("application %s active group is now %q", app.Name, app.ActiveGroup)
+	default:
+		w.WriteHeader(405)
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// healthy returns the number of UP instances of the app.
+func (a *Application) healthy() int {
+	n := 0
+	for _, inst := range a.Instances {
+		if inst.Status == UP {
+			n++
+		}
+	}
+	return n
+}
+
+// checkFloor reports whether an admin operation taking down the number of
+// healthy instances specified keeps the app at its MinHealthy.
+// Operations with ?force=true are always allowed.
+func checkFloor(app *Application, down int, r *http.Request) bool {
+	if app.MinHealthy == 0 || down == 0 || r.URL.Query().Get("force") == "true" {
+		return true
+	}
+	if app.healthy()-down >= app.MinHealthy {
+		return true
+	}
+	log.Printf("app %s would drop below %d healthy instances", app.Name, app.MinHealthy)
+	return false
+}
+
+// checkBreach emits an event when the app crosses its MinHealthy floor.
+// It must be called with s.mu held.
+func (s *Server) checkBreach(app *Application) {
+	breached := app.MinHealthy > 0 && app.healthy() < app.MinHealthy
+	if breached == app.breached {
+		return
+	}
+	app.breached = breached
+
+	typ := AppHealthRestored
+	if breached {
+		typ = AppBelowMinHealthy
+	}
+	s.States.emit(Event{Type: typ, App: app.Name})
+}
+
+// checkDown emits an event when the app loses its last UP instance while
+// others are DOWN, and when it is back up. It must be called with s.mu held.
+func (s *Server) checkDown(app *Application) {
+	if app.healthy() > 0 {
+		if app.down {
+			app.down = false
+			s.States.emit(Event{Type: AppUp, App: app.Name})
+		}
+		return
+	}
+	if app.down {
+		return
+	}
+	for _, inst := range app.Instances {
+		if inst.Status == DOWN {
+			app.down = true
+			s.States.emit(Event{Type: AppDown, App: app.Name})
+			return
+		}
+	}
+}
+
+// checkStorm counts an eviction, emitting an event when the evictions in
+// the last minute reach EvictionStormThreshold. It must be called with s.mu
+// held.
+func (s *Server) checkStorm() {
+	now := time.Now()
+	s.evictions.add(now)
+	if s.EvictionStormThreshold <= 0 {
+		return
+	}
+
+	n := s.evictions.lastMinute(now)
+	switch {
+	case n >= s.EvictionStormThreshold && !s.storming:
+		s.storming = true
+		s.States.emit(Event{Type: EvictionStorm, Count: n})
+	case n < s.EvictionStormThreshold:
+		s.storming = false
+	}
+}
+
+// patchApp updates the app settings from r.Body.
+// It must be called with s.mu held.
+func (s *Server) patchApp(app *Application, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	var request struct {
+		MinHealthy  *int       `json:"minHealthyInstances"`
+		TTL         *float64   `json:"ttl"`
+		ExpiresAt   *time.Time `json:"expiresAt"`
+		ExpiresIn   *float64   `json:"expiresIn"`
+		Environment *string    `json:"environment"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	minHealthy, ttl, expiresAt, env := app.MinHealthy, app.TTL, app.ExpiresAt, app.Environment
+	if request.MinHealthy != nil {
+		if *request.MinHealthy < 0 {
+			w.WriteHeader(400)
+			return
+		}
+		minHealthy = *request.MinHealthy
+	}
+	if request.TTL != nil {
+		if *request.TTL < 0 {
+			w.WriteHeader(400)
+			return
+		}
+		ttl = time.Duration(*request.TTL * float64(time.Second))
+	}
+	switch {
+	case request.ExpiresIn != nil && *request.ExpiresIn == 0:
+		// Zero makes the app permanent again.
+		expiresAt = time.Time{}
+	case request.ExpiresAt != nil || request.ExpiresIn != nil:
+		var in float64
+		if request.ExpiresIn != nil {
+			in = *request.ExpiresIn
+		}
+		if expiresAt, err = expiryTime(request.ExpiresAt, in); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	if request.Environment != nil && *request.Environment != env {
+		// Promoting an app to another environment is left to the clients
+		// of every environment.
+		if RequestEnvironment(r) != "" {
+			w.WriteHeader(403)
+			return
+		}
+		env = *request.Environment
+	}
+	if isDryRun(r) {
+		after := app.view()
+		after.MinHealthy = minHealthy
+		after.TTL = ttl.Seconds()
+		after.ExpiresAt = timeRef(expiresAt)
+		after.Environment = env
+		writeDryRun(w, r, "update", app.view(), after)
+		return
+	}
+	app.MinHealthy = minHealthy
+	app.TTL = ttl
+	app.ExpiresAt = expiresAt
+	app.Environment = env
+
+	s.record(PutApplication, app, nil)
+	s.publish(app)
+	w.WriteHeader(204)
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/numercfd/registro/model"
+)
+
+// maxVirtualNodes bounds the points of every instance on a hash ring, so
+// rings of large apps stay reasonably small.
+const maxVirtualNodes = 1000
+
+// hashRingHandler is the HTTP handler for /apps/{appName}/hashring. It
+// returns the model.HashRing of the available instances of the app, with
+// ?vnodes= points each (the server VirtualNodes by default), so sharded
+// clients agree on the instance of every key.
+func (s *Server) hashRingHandler(w http.ResponseWriter, r *http.Request) {
+	c := s.snapshot()
+	app := c.GetApplication(mux.Vars(r)["appName"])
+	if app == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	vnodes := s.VirtualNodes
+	if v := r.URL.Query().Get("vnodes"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxVirtualNodes {
+			w.WriteHeader(400)
+			return
+		}
+		vnodes = n
+	}
+
+	group := r.URL.Query().Get("group")
+	s.setCacheControl(w, app)
+	key := "apps/" + app.Name + "/hashring?group=" + group + "&vnodes=" + strconv.Itoa(vnodes)
+	data, err := c.encode(key, isPretty(r), func() interface{} {
+		return model.NewHashRing(app.inGroup(group).view(), vnodes)
+	})
+	writeBody(w, 200, data, err)
+}
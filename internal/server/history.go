@@ -0,0 +1,167 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// EventStore is implemented by the stores which also keep the registry
+// events, so the event history survives restarts.
+type EventStore interface {
+	// LoadEvents returns the events saved in the store, oldest first.
+	LoadEvents() ([]Event, error)
+
+	// WriteEvents appends events to the store, and drops the ones not
+	// after since or beyond the max most recent.
+	WriteEvents(events []Event, since time.Time, max int) error
+}
+
+// eventHistory holds the latest events emitted, for post-incident queries.
+type eventHistory struct {
+	// mu protects events and pending.
+	mu     sync.Mutex
+	events []Event
+
+	// pending holds the events not yet written to the EventStore.
+	pending []Event
+}
+
+// recordEvent adds the event to the history. It is a StateMachine listener.
+func (s *Server) recordEvent(e Event) {
+	if s.MaxEvents <= 0 {
+		return
+	}
+
+	h := &s.history
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, e)
+	h.pending = append(h.pending, e)
+	h.events = s.retain(h.events)
+}
+
+// retain drops the events beyond the retention limits from events, which
+// is ordered oldest first.
+func (s *Server) retain(events []Event) []Event {
+	return trimEvents(events, s.eventsSince(), s.MaxEvents)
+}
+
+// trimEvents drops from events, ordered oldest first, the ones not after
+// since and beyond the max most recent.
+func trimEvents(events []Event, since time.Time, max int) []Event {
+	drop := 0
+	if len(events) > max {
+		drop = len(events) - max
+	}
+	for drop < len(events) && !events[drop].Time.After(since) {
+		drop++
+	}
+	return events[drop:]
+}
+
+// eventsSince returns the time before which events are dropped. The zero
+// time keeps events regardless of their age.
+func (s *Server) eventsSince() time.Time {
+	if s.EventMaxAge <= 0 {
+		return time.Time{}
+	}
+	return s.now().Add(-s.EventMaxAge)
+}
+
+// restoreEvents loads the history from store.
+func (s *Server) restoreEvents(store EventStore) error {
+	events, err := store.LoadEvents()
+	if err != nil {
+		return err
+	}
+
+	h := &s.history
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = s.retain(append(events, h.events...))
+	return nil
+}
+
+// flushEvents writes the pending events to store. On failure they are kept
+// for the next flush.
+func (s *Server) flushEvents(store EventStore) error {
+	h := &s.history
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if len(h.pending) == 0 {
+		return nil
+	}
+	if err := store.WriteEvents(h.pending, s.eventsSince(), s.MaxEvents); err != nil {
+		return err
+	}
+	h.pending = nil
+	return nil
+}
+
+// runEvents flushes the pending events to store every interval until
+// s.stop is closed.
+func (s *Server) runEvents(store EventStore, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.flushEvents(store); err != nil {
+				log.Printf("event storage error: %s", err)
+			}
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// queryEvents returns the events in the history matching app, typ and
+// emitted after since. Empty values match every event.
+func (s *Server) queryEvents(app string, typ EventType, since time.Time) []Event {
+	h := &s.history
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	events := make([]Event, 0)
+	for _, e := range h.events {
+		if (app == "" || e.App == app) && (typ == "" || e.Type == typ) && e.Time.After(since) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// parseSince parses the since query parameter, either a RFC 3339 time or a
+// unix timestamp in seconds.
+func parseSince(v string) (time.Time, bool) {
+	if v == "" {
+		return time.Time{}, true
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, true
+	}
+	if sec, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(sec, 0), true
+	}
+	return time.Time{}, false
+}
+
+// historyHandler is the HTTP handler for /events/history.
+func (s *Server) historyHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	since, ok := parseSince(q.Get("since"))
+	if !ok {
+		w.WriteHeader(400)
+		return
+	}
+
+	response := struct {
+		Events []Event `json:"events"`
+	}{s.queryEvents(q.Get("app"), EventType(q.Get("type")), since)}
+	data, err := encodeJSON(response, isPretty(r))
+	writeBody(w, 200, data, err)
+}
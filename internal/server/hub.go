@@ -0,0 +1,122 @@
+package server
+
+import (
+	"expvar"
+	"sync"
+)
+
+// hubVars publishes the watchers connected and the changes delivered to
+// them, along with the slow watchers evicted.
+var hubVars = expvar.NewMap("watchHub")
+
+// change is an update delivered by the hub: either a new copy of an app, or
+// an event.
+type change struct {
+	// App is the name of the app changed.
+	App string
+
+	// Copy is the catalog copy of the app, nil if it was removed. It is
+	// unset for events.
+	Copy *Application
+
+	// Version is the catalog version after the change. It is unset for
+	// events.
+	Version uint64
+
+	// Event is the event emitted, if the change is an event.
+	Event *Event
+}
+
+// hub fans out the changes of the catalog and the events to the watchers
+// (agent streams and /watch). Publishing never blocks: each watcher has a
+// bounded queue, and a watcher too slow to drain it is evicted, so a
+// stalled one does not hold back the others, nor the writers publishing.
+type hub struct {
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+}
+
+// watcher is a subscription to the hub.
+type watcher struct {
+	// C receives the changes. It is closed when the watcher is evicted.
+	C chan change
+
+	// apps holds the apps watched, all of them if nil. It is protected by
+	// the hub mu.
+	apps map[string]bool
+
+	// events is set to also receive the events.
+	events bool
+}
+
+// subscribe returns a new watcher of the apps specified, or of every app if
+// none is. Its queue holds at most size changes.
+//
+// Changes are published after the catalog is replaced, so a snapshot taken
+// once subscribed misses none of them: the changes queued up to the
+// snapshot version are already in it, and must be skipped.
+func (h *hub) subscribe(size int, events bool, apps ...string) *watcher {
+	w := &watcher{C: make(chan change, size), events: events}
+	if len(apps) > 0 {
+		w.apps = make(map[string]bool)
+		for _, name := range apps {
+			w.apps[name] = true
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.watchers == nil {
+		h.watchers = make(map[*watcher]bool)
+	}
+	h.watchers[w] = true
+	hubVars.Add("watchers", 1)
+	return w
+}
+
+// unsubscribe removes the watcher, if it was not evicted already.
+func (h *hub) unsubscribe(w *watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.watchers[w] {
+		delete(h.watchers, w)
+		hubVars.Add("watchers", -1)
+	}
+}
+
+// watch adds the app to the ones watched by w.
+func (h *hub) watch(w *watcher, app string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if w.apps == nil {
+		w.apps = make(map[string]bool)
+	}
+	w.apps[app] = true
+}
+
+// publish queues the change for every watcher of its app. Watchers whose
+// queue is full are evicted.
+func (h *hub) publish(c change) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	hubVars.Add("published", 1)
+	for w := range h.watchers {
+		if (c.Event != nil && !w.events) || (w.apps != nil && !w.apps[c.App]) {
+			continue
+		}
+		select {
+		case w.C <- c:
+			hubVars.Add("delivered", 1)
+		default:
+			delete(h.watchers, w)
+			close(w.C)
+			hubVars.Add("watchers", -1)
+			hubVars.Add("evicted", 1)
+		}
+	}
+}
+
+// publishEvent is a StateMachine listener publishing the events to the hub.
+func (s *Server) publishEvent(e Event) {
+	s.watchers.publish(change{App: e.App, Event: &e})
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"expvar"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyHeader is the request header carrying the key of an
+// idempotent change, see Server.IdempotencyWindow.
+const IdempotencyHeader = "Idempotency-Key"
+
+// ReplayedHeader is set on responses replayed for a repeated idempotency
+// key.
+const ReplayedHeader = "Idempotent-Replayed"
+
+// idempotencyVars counts the responses stored and replayed.
+var idempotencyVars = expvar.NewMap("idempotency")
+
+// replayedHeaders are the response headers stored along with the body.
+var replayedHeaders = []string{"Content-Type", "Location", "ETag"}
+
+// storedResponse is the response to a request with an idempotency key.
+type storedResponse struct {
+	// key is the idempotency key, method, path, query and caller of the
+	// request.
+	key string
+
+	// done is closed once the response is stored.
+	done chan struct{}
+
+	// digest is the digest of the request body, checked on replays.
+	digest [sha256.Size]byte
+
+	// expires is when the response is forgotten.
+	expires time.Time
+
+	// keep is unset if the response must not be replayed, e.g. a 503:
+	// the request is handled again instead.
+	keep bool
+
+	code   int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyCache holds the responses to requests with an idempotency
+// key, by key, method, path, query and caller.
+type idempotencyCache struct {
+	mu        sync.Mutex
+	responses map[string]*storedResponse
+
+	// order holds the responses, oldest first.
+	order []*storedResponse
+}
+
+// get returns the stored response for key, or adds a pending one and
+// returns it with added set. It drops the expired responses, and the oldest
+// ones beyond max (if not zero).
+func (c *idempotencyCache) get(key string, digest [sha256.Size]byte, window time.Duration, max int) (resp *storedResponse, added bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.responses == nil {
+		c.responses = make(map[string]*storedResponse)
+	}
+
+	now := time.Now()
+	for len(c.order) > 0 {
+		oldest := c.order[0]
+		if now.Before(oldest.expires) && (max <= 0 || len(c.order) < max) {
+			break
+		}
+		if c.responses[oldest.key] == oldest {
+			delete(c.responses, oldest.key)
+		}
+		c.order = c.order[1:]
+	}
+
+	if resp := c.responses[key]; resp != nil {
+		return resp, false
+	}
+	resp = &storedResponse{key: key, done: make(chan struct{}), digest: digest, expires: now.Add(window)}
+	c.responses[key] = resp
+	c.order = append(c.order, resp)
+	return resp, true
+}
+
+// forget removes resp, so its request may be handled again.
+func (c *idempotencyCache) forget(resp *storedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.responses[resp.key] == resp {
+		delete(c.responses, resp.key)
+	}
+}
+
+// recordingWriter keeps a copy of the response written.
+type recordingWriter struct {
+	*statusWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(b []byte) (int, error) {
+	n, err := w.statusWriter.Write(b)
+	w.body.Write(b[:n])
+	return n, err
+}
+
+// idempotent is a Middleware making changes carrying an Idempotency-Key
+// safe to retry: the response is stored for IdempotencyWindow, and
+// replayed to later requests with the same key, method, path and query
+// from the same caller without handling them again. A request with the key of one in progress waits for
+// it, and one reusing a key with another body is rejected with 422.
+//
+// Responses with a 5xx or 429 status, which a retry may change, are not
+// stored. Reads and streams are handled as usual.
+func (s *Server) idempotent(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(IdempotencyHeader)
+		if key == "" || s.IdempotencyWindow <= 0 || r.Method == "GET" || r.Method == "HEAD" ||
+			r.Method == "OPTIONS" || RequestRoute(r).Stream {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		digest := sha256.Sum256(body)
+		key = r.Method + " " + r.URL.RequestURI() + " " + requestCaller(r) + " " + key
+
+		for {
+			resp, added := s.idempotency.get(key, digest, s.IdempotencyWindow, s.MaxIdempotencyKeys)
+			if added {
+				s.storeResponse(resp, next, w, r)
+				return
+			}
+			if resp.digest != digest {
+				data, err := encodeJSON(errorBody{Error: "idempotency key reused with another request"}, false)
+				writeBody(w, 422, data, err)
+				return
+			}
+
+			select {
+			case <-resp.done:
+			case <-r.Context().Done():
+				w.WriteHeader(409)
+				return
+			}
+			if !resp.keep {
+				// Forgotten by now: handle the request again.
+				continue
+			}
+
+			idempotencyVars.Add("replayed", 1)
+			for k, v := range resp.header {
+				w.Header()[k] = v
+			}
+			w.Header().Set(ReplayedHeader, "true")
+			w.WriteHeader(resp.code)
+			w.Write(resp.body)
+			return
+		}
+	})
+}
+
+// storeResponse handles the request, storing its response in resp.
+func (s *Server) storeResponse(resp *storedResponse, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	rw := &recordingWriter{statusWriter: &statusWriter{ResponseWriter: w}}
+	defer func() {
+		if !resp.keep {
+			s.idempotency.forget(resp)
+		}
+		close(resp.done)
+	}()
+	next.ServeHTTP(rw, r)
+
+	code := rw.code
+	if code == 0 {
+		code = 200
+	}
+	if code >= 500 || code == 429 {
+		return
+	}
+	resp.code = code
+	resp.body = rw.body.Bytes()
+	resp.header = make(http.Header)
+	for _, k := range replayedHeaders {
+		if v := rw.Header().Values(k); len(v) > 0 {
+			resp.header[k] = v
+		}
+	}
+	resp.keep = true
+	idempotencyVars.Add("stored", 1)
+}
+
+// requestCaller names the caller of r: its token, or its address when the
+// server has no tokens. Keys are chosen by clients, so a response, which
+// may hold a lease, is only replayed to the caller it was sent to.
+func requestCaller(r *http.Request) string {
+	if t := RequestToken(r); t != nil {
+		return "token:" + t.Name
+	}
+	return "ip:" + ClientIP(r)
+}
@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIdempotentReplay(t *testing.T) {
+	s := NewServer("")
+	s.IdempotencyWindow = time.Minute
+	populate(s, 1, 0)
+	h := s.Handler()
+	body := `{"id": "i-1", "ip": "10.0.0.1", "port": 8080}`
+
+	first := do(h, "POST", "/apps/app0", body, IdempotencyHeader, "k1")
+	expect(t, first, 201)
+	again := do(h, "POST", "/apps/app0", body, IdempotencyHeader, "k1")
+	expect(t, again, 201)
+	if again.Header().Get(ReplayedHeader) != "true" || again.Body.String() != first.Body.String() {
+		t.Errorf("retry not replayed: %s", again.Body)
+	}
+	expect(t, do(h, "POST", "/apps/app0", `{"id": "i-2", "ip": "10.0.0.1", "port": 8080}`, IdempotencyHeader, "k1"), 422)
+}
+
+func TestIdempotentQuery(t *testing.T) {
+	s := NewServer("")
+	s.IdempotencyWindow = time.Minute
+	populate(s, 1, 0)
+	h := s.Handler()
+	body := `{"id": "i-1", "ip": "10.0.0.1", "port": 8080}`
+
+	// A dry run and the change it previews are different requests.
+	expect(t, do(h, "POST", "/apps/app0?dryRun=true", body, IdempotencyHeader, "k1"), 200)
+	rec := do(h, "POST", "/apps/app0", body, IdempotencyHeader, "k1")
+	expect(t, rec, 201)
+	if rec.Header().Get(ReplayedHeader) != "" {
+		t.Error("registration replayed the dry run")
+	}
+	expect(t, do(h, "GET", "/apps/app0/i-1", ""), 200)
+}
+
+func TestIdempotentCallers(t *testing.T) {
+	s := NewServer("")
+	s.IdempotencyWindow = time.Minute
+	s.Tokens = []Token{
+		{Name: "a", Secret: "secret-a", Scopes: []Scope{RegisterScope}},
+		{Name: "b", Secret: "secret-b", Scopes: []Scope{RegisterScope}},
+	}
+	populate(s, 1, 0)
+	h := s.Handler()
+	body := `{"id": "i-1", "ip": "10.0.0.1", "port": 8080}`
+
+	expect(t, do(h, "POST", "/apps/app0", body, IdempotencyHeader, "k1", "Authorization", "Bearer secret-a"), 201)
+	rec := do(h, "POST", "/apps/app0", body, IdempotencyHeader, "k1", "Authorization", "Bearer secret-b")
+	expect(t, rec, 201)
+	if rec.Header().Get(ReplayedHeader) != "" {
+		t.Error("response of a token replayed to another")
+	}
+
+	// Without tokens, callers are told apart by their address.
+	s = NewServer("")
+	s.IdempotencyWindow = time.Minute
+	populate(s, 1, 0)
+	h = s.Handler()
+	for _, addr := range []string{"10.1.0.1:4000", "10.1.0.2:4000"} {
+		r := httptest.NewRequest("POST", "/registro/1.0/apps/app0", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set(IdempotencyHeader, "k1")
+		r.RemoteAddr = addr
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		expect(t, rec, 201)
+		if rec.Header().Get(ReplayedHeader) != "" {
+			t.Errorf("response replayed to %s", addr)
+		}
+	}
+}
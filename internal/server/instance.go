@@ -0,0 +1,202 @@
+package server
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// NewInstance return a new Instance object with the specified data.
+func NewInstance(id, ip string, port int) *Instance {
+	inst := &Instance{
+		Id:     id,
+		IPAddr: ip,
+		Port:   port,
+		Status: STARTING,
+	}
+	inst.Touch()
+	return inst
+}
+
+// Instance represents a service running an application. It holds the
+// runtime state of the instance, responses show its view instead.
+type Instance struct {
+	// Id is a unique identifier for an Instance.
+	Id string
+
+	// IPAddr is the newowrk address where the instance is located.
+	IPAddr string
+
+	// Port is the network port where the instance is located.
+	Port int
+
+	// Status provide information of the operational status of the instance.
+	Status StatusType
+
+	// Generation is incremented every time the instance id is registered.
+	// Requests carrying an older generation are rejected.
+	Generation uint64
+
+	// Metadata holds arbitrary key/value pairs describing the instance.
+	// It is replaced on updates, never modified in place, as catalog copies
+	// of the instance share it.
+	Metadata map[string]string
+
+	// Version is incremented every time the instance metadata changes.
+	Version uint64
+
+	// DeploymentGroup labels the deployment the instance belongs to (e.g.
+	// blue or green). Discovery only serves the app ActiveGroup by default.
+	DeploymentGroup string
+
+	// Vitals holds the runtime measurements sent with the last renewal
+	// carrying them. It is replaced on renewals, never modified in place.
+	// Vitals are not persisted.
+	Vitals *Vitals
+
+	// PlannedTermination is when the instance is expected to stop, zero if
+	// unknown.
+	PlannedTermination time.Time
+
+	// RegisteredAt is when the instance was registered.
+	RegisteredAt time.Time
+
+	// FirstUpAt is when the instance was first UP after its registration,
+	// zero until then.
+	FirstUpAt time.Time
+
+	// StatusChangedAt is when the instance status last changed.
+	StatusChangedAt time.Time
+
+	// ClockSkew is how far ahead of the SR clock the instance clock was on
+	// its last renewal telling its time, network latency included. It is
+	// not persisted.
+	ClockSkew time.Duration
+
+	// skewKnown is set once a renewal told the instance time.
+	skewKnown bool
+
+	// heartbeatTime is the time of the last UDP heartbeat accepted, as told
+	// by the instance clock, in unix milliseconds.
+	heartbeatTime int64
+
+	// LeaseId identifies the registration holding the instance. Renewals
+	// must present it, so a stale process cannot renew an instance after
+	// it was registered again. It is never exposed in views.
+	LeaseId string
+
+	// LastRenewal holds the timestamp when the instance last contacted the SR.
+	// It is only informative, leases are tracked with renewedAt.
+	LastRenewal int64
+
+	// renewedAt holds the time of the last renewal. As it is obtained with
+	// time.Now it carries a monotonic reading immune to wall clock changes.
+	renewedAt time.Time
+
+	// leaseExpires is the deadline for the next renewal.
+	leaseExpires time.Time
+
+	// expiry is the instance entry in the server expiry queue.
+	expiry *expiry
+
+	// renewals holds the state changed by the last renewal, shared with the
+	// catalog copies of the instance. Renewals which change nothing else
+	// store it instead of publishing the application.
+	renewals *atomic.Value
+
+	// copied is set on the catalog copies of the instance, which read the
+	// state changed by renewals from renewals.
+	copied bool
+
+	// static is set for the instances of a StaticApp.
+	static bool
+}
+
+// Touch updates the instance LastRenewal time.
+func (i *Instance) Touch() {
+	i.touch(time.Now())
+}
+
+// touch sets the instance LastRenewal time to now.
+func (i *Instance) touch(now time.Time) {
+	i.renewedAt = now
+	i.LastRenewal = now.Unix()
+}
+
+// renewal is the state of an instance changed by its renewals.
+type renewal struct {
+	LastRenewal  int64
+	leaseExpires time.Time
+	Vitals       *Vitals
+	ClockSkew    time.Duration
+	skewKnown    bool
+}
+
+// shareRenewal shares the state changed by renewals with the catalog copies
+// of the instance. It must be called with s.mu held.
+func (i *Instance) shareRenewal() {
+	if i.renewals == nil {
+		i.renewals = new(atomic.Value)
+	}
+	i.renewals.Store(renewal{i.LastRenewal, i.leaseExpires, i.Vitals, i.ClockSkew, i.skewKnown})
+}
+
+// lastRenewal returns the state changed by the last renewal of the
+// instance, which is newer than the fields of a catalog copy if it was
+// renewed since.
+func (i *Instance) lastRenewal() renewal {
+	if i.copied && i.renewals != nil {
+		if r, ok := i.renewals.Load().(renewal); ok {
+			return r
+		}
+	}
+	return renewal{i.LastRenewal, i.leaseExpires, i.Vitals, i.ClockSkew, i.skewKnown}
+}
+
+// ETag returns the entity tag of the instance resource. It changes when
+// the instance is registered again or its metadata changes.
+func (i *Instance) ETag() string {
+	return fmt.Sprintf(`"%d.%d"`, i.Generation, i.Version)
+}
+
+// LeaseRemaining returns the time left until the instance lease expires.
+func (i *Instance) LeaseRemaining() time.Duration {
+	expires := i.lastRenewal().leaseExpires
+	if expires.IsZero() {
+		return 0
+	}
+	if d := time.Until(expires); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// StatusType represents an instance status
+type StatusType = model.StatusType
+
+const (
+	// UP represents an instance receiving requests.
+	UP = model.UP
+
+	// DOWN representes an instance that has not sent heartbeats after some time.
+	DOWN = model.DOWN
+
+	// STARTING represents an instance that has registered, but has not yet send any heartbeats.
+	STARTING = model.STARTING
+
+	// OUTOFSERVICE represents an instance that has been deliberately deleted.
+	// It may be down for maintainance or shutting down. It may be restored
+	// until the States.TombstoneTimeout expires.
+	OUTOFSERVICE = model.OUTOFSERVICE
+
+	// MAINTENANCE represents an instance under a maintenance window. It is
+	// only shown in discovery responses, the instance keeps its own status.
+	MAINTENANCE = model.MAINTENANCE
+
+	// DRAINING represents an instance about to reach its planned
+	// termination, see States.DrainLead. It keeps renewing, but is not
+	// available anymore.
+	DRAINING = model.DRAINING
+)
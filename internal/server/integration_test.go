@@ -0,0 +1,345 @@
+package server
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/numercfd/registro/client"
+)
+
+// clock is a virtual clock for servers serving real requests. It starts
+// at the current time, so the scheduler sleeps until the expiries it
+// knows of rather than applying them, and the test applies them once it
+// advances the clock.
+type clock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *clock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	c.mu.Unlock()
+}
+
+// backend is a storage backend the integration tests run against.
+type backend struct {
+	name string
+
+	// store returns the Store of a server, nil to keep the registry in
+	// memory. Calls with the same dir share their state.
+	store func(dir string) Store
+
+	// durable is set if the registry survives restarts.
+	durable bool
+}
+
+var backends = []backend{
+	{"memory", func(string) Store { return nil }, false},
+	{"file", func(dir string) Store { return NewFileStore(filepath.Join(dir, "registry.json")) }, true},
+}
+
+// registry is a server under test, served over HTTP.
+type registry struct {
+	*Server
+	clock *clock
+	http  *httptest.Server
+}
+
+// startRegistry starts a server with the Store of b in dir, configured by
+// config, and serves it over HTTP until stop.
+func startRegistry(t *testing.T, b backend, dir string, config func(*Server)) *registry {
+	t.Helper()
+	c := &clock{now: time.Now()}
+	s := NewServer("")
+	s.States.Now = c.Now
+	s.Durability = SyncDurability
+	s.Store = b.store(dir)
+	if config != nil {
+		config(s)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return &registry{Server: s, clock: c, http: httptest.NewServer(s.Handler())}
+}
+
+// client returns a client of the registry.
+func (r *registry) client(opts ...client.Option) *client.Client {
+	return client.NewClient(r.http.URL+"/registro", opts...)
+}
+
+// advance moves the clock forward, and applies the expiries due.
+func (r *registry) advance(d time.Duration) {
+	r.clock.Advance(d)
+	r.mu.Lock()
+	r.expireDue(r.clock.Now())
+	r.mu.Unlock()
+}
+
+// stop closes the connections and shuts the server down.
+func (r *registry) stop(t *testing.T) {
+	t.Helper()
+	r.http.CloseClientConnections()
+	r.http.Close()
+	if err := r.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// runBackends runs test against every backend, with a directory for its
+// storage.
+func runBackends(t *testing.T, test func(t *testing.T, b backend, dir string)) {
+	for _, b := range backends {
+		b := b
+		t.Run(b.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "registro")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			test(t, b, dir)
+		})
+	}
+}
+
+func TestIntegrationLifecycle(t *testing.T) {
+	runBackends(t, func(t *testing.T, b backend, dir string) {
+		r := startRegistry(t, b, dir, nil)
+		defer r.stop(t)
+		c := r.client()
+
+		app, inst, err := c.RegisterService("i-1", "web", "10.0.0.1", 8080)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inst.Status != STARTING {
+			t.Fatalf("registered instance is %s, want %s", inst.Status, STARTING)
+		}
+		if err := c.RenewInstance(app, inst); err != nil {
+			t.Fatal(err)
+		}
+		expectStatus(t, c, app, inst.Id, UP)
+
+		// Renewals within the lease keep the instance UP.
+		for i := 0; i < 3; i++ {
+			r.advance(r.States.RenewalTimeout / 2)
+			if err := c.RenewInstance(app, inst); err != nil {
+				t.Fatal(err)
+			}
+			expectStatus(t, c, app, inst.Id, UP)
+		}
+
+		r.advance(r.States.RenewalTimeout + time.Second)
+		expectStatus(t, c, app, inst.Id, DOWN)
+
+		r.advance(r.States.EvictionTimeout)
+		if _, err := c.GetInstance(app, inst.Id); err != client.ErrInstNotExist {
+			t.Fatalf("got %v for an evicted instance, want ErrInstNotExist", err)
+		}
+
+		app, inst, err = c.RegisterService("i-2", "web", "10.0.0.2", 8080)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.DeleteInstance(app, inst); err != nil {
+			t.Fatal(err)
+		}
+		expectStatus(t, c, app, inst.Id, OUTOFSERVICE)
+
+		r.advance(r.States.TombstoneTimeout + time.Second)
+		if _, err := c.GetInstance(app, inst.Id); err != client.ErrInstNotExist {
+			t.Fatalf("got %v for a deleted instance, want ErrInstNotExist", err)
+		}
+	})
+}
+
+func TestIntegrationDiscovery(t *testing.T) {
+	runBackends(t, func(t *testing.T, b backend, dir string) {
+		r := startRegistry(t, b, dir, nil)
+		defer r.stop(t)
+		c := r.client()
+
+		for _, id := range []string{"i-1", "i-2", "i-3"} {
+			app, inst, err := c.RegisterService(id, "api", "10.0.1.1", 9000)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := c.RenewInstance(app, inst); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, _, err := c.RegisterService("i-1", "db", "10.0.2.1", 5432); err != nil {
+			t.Fatal(err)
+		}
+
+		apps, err := c.GetApps()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(apps) != 2 {
+			t.Fatalf("got %d apps, want 2", len(apps))
+		}
+		app, err := c.GetApp("api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		up, err := c.ListInstances(app, &client.InstanceFilter{Status: UP})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(up) != 3 {
+			t.Fatalf("got %d UP instances of api, want 3", len(up))
+		}
+		if _, err := c.GetApp("missing"); err != client.ErrAppNotExist {
+			t.Fatalf("got %v for a missing app, want ErrAppNotExist", err)
+		}
+	})
+}
+
+func TestIntegrationWatch(t *testing.T) {
+	runBackends(t, func(t *testing.T, b backend, dir string) {
+		r := startRegistry(t, b, dir, nil)
+		defer r.stop(t)
+		c := r.client()
+
+		app, inst, err := c.RegisterService("i-1", "web", "10.0.0.1", 8080)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := c.Watch("web")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		if n := len(w.Snapshot.Apps); n != 1 || len(w.Snapshot.Apps[0].Instances) != 1 {
+			t.Fatalf("snapshot has %d apps, want web with an instance", n)
+		}
+
+		if err := c.RenewInstance(app, inst); err != nil {
+			t.Fatal(err)
+		}
+		d := nextDelta(t, w)
+		if d.Version <= w.Snapshot.Version {
+			t.Errorf("delta version %d is not after the snapshot version %d", d.Version, w.Snapshot.Version)
+		}
+		if d.App == nil || d.App.GetInstance(inst.Id) == nil || d.App.GetInstance(inst.Id).Status != UP {
+			t.Fatalf("delta %+v does not show the instance UP", d)
+		}
+
+		if err := c.DeleteInstance(app, inst); err != nil {
+			t.Fatal(err)
+		}
+		if d := nextDelta(t, w); d.App == nil || d.App.GetInstance(inst.Id) == nil || d.App.GetInstance(inst.Id).Status != OUTOFSERVICE {
+			t.Fatalf("delta %+v does not show the deleted instance out of service", d)
+		}
+	})
+}
+
+func TestIntegrationTokens(t *testing.T) {
+	runBackends(t, func(t *testing.T, b backend, dir string) {
+		r := startRegistry(t, b, dir, func(s *Server) {
+			s.Tokens = []Token{
+				{Name: "workloads", Secret: "discover-secret", Scopes: []Scope{DiscoverScope}},
+				{Name: "deployer", Secret: "register-secret", Scopes: []Scope{RegisterScope}},
+			}
+		})
+		defer r.stop(t)
+
+		expectCode(t, r.client().NewApp, "web", 401)
+		expectCode(t, r.client(client.WithToken("wrong")).NewApp, "web", 401)
+		expectCode(t, r.client(client.WithToken("discover-secret")).NewApp, "web", 403)
+
+		deployer := r.client(client.WithToken("register-secret"))
+		if _, _, err := deployer.RegisterService("i-1", "web", "10.0.0.1", 8080); err != nil {
+			t.Fatal(err)
+		}
+		app, err := r.client(client.WithToken("discover-secret")).GetApp("web")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(app.Instances) != 1 {
+			t.Fatalf("got %d instances, want 1", len(app.Instances))
+		}
+	})
+}
+
+func TestIntegrationRestart(t *testing.T) {
+	runBackends(t, func(t *testing.T, b backend, dir string) {
+		if !b.durable {
+			t.Skip("the registry does not survive restarts")
+		}
+		r := startRegistry(t, b, dir, nil)
+		c := r.client()
+		app, inst, err := c.RegisterService("i-1", "web", "10.0.0.1", 8080)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.RenewInstance(app, inst); err != nil {
+			t.Fatal(err)
+		}
+		r.stop(t)
+
+		r = startRegistry(t, b, dir, nil)
+		defer r.stop(t)
+		c = r.client()
+		expectStatus(t, c, app, inst.Id, UP)
+
+		// The lease of the previous run still holds.
+		if err := c.RenewInstance(app, inst); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.DeleteInstance(app, inst); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// expectStatus fails the test if the instance has not the status.
+func expectStatus(t *testing.T, c *client.Client, app *client.Application, id string, status StatusType) {
+	t.Helper()
+	inst, err := c.GetInstance(app, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inst.Status != status {
+		t.Fatalf("instance %s is %s, want %s", id, inst.Status, status)
+	}
+}
+
+// expectCode fails the test unless fn fails with the status code.
+func expectCode(t *testing.T, fn func(string) (*client.Application, error), arg string, code int) {
+	t.Helper()
+	_, err := fn(arg)
+	if e, ok := err.(*client.UnexpectedCodeError); !ok || e.Code != code {
+		t.Fatalf("got %v, want status %d", err, code)
+	}
+}
+
+// nextDelta returns the next delta of the watch, failing the test if none
+// comes in time.
+func nextDelta(t *testing.T, w *client.Watch) *client.Delta {
+	t.Helper()
+	select {
+	case d, ok := <-w.Deltas():
+		if !ok {
+			t.Fatalf("watch ended: %v", w.Err())
+		}
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delta received")
+	}
+	return nil
+}
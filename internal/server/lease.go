@@ -0,0 +1,71 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+const (
+	// LeaseHeader is the request header carrying the lease id of an instance.
+	LeaseHeader = "Registro-Lease"
+
+	// GenerationHeader is the request header carrying the generation of an instance.
+	GenerationHeader = "Registro-Generation"
+
+	// ClockHeader is the renewal header carrying the instance time, in RFC
+	// 3339 format, to measure its clock skew.
+	ClockHeader = "Registro-Client-Time"
+)
+
+// newLeaseId returns a new random lease id.
+func newLeaseId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newInstanceId returns a random (version 4) UUID, used as the id of
+// instances registered without one.
+func newInstanceId() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// checkLease verifies the lease and generation presented in r against the
+// instance. It returns 0 if they are valid, or the HTTP status code to reply
+// otherwise: 400 if a required lease is missing or the generation is
+// malformed, and 409 if the lease or generation are from a registration
+// older than the current one.
+func checkLease(inst *Instance, r *http.Request, required bool) int {
+	if g := r.Header.Get(GenerationHeader); g != "" {
+		gen, err := strconv.ParseUint(g, 10, 64)
+		if err != nil {
+			return 400
+		}
+		if gen != inst.Generation {
+			return 409
+		}
+	}
+
+	lease := r.Header.Get(LeaseHeader)
+	if lease == "" {
+		if required {
+			return 400
+		}
+		return 0
+	}
+	if lease != inst.LeaseId {
+		return 409
+	}
+	return 0
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// UnixPrefix starts the ListenAddr of a unix domain socket, followed by
+// its path (e.g. unix:///var/run/registro.sock).
+const UnixPrefix = "unix://"
+
+// listen returns a listener on addr, a TCP address or a unix socket.
+func listen(addr string) (net.Listener, error) {
+	path := strings.TrimPrefix(addr, UnixPrefix)
+	if path == addr {
+		return net.Listen("tcp", addr)
+	}
+
+	// A socket left by a previous run would make the listener fail.
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return net.Listen("unix", path)
+}
+
+// Listener is an additional address the server is reachable at. Every
+// listener serves the same registry.
+type Listener struct {
+	// Addr is the TCP address or unix socket listened to.
+	Addr string
+
+	// CertFile and KeyFile, if set, hold the certificate and key of the
+	// listener, which then serves HTTPS.
+	CertFile, KeyFile string
+
+	// GetCertificate, if set, returns the certificate of the listener
+	// instead of CertFile, e.g. so rotated certificates are served without
+	// a restart.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+	// Admin marks the listener serving the routes under /registro/admin.
+	// Once a listener is marked, the others no longer serve them.
+	Admin bool
+}
+
+// String returns a description of the listener for logs.
+func (l Listener) String() string {
+	s := l.Addr
+	if l.CertFile != "" || l.GetCertificate != nil {
+		s += " (tls)"
+	}
+	if l.Admin {
+		s += " (admin)"
+	}
+	return s
+}
+
+// serve accepts connections on ln with srv, whose TLSConfig must be set,
+// until it is shut down.
+func (l Listener) serve(srv *http.Server, ln net.Listener) error {
+	if l.GetCertificate != nil {
+		srv.TLSConfig.GetCertificate = l.GetCertificate
+		return srv.ServeTLS(ln, "", "")
+	}
+	if l.CertFile != "" {
+		return srv.ServeTLS(ln, l.CertFile, l.KeyFile)
+	}
+	return srv.Serve(ln)
+}
+
+// listeners returns every listener of the server, ListenAddr included.
+func (s *Server) listeners() []Listener {
+	listeners := make([]Listener, 0, len(s.Listeners)+1)
+	if s.ListenAddr != "" {
+		listeners = append(listeners, Listener{Addr: s.ListenAddr})
+	}
+	return append(listeners, s.Listeners...)
+}
+
+// hideAdmin answers the requests to the admin routes with 404.
+func hideAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/registro/admin/") {
+			w.WriteHeader(404)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// NewLockout returns a Lockout banning clients for a minute after 5
+// failures, up to an hour for repeat offenders.
+func NewLockout() *Lockout {
+	return &Lockout{
+		MaxFailures: 5,
+		Window:      15 * time.Minute,
+		BanTime:     time.Minute,
+		MaxBanTime:  time.Hour,
+		clients:     make(map[string]*lockoutState),
+	}
+}
+
+// Lockout bans the clients failing to authenticate too often, so tokens
+// cannot be brute-forced. Failures are counted by client address, and by
+// prefix of the unknown token presented, so attempts spread over many
+// addresses are banned too. Bans only refuse unknown tokens: valid ones
+// are accepted from a banned address, e.g. a NAT shared with an attacker.
+// It is safe for concurrent use.
+type Lockout struct {
+	// MaxFailures is the number of failures within Window banning a
+	// client. Zero disables the lockout.
+	MaxFailures int
+
+	// Window is the time failures are remembered.
+	Window time.Duration
+
+	// BanTime is the length of the first ban of a client, doubled on every
+	// further ban within Window of the previous one, up to MaxBanTime.
+	BanTime, MaxBanTime time.Duration
+
+	// mu protects the fields below.
+	mu      sync.Mutex
+	clients map[string]*lockoutState
+
+	// expired is when the clients were last expired.
+	expired time.Time
+}
+
+// lockoutState holds the failures of a client.
+type lockoutState struct {
+	failures int
+	last     time.Time
+
+	// bans is the number of bans in a row, and until the end of the
+	// current one.
+	bans  int
+	until time.Time
+}
+
+// lockoutKeys returns the keys the failures of a request with an unknown
+// token are counted by: its address, and the fingerprint of the prefix of
+// the token, if any.
+func lockoutKeys(ip, token string) []string {
+	keys := []string{"ip:" + ip}
+	if token != "" {
+		if len(token) > 8 {
+			token = token[:8]
+		}
+		sum := sha256.Sum256([]byte(token))
+		keys = append(keys, "token:"+hex.EncodeToString(sum[:6]))
+	}
+	return keys
+}
+
+// banned returns when the ban of the first of keys banned ends, zero if
+// none is.
+func (l *Lockout) banned(keys []string, now time.Time) time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, k := range keys {
+		if st := l.clients[k]; st != nil && now.Before(st.until) {
+			return st.until
+		}
+	}
+	return time.Time{}
+}
+
+// fail counts a failure of keys, returning the keys it bans.
+func (l *Lockout) fail(keys []string, now time.Time) (banned []string) {
+	if l.MaxFailures <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.expire(now)
+
+	for _, k := range keys {
+		st := l.clients[k]
+		if st == nil {
+			st = new(lockoutState)
+			l.clients[k] = st
+		}
+		if now.Sub(st.last) > l.Window {
+			st.failures = 0
+		}
+		if now.Sub(st.until) > l.Window {
+			st.bans = 0
+		}
+		st.failures++
+		st.last = now
+		if st.failures < l.MaxFailures {
+			continue
+		}
+
+		d := l.BanTime << uint(st.bans)
+		if d > l.MaxBanTime || d <= 0 {
+			d = l.MaxBanTime
+		}
+		st.bans++
+		st.failures = 0
+		st.until = now.Add(d)
+		banned = append(banned, k)
+	}
+	return banned
+}
+
+// expire forgets the clients without failures or bans within Window, at
+// most once a minute. It must be called with l.mu held.
+func (l *Lockout) expire(now time.Time) {
+	if now.Sub(l.expired) < time.Minute {
+		return
+	}
+	l.expired = now
+	for k, st := range l.clients {
+		if now.Sub(st.last) > l.Window && now.Sub(st.until) > l.Window {
+			delete(l.clients, k)
+		}
+	}
+}
+
+// Bans returns the clients banned, with the end of their ban.
+func (l *Lockout) Bans() map[string]time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	bans := make(map[string]time.Time)
+	for k, st := range l.clients {
+		if now.Before(st.until) {
+			bans[k] = st.until
+		}
+	}
+	return bans
+}
+
+// publishLockout publishes the clients banned in the "auth" expvar map.
+func (s *Server) publishLockout() {
+	authVars.Set("bans", expvar.Func(func() interface{} {
+		if s.Lockout == nil {
+			return nil
+		}
+		return s.Lockout.Bans()
+	}))
+}
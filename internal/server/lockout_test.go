@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestLockout(t *testing.T) {
+	s := NewServer("")
+	s.Tokens = []Token{{Name: "deployer", Secret: "deployer-secret", Scopes: []Scope{DiscoverScope}}}
+	s.Lockout = NewLockout()
+	h := s.Handler()
+	bearer := func(secret string) []string { return []string{"Authorization", "Bearer " + secret} }
+
+	// An attacker sharing the address of the deployer guesses tokens with
+	// the prefix of its one.
+	for i := 0; i < s.Lockout.MaxFailures; i++ {
+		expect(t, do(h, "GET", "/apps", "", bearer("deployer-guess")...), 401)
+		expect(t, do(h, "GET", "/apps", "", bearer("deployer-secret")...), 200)
+	}
+	expect(t, do(h, "GET", "/apps", "", bearer("deployer-guess")...), 429)
+	expect(t, do(h, "GET", "/apps", "", bearer("another-guess")...), 429)
+	expect(t, do(h, "GET", "/apps", ""), 429)
+
+	// The deployer is never refused.
+	expect(t, do(h, "GET", "/apps", "", bearer("deployer-secret")...), 200)
+	if bans := s.Lockout.Bans(); len(bans) != 2 {
+		t.Errorf("got bans %v, want the address and the prefix guessed", bans)
+	}
+}
+
+func TestLockoutPrefix(t *testing.T) {
+	s := NewServer("")
+	s.Tokens = []Token{{Name: "deployer", Secret: "deployer-secret", Scopes: []Scope{DiscoverScope}}}
+	s.Lockout = NewLockout()
+	h := s.Handler()
+
+	// Valid tokens do not count against their prefix: guesses from
+	// elsewhere are only banned after as many failures.
+	for i := 0; i < 10; i++ {
+		expect(t, do(h, "GET", "/apps", "", "Authorization", "Bearer deployer-secret"), 200)
+	}
+	if bans := s.Lockout.Bans(); len(bans) != 0 {
+		t.Errorf("got bans %v for a valid token", bans)
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/numercfd/registro/model"
+)
+
+// Maintenance is a window of time where an application (or a single
+// instance) is expected to be unavailable. Instances under maintenance are
+// never changed to DOWN nor evicted, and are shown as MAINTENANCE.
+type Maintenance = model.Maintenance
+
+// maintenanceEnd returns when the maintenance of the instance running at
+// time t ends. It returns the zero time if the instance is not under
+// maintenance.
+func (a *Application) maintenanceEnd(inst *Instance, t time.Time) time.Time {
+	var end time.Time
+	for _, m := range a.Maintenance {
+		if m.Covers(inst.Id, t) && m.End.After(end) {
+			end = m.End
+		}
+	}
+	return end
+}
+
+// maintenanceHandler is the HTTP handler for /apps/{appName}:maintenance.
+// GET lists the windows, POST adds a new one and DELETE ends them all.
+func (s *Server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["appName"]
+	switch r.Method {
+	case "GET":
+		app := s.snapshot().GetApplication(name)
+		if app == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		var response struct {
+			Maintenance []*Maintenance `json:"maintenance"`
+		}
+		response.Maintenance = append(make([]*Maintenance, 0), app.Maintenance...)
+		data, err := encodeJSON(response, isPretty(r))
+		writeBody(w, 200, data, err)
+	case "POST":
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		m := new(Maintenance)
+		if err := json.Unmarshal(body, m); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		if err := m.Validate(); err != nil {
+			log.Printf("invalid maintenance of app %s: %s", name, err)
+			w.WriteHeader(400)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		app := s.GetApplication(name)
+		if app == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		// The list is never modified in place, as catalog copies share it.
+		app.Maintenance = append(append(make([]*Maintenance, 0, len(app.Maintenance)+1), app.Maintenance...), m)
+		s.publish(app)
+
+		// Discovery responses must change when the window starts and ends.
+		time.AfterFunc(time.Until(m.Start), func() { s.refreshMaintenance(app) })
+		time.AfterFunc(time.Until(m.End), func() { s.refreshMaintenance(app) })
+
+		w.WriteHeader(201)
+		log.Printf("maintenance of app %s scheduled from %s to %s", app.Name, m.Start.Format(time.RFC3339), m.End.Format(time.RFC3339))
+	case "DELETE":
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		app := s.GetApplication(name)
+		if app == nil {
+			w.WriteHeader(404)
+			return
+		}
+
+		app.Maintenance = nil
+		for _, inst := range app.Instances {
+			// Instances skipped their checks while under maintenance.
+			s.schedule(app, inst)
+		}
+		s.publish(app)
+		w.WriteHeader(204)
+		log.Printf("maintenance of app %s ended", app.Name)
+	default:
+		w.WriteHeader(405)
+	}
+}
+
+// refreshMaintenance drops the finished maintenance windows of the app and
+// publishes it, so its instances are shown with the right status.
+func (s *Server) refreshMaintenance(app *Application) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.GetApplication(app.Name) != app {
+		// Application has been deleted.
+		return
+	}
+
+	now := time.Now()
+	windows := make([]*Maintenance, 0, len(app.Maintenance))
+	for _, m := range app.Maintenance {
+		if m.End.After(now) {
+			windows = append(windows, m)
+		}
+	}
+	if len(windows) == 0 {
+		windows = nil
+	}
+	app.Maintenance = windows
+	s.publish(app)
+}
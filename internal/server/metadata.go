@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// checkIfMatch reports whether the If-Match header of r, if any, matches
+// the instance ETag. It allows controllers to update an instance without
+// silently overwriting a concurrent update.
+func checkIfMatch(inst *Instance, r *http.Request) bool {
+	match := r.Header.Get("If-Match")
+	return match == "" || match == "*" || match == inst.ETag()
+}
+
+// setMetadata replaces the instance metadata, bumping its version.
+// It must be called with s.mu held.
+func (s *Server) setMetadata(app *Application, inst *Instance, metadata map[string]string) {
+	inst.Metadata = metadata
+	inst.Version++
+	s.record(PutInstance, app, inst)
+	s.publish(app)
+	log.Printf("instance %s of app %s metadata updated to version %d", inst.Id, app.Name, inst.Version)
+}
+
+// dryRunMetadata answers a dry run replacing the instance metadata.
+func dryRunMetadata(inst *Instance, metadata map[string]string, w http.ResponseWriter, r *http.Request) {
+	after := inst.view()
+	after.Metadata = metadata
+	after.Version++
+	writeDryRun(w, r, "update", inst.view(), after)
+}
+
+// patchInstance merges the metadata in r.Body into the instance metadata.
+// Keys set to null are removed.
+func (s *Server) patchInstance(app *Application, inst *Instance, w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	var request struct {
+		Metadata map[string]*string `json:"metadata"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	if !checkIfMatch(inst, r) {
+		w.WriteHeader(412)
+		return
+	}
+
+	// Metadata is never modified in place, as catalog copies share it.
+	metadata := make(map[string]string, len(inst.Metadata))
+	for k, v := range inst.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range request.Metadata {
+		if v == nil {
+			delete(metadata, k)
+		} else {
+			metadata[k] = *v
+		}
+	}
+	if isDryRun(r) {
+		dryRunMetadata(inst, metadata, w, r)
+		return
+	}
+	s.setMetadata(app, inst, metadata)
+	viewInstance(inst, w, r)
+}
+
+// metadataHandler is the HTTP handler for /apps/{appName}/{instanceId}/metadata.
+func (s *Server) metadataHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if r.Method == "GET" {
+		// Show instance metadata from the catalog snapshot
+		var inst *Instance
+		if app := s.snapshot().GetApplication(vars["appName"]); app != nil {
+			inst = app.GetInstance(vars["instanceId"])
+		}
+		if inst == nil {
+			w.WriteHeader(404)
+			return
+		}
+		w.Header().Set("ETag", inst.ETag())
+		data, err := encodeJSON(inst.Metadata, isPretty(r))
+		writeBody(w, 200, data, err)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app := s.GetApplication(vars["appName"])
+	if app == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	inst := app.GetInstance(vars["instanceId"])
+	if inst == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if inst.static {
+		// Static instances are managed in the configuration.
+		w.WriteHeader(409)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		// Replace instance metadata
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		metadata := make(map[string]string)
+		if err := json.Unmarshal(body, &metadata); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+
+		if !checkIfMatch(inst, r) {
+			w.WriteHeader(412)
+			return
+		}
+		if isDryRun(r) {
+			dryRunMetadata(inst, metadata, w, r)
+			return
+		}
+		s.setMetadata(app, inst, metadata)
+		w.Header().Set("ETag", inst.ETag())
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(405)
+	}
+}
@@ -0,0 +1,179 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// Middleware wraps the handler of every route, adding a cross-cutting
+// concern (auth, logging, rate limiting...) without touching the handlers.
+type Middleware func(next http.Handler) http.Handler
+
+// chain returns h wrapped by the middlewares, the first being the outermost.
+func chain(h http.Handler, mws ...Middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// Scope is the permission required by an operation.
+type Scope string
+
+const (
+	// DiscoverScope allows reading and watching the catalog, without
+	// changing it, e.g. for the workloads consuming discovery.
+	DiscoverScope Scope = "discover"
+
+	// RegisterScope allows registering and changing apps and instances,
+	// along with DiscoverScope.
+	RegisterScope Scope = "register"
+
+	// AdminScope allows the operations under /registro/admin, along with
+	// every other scope.
+	AdminScope Scope = "admin"
+)
+
+// RouteInfo describes the route a request was matched to.
+type RouteInfo struct {
+	// Path is the path template of the route, as in version 1.0 of the API
+	// whatever the version requested, e.g. /registro/1.0/apps/{appName}.
+	Path string
+
+	// Version is the version of the API requested, empty for the routes
+	// which are not versioned, such as /registro/admin.
+	Version string
+
+	// Scope is the permission required by the operation requested.
+	// It is empty for methods not accepted on the route.
+	Scope Scope
+
+	// Stream is set for long lived requests, such as the agent stream.
+	Stream bool
+
+	// Signed is set for the catalog routes, see Server.Signer.
+	Signed bool
+
+	// Public is set for the routes served without a token.
+	Public bool
+}
+
+// routeKey is the context key of the RouteInfo.
+type routeKey struct{}
+
+// RequestRoute returns the route the request was matched to. Middlewares
+// use it to apply per route policies.
+func RequestRoute(r *http.Request) RouteInfo {
+	info, _ := r.Context().Value(routeKey{}).(RouteInfo)
+	return info
+}
+
+// withRoute stores the RouteInfo of the request to the route in the API
+// version in its context.
+func withRoute(rt route, version string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info := RouteInfo{Path: rt.Path, Version: version, Scope: rt.scope(r.Method), Stream: rt.Stream, Signed: rt.Signed, Public: rt.Public}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), routeKey{}, info)))
+	})
+}
+
+// statusWriter records the status code written to a ResponseWriter.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = 200
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher, so streamed responses keep working.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the original ResponseWriter, for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requests counts the requests handled by route, method and status code.
+var requests = expvar.NewMap("requests")
+
+// CountRequests is a Middleware publishing the number of requests handled
+// by route, method and status code in expvar.
+func CountRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		requests.Add(r.Method+" "+RequestRoute(r).Path+" "+strconv.Itoa(sw.code), 1)
+	})
+}
+
+// LogRequests is a Middleware writing a log line for every request.
+func LogRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		log.Printf("%s %s %s %d %s", ClientIP(r), r.Method, r.URL.RequestURI(), sw.code, time.Since(start))
+	})
+}
+
+// ErrorReporter receives the panics recovered while handling requests, to
+// send them to an error tracking service.
+type ErrorReporter interface {
+	ReportPanic(r *http.Request, value interface{}, stack []byte)
+}
+
+// recoverPanics is a Middleware answering requests whose handler panicked
+// with a 500 error. The panic is logged with its stack and sent to the
+// server Reporter, if any.
+func (s *Server) recoverPanics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				// Deliberate abort of the response, let net/http handle it.
+				panic(v)
+			}
+
+			stack := debug.Stack()
+			log.Printf("panic serving %s %s: %v\n%s", r.Method, r.URL.RequestURI(), v, stack)
+			if s.Reporter != nil {
+				s.Reporter.ReportPanic(r, v, stack)
+			}
+			if sw.code == 0 {
+				data, err := encodeJSON(errorBody{Error: "internal server error"}, false)
+				writeBody(sw, 500, data, err)
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// errorBody is the response body of unexpected errors.
+type errorBody struct {
+	Error string `json:"error"`
+}
@@ -0,0 +1,264 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FileBackend is the name of the FileStore in the migration registry.
+const FileBackend = "file"
+
+// Migration changes the persisted data of a storage backend from the
+// previous schema version to Version (Up), and back (Down). The data is
+// handled as decoded JSON, so migrations do not depend on the current
+// record types.
+type Migration struct {
+	// Version is the schema version the migration upgrades to. The first
+	// schema is version 1.
+	Version int
+
+	// Description tells what the migration changes, for the logs.
+	Description string
+
+	// Up upgrades the data from Version-1 to Version.
+	Up func(doc map[string]interface{}) error
+
+	// Down downgrades the data from Version to Version-1.
+	Down func(doc map[string]interface{}) error
+}
+
+// Migrator is implemented by the Stores whose persisted data is versioned.
+type Migrator interface {
+	// Migrate moves the persisted data to the schema version specified,
+	// applying the migrations registered for the backend up or down. With
+	// dryRun, the migrations are only applied in memory and nothing is
+	// saved.
+	Migrate(to int, dryRun bool) error
+}
+
+// SchemaError is returned when loading data saved with a schema version
+// other than the one of this binary.
+type SchemaError struct {
+	// Backend is the storage backend.
+	Backend string
+
+	// Found is the schema version of the data.
+	Found int
+
+	// Expected is the schema version of this binary.
+	Expected int
+}
+
+func (e *SchemaError) Error() string {
+	if e.Found > e.Expected {
+		return fmt.Sprintf("%s storage schema version %d is newer than %d, supported by this binary",
+			e.Backend, e.Found, e.Expected)
+	}
+	return fmt.Sprintf("%s storage schema version %d is older than %d, run serve with --migrate",
+		e.Backend, e.Found, e.Expected)
+}
+
+var (
+	// migrationsMu protects migrations.
+	migrationsMu sync.Mutex
+
+	// migrations holds the migrations of each backend, by version.
+	migrations = make(map[string][]Migration)
+)
+
+// RegisterMigration adds a migration to the backend specified. It panics if
+// the backend already has one for the same version.
+func RegisterMigration(backend string, m Migration) {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	if m.Version < 2 {
+		panic(fmt.Sprintf("migration of %s to invalid version %d", backend, m.Version))
+	}
+	for _, o := range migrations[backend] {
+		if o.Version == m.Version {
+			panic(fmt.Sprintf("duplicate migration of %s to version %d", backend, m.Version))
+		}
+	}
+	ms := append(migrations[backend], m)
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	migrations[backend] = ms
+}
+
+// SchemaVersion returns the latest schema version of the backend specified.
+func SchemaVersion(backend string) int {
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	ms := migrations[backend]
+	if len(ms) == 0 {
+		return 1
+	}
+	return ms[len(ms)-1].Version
+}
+
+// migrationStep is a migration to apply in one direction.
+type migrationStep struct {
+	Migration
+	down bool
+}
+
+// apply runs the step on doc.
+func (s migrationStep) apply(doc map[string]interface{}) error {
+	if s.down {
+		if s.Down == nil {
+			return fmt.Errorf("migration to version %d cannot be reverted", s.Version)
+		}
+		return s.Down(doc)
+	}
+	return s.Up(doc)
+}
+
+// String describes the step for the logs.
+func (s migrationStep) String() string {
+	if s.down {
+		return fmt.Sprintf("%d -> %d: revert %s", s.Version, s.Version-1, s.Description)
+	}
+	return fmt.Sprintf("%d -> %d: %s", s.Version-1, s.Version, s.Description)
+}
+
+// migrationPlan returns the steps moving the data of backend from one
+// schema version to another, in order.
+func migrationPlan(backend string, from, to int) ([]migrationStep, error) {
+	latest := SchemaVersion(backend)
+	if to < 1 || to > latest {
+		return nil, fmt.Errorf("%s storage schema version %d does not exist, the latest is %d", backend, to, latest)
+	}
+	if from > latest {
+		return nil, &SchemaError{Backend: backend, Found: from, Expected: latest}
+	}
+
+	migrationsMu.Lock()
+	defer migrationsMu.Unlock()
+	var steps []migrationStep
+	for v := from + 1; v <= to; v++ {
+		m, ok := findMigration(migrations[backend], v)
+		if !ok {
+			return nil, fmt.Errorf("no migration of %s storage to version %d", backend, v)
+		}
+		steps = append(steps, migrationStep{Migration: m})
+	}
+	for v := from; v > to; v-- {
+		m, ok := findMigration(migrations[backend], v)
+		if !ok {
+			return nil, fmt.Errorf("no migration of %s storage to version %d", backend, v)
+		}
+		steps = append(steps, migrationStep{Migration: m, down: true})
+	}
+	return steps, nil
+}
+
+// findMigration returns the migration to version v in ms.
+func findMigration(ms []Migration, v int) (Migration, bool) {
+	for _, m := range ms {
+		if m.Version == v {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
+
+// Migrate implements Migrator. The file is backed up as is to
+// <path>.v<version> before being replaced. A missing file needs no migration.
+func (f *FileStore) Migrate(to int, dryRun bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	raw, err := ioutil.ReadFile(f.Path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, _, err := f.Keys.open(raw)
+	if err != nil {
+		return err
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+
+	from := docVersion(doc)
+	steps, err := migrationPlan(FileBackend, from, to)
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		log.Printf("storage schema is at version %d, nothing to migrate", from)
+		return nil
+	}
+	for _, s := range steps {
+		log.Printf("migrating storage %s", s)
+		if err := s.apply(doc); err != nil {
+			return fmt.Errorf("migration %s: %s", s, err)
+		}
+	}
+	if dryRun {
+		log.Printf("dry run, storage left at version %d", from)
+		return nil
+	}
+
+	doc["schemaVersion"] = to
+	out, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	backup := fmt.Sprintf("%s.v%d", f.Path, from)
+	if err := writeFile(backup, raw); err != nil {
+		return err
+	}
+	if err := f.writeFile(f.Path, out); err != nil {
+		return err
+	}
+	log.Printf("storage migrated to version %d, version %d backed up to %s", to, from, backup)
+	return nil
+}
+
+// docVersion returns the schema version of a decoded file. Files saved
+// before versioning are version 1.
+func docVersion(doc map[string]interface{}) int {
+	if v, ok := doc["schemaVersion"].(float64); ok {
+		return int(v)
+	}
+	return 1
+}
+
+func init() {
+	RegisterMigration(FileBackend, Migration{
+		Version:     2,
+		Description: "save app TTLs in seconds, like the API",
+		Up: func(doc map[string]interface{}) error {
+			return convertTTLs(doc, func(ns float64) float64 { return ns / float64(time.Second) })
+		},
+		Down: func(doc map[string]interface{}) error {
+			return convertTTLs(doc, func(s float64) float64 { return math.Round(s * float64(time.Second)) })
+		},
+	})
+}
+
+// convertTTLs replaces the TTL of every app in doc by its conversion.
+func convertTTLs(doc map[string]interface{}, convert func(float64) float64) error {
+	apps, _ := doc["applications"].([]interface{})
+	for _, a := range apps {
+		app, ok := a.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("invalid application %v", a)
+		}
+		if ttl, ok := app["ttl"].(float64); ok {
+			app["ttl"] = convert(ttl)
+		}
+	}
+	return nil
+}
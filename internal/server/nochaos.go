@@ -0,0 +1,19 @@
+//go:build !chaos
+
+package server
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// chaos is empty, as faults are only injected in binaries built with the
+// chaos tag.
+type chaos struct{}
+
+// withChaos returns router unchanged. Fault injection is only available in
+// binaries built with the chaos tag.
+func (s *Server) withChaos(router *mux.Router) http.Handler {
+	return router
+}
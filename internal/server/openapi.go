@@ -0,0 +1,235 @@
+package server
+
+//go:generate go run ../../cmd/registro-openapi -out ../../openapi.json
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// pathParam matches the parameters of a route path.
+var pathParam = regexp.MustCompile(`{(\w+)}`)
+
+// OpenAPI returns the OpenAPI 3 document describing the REST API. It is
+// built from the route table and the types it references, so it is always
+// in sync with the server.
+func OpenAPI() ([]byte, error) {
+	return json.MarshalIndent(openAPI(), "", "  ")
+}
+
+// openAPIHandler is the HTTP handler for /registro/openapi.json.
+func (s *Server) openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		return
+	}
+	data, err := encodeJSON(openAPI(), isPretty(r))
+	writeBody(w, 200, data, err)
+}
+
+// object is a JSON object of the OpenAPI document.
+type object map[string]interface{}
+
+// openAPI builds the OpenAPI document.
+func openAPI() object {
+	schemas := make(object)
+	paths := make(object)
+	for _, rt := range routes {
+		var params []object
+		for _, m := range pathParam.FindAllStringSubmatch(rt.Path, -1) {
+			params = append(params, object{
+				"name":     m[1],
+				"in":       "path",
+				"required": true,
+				"schema":   object{"type": "string"},
+			})
+		}
+
+		item := make(object)
+		if params != nil {
+			item["parameters"] = params
+		}
+		for _, op := range rt.Operations {
+			item[strings.ToLower(op.Method)] = rt.document(op, schemas)
+		}
+		paths[rt.Path] = item
+	}
+
+	var versions []string
+	for _, v := range apiVersions {
+		versions = append(versions, v.Name)
+	}
+	return object{
+		"openapi": "3.0.3",
+		"info": object{
+			"title":   "Registro",
+			"version": "1.0",
+			"description": "The paths under " + basePrefix + " are also served under the prefix of every other version of the API: " +
+				strings.Join(versions, ", ") + ". The versions only differ in their responses.",
+			"x-registro-versions": versions,
+		},
+		"paths":      paths,
+		"components": object{"schemas": schemas},
+	}
+}
+
+// document returns the OpenAPI operation object of op on the route.
+// Named types referenced are added to schemas.
+func (rt route) document(op operation, schemas object) object {
+	doc := object{"summary": op.Summary, "x-registro-scope": rt.scope(op.Method)}
+
+	if len(op.Query) > 0 {
+		var params []object
+		for _, name := range sortedKeys(op.Query) {
+			params = append(params, object{
+				"name":        name,
+				"in":          "query",
+				"description": op.Query[name],
+				"schema":      object{"type": "string"},
+			})
+		}
+		doc["parameters"] = params
+	}
+
+	if op.Request != nil {
+		doc["requestBody"] = object{
+			"content": object{
+				"application/json": object{"schema": schemaOf(reflect.TypeOf(op.Request), schemas)},
+			},
+		}
+	}
+
+	response := object{"description": http.StatusText(op.Status)}
+	if op.Response != nil {
+		response["content"] = object{
+			"application/json": object{"schema": schemaOf(reflect.TypeOf(op.Response), schemas)},
+		}
+	}
+	doc["responses"] = object{strconv.Itoa(op.Status): response}
+	return doc
+}
+
+// schemaOf returns the JSON schema of values of type t, as encoded by
+// encoding/json. Named structs are added to schemas and referenced.
+func schemaOf(t reflect.Type, schemas object) object {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return object{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return object{"type": "array", "items": schemaOf(t.Elem(), schemas)}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": schemaOf(t.Elem(), schemas)}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return structSchema(t, schemas)
+		}
+		name := strings.ToUpper(t.Name()[:1]) + t.Name()[1:]
+		if _, ok := schemas[name]; !ok {
+			// Reserve the name first, so recursive types terminate.
+			schemas[name] = object{}
+			schemas[name] = structSchema(t, schemas)
+		}
+		return object{"$ref": "#/components/schemas/" + name}
+	}
+	return object{}
+}
+
+// structSchema returns the JSON schema of the struct type t.
+func structSchema(t reflect.Type, schemas object) object {
+	props := make(object)
+	var required []string
+	embedded := make(object)
+	var embeddedRequired []string
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		_, tagged := f.Tag.Lookup("json")
+		if f.Anonymous && !tagged {
+			// Fields of embedded structs are encoded as if they were in t,
+			// unless t has a field with the same name.
+			ft := f.Type
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				s := structSchema(ft, schemas)
+				for name, prop := range s["properties"].(object) {
+					embedded[name] = prop
+				}
+				if r, ok := s["required"].([]string); ok {
+					embeddedRequired = append(embeddedRequired, r...)
+				}
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			// Unexported fields are not encoded.
+			continue
+		}
+
+		name, opts := f.Name, ""
+		if tag, ok := f.Tag.Lookup("json"); ok {
+			if tag == "-" {
+				continue
+			}
+			name, opts = tag, ""
+			if i := strings.Index(tag, ","); i >= 0 {
+				name, opts = tag[:i], tag[i:]
+			}
+			if name == "" {
+				name = f.Name
+			}
+		}
+
+		props[name] = schemaOf(f.Type, schemas)
+		if !strings.Contains(opts, "omitempty") {
+			required = append(required, name)
+		}
+	}
+
+	for _, name := range embeddedRequired {
+		if _, ok := props[name]; !ok {
+			required = append(required, name)
+		}
+	}
+	for name, prop := range embedded {
+		if _, ok := props[name]; !ok {
+			props[name] = prop
+		}
+	}
+
+	s := object{"type": "object", "properties": props}
+	if required != nil {
+		s["required"] = required
+	}
+	return s
+}
+
+// sortedKeys returns the keys of m in order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,120 @@
+//go:build !chaos
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// TestOpenAPIGenerated checks openapi.json is the document of the routes.
+// It is generated without the chaos routes, hence the build tag.
+func TestOpenAPIGenerated(t *testing.T) {
+	want, err := OpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile("../../openapi.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, append(want, '\n')) {
+		t.Error("openapi.json is out of date, run go generate ./internal/server")
+	}
+
+	rec := do(NewServer("").Handler(), "GET", "/registro/openapi.json", "")
+	expect(t, rec, 200)
+	var served, built interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &served); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(want, &built); err != nil {
+		t.Fatal(err)
+	}
+	if !jsonEqual(served, built) {
+		t.Error("the document served is not the one generated")
+	}
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	var doc struct {
+		Paths map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	data, err := OpenAPI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatal(err)
+	}
+	documented := make(map[string]string)
+	for path, item := range doc.Paths {
+		var methods []string
+		for key := range item {
+			if key != "parameters" {
+				methods = append(methods, strings.ToUpper(key))
+			}
+		}
+		documented[path] = methodSet(methods)
+	}
+
+	// The router serves every route in every version, and each accepts the
+	// methods documented, HEAD along GET, and OPTIONS.
+	router := mux.NewRouter()
+	for _, rt := range routes {
+		rt.register(NewServer(""), router)
+	}
+	served := make(map[string]string)
+	router.Walk(func(r *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		path, err := r.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		if methods, err := r.GetMethods(); err == nil {
+			served[path] = methodSet(methods)
+		}
+		return nil
+	})
+	for path, methods := range documented {
+		var want []string
+		for _, m := range strings.Fields(methods) {
+			want = append(want, m)
+			if m == "GET" {
+				want = append(want, "HEAD")
+			}
+		}
+		want = append(want, "OPTIONS")
+		paths := make(map[string]bool)
+		for _, v := range apiVersions {
+			paths[v.path(path)] = true
+		}
+		for p := range paths {
+			if got := served[p]; got != methodSet(want) {
+				t.Errorf("%s serves %q, documented %q", p, got, methods)
+			}
+			delete(served, p)
+		}
+	}
+	for path := range served {
+		t.Errorf("%s is not documented", path)
+	}
+}
+
+// methodSet returns the methods sorted, as a string.
+func methodSet(methods []string) string {
+	sort.Strings(methods)
+	return strings.Join(methods, " ")
+}
+
+// jsonEqual reports whether two decoded JSON documents are equal.
+func jsonEqual(a, b interface{}) bool {
+	x, _ := json.Marshal(a)
+	y, _ := json.Marshal(b)
+	return bytes.Equal(x, y)
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/numercfd/registro/model"
+)
+
+const (
+	// ZoneMetadataKey is the metadata key holding the zone of an instance.
+	ZoneMetadataKey = "zone"
+
+	// LoadMetadataKey is the metadata key holding the load score of an
+	// instance which does not report vitals.
+	LoadMetadataKey = "load"
+)
+
+// picker holds the state of the server side instance balancing.
+type picker struct {
+	// next holds the round-robin counter (*uint64) of every app.
+	next sync.Map
+}
+
+// roundRobin returns every instance in turn.
+func (p *picker) roundRobin(app string, instances []*Instance) *Instance {
+	v, _ := p.next.LoadOrStore(app, new(uint64))
+	n := atomic.AddUint64(v.(*uint64), 1) - 1
+	return instances[n%uint64(len(instances))]
+}
+
+// leastLoaded returns the instance with the lowest load. Vitals count half
+// of their value every halfLife, so instances which have not reported for a
+// while get a chance to take new requests.
+func leastLoaded(instances []*Instance, halfLife time.Duration) *Instance {
+	var best *Instance
+	min := math.Inf(1)
+	for _, inst := range instances {
+		l := inst.load()
+		if v := inst.lastRenewal().Vitals; v != nil && halfLife > 0 {
+			age := time.Since(time.Unix(v.ReportedAt, 0))
+			l *= math.Pow(0.5, age.Seconds()/halfLife.Seconds())
+		}
+		if l < min {
+			best, min = inst, l
+		}
+	}
+	return best
+}
+
+// affinity returns the instance the consumer sticks to, the one with the
+// highest model.AffinityScore, so the same consumer is given the same
+// instance as long as it is available.
+func affinity(instances []*Instance, consumer string) *Instance {
+	var best *Instance
+	var max uint64
+	for _, inst := range instances {
+		if score := model.AffinityScore(consumer, inst.Id); best == nil || score > max {
+			best, max = inst, score
+		}
+	}
+	return best
+}
+
+// load returns the in-flight requests of the instance plus the fraction of
+// CPU in use. Instances without vitals use the LoadMetadataKey metadata.
+func (i *Instance) load() float64 {
+	if v := i.lastRenewal().Vitals; v != nil {
+		return float64(v.InFlight) + v.CPU
+	}
+	if l, err := strconv.ParseFloat(i.Metadata[LoadMetadataKey], 64); err == nil {
+		return l
+	}
+	return 0
+}
+
+// pickHandler is the HTTP handler for /apps/{appName}/pick. It returns a
+// single available instance, for clients which cannot balance by themselves.
+func (s *Server) pickHandler(w http.ResponseWriter, r *http.Request) {
+	app := s.snapshot().GetApplication(mux.Vars(r)["appName"])
+	if app == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	group := r.URL.Query().Get("group")
+	if group == "" && app.Rollout.Active() {
+		// Requests are split between the groups of the rollout.
+		group = app.Rollout.PickGroup()
+	}
+	instances := app.inGroup(group).GetAvailableInstances()
+	if zone := r.URL.Query().Get("zone"); zone != "" {
+		inZone := make([]*Instance, 0, len(instances))
+		for _, inst := range instances {
+			if inst.Metadata[ZoneMetadataKey] == zone {
+				inZone = append(inZone, inst)
+			}
+		}
+		instances = inZone
+	}
+
+	var strategy func() *Instance
+	switch r.URL.Query().Get("strategy") {
+	case "", "round-robin":
+		strategy = func() *Instance { return s.picker.roundRobin(app.Name, instances) }
+	case "least-loaded":
+		strategy = func() *Instance { return leastLoaded(instances, s.States.RenewalTimeout) }
+	case "affinity":
+		consumer := r.URL.Query().Get("consumer")
+		if consumer == "" {
+			w.WriteHeader(400)
+			return
+		}
+		strategy = func() *Instance { return affinity(instances, consumer) }
+	default:
+		w.WriteHeader(400)
+		return
+	}
+
+	if len(instances) == 0 {
+		w.WriteHeader(503)
+		return
+	}
+	viewInstance(strategy(), w, r)
+}
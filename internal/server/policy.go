@@ -0,0 +1,192 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/gorilla/mux"
+)
+
+// policyVars counts the policy decisions, by outcome.
+var policyVars = expvar.NewMap("policy")
+
+// PolicyInput describes a request to a Policy.
+type PolicyInput struct {
+	// Client identifies the client, as accounted in the server Usage: its
+	// address, or the value of the usage header.
+	Client string `json:"client"`
+
+	// Token is the name of the token the request was authenticated with,
+	// if any.
+	Token string `json:"token,omitempty"`
+
+	// Environment is the environment of the client, if any.
+	Environment string `json:"environment,omitempty"`
+
+	// Address is the client address.
+	Address string `json:"address"`
+
+	// Method is the request method.
+	Method string `json:"method"`
+
+	// Route is the path template of the route, e.g.
+	// /registro/1.0/apps/{appName}.
+	Route string `json:"route"`
+
+	// Scope is the permission the operation requires.
+	Scope Scope `json:"scope"`
+
+	// Params holds the path parameters, e.g. appName.
+	Params map[string]string `json:"params"`
+
+	// Query holds the query parameters.
+	Query map[string][]string `json:"query,omitempty"`
+
+	// Body holds the request body, if it is JSON.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// Decision is the outcome of a Policy.
+type Decision struct {
+	// Allow is set if the request may proceed.
+	Allow bool `json:"allow"`
+
+	// Reason tells why the request was denied, if it was.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Policy decides whether requests are allowed, e.g. through OPA, so
+// authorization and admission rules live outside of the registry code.
+// Embedders may implement it with an embedded policy engine.
+type Policy interface {
+	Decide(ctx context.Context, input *PolicyInput) (Decision, error)
+}
+
+// OPAPolicy is a Policy asking an OPA server, through its data API.
+type OPAPolicy struct {
+	// URL is the data API URL of the decision, e.g.
+	// http://localhost:8181/v1/data/registro/allow. The decision is either
+	// a boolean, or an object with "allow" and "reason". An undefined
+	// decision denies the request.
+	URL string
+
+	// Client is the HTTP client used. If nil, http.DefaultClient is.
+	Client *http.Client
+}
+
+// Decide implements Policy.
+func (p *OPAPolicy) Decide(ctx context.Context, input *PolicyInput) (Decision, error) {
+	body, err := json.Marshal(struct {
+		Input *PolicyInput `json:"input"`
+	}{input})
+	if err != nil {
+		return Decision{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, p.URL, bytes.NewReader(body))
+	if err != nil {
+		return Decision{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return Decision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return Decision{}, fmt.Errorf("policy server answered %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Result json.RawMessage `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return Decision{}, err
+	}
+	var d Decision
+	switch {
+	case len(result.Result) == 0:
+		d.Reason = "no policy decision"
+	case json.Unmarshal(result.Result, &d.Allow) == nil:
+	default:
+		if err := json.Unmarshal(result.Result, &d); err != nil {
+			return Decision{}, fmt.Errorf("invalid policy decision: %s", err)
+		}
+	}
+	return d, nil
+}
+
+// enforcePolicy is a Middleware asking the server Policy, if any, whether
+// requests are allowed. Denied requests are answered with 403 and the
+// reason. Requests the policy fails to decide are answered with 503, unless
+// PolicyFailOpen is set.
+func (s *Server) enforcePolicy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Policy == nil || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		route := RequestRoute(r)
+		input := &PolicyInput{
+			Client:  s.clientKey(r),
+			Address: ClientIP(r),
+			Method:  r.Method,
+			Route:   route.Path,
+			Scope:   route.Scope,
+			Params:  mux.Vars(r),
+			Query:   r.URL.Query(),
+		}
+		if t := RequestToken(r); t != nil {
+			input.Token = t.Name
+		}
+		input.Environment = RequestEnvironment(r)
+		if r.Method != "GET" && r.Method != "HEAD" && !route.Stream && r.Body != nil {
+			body, err := ioutil.ReadAll(r.Body)
+			if err != nil {
+				w.WriteHeader(400)
+				return
+			}
+			r.Body = ioutil.NopCloser(bytes.NewReader(body))
+			if json.Valid(body) {
+				input.Body = body
+			}
+		}
+
+		d, err := s.Policy.Decide(r.Context(), input)
+		switch {
+		case err != nil && s.PolicyFailOpen:
+			log.Printf("policy error, request allowed: %s", err)
+			policyVars.Add("failedOpen", 1)
+		case err != nil:
+			log.Printf("policy error: %s", err)
+			policyVars.Add("failed", 1)
+			data, err := encodeJSON(errorBody{Error: "policy unavailable"}, false)
+			writeBody(w, 503, data, err)
+			return
+		case !d.Allow:
+			policyVars.Add("denied", 1)
+			reason := d.Reason
+			if reason == "" {
+				reason = "denied by policy"
+			}
+			s.securityEvent(r, SecurityEvent{Type: PolicyDenied, Status: 403, Reason: reason})
+			data, err := encodeJSON(errorBody{Error: reason}, false)
+			writeBody(w, 403, data, err)
+			return
+		default:
+			policyVars.Add("allowed", 1)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ProbeType identifies how a Probe checks an instance.
+type ProbeType string
+
+const (
+	// TCPProbe checks the instance accepts TCP connections.
+	TCPProbe ProbeType = "tcp"
+
+	// HTTPProbe checks the instance answers an HTTP GET with a 2xx or 3xx
+	// status code.
+	HTTPProbe ProbeType = "http"
+)
+
+// Probe is an active health check of a static instance, which sends no
+// heartbeats. Probed instances are STARTING until they are healthy, then
+// go DOWN and back UP as probes fail and succeed.
+type Probe struct {
+	// Type is how the instance is checked.
+	Type ProbeType
+
+	// Path is the path requested by HTTP probes. Empty requests /.
+	Path string
+
+	// Interval is the time between checks. Zero checks every 10 seconds.
+	Interval time.Duration
+
+	// Timeout bounds each check. Zero waits 2 seconds.
+	Timeout time.Duration
+
+	// HealthyThreshold is the number of checks in a row which must succeed
+	// for the instance to be UP. Zero means 1.
+	HealthyThreshold int
+
+	// UnhealthyThreshold is the number of checks in a row which must fail
+	// for the instance to be DOWN. Zero means 3.
+	UnhealthyThreshold int
+}
+
+// withDefaults returns the probe with its unset fields defaulted, or an
+// error if its type is unknown.
+func (p Probe) withDefaults() (Probe, error) {
+	if p.Type != TCPProbe && p.Type != HTTPProbe {
+		return p, fmt.Errorf("unknown probe type %q", p.Type)
+	}
+	if p.Path == "" {
+		p.Path = "/"
+	}
+	if p.Interval <= 0 {
+		p.Interval = 10 * time.Second
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = 2 * time.Second
+	}
+	if p.HealthyThreshold <= 0 {
+		p.HealthyThreshold = 1
+	}
+	if p.UnhealthyThreshold <= 0 {
+		p.UnhealthyThreshold = 3
+	}
+	return p, nil
+}
+
+// check probes the instance at ip:port once.
+func (p Probe) check(ip string, port int) error {
+	addr := net.JoinHostPort(ip, strconv.Itoa(port))
+	if p.Type == TCPProbe {
+		conn, err := net.DialTimeout("tcp", addr, p.Timeout)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+
+	client := http.Client{
+		Timeout: p.Timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	r, err := client.Get("http://" + addr + p.Path)
+	if err != nil {
+		return err
+	}
+	r.Body.Close()
+	if r.StatusCode >= 400 {
+		return fmt.Errorf("status code %d", r.StatusCode)
+	}
+	return nil
+}
+
+// runProbe checks the static instance of app with p until the server shuts
+// down, or the instance is replaced or removed.
+func (s *Server) runProbe(app string, inst *Instance, p Probe) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+
+	// The address of static instances never changes.
+	ip, port := inst.IPAddr, inst.Port
+	healthy, unhealthy := 0, 0
+	for {
+		err := p.check(ip, port)
+		if err == nil {
+			healthy, unhealthy = healthy+1, 0
+		} else {
+			healthy, unhealthy = 0, unhealthy+1
+		}
+
+		s.mu.Lock()
+		a := s.GetApplication(app)
+		if a == nil || a.GetInstance(inst.Id) != inst {
+			s.mu.Unlock()
+			return
+		}
+		status := inst.Status
+		switch {
+		case healthy >= p.HealthyThreshold:
+			s.States.Transition(app, inst, UP)
+		case unhealthy >= p.UnhealthyThreshold && status == UP:
+			log.Printf("probe of instance %s of app %s failed: %s", inst.Id, app, err)
+			s.States.Transition(app, inst, DOWN)
+		}
+		if inst.Status != status {
+			s.publish(a)
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-ticker.C:
+		case <-s.closing:
+			return
+		}
+	}
+}
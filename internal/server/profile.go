@@ -0,0 +1,270 @@
+package server
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode"
+
+	"github.com/numercfd/registro/model"
+)
+
+// Profile selects the shape of discovery responses, so consumers built for
+// other registries may read them without an adapter.
+type Profile string
+
+const (
+	// NativeProfile is the registro format, with camelCase fields.
+	NativeProfile Profile = "native"
+
+	// SnakeCaseProfile is the registro format, with snake_case fields.
+	SnakeCaseProfile Profile = "snake_case"
+
+	// EurekaProfile mimics the Eureka REST API.
+	EurekaProfile Profile = "eureka"
+
+	// EndpointsProfile mimics Kubernetes Endpoints objects, one per app.
+	EndpointsProfile Profile = "endpoints"
+)
+
+// requestProfile returns the profile asked by the request, either with
+// ?profile= or with the profile parameter of the Accept header (e.g.
+// application/json; profile=eureka). It reports false if the profile is
+// unknown.
+func requestProfile(r *http.Request) (Profile, bool) {
+	p := Profile(r.URL.Query().Get("profile"))
+	if p == "" {
+		for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+			if _, params, err := mime.ParseMediaType(accept); err == nil && params["profile"] != "" {
+				p = Profile(params["profile"])
+				break
+			}
+		}
+	}
+
+	switch p {
+	case "":
+		return NativeProfile, true
+	case NativeProfile, SnakeCaseProfile, EurekaProfile, EndpointsProfile:
+		return p, true
+	default:
+		return "", false
+	}
+}
+
+// list returns the response body listing apps in the profile.
+func (p Profile) list(l model.AppList) interface{} {
+	switch p {
+	case SnakeCaseProfile:
+		return snakeCase(l)
+	case EurekaProfile:
+		apps := make([]eurekaApp, 0, len(l.Apps))
+		for _, app := range l.Apps {
+			apps = append(apps, newEurekaApp(app))
+		}
+		return map[string]interface{}{
+			"applications": map[string]interface{}{"application": apps},
+		}
+	case EndpointsProfile:
+		items := make([]endpoints, 0, len(l.Apps))
+		for _, app := range l.Apps {
+			items = append(items, newEndpoints(app.Name, app.Instances))
+		}
+		return map[string]interface{}{"kind": "EndpointsList", "apiVersion": "v1", "items": items}
+	default:
+		return l
+	}
+}
+
+// app returns the response body showing an app in the profile.
+func (p Profile) app(a *model.Application) interface{} {
+	switch p {
+	case SnakeCaseProfile:
+		return snakeCase(a)
+	case EurekaProfile:
+		return map[string]interface{}{"application": newEurekaApp(a)}
+	case EndpointsProfile:
+		return newEndpoints(a.Name, a.Instances)
+	default:
+		return a
+	}
+}
+
+// instance returns the response body showing an instance of the app in the
+// profile.
+func (p Profile) instance(app string, i *model.Instance) interface{} {
+	switch p {
+	case SnakeCaseProfile:
+		return snakeCase(i)
+	case EurekaProfile:
+		return map[string]interface{}{"instance": newEurekaInstance(app, i)}
+	case EndpointsProfile:
+		return newEndpoints(app, []*model.Instance{i})
+	default:
+		return i
+	}
+}
+
+// snakeCase returns v encoded as JSON with its field names in snake_case.
+// Keys of metadata and gauges are user data, and are kept as is.
+func snakeCase(v interface{}) interface{} {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return v
+	}
+	var generic interface{}
+	if err := json.Unmarshal(data, &generic); err != nil {
+		return v
+	}
+	return snakeKeys(generic)
+}
+
+// snakeKeys renames the keys of every object in v to snake_case.
+func snakeKeys(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			if k != "metadata" && k != "gauges" {
+				e = snakeKeys(e)
+			}
+			m[toSnake(k)] = e
+		}
+		return m
+	case []interface{}:
+		for i, e := range v {
+			v[i] = snakeKeys(e)
+		}
+	}
+	return v
+}
+
+// toSnake converts a camelCase name to snake_case.
+func toSnake(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// eurekaApp is an application in the Eureka format.
+type eurekaApp struct {
+	Name      string           `json:"name"`
+	Instances []eurekaInstance `json:"instance"`
+}
+
+// eurekaInstance is an instance in the Eureka format.
+type eurekaInstance struct {
+	InstanceId string            `json:"instanceId"`
+	HostName   string            `json:"hostName"`
+	App        string            `json:"app"`
+	IPAddr     string            `json:"ipAddr"`
+	Status     string            `json:"status"`
+	Port       eurekaPort        `json:"port"`
+	Metadata   map[string]string `json:"metadata,omitempty"`
+
+	// LastUpdatedTimestamp is in milliseconds.
+	LastUpdatedTimestamp int64 `json:"lastUpdatedTimestamp"`
+}
+
+// eurekaPort is a port in the Eureka format.
+type eurekaPort struct {
+	Port    int    `json:"$"`
+	Enabled string `json:"@enabled"`
+}
+
+// newEurekaApp returns the app in the Eureka format.
+func newEurekaApp(a *model.Application) eurekaApp {
+	app := eurekaApp{Name: strings.ToUpper(a.Name), Instances: make([]eurekaInstance, 0, len(a.Instances))}
+	for _, inst := range a.Instances {
+		app.Instances = append(app.Instances, newEurekaInstance(a.Name, inst))
+	}
+	return app
+}
+
+// newEurekaInstance returns the instance of app in the Eureka format.
+func newEurekaInstance(app string, i *model.Instance) eurekaInstance {
+	status := map[StatusType]string{
+		UP:           "UP",
+		DOWN:         "DOWN",
+		STARTING:     "STARTING",
+		OUTOFSERVICE: "OUT_OF_SERVICE",
+		MAINTENANCE:  "OUT_OF_SERVICE",
+		DRAINING:     "OUT_OF_SERVICE",
+	}[i.Status]
+	if status == "" {
+		status = "UNKNOWN"
+	}
+	return eurekaInstance{
+		InstanceId:           i.Id,
+		HostName:             i.IPAddr,
+		App:                  strings.ToUpper(app),
+		IPAddr:               i.IPAddr,
+		Status:               status,
+		Port:                 eurekaPort{Port: i.Port, Enabled: "true"},
+		Metadata:             i.Metadata,
+		LastUpdatedTimestamp: i.LastRenewal * 1000,
+	}
+}
+
+// endpoints is an application in the format of Kubernetes Endpoints.
+type endpoints struct {
+	Kind       string            `json:"kind"`
+	APIVersion string            `json:"apiVersion"`
+	Metadata   map[string]string `json:"metadata"`
+	Subsets    []*endpointSubset `json:"subsets"`
+}
+
+// endpointSubset groups the addresses listening on the same port. Only UP
+// instances are ready.
+type endpointSubset struct {
+	Addresses         []endpointAddress `json:"addresses,omitempty"`
+	NotReadyAddresses []endpointAddress `json:"notReadyAddresses,omitempty"`
+	Ports             []endpointPort    `json:"ports"`
+}
+
+// endpointAddress is an instance address in an endpointSubset.
+type endpointAddress struct {
+	IP        string            `json:"ip"`
+	TargetRef map[string]string `json:"targetRef"`
+}
+
+// endpointPort is the port of an endpointSubset.
+type endpointPort struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+}
+
+// newEndpoints returns the instances of app as Kubernetes Endpoints.
+func newEndpoints(app string, instances []*model.Instance) endpoints {
+	e := endpoints{
+		Kind:       "Endpoints",
+		APIVersion: "v1",
+		Metadata:   map[string]string{"name": app},
+		Subsets:    make([]*endpointSubset, 0),
+	}
+	byPort := make(map[int]*endpointSubset)
+	for _, inst := range instances {
+		subset := byPort[inst.Port]
+		if subset == nil {
+			subset = &endpointSubset{Ports: []endpointPort{{Port: inst.Port, Protocol: "TCP"}}}
+			byPort[inst.Port] = subset
+			e.Subsets = append(e.Subsets, subset)
+		}
+		addr := endpointAddress{IP: inst.IPAddr, TargetRef: map[string]string{"kind": "Instance", "name": inst.Id}}
+		if inst.Status == UP {
+			subset.Addresses = append(subset.Addresses, addr)
+		} else {
+			subset.NotReadyAddresses = append(subset.NotReadyAddresses, addr)
+		}
+	}
+	return e
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+)
+
+// ReadOnly describes the read-only mode of the registry. While it is
+// enabled, requests changing the registry are rejected with 503, reads are
+// served from the last known state and instances are neither expired nor
+// evicted, as they cannot renew.
+type ReadOnly struct {
+	// Enabled is set while the registry is read-only.
+	Enabled bool `json:"readOnly"`
+
+	// Reason describes why the registry is read-only.
+	Reason string `json:"reason,omitempty"`
+
+	// Automatic is set when the mode was entered on a storage failure.
+	Automatic bool `json:"automatic,omitempty"`
+
+	// Since holds when the mode was last changed.
+	Since time.Time `json:"since"`
+}
+
+// ReadOnly returns the read-only mode of the registry.
+func (s *Server) ReadOnly() ReadOnly {
+	ro, _ := s.readOnly.Load().(ReadOnly)
+	return ro
+}
+
+// SetReadOnly enables or disables the read-only mode of the registry.
+func (s *Server) SetReadOnly(enabled bool, reason string) {
+	s.setReadOnly(ReadOnly{Enabled: enabled, Reason: reason, Since: time.Now()})
+}
+
+// setReadOnly replaces the read-only mode, logging the change.
+func (s *Server) setReadOnly(ro ReadOnly) {
+	old := s.ReadOnly()
+	s.readOnly.Store(ro)
+	switch {
+	case ro.Enabled && !old.Enabled:
+		log.Printf("registry is now read-only: %s", ro.Reason)
+	case !ro.Enabled && old.Enabled:
+		log.Printf("registry is no longer read-only")
+	}
+}
+
+// storageFailed makes the registry read-only after a storage error, so it
+// does not accept changes it cannot persist. An operator must disable the
+// mode once storage is back.
+func (s *Server) storageFailed(err error) {
+	log.Printf("storage write error: %s", err)
+	if !s.ReadOnly().Enabled {
+		s.setReadOnly(ReadOnly{Enabled: true, Reason: "storage write error: " + err.Error(), Automatic: true, Since: time.Now()})
+	}
+}
+
+// rejectReadOnly answers requests changing the registry with 503 while it
+// is read-only. It reports whether the request was rejected. Reads, dry
+// runs and admin requests, which toggle the mode, are let through.
+func (s *Server) rejectReadOnly(rt route, w http.ResponseWriter, r *http.Request) bool {
+	switch {
+	case r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS":
+		return false
+	case rt.scope(r.Method) == AdminScope:
+		return false
+	case isDryRun(r):
+		return false
+	case !s.ReadOnly().Enabled:
+		return false
+	}
+
+	data, err := encodeJSON(errorBody{Error: "registry is read-only"}, false)
+	w.Header().Set("Retry-After", "30")
+	writeBody(w, 503, data, err)
+	return true
+}
+
+// readOnlyHandler is the HTTP handler for /registro/admin/readonly.
+func (s *Server) readOnlyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		data, err := encodeJSON(s.ReadOnly(), isPretty(r))
+		writeBody(w, 200, data, err)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	var request ReadOnly
+	if err := json.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	s.SetReadOnly(request.Enabled, request.Reason)
+	w.WriteHeader(204)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// renewalVars publishes the expected and actual renewals per minute.
+var renewalVars = expvar.NewMap("renewals")
+
+// rateCounter counts events over the last minute, in one second buckets.
+type rateCounter struct {
+	mu      sync.Mutex
+	buckets [60]int
+	seconds [60]int64
+}
+
+// add counts an event at t.
+func (c *rateCounter) add(t time.Time) {
+	sec := t.Unix()
+	i := sec % 60
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.seconds[i] != sec {
+		c.seconds[i] = sec
+		c.buckets[i] = 0
+	}
+	c.buckets[i]++
+}
+
+// lastMinute returns the number of events in the minute before t.
+func (c *rateCounter) lastMinute(t time.Time) int {
+	sec := t.Unix()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for i, s := range c.seconds {
+		if sec-s < 60 {
+			n += c.buckets[i]
+		}
+	}
+	return n
+}
+
+// RenewalRate compares the renewals received to the ones expected from the
+// registered instances. A ratio well below 1 means instances fail to reach
+// the registry, e.g. during a network partition.
+type RenewalRate struct {
+	// Expected is the number of renewals expected per minute.
+	Expected float64 `json:"expectedPerMinute"`
+
+	// Actual is the number of renewals received in the last minute.
+	Actual float64 `json:"lastMinute"`
+
+	// Ratio is Actual over Expected, 1 if no renewal is expected.
+	Ratio float64 `json:"ratio"`
+}
+
+// expectedRenewals returns the renewals expected per minute: one every
+// RenewalInterval from each UP or STARTING instance not under maintenance.
+func (s *Server) expectedRenewals() float64 {
+	if s.RenewalInterval <= 0 {
+		return 0
+	}
+	now := time.Now()
+	n := 0
+	for _, app := range s.snapshot().Applications {
+		for _, inst := range app.Instances {
+			if (inst.Status == UP || inst.Status == STARTING || inst.Status == DRAINING) && !inst.static && app.maintenanceEnd(inst, now).IsZero() {
+				n++
+			}
+		}
+	}
+	return float64(n) * time.Minute.Seconds() / s.RenewalInterval.Seconds()
+}
+
+// RenewalRate returns the renewals received in the last minute, along with
+// the ones expected.
+func (s *Server) RenewalRate() RenewalRate {
+	rate := RenewalRate{
+		Expected: s.expectedRenewals(),
+		Actual:   float64(s.renewals.lastMinute(time.Now())),
+		Ratio:    1,
+	}
+	if rate.Expected > 0 {
+		rate.Ratio = rate.Actual / rate.Expected
+	}
+	return rate
+}
+
+// publishRenewalRate publishes the renewal rate of the server in the
+// "renewals" expvar map.
+func (s *Server) publishRenewalRate() {
+	renewalVars.Set("expectedPerMinute", expvar.Func(func() interface{} {
+		return s.expectedRenewals()
+	}))
+	renewalVars.Set("lastMinute", expvar.Func(func() interface{} {
+		return s.renewals.lastMinute(time.Now())
+	}))
+}
+
+// Summary is an overview of the registry, for dashboards.
+type Summary struct {
+	// Applications is the number of applications registered.
+	Applications int `json:"applications"`
+
+	// Instances is the number of instances registered.
+	Instances int `json:"instances"`
+
+	// Statuses holds the number of instances in each status.
+	Statuses map[StatusType]int `json:"statuses"`
+
+	// Renewals compares the renewals received to the ones expected.
+	Renewals RenewalRate `json:"renewals"`
+}
+
+// summaryHandler is the HTTP handler for /summary.
+func (s *Server) summaryHandler(w http.ResponseWriter, r *http.Request) {
+	summary := Summary{Statuses: make(map[StatusType]int), Renewals: s.RenewalRate()}
+	for _, app := range s.snapshot().Applications {
+		summary.Applications++
+		for _, inst := range app.Instances {
+			summary.Instances++
+			summary.Statuses[inst.Status]++
+		}
+	}
+	data, err := encodeJSON(summary, isPretty(r))
+	writeBody(w, 200, data, err)
+}
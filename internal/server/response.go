@@ -0,0 +1,58 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// streamFlushEvery is the number of applications written between flushes
+// when streaming the catalog.
+const streamFlushEvery = 100
+
+// isPretty reports whether the request asked for indented JSON output.
+func isPretty(r *http.Request) bool {
+	return r.URL.Query().Get("pretty") == "true"
+}
+
+// encodeJSON returns the JSON encoding of v followed by a new line.
+// The output is indented if pretty is set.
+func encodeJSON(v interface{}, pretty bool) ([]byte, error) {
+	var data []byte
+	var err error
+	if pretty {
+		data, err = json.MarshalIndent(v, "", "  ")
+	} else {
+		data, err = json.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// location returns the path of a resource as seen by the client. Behind a
+// reverse proxy serving the API under another path, the prefix it sends in
+// X-Forwarded-Prefix is added. Prefixes which are not an absolute path are
+// ignored, so they cannot point the client to another host.
+func location(r *http.Request, path string) string {
+	prefix := strings.TrimSuffix(r.Header.Get("X-Forwarded-Prefix"), "/")
+	if !strings.HasPrefix(prefix, "/") || strings.HasPrefix(prefix, "//") {
+		return path
+	}
+	return prefix + path
+}
+
+// writeBody writes an encoded JSON response with the status code to w.
+// If err is set a 500 error is written instead.
+func writeBody(w http.ResponseWriter, code int, data []byte, err error) {
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(code)
+	w.Write(data)
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/numercfd/registro/model"
+)
+
+// RolloutState represents the progress of a Rollout.
+type RolloutState = model.RolloutState
+
+const (
+	// RolloutRunning is a rollout shifting traffic at every interval.
+	RolloutRunning = model.RolloutRunning
+
+	// RolloutPaused is a rollout kept at its current weight.
+	RolloutPaused = model.RolloutPaused
+
+	// RolloutCompleted is a rollout which reached 100%. Its target group
+	// became the app active group.
+	RolloutCompleted = model.RolloutCompleted
+
+	// RolloutAborted is a rollout stopped by an operator. Traffic is back
+	// to the original group.
+	RolloutAborted = model.RolloutAborted
+)
+
+// Rollout gradually shifts traffic from a deployment group to another.
+// A Rollout is replaced on every change, never modified in place, as
+// catalog copies of the app share it.
+type Rollout = model.Rollout
+
+// rolloutInterval returns the time between steps of r.
+func rolloutInterval(r *Rollout) time.Duration {
+	return time.Duration(r.Interval * float64(time.Second))
+}
+
+// checkRollout reports whether the To instances are healthy enough for the
+// rollout to move on. If not, the reason is returned.
+func checkRollout(app *Application, r *Rollout) (bool, string) {
+	var n int
+	var cpu float64
+	for _, inst := range app.Instances {
+		if inst.DeploymentGroup != r.To {
+			continue
+		}
+		if inst.Status != UP {
+			return false, fmt.Sprintf("instance %s is %s", inst.Id, inst.Status)
+		}
+		if inst.Vitals != nil {
+			cpu += inst.Vitals.CPU
+		}
+		n++
+	}
+	if n == 0 {
+		return false, fmt.Sprintf("group %s has no instances", r.To)
+	}
+	if r.MaxCPU > 0 && cpu/float64(n) > r.MaxCPU {
+		return false, fmt.Sprintf("group %s average cpu is %.2f", r.To, cpu/float64(n))
+	}
+	return true, ""
+}
+
+// setRollout replaces the app rollout, scheduling its next step if it is
+// running. It must be called with s.mu held.
+func (s *Server) setRollout(app *Application, r *Rollout) {
+	app.Rollout = r
+	s.publish(app)
+	if r.State == RolloutRunning {
+		time.AfterFunc(rolloutInterval(r), func() { s.advanceRollout(app, r) })
+	}
+}
+
+// advanceRollout moves the rollout to its next step if the To instances
+// are healthy, or holds it until the next interval otherwise.
+func (s *Server) advanceRollout(app *Application, r *Rollout) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.GetApplication(app.Name) != app || app.Rollout != r || r.State != RolloutRunning {
+		// Rollout has been replaced, paused or its app deleted.
+		return
+	}
+
+	next := *r
+	ok, reason := checkRollout(app, r)
+	if s.ReadOnly().Enabled {
+		ok, reason = false, "registry is read-only"
+	}
+	if !ok {
+		next.Reason = reason
+		log.Printf("rollout of app %s held at %g%%: %s", app.Name, r.Weight, reason)
+		s.setRollout(app, &next)
+		return
+	}
+
+	next.Step++
+	next.Weight = next.Steps[next.Step]
+	next.Reason = ""
+	if next.Step == len(next.Steps)-1 {
+		next.State = RolloutCompleted
+		app.ActiveGroup = next.To
+		s.record(PutApplication, app, nil)
+	}
+	log.Printf("rollout of app %s to group %s at %g%%", app.Name, next.To, next.Weight)
+	s.setRollout(app, &next)
+}
+
+// rolloutHandler is the HTTP handler for /registro/admin/rollouts/{appName}.
+// PUT starts a rollout, PATCH pauses or resumes it and DELETE aborts it.
+func (s *Server) rolloutHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["appName"]
+	if r.Method == "GET" {
+		app := s.snapshot().GetApplication(name)
+		if app == nil || app.Rollout == nil {
+			w.WriteHeader(404)
+			return
+		}
+		data, err := encodeJSON(app.Rollout, isPretty(r))
+		writeBody(w, 200, data, err)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app := s.GetApplication(name)
+	if app == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		if app.Rollout.Active() {
+			w.WriteHeader(409)
+			return
+		}
+
+		ro := new(Rollout)
+		if err := json.Unmarshal(body, ro); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		if err := ro.Validate(); err != nil {
+			log.Printf("invalid rollout of app %s: %s", app.Name, err)
+			w.WriteHeader(400)
+			return
+		}
+		ro.Step, ro.Weight, ro.State, ro.Reason = 0, ro.Steps[0], RolloutRunning, ""
+		s.setRollout(app, ro)
+		log.Printf("rollout of app %s from group %s to %s started at %g%%", app.Name, ro.From, ro.To, ro.Weight)
+		w.WriteHeader(201)
+	case "PATCH":
+		var request struct {
+			Paused bool `json:"paused"`
+		}
+		if err := json.Unmarshal(body, &request); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		if !app.Rollout.Active() {
+			w.WriteHeader(409)
+			return
+		}
+
+		next := *app.Rollout
+		next.State = RolloutRunning
+		if request.Paused {
+			next.State = RolloutPaused
+		}
+		if next.State != app.Rollout.State {
+			s.setRollout(app, &next)
+			log.Printf("rollout of app %s is now %s", app.Name, next.State)
+		}
+		w.WriteHeader(204)
+	case "DELETE":
+		if !app.Rollout.Active() {
+			w.WriteHeader(409)
+			return
+		}
+
+		next := *app.Rollout
+		next.State, next.Weight = RolloutAborted, 0
+		s.setRollout(app, &next)
+		log.Printf("rollout of app %s aborted", app.Name)
+		w.WriteHeader(204)
+	default:
+		w.WriteHeader(405)
+	}
+}
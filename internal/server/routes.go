@@ -0,0 +1,441 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/numercfd/registro/model"
+)
+
+// route is an endpoint of the REST API. Routes are registered in the order
+// they appear in routes, and their operations document the API.
+type route struct {
+	// Path is the path template matched by the router.
+	Path string
+
+	// Handler handles every request to the path.
+	Handler func(s *Server, w http.ResponseWriter, r *http.Request)
+
+	// Operations holds the methods accepted on the path.
+	Operations []operation
+
+	// Timeout is the deadline of requests to the route. Zero uses the
+	// server RequestTimeout.
+	Timeout time.Duration
+
+	// Stream is set for long lived requests, which have no deadline and
+	// are not subject to load shedding.
+	Stream bool
+
+	// Signed is set for the catalog routes, whose responses to GET are
+	// signed by the server Signer.
+	Signed bool
+
+	// Public is set for the routes served without a token, such as health
+	// checks, see Server.Tokens.
+	Public bool
+}
+
+// operation documents a method accepted by a route.
+type operation struct {
+	Method  string
+	Summary string
+
+	// Scope is the permission required. If empty, routes under
+	// /registro/admin require AdminScope, GET requires DiscoverScope and
+	// other methods RegisterScope.
+	Scope Scope
+
+	// Query holds the query parameters accepted, and their description.
+	Query map[string]string
+
+	// Request is a value of the type expected in the request body, if any.
+	Request interface{}
+
+	// Status is the status code of a successful response.
+	Status int
+
+	// Response is a value of the type returned in the response body, if any.
+	Response interface{}
+}
+
+// methods returns the methods accepted on the route.
+func (rt route) methods() []string {
+	var methods []string
+	for _, op := range rt.Operations {
+		methods = append(methods, op.Method)
+		if op.Method == "GET" {
+			methods = append(methods, "HEAD")
+		}
+	}
+	return append(methods, "OPTIONS")
+}
+
+// allow returns the methods accepted on the route, for the Allow header.
+func (rt route) allow() string {
+	return strings.Join(rt.methods(), ", ")
+}
+
+// scope returns the permission required by the method on the route.
+// It returns an empty Scope if the method is not accepted.
+func (rt route) scope(method string) Scope {
+	if method == "HEAD" || method == "OPTIONS" {
+		method = "GET"
+	}
+	for _, op := range rt.Operations {
+		if op.Method != method {
+			continue
+		}
+		switch {
+		case op.Scope != "":
+			return op.Scope
+		case strings.HasPrefix(rt.Path, "/registro/admin/"):
+			return AdminScope
+		case method == "GET":
+			return DiscoverScope
+		default:
+			return RegisterScope
+		}
+	}
+	return ""
+}
+
+// register adds the route to router, wrapped by the server middlewares,
+// under the prefix of every API version if it is versioned. Requests to the
+// path with a method not accepted are answered with 405 and the methods
+// allowed.
+func (rt route) register(s *Server, router *mux.Router) {
+	handler := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rt.serve(s, w, r)
+	}), s.Middleware...)
+	notAllowed := chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Allow", rt.allow())
+		w.WriteHeader(405)
+	}), s.Middleware...)
+
+	if !strings.HasPrefix(rt.Path, basePrefix) {
+		router.Handle(rt.Path, withRoute(rt, "", s.withClientIP(s.withTimeout(rt, handler)))).Methods(rt.methods()...)
+		router.Handle(rt.Path, withRoute(rt, "", s.withClientIP(notAllowed)))
+		return
+	}
+	for _, v := range apiVersions {
+		router.Handle(v.path(rt.Path), v.adapt(withRoute(rt, v.Name, s.withClientIP(s.withTimeout(rt, handler))))).Methods(rt.methods()...)
+		router.Handle(v.path(rt.Path), v.adapt(withRoute(rt, v.Name, s.withClientIP(notAllowed))))
+	}
+}
+
+// serve handles a request to the route. HEAD is handled as GET, with the
+// body discarded by net/http, and OPTIONS replies with the methods allowed.
+func (rt route) serve(s *Server, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "OPTIONS":
+		w.Header().Set("Allow", rt.allow())
+		w.WriteHeader(204)
+		return
+	case "HEAD":
+		get := *r
+		get.Method = "GET"
+		r = &get
+	}
+	if s.rejectReadOnly(rt, w, r) {
+		return
+	}
+	rt.Handler(s, w, r)
+}
+
+// dryRunQuery describes the dryRun parameter of the changes supporting it.
+const dryRunQuery = "only validate the change and answer 200 with a DryRun of it when true"
+
+// routes holds every endpoint of the REST API. Routes with a suffix come
+// first, as {instanceId} also matches them.
+var routes = []route{
+	{
+		Path:    "/registro/1.0/apps/{appName}:restore",
+		Handler: (*Server).restoreAppHandler,
+		Operations: []operation{
+			{Method: "POST", Summary: "Restore a deleted application", Status: 204},
+		},
+	},
+	{
+		Path:    "/registro/1.0/apps/{appName}/{instanceId}:restore",
+		Handler: (*Server).restoreInstanceHandler,
+		Operations: []operation{
+			{Method: "POST", Summary: "Restore an out-of-service instance", Status: 204},
+		},
+	},
+	{
+		Path:    "/registro/1.0/apps/{appName}:maintenance",
+		Handler: (*Server).maintenanceHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "List the maintenance windows of an application", Status: 200, Response: struct {
+				Maintenance []*Maintenance `json:"maintenance"`
+			}{}},
+			{Method: "POST", Summary: "Declare a maintenance window", Request: &Maintenance{}, Status: 201},
+			{Method: "DELETE", Summary: "End every maintenance window", Status: 204},
+		},
+	},
+	{
+		Path:    "/registro/1.0/apps/{appName}:activeGroup",
+		Handler: (*Server).activeGroupHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show the active deployment group", Status: 200, Response: activeGroup{}},
+			{Method: "PUT", Summary: "Switch the active deployment group", Request: activeGroup{}, Status: 204},
+		},
+	},
+	{
+		Path:    "/registro/1.0/apps/{appName}/pick",
+		Handler: (*Server).pickHandler,
+		Signed:  true,
+		Operations: []operation{
+			{Method: "GET", Summary: "Pick an available instance", Query: map[string]string{
+				"strategy": "round-robin (default), least-loaded or affinity",
+				"consumer": "identity of the consumer, sticking to an instance with the affinity strategy",
+				"zone":     "only pick instances with this zone metadata",
+				"group":    "only pick instances of this deployment group",
+			}, Status: 200, Response: &model.Instance{}},
+		},
+	},
+	{
+		Path:    "/registro/1.0/apps/{appName}/hashring",
+		Handler: (*Server).hashRingHandler,
+		Signed:  true,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show the consistent hash ring of the available instances", Query: map[string]string{
+				"vnodes": "points of every instance on the ring (the server default if unset)",
+				"group":  "only place instances of this deployment group",
+			}, Status: 200, Response: &model.HashRing{}},
+		},
+	},
+	{
+		Path:    "/registro/1.0/apps",
+		Handler: (*Server).listAppsHandler,
+		Signed:  true,
+		Operations: []operation{
+			{Method: "GET", Summary: "List applications", Query: map[string]string{
+				"group":   "deployment group of the instances listed, * for all",
+				"stream":  "write one application at a time when true",
+				"deleted": "list the deleted applications instead when true",
+				"pretty":  "indent the response when true",
+			}, Status: 200, Response: model.AppList{}},
+			{Method: "POST", Summary: "Create an application", Request: struct {
+				Name        string     `json:"name"`
+				MinHealthy  int        `json:"minHealthyInstances,omitempty"`
+				ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+				ExpiresIn   float64    `json:"expiresIn,omitempty"`
+				Environment string     `json:"environment,omitempty"`
+			}{}, Status: 201},
+		},
+	},
+	{
+		Path:    "/registro/1.0/apps/{appName}",
+		Handler: (*Server).viewAppHandler,
+		Signed:  true,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show an application", Query: map[string]string{
+				"group": "deployment group of the instances shown, * for all",
+			}, Status: 200, Response: &model.Application{}},
+			{Method: "POST", Summary: "Register an instance", Query: map[string]string{
+				"dryRun": dryRunQuery,
+			}, Request: model.Registration{}, Status: 201, Response: model.Lease{}},
+			{Method: "PATCH", Summary: "Update application settings", Query: map[string]string{
+				"dryRun": dryRunQuery,
+			}, Request: struct {
+				MinHealthy  int        `json:"minHealthyInstances"`
+				TTL         float64    `json:"ttl"`
+				ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+				ExpiresIn   float64    `json:"expiresIn,omitempty"`
+				Environment string     `json:"environment,omitempty"`
+			}{}, Status: 204},
+			{Method: "DELETE", Summary: "Delete an application", Query: map[string]string{
+				"force":  "ignore minHealthyInstances when true",
+				"dryRun": dryRunQuery,
+			}, Status: 204},
+		},
+	},
+	{
+		Path:    "/registro/1.0/apps/{appName}/{instanceId}",
+		Handler: (*Server).viewInstanceHandler,
+		Signed:  true,
+		// Heartbeats are worthless once the instance gave up waiting.
+		Timeout: 5 * time.Second,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show an instance", Status: 200, Response: &model.Instance{}},
+			{Method: "PUT", Summary: "Renew an instance lease", Request: &Vitals{}, Status: 204},
+			{Method: "PATCH", Summary: "Merge instance metadata", Query: map[string]string{
+				"dryRun": dryRunQuery,
+			}, Request: struct {
+				Metadata map[string]*string `json:"metadata"`
+			}{}, Status: 200, Response: &model.Instance{}},
+			{Method: "DELETE", Summary: "Put an instance out-of-service", Query: map[string]string{
+				"force":  "ignore minHealthyInstances when true",
+				"dryRun": dryRunQuery,
+			}, Status: 204},
+		},
+	},
+	{
+		Path:    "/registro/1.0/apps/{appName}/{instanceId}/metadata",
+		Handler: (*Server).metadataHandler,
+		Signed:  true,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show instance metadata", Status: 200, Response: map[string]string{}},
+			{Method: "PUT", Summary: "Replace instance metadata", Query: map[string]string{
+				"dryRun": dryRunQuery,
+			}, Request: map[string]string{}, Status: 204},
+		},
+	},
+	{
+		Path:    "/registro/1.0/conflicts",
+		Handler: (*Server).conflictsHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "List addresses shared by several instances", Status: 200, Response: struct {
+				Conflicts []*Conflict `json:"conflicts"`
+			}{}},
+		},
+	},
+	{
+		Path:    "/registro/1.0/stream",
+		Handler: (*Server).streamHandler,
+		Stream:  true,
+		Operations: []operation{
+			{Method: "POST", Summary: "Open an agent stream, multiplexing renewals, status changes and watches (see model.FrameType)", Status: 200},
+		},
+	},
+	{
+		Path:    "/registro/1.0/watch",
+		Handler: (*Server).watchHandler,
+		Stream:  true,
+		Operations: []operation{
+			{Method: "GET", Summary: "Stream the changes of apps and their events as server-sent events", Query: map[string]string{
+				"app":      "application watched, may be repeated (every app if unset)",
+				"consumer": "identity of the consumer, ordering the instances by affinity",
+				"zone":     "zone of the consumer, ordering the instances with this zone metadata first",
+			}, Status: 200},
+		},
+	},
+	{
+		Path:    "/registro/1.0/keys",
+		Handler: (*Server).keysHandler,
+		Public:  true,
+		Operations: []operation{
+			{Method: "GET", Summary: "List the public keys signing the catalog responses", Status: 200, Response: model.JWKSet{}},
+		},
+	},
+	{
+		Path:    "/registro/1.0/events/history",
+		Handler: (*Server).historyHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "List past events", Query: map[string]string{
+				"app":   "application of the events",
+				"type":  "type of the events, e.g. instance-evicted",
+				"since": "only events after this time, RFC 3339 or unix seconds",
+			}, Status: 200, Response: struct {
+				Events []Event `json:"events"`
+			}{}},
+		},
+	},
+	{
+		Path:    "/registro/1.0/summary",
+		Handler: (*Server).summaryHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show an overview of the registry", Status: 200, Response: Summary{}},
+		},
+	},
+	{
+		Path:    "/registro/admin/rollouts/{appName}",
+		Handler: (*Server).rolloutHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show the rollout of an application", Status: 200, Response: &Rollout{}},
+			{Method: "PUT", Summary: "Start a rollout", Request: &Rollout{}, Status: 201},
+			{Method: "PATCH", Summary: "Pause or resume a rollout", Request: struct {
+				Paused bool `json:"paused"`
+			}{}, Status: 204},
+			{Method: "DELETE", Summary: "Abort a rollout", Status: 204},
+		},
+	},
+	{
+		Path:    "/registro/admin/evictions/preview",
+		Handler: (*Server).evictionPreviewHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "List the instances evicted soon if none renewed", Query: map[string]string{
+				"within":          "seconds ahead covered by the preview (60 by default)",
+				"evictionTimeout": "eviction timeout assumed, in seconds (the server one by default)",
+			}, Status: 200, Response: EvictionPreview{}},
+		},
+	},
+	{
+		Path:    "/registro/admin/usage",
+		Handler: (*Server).usageHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show the requests and bytes transferred by route and client", Status: 200, Response: UsageReport{}},
+		},
+	},
+	{
+		Path:    "/registro/admin/consumers",
+		Handler: (*Server).consumersHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show the most polled and watched applications, and by which consumers", Query: map[string]string{
+				"app": "only show this application (* for the listings of every app)",
+				"top": "only show this number of applications",
+			}, Status: 200, Response: ConsumersReport{}},
+		},
+	},
+	{
+		Path:    "/registro/admin/clock-skew",
+		Handler: (*Server).clockSkewHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "List the instances whose clock is skewed", Status: 200, Response: SkewReport{}},
+		},
+	},
+	{
+		Path:    "/registro/admin/readonly",
+		Handler: (*Server).readOnlyHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show whether the registry is read-only", Status: 200, Response: ReadOnly{}},
+			{Method: "PUT", Summary: "Enable or disable the read-only mode", Request: ReadOnly{}, Status: 204},
+		},
+	},
+	{
+		Path:    "/registro/admin/shards",
+		Handler: (*Server).shardsHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show the nodes of a sharded registry", Status: 200, Response: ShardMembership{}},
+			{Method: "PUT", Summary: "Change the nodes of a sharded registry, moving the apps to their new owners", Request: ShardMembership{}, Status: 204},
+		},
+	},
+	{
+		Path:    "/registro/admin/shards/handoff",
+		Handler: (*Server).handoffHandler,
+		Operations: []operation{
+			{Method: "POST", Summary: "Receive an application handed off by another node", Request: appRecord{}, Status: 201},
+		},
+	},
+	{
+		Path:    "/readyz",
+		Handler: (*Server).readyHandler,
+		Public:  true,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show whether the warm-up is over", Status: 200, Response: Readiness{}},
+		},
+	},
+	{
+		Path:    "/registro/admin/archived",
+		Handler: (*Server).archivedHandler,
+		Operations: []operation{
+			{Method: "GET", Summary: "List archived applications", Status: 200, Response: model.AppList{}},
+		},
+	},
+}
+
+func init() {
+	// Added here, as the document is built from routes itself.
+	routes = append(routes, route{
+		Path:    "/registro/openapi.json",
+		Handler: (*Server).openAPIHandler,
+		Public:  true,
+		Operations: []operation{
+			{Method: "GET", Summary: "Show this OpenAPI document", Status: 200},
+		},
+	})
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// testMethods are the methods sent to every route.
+var testMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+
+func TestRouteMethods(t *testing.T) {
+	params := strings.NewReplacer("{appName}", "app0", "{instanceId}", "i-0")
+	for _, rt := range routes {
+		allowed := make(map[string]bool)
+		for _, m := range rt.methods() {
+			allowed[m] = true
+		}
+		paths := make(map[string]bool)
+		for _, v := range apiVersions {
+			paths[params.Replace(v.path(rt.Path))] = true
+		}
+
+		for path := range paths {
+			for _, method := range testMethods {
+				if rt.Stream && allowed[method] && method != "OPTIONS" {
+					// Streams do not end until the client leaves.
+					continue
+				}
+
+				// Every request goes to a server of its own, as the
+				// methods allowed may change or remove the app.
+				s := NewServer("")
+				populate(s, 1, 1)
+				rec := httptest.NewRecorder()
+				s.Handler().ServeHTTP(rec, httptest.NewRequest(method, path, nil))
+
+				switch {
+				case method == "OPTIONS":
+					if rec.Code != 204 || rec.Header().Get("Allow") != rt.allow() {
+						t.Errorf("OPTIONS %s: got %d allowing %q, want 204 allowing %q", path, rec.Code, rec.Header().Get("Allow"), rt.allow())
+					}
+				case !allowed[method]:
+					if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != rt.allow() {
+						t.Errorf("%s %s: got %d allowing %q, want 405 allowing %q", method, path, rec.Code, rec.Header().Get("Allow"), rt.allow())
+					}
+				case rec.Code == http.StatusMethodNotAllowed:
+					t.Errorf("%s %s: got 405, but %s is allowed", method, path, method)
+				}
+			}
+		}
+	}
+}
+
+func TestUnknownPath(t *testing.T) {
+	h := NewServer("").Handler()
+	for _, path := range []string{"/registro/1.0/nothing", "/registro/3.0/apps", "/registro/admin/nothing"} {
+		for _, method := range testMethods {
+			if rec := do(h, method, path, ""); rec.Code != 404 {
+				t.Errorf("%s %s: got %d, want 404", method, path, rec.Code)
+			}
+		}
+	}
+}
+
+func TestRoutesReserveIds(t *testing.T) {
+	// Routes under an app would be taken for the instance of their name.
+	const prefix = "/registro/1.0/apps/{appName}/"
+	for _, rt := range routes {
+		if name := strings.TrimPrefix(rt.Path, prefix); name != rt.Path && !strings.Contains(name, "{") {
+			if err := checkInstanceId(name); err == nil {
+				t.Errorf("instance id %q is not reserved for %s", name, rt.Path)
+			}
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package server
+
+import (
+	"container/heap"
+	"log"
+	"time"
+
+	"github.com/numercfd/registro/systemd"
+)
+
+// expiry is the next point in time where an instance must be checked.
+type expiry struct {
+	at    time.Time
+	app   *Application
+	inst  *Instance
+	index int
+}
+
+// expiryQueue is a min-heap of expiries ordered by time, holding at most
+// one entry per instance. It implements heap.Interface.
+type expiryQueue []*expiry
+
+func (q expiryQueue) Len() int           { return len(q) }
+func (q expiryQueue) Less(i, j int) bool { return q[i].at.Before(q[j].at) }
+
+func (q expiryQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *expiryQueue) Push(x interface{}) {
+	e := x.(*expiry)
+	e.index = len(*q)
+	*q = append(*q, e)
+}
+
+func (q *expiryQueue) Pop() interface{} {
+	old := *q
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return e
+}
+
+// schedule queues the instance to be checked at its next deadline, replacing
+// any previous entry. It must be called with s.mu held.
+func (s *Server) schedule(app *Application, inst *Instance) {
+	s.scheduleAt(app, inst, s.States.NextDeadline(inst))
+}
+
+// scheduleAt queues the instance to be checked at the specified time,
+// replacing any previous entry. Static instances are never checked. It must
+// be called with s.mu held.
+func (s *Server) scheduleAt(app *Application, inst *Instance, at time.Time) {
+	if inst.static {
+		return
+	}
+	next := s.nextExpiry()
+	if e := inst.expiry; e != nil {
+		e.at = at
+		heap.Fix(&s.expiries, e.index)
+	} else {
+		inst.expiry = &expiry{at: at, app: app, inst: inst}
+		heap.Push(&s.expiries, inst.expiry)
+	}
+
+	if next.IsZero() || at.Before(next) {
+		// Wake the scheduler up so it can sleep until the new deadline.
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// unschedule removes the instance from the queue.
+// It must be called with s.mu held.
+func (s *Server) unschedule(inst *Instance) {
+	if e := inst.expiry; e != nil {
+		heap.Remove(&s.expiries, e.index)
+		inst.expiry = nil
+	}
+}
+
+// nextExpiry returns the time of the earliest expiry queued.
+// It returns the zero time if the queue is empty.
+func (s *Server) nextExpiry() time.Time {
+	if len(s.expiries) == 0 {
+		return time.Time{}
+	}
+	return s.expiries[0].at
+}
+
+// runScheduler applies the expiries as they are due. Instead of checking
+// every instance periodically it sleeps until the next deadline, so only
+// instances actually expiring are touched.
+func (s *Server) runScheduler() {
+	watchdog := systemd.WatchdogInterval() / 2
+	timer := time.NewTimer(0)
+	for {
+		select {
+		case <-timer.C:
+		case <-s.wake:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-s.stop:
+			timer.Stop()
+			return
+		}
+
+		s.mu.Lock()
+		next := s.expireDue(s.now())
+		s.mu.Unlock()
+
+		if watchdog > 0 {
+			// Feeding from this loop lets systemd restart a hung registry.
+			if err := systemd.Watchdog(); err != nil {
+				log.Printf("systemd watchdog error: %s", err)
+			}
+		}
+
+		wait := time.Minute
+		if !next.IsZero() {
+			wait = time.Until(next)
+		}
+		if watchdog > 0 && watchdog < wait {
+			wait = watchdog
+		}
+		timer.Reset(wait)
+	}
+}
+
+// expireDue checks the instances whose expiry is due by now, and returns the
+// time of the next expiry, zero if the queue is empty. It must be called
+// with s.mu held.
+func (s *Server) expireDue(now time.Time) time.Time {
+	for len(s.expiries) > 0 && !s.expiries[0].at.After(now) {
+		e := heap.Pop(&s.expiries).(*expiry)
+		e.inst.expiry = nil
+		s.checkInstance(e.app, e.inst)
+	}
+	return s.nextExpiry()
+}
+
+// now returns the current time, as told by the StateMachine.
+func (s *Server) now() time.Time {
+	return s.States.now()
+}
+
+// checkInstance applies lease expiration and eviction to a single instance
+// and schedules its next check. It must be called with s.mu held.
+func (s *Server) checkInstance(app *Application, inst *Instance) {
+	if app.GetInstance(inst.Id) != inst {
+		// Instance has already been removed.
+		return
+	}
+
+	defer s.publish(app)
+
+	if s.ReadOnly().Enabled {
+		// Renewals are rejected, so leases cannot be honored.
+		s.scheduleAt(app, inst, s.now().Add(s.States.RenewalTimeout))
+		return
+	}
+	if s.warmingUp() {
+		// Renewals are yet to arrive after a restart.
+		s.scheduleAt(app, inst, s.warm.until)
+		return
+	}
+	if end := app.maintenanceEnd(inst, s.now()); !end.IsZero() {
+		// Instances under maintenance are expected not to send heartbeats.
+		s.scheduleAt(app, inst, end)
+		return
+	}
+
+	status := inst.Status
+	s.States.ApplyDrain(app.Name, inst)
+	s.States.ApplyExpiration(app.Name, inst)
+	if s.States.ApplyEviction(app.Name, inst) {
+		app.removeInstance(inst)
+		s.record(DeleteInstance, app, inst)
+		s.checkStorm()
+		return
+	}
+	if inst.Status != status {
+		s.record(PutInstance, app, inst)
+	}
+	s.schedule(app, inst)
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+// fleetSizes are the numbers of instances the scheduler is benchmarked
+// with: checking instances must not cost more with more of them.
+var fleetSizes = []int{1000, 10000, 50000}
+
+// newFleet returns a server with n UP instances, in apps of a hundred,
+// scheduled in random order. Their leases were renewed one after the other
+// within the last two renewal timeouts, so half of them are expired.
+func newFleet(n int) *Server {
+	s := NewServer("")
+	s.States.Listeners = nil
+
+	now := time.Now()
+	step := 2 * s.States.RenewalTimeout / time.Duration(n)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var app *Application
+	var expiries []*expiry
+	for i := 0; i < n; i++ {
+		if i%100 == 0 {
+			app = NewApplication(fmt.Sprintf("app%d", i/100))
+			s.Applications = append(s.Applications, app)
+		}
+		inst := NewInstance(fmt.Sprintf("i-%d", i), "10.0.0.1", 8080+i%100)
+		app.Instances = append(app.Instances, inst)
+		s.States.ApplyRenewal(app.Name, inst)
+		inst.renewedAt = now.Add(-2 * s.States.RenewalTimeout).Add(step * time.Duration(i))
+		inst.leaseExpires = inst.renewedAt.Add(s.States.RenewalTimeout)
+		expiries = append(expiries, &expiry{app: app, inst: inst})
+	}
+	rand.New(rand.NewSource(1)).Shuffle(n, func(i, j int) { expiries[i], expiries[j] = expiries[j], expiries[i] })
+	for _, e := range expiries {
+		s.schedule(e.app, e.inst)
+	}
+	return s
+}
+
+func TestSchedulerExpiresInOrder(t *testing.T) {
+	s := newFleet(300)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Scheduling an instance again moves its entry.
+	inst := s.Applications[0].Instances[0]
+	s.States.ApplyRenewal(s.Applications[0].Name, inst)
+	s.schedule(s.Applications[0], inst)
+	if len(s.expiries) != 300 {
+		t.Fatalf("%d expiries queued for 300 instances", len(s.expiries))
+	}
+
+	var last time.Time
+	for len(s.expiries) > 0 {
+		e := heap.Pop(&s.expiries).(*expiry)
+		if e.at.Before(last) {
+			t.Fatalf("expiry at %s queued after the one at %s", e.at, last)
+		}
+		if e.at != s.States.NextDeadline(e.inst) {
+			t.Errorf("instance %s queued at %s, its deadline is %s", e.inst.Id, e.at, s.States.NextDeadline(e.inst))
+		}
+		last = e.at
+	}
+	if last != inst.leaseExpires {
+		t.Errorf("last expiry at %s, want the renewed lease at %s", last, inst.leaseExpires)
+	}
+}
+
+func BenchmarkCheckInstance(b *testing.B) {
+	for _, n := range fleetSizes {
+		b.Run(fmt.Sprintf("instances=%d", n), func(b *testing.B) {
+			s := newFleet(n)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// The earliest instance is checked, and queued again until
+				// its eviction.
+				s.mu.Lock()
+				e := heap.Pop(&s.expiries).(*expiry)
+				e.inst.expiry = nil
+				s.checkInstance(e.app, e.inst)
+				s.mu.Unlock()
+			}
+		})
+	}
+}
+
+func BenchmarkReschedule(b *testing.B) {
+	for _, n := range fleetSizes {
+		b.Run(fmt.Sprintf("instances=%d", n), func(b *testing.B) {
+			s := newFleet(n)
+			var insts []*Instance
+			for _, app := range s.Applications {
+				insts = append(insts, app.Instances...)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// Renewals move the deadline of an instance to the back.
+				inst := insts[i%n]
+				s.mu.Lock()
+				inst.leaseExpires = inst.leaseExpires.Add(s.States.RenewalTimeout)
+				s.schedule(inst.expiry.app, inst)
+				s.mu.Unlock()
+			}
+		})
+	}
+}
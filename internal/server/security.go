@@ -0,0 +1,108 @@
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"time"
+)
+
+// securityVars counts the security events emitted, by type.
+var securityVars = expvar.NewMap("security")
+
+const (
+	// AuthFailed is emitted when a request presents no valid token.
+	AuthFailed EventType = "auth-failed"
+
+	// TokenMisused is emitted when a request presents a token lacking the
+	// scope of its operation.
+	TokenMisused EventType = "token-misused"
+
+	// PolicyDenied is emitted when the server Policy denies a request.
+	PolicyDenied EventType = "policy-denied"
+
+	// AdminAction is emitted when a change is requested to the operations
+	// under /registro/admin, whatever its outcome.
+	AdminAction EventType = "admin-action"
+)
+
+// SecurityEvent describes a request of interest to security monitoring,
+// e.g. for ingestion by a SIEM. They are sent to the server
+// SecurityListeners, apart from the registry Events: they are about
+// clients rather than the catalog, and may be many.
+type SecurityEvent struct {
+	// Type is AuthFailed, TokenMisused, PolicyDenied, AdminAction or
+	// ClientBanned.
+	Type EventType `json:"type"`
+
+	// Severity ranks the event from 0 (lowest) to 10, as in CEF.
+	Severity int `json:"severity"`
+
+	// Address is the client address.
+	Address string `json:"address"`
+
+	// Client identifies the client banned by a ClientBanned.
+	Client string `json:"client,omitempty"`
+
+	// Token is the name of the token presented, if valid.
+	Token string `json:"token,omitempty"`
+
+	// Method and Path describe the request.
+	Method string `json:"method"`
+	Path   string `json:"path"`
+
+	// Status is the response status code.
+	Status int `json:"status"`
+
+	// Reason tells why the request was refused, if it was.
+	Reason string `json:"reason,omitempty"`
+
+	// Time is when the event happened.
+	Time time.Time `json:"time"`
+}
+
+// securitySeverity holds the Severity of the security events, by type.
+var securitySeverity = map[EventType]int{
+	AuthFailed:   5,
+	TokenMisused: 6,
+	PolicyDenied: 4,
+	AdminAction:  3,
+	ClientBanned: 8,
+}
+
+// securityEvent completes e with the request, and sends it to the server
+// SecurityListeners.
+func (s *Server) securityEvent(r *http.Request, e SecurityEvent) {
+	securityVars.Add(string(e.Type), 1)
+	if len(s.SecurityListeners) == 0 {
+		return
+	}
+	e.Severity = securitySeverity[e.Type]
+	e.Address = ClientIP(r)
+	e.Method = r.Method
+	e.Path = r.URL.Path
+	e.Time = time.Now()
+	if t := RequestToken(r); t != nil && e.Token == "" {
+		e.Token = t.Name
+	}
+	for _, l := range s.SecurityListeners {
+		l(e)
+	}
+}
+
+// auditAdmin is a Middleware emitting an AdminAction security event for
+// every change requested to the admin routes, with its response status.
+func (s *Server) auditAdmin(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if RequestRoute(r).Scope != AdminScope || r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+		if sw.code == 0 {
+			sw.code = 200
+		}
+		s.securityEvent(r, SecurityEvent{Type: AdminAction, Status: sw.code})
+	})
+}
@@ -0,0 +1,1034 @@
+// Package server provides REST server implementation for the Service Registry.
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/numercfd/registro/model"
+	"github.com/numercfd/registro/systemd"
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+}
+
+// NewServer returns a new server instance with the selected ListenAddr.
+func NewServer(addr string) *Server {
+	states := NewStateMachine()
+	states.Listeners = append(states.Listeners, logEvent)
+	s := &Server{
+		ListenAddr:             addr,
+		IdleTimeout:            2 * time.Minute,
+		Applications:           make([]*Application, 0),
+		States:                 states,
+		Durability:             BatchDurability,
+		FlushInterval:          5 * time.Second,
+		Duplicates:             WarnDuplicates,
+		DiscoveryTTL:           30 * time.Second,
+		RequestTimeout:         30 * time.Second,
+		WarmUpThreshold:        0.85,
+		RenewalInterval:        30 * time.Second,
+		EvictionStormThreshold: 10,
+		MaxEvents:              10000,
+		EventMaxAge:            7 * 24 * time.Hour,
+		WatchQueue:             256,
+		IdempotencyWindow:      10 * time.Minute,
+		MaxClockSkew:           5 * time.Second,
+		MaxIdempotencyKeys:     10000,
+		VirtualNodes:           model.DefaultVirtualNodes,
+		wake:                   make(chan struct{}, 1),
+		stop:                   make(chan struct{}),
+		closing:                make(chan struct{}),
+	}
+	s.Usage = NewUsage(nil)
+	s.Consumers = NewConsumers()
+	s.Lockout = NewLockout()
+	s.Middleware = []Middleware{s.recoverPanics, s.shedLoad, CountRequests, s.accountUsage, s.authenticate, s.isolateEnvironment, s.enforcePolicy, s.routeShards, s.accountConsumers, s.auditAdmin, s.idempotent, s.signResponses}
+	states.Listeners = append(states.Listeners, s.recordEvent, s.publishEvent)
+	s.catalog.Store(&catalog{Applications: make([]*Application, 0)})
+	return s
+}
+
+// Server represents a Service Register REST server.
+// It can be used by calling Serve.
+type Server struct {
+	// ListenAddr is the address for the listening socket. It may be the
+	// path of a unix domain socket, see UnixPrefix. Empty only listens to
+	// Listeners.
+	ListenAddr string
+
+	// Listeners holds other addresses served along with ListenAddr, such
+	// as a TLS port or an admin port bound to localhost.
+	Listeners []Listener
+
+	// IdleTimeout is how long keep-alive connections are kept open between
+	// requests. Instances renewing through the same connection avoid a new
+	// TCP handshake on every heartbeat.
+	IdleTimeout time.Duration
+
+	// Applications holds the list of apps registered. It is protected by
+	// the server lock: other packages must use Apps instead.
+	Applications []*Application
+
+	// States controls the status changes of every instance.
+	States *StateMachine
+
+	// Store persists the registry state. If nil, the state is only kept in
+	// memory and lost when the server stops.
+	Store Store
+
+	// Durability controls when changes are written to the Store.
+	Durability Durability
+
+	// FlushInterval is the time between writes of buffered changes.
+	FlushInterval time.Duration
+
+	// Middleware holds the middlewares wrapping every route, the first being
+	// the outermost. It must be set before Serve is called.
+	Middleware []Middleware
+
+	// RequestTimeout is the deadline of requests to routes without their
+	// own timeout, after which they are answered with 503. Zero sets no
+	// deadline.
+	RequestTimeout time.Duration
+
+	// Shedder, if set, limits the requests handled at once. It applies
+	// right after panics are recovered, so no work is spent on the requests
+	// it sheds. It must be set before Serve is called.
+	Shedder *LoadShedder
+
+	// Reporter, if set, receives the panics recovered while handling
+	// requests.
+	Reporter ErrorReporter
+
+	// MaxClockSkew is the clock skew above which instances are reported in
+	// /registro/admin/clock-skew. Zero disables the report.
+	MaxClockSkew time.Duration
+
+	// IdempotencyWindow is the time the responses to changes carrying an
+	// Idempotency-Key are replayed to retries. Zero disables it.
+	IdempotencyWindow time.Duration
+
+	// MaxIdempotencyKeys is the number of responses kept for
+	// IdempotencyWindow, the oldest being dropped first. Zero sets no limit.
+	MaxIdempotencyKeys int
+
+	// Tokens, if set, are the API tokens accepted: every request must then
+	// present one granting the scope of its operation.
+	Tokens []Token
+
+	// Lockout, if set, bans the clients failing to present a valid token
+	// too often.
+	Lockout *Lockout
+
+	// VirtualNodes is the default number of points of every instance on the
+	// hash rings of /apps/{appName}/hashring.
+	VirtualNodes int
+
+	// Shards, if set, partitions the catalog across the nodes of the
+	// registry. It must be set before Serve is called.
+	Shards *Shards
+
+	// StrictEnvironments requires the requests to the catalog to have an
+	// environment, named in the Registro-Environment header or pinned by
+	// their token, and hides the apps without an environment from them.
+	// Otherwise, requests without an environment see every app, and the
+	// apps without an environment are seen by every request.
+	StrictEnvironments bool
+
+	// SecurityListeners are called for every SecurityEvent, such as the
+	// authentication failures and the admin actions.
+	SecurityListeners []func(SecurityEvent)
+
+	// Policy, if set, decides whether requests are allowed.
+	Policy Policy
+
+	// PolicyFailOpen allows the requests the Policy fails to decide,
+	// rather than answering them with 503.
+	PolicyFailOpen bool
+
+	// TLSConfig is the TLS configuration of the listeners serving HTTPS,
+	// e.g. to meet compliance requirements. If nil, DefaultTLSConfig is.
+	TLSConfig *tls.Config
+
+	// Signer, if set, signs the catalog responses and watch events, whose
+	// public key is served at /registro/1.0/keys.
+	Signer *Signer
+
+	// Usage accounts the requests by route and client, shown in
+	// /registro/admin/usage. Nil disables the accounting.
+	Usage *Usage
+
+	// Consumers accounts the reads and watches of every app by consumer,
+	// shown in /registro/admin/consumers. Nil disables the accounting.
+	Consumers *Consumers
+
+	// ArchiveAfter is the time an application may have no instances before
+	// it is archived. Zero disables archival.
+	ArchiveAfter time.Duration
+
+	// PurgeAfter is the time an application may have no instances before
+	// it is removed. Zero disables it.
+	PurgeAfter time.Duration
+
+	// DiscoveryTTL is how long clients may reuse discovery responses. It is
+	// sent in the Cache-Control header, and may be overridden per app.
+	DiscoveryTTL time.Duration
+
+	// TrustedProxies holds the networks of the reverse proxies trusted to
+	// report the client address in X-Forwarded-For or X-Real-IP. See
+	// ClientIP.
+	TrustedProxies []*net.IPNet
+
+	// RenewalInterval is the time between renewals expected from each
+	// instance, used to compute the expected renewal rate.
+	RenewalInterval time.Duration
+
+	// WarmUp is the time after Serve is called during which instances are
+	// neither expired nor evicted, and /readyz is unready, as renewals are
+	// yet to arrive. Zero disables it.
+	WarmUp time.Duration
+
+	// WarmUpThreshold is the fraction of the instances restored from the
+	// Store which must renew to end the warm-up early.
+	WarmUpThreshold float64
+
+	// EvictionStormThreshold is the number of instances evicted within a
+	// minute which emits an EvictionStorm event. Zero disables it.
+	EvictionStormThreshold int
+
+	// MaxEvents is the number of events kept in the history. Zero disables
+	// the history.
+	MaxEvents int
+
+	// EventMaxAge is the time events are kept in the history. Zero keeps
+	// them regardless of their age.
+	EventMaxAge time.Duration
+
+	// WatchQueue is the number of changes queued for each watcher (agent
+	// streams and /watch). Watchers falling further behind are evicted.
+	WatchQueue int
+
+	// HeartbeatAddr is the UDP address accepting heartbeat packets (see
+	// model.Heartbeat), lighter than HTTP renewals for very large fleets.
+	// Empty disables it.
+	HeartbeatAddr string
+
+	// Static holds the apps whose instances are declared rather than
+	// registered. They are added by Serve.
+	Static []StaticApp
+
+	// Duplicates controls what happens when an instance registers with the
+	// address of another instance of the same app.
+	Duplicates DuplicatePolicy
+
+	// mu protects Applications and their instances.
+	mu sync.Mutex
+
+	// tombstones holds the deleted applications which may still be restored.
+	tombstones []*Application
+
+	// buffer holds changes waiting to be written to the Store.
+	buffer *writeBuffer
+
+	// history holds the latest events.
+	history eventHistory
+
+	// watchers fans out the changes to the watchers.
+	watchers hub
+
+	// idempotency holds the responses replayed to retries.
+	idempotency idempotencyCache
+
+	// renewals counts the renewals received in the last minute.
+	renewals rateCounter
+
+	// evictions counts the instances evicted in the last minute.
+	evictions rateCounter
+
+	// storming is set while evictions are above EvictionStormThreshold.
+	storming bool
+
+	// warm tracks the renewals expected during the warm-up.
+	warm warmUp
+
+	// httpServers holds the servers started by Serve, one per listener.
+	httpServers []*http.Server
+
+	// udp receives the heartbeats sent to HeartbeatAddr.
+	udp net.PacketConn
+
+	// stop is closed when the server shuts down.
+	stop chan struct{}
+
+	// closing is closed when the server starts shutting down, before
+	// waiting for the requests in flight, so long lived ones end.
+	closing chan struct{}
+
+	// readOnly holds the ReadOnly mode.
+	readOnly atomic.Value
+
+	// catalog holds the *catalog snapshot served to readers.
+	catalog atomic.Value
+
+	// picker balances the instances returned by the pick endpoint.
+	picker picker
+
+	// expiries holds the upcoming instance deadlines.
+	expiries expiryQueue
+
+	// wake signals the scheduler that an earlier deadline was queued.
+	wake chan struct{}
+
+	// chaos holds the faults injected, in binaries built with the chaos tag.
+	chaos chaos
+
+	// started runs Start once, and startErr holds its result.
+	started  sync.Once
+	startErr error
+
+	// handlerOnce builds the handler returned by Handler once.
+	handlerOnce sync.Once
+	handler     http.Handler
+}
+
+// Start restores the Store, then starts expiring, archiving and evicting
+// instances and apps. It is called by Serve, and must be called by programs
+// serving Handler with their own http.Server. Further calls return the
+// result of the first one.
+func (s *Server) Start() error {
+	s.started.Do(func() { s.startErr = s.start() })
+	return s.startErr
+}
+
+// start implements Start.
+func (s *Server) start() error {
+	s.publishRenewalRate()
+	s.publishUsage()
+	s.publishSkew()
+	s.publishLockout()
+
+	if s.Store != nil {
+		if err := s.restore(); err != nil {
+			return err
+		}
+		s.buffer = newWriteBuffer(s.Store, s.Durability)
+		go s.buffer.run(s.FlushInterval, s.stop, s.storageFailed)
+
+		if es, ok := s.Store.(EventStore); ok {
+			if err := s.restoreEvents(es); err != nil {
+				return err
+			}
+			go s.runEvents(es, s.FlushInterval)
+		}
+	}
+	s.mu.Lock()
+	s.startWarmUp()
+	serr := s.seed()
+	s.mu.Unlock()
+	if serr != nil {
+		return serr
+	}
+
+	go s.runScheduler()
+	go s.runJanitor()
+	return nil
+}
+
+// Handler returns the handler of the REST API and /debug/vars, for programs
+// serving it with their own http.Server, after Start. The Middleware must
+// be set before its first call.
+func (s *Server) Handler() http.Handler {
+	s.handlerOnce.Do(func() {
+		router := mux.NewRouter().StrictSlash(true)
+		for _, rt := range routes {
+			rt.register(s, router)
+		}
+		router.Handle("/debug/vars", expvar.Handler())
+		s.handler = s.withChaos(router)
+	})
+	return s.handler
+}
+
+// Serve start listening on ListenAddr for REST requests.
+func (s *Server) Serve() error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	listeners := s.listeners()
+	lns := make([]net.Listener, 0, len(listeners))
+	admin := false
+	for _, l := range listeners {
+		ln, err := listen(l.Addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		lns = append(lns, ln)
+		admin = admin || l.Admin
+		log.Printf("listening to %s", l)
+	}
+
+	if s.HeartbeatAddr != "" {
+		conn, err := net.ListenPacket("udp", s.HeartbeatAddr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		s.udp = conn
+		go s.serveHeartbeats(conn)
+		log.Printf("listening to heartbeats on udp %s", s.HeartbeatAddr)
+	}
+
+	// Only tell systemd we are ready after storage is restored and the
+	// listener is up.
+	if err := systemd.Ready(); err != nil {
+		log.Printf("systemd notify error: %s", err)
+	}
+
+	handler := s.Handler()
+	errs := make(chan error, len(listeners))
+	s.mu.Lock()
+	for i, l := range listeners {
+		h := handler
+		if admin && !l.Admin {
+			h = hideAdmin(h)
+		}
+
+		// Serve both HTTP/1.1 and HTTP/2, even without TLS (h2c), so
+		// heartbeats from a host may be multiplexed over a single
+		// connection.
+		srv := &http.Server{
+			Handler:           h,
+			ReadHeaderTimeout: 10 * time.Second,
+			IdleTimeout:       s.IdleTimeout,
+			TLSConfig:         s.tlsConfig(),
+			Protocols:         new(http.Protocols),
+		}
+		srv.Protocols.SetHTTP1(true)
+		srv.Protocols.SetHTTP2(true)
+		srv.Protocols.SetUnencryptedHTTP2(true)
+		s.httpServers = append(s.httpServers, srv)
+
+		l, ln := l, lns[i]
+		go func() { errs <- l.serve(srv, ln) }()
+	}
+	s.mu.Unlock()
+
+	err := <-errs
+	if err != http.ErrServerClosed {
+		// A listener failed, stop the others as well.
+		s.mu.Lock()
+		for _, srv := range s.httpServers {
+			srv.Close()
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Shutdown gracefully stops the server, writing any buffered change to the
+// Store. Serve returns http.ErrServerClosed once Shutdown is called.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	servers := s.httpServers
+	s.mu.Unlock()
+	close(s.closing)
+	if s.udp != nil {
+		s.udp.Close()
+	}
+
+	var err error
+	for _, srv := range servers {
+		if serr := srv.Shutdown(ctx); serr != nil {
+			err = serr
+		}
+	}
+	close(s.stop)
+
+	if s.buffer != nil {
+		if ferr := s.buffer.Flush(); ferr != nil {
+			log.Printf("storage flush error: %s", ferr)
+			err = ferr
+		}
+		if es, ok := s.Store.(EventStore); ok {
+			if ferr := s.flushEvents(es); ferr != nil {
+				log.Printf("event storage error: %s", ferr)
+				err = ferr
+			}
+		}
+		if cerr := s.Store.Close(); cerr != nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// restore loads the applications saved in the Store.
+func (s *Server) restore() error {
+	apps, err := s.Store.Load()
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, app := range apps {
+		for _, inst := range app.Instances {
+			app.generations[inst.Id] = inst.Generation
+			s.States.ApplyLoad(app.Name, inst)
+			s.schedule(app, inst)
+		}
+		s.Applications = append(s.Applications, app)
+		s.record(PutApplication, app, nil)
+		s.publish(app)
+	}
+	log.Printf("restored %d applications from storage", len(apps))
+	return nil
+}
+
+// record writes a change to the Store, if there is one.
+// It must be called with s.mu held.
+func (s *Server) record(typ ChangeType, app *Application, inst *Instance) {
+	if s.buffer == nil || (inst != nil && inst.static) {
+		return
+	}
+
+	c := Change{Type: typ, App: app.Name, ActiveGroup: app.ActiveGroup, MinHealthy: app.MinHealthy, TTL: app.TTL, Archived: app.Archived,
+		Environment: app.Environment, ExpiresAt: app.ExpiresAt}
+	if inst != nil {
+		i := *inst
+		i.expiry = nil
+		c.Instance = &i
+	}
+	if err := s.buffer.Add(c); err != nil {
+		s.storageFailed(err)
+	}
+}
+
+// GetApplication return the Application which has the coresponding name.
+// Return nil if no Application with this name has been found.
+func (s *Server) GetApplication(name string) *Application {
+	for _, app := range s.Applications {
+		if app.Name == name {
+			return app
+		}
+	}
+	return nil
+}
+
+// listAppsHandler is the HTTP handler for /apps
+func (s *Server) listAppsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		// List all applications registered to the server
+		if r.URL.Query().Get("deleted") == "true" {
+			s.listTombstones(w, r)
+			return
+		}
+		c := s.snapshot()
+		s.setCacheControl(w, c.Applications...)
+		if p, _ := requestProfile(r); p == NativeProfile && r.URL.Query().Get("stream") == "true" {
+			// Other profiles are not streamed.
+			streamApps(c, w, r)
+			return
+		}
+		if s.Shards != nil && !s.forwarded(r) {
+			s.listShardedApps(c, w, r)
+			return
+		}
+		listApps(c, w, r)
+	case "POST":
+		// Register a new application
+		app, err := newApp(w, r)
+		if err != nil {
+			log.Printf("%s", err)
+			return
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// Check if app already exists
+		if s.GetApplication(app.Name) != nil {
+			w.WriteHeader(409)
+			return
+		}
+
+		// Add application
+		s.Applications = append(s.Applications, app)
+		s.record(PutApplication, app, nil)
+		s.publish(app)
+		w.WriteHeader(201)
+		log.Printf("new application created: %s", app.Name)
+	default:
+		// Unsuported method
+		w.WriteHeader(405)
+	}
+}
+
+// listApps writes the list of applications to w.
+func listApps(c *catalog, w http.ResponseWriter, r *http.Request) {
+	profile, ok := requestProfile(r)
+	if !ok {
+		w.WriteHeader(406)
+		return
+	}
+
+	group := r.URL.Query().Get("group")
+	env := environmentOf(r)
+	data, err := c.encode("apps?group="+group+"&profile="+string(profile)+"&environment="+env.Name, isPretty(r), func() interface{} {
+		apps := make([]*Application, 0, len(c.Applications))
+		for _, app := range c.Applications {
+			if !app.Archived && env.sees(app) {
+				apps = append(apps, app.inGroup(group))
+			}
+		}
+		return profile.list(appList(apps))
+	})
+	writeBody(w, 200, data, err)
+}
+
+// streamApps writes the list of applications to w one at a time.
+// Unlike listApps the response is never held in memory as a whole, which
+// avoids GC spikes when serving very large catalogs to bulk consumers.
+func streamApps(c *catalog, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	flusher, _ := w.(http.Flusher)
+
+	enc := json.NewEncoder(w)
+	if isPretty(r) {
+		enc.SetIndent("", "  ")
+	}
+
+	group := r.URL.Query().Get("group")
+	env := environmentOf(r)
+	io.WriteString(w, `{"applications":[`)
+	i := 0
+	for _, app := range c.Applications {
+		if app.Archived || !env.sees(app) {
+			continue
+		}
+		if i > 0 {
+			io.WriteString(w, ",")
+		}
+		if err := enc.Encode(app.inGroup(group).view()); err != nil {
+			// Headers are already sent, all we can do is stop.
+			log.Printf("stream error: %s", err)
+			return
+		}
+		if flusher != nil && i%streamFlushEvery == streamFlushEvery-1 {
+			flusher.Flush()
+		}
+		i++
+	}
+	io.WriteString(w, "]}\n")
+}
+
+// newApp return a new application from the r.Body.
+func newApp(w http.ResponseWriter, r *http.Request) (*Application, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return nil, err
+	}
+
+	// Unmarshal request and return
+	var request struct {
+		Name        string     `json:"name"`
+		MinHealthy  int        `json:"minHealthyInstances"`
+		ExpiresAt   *time.Time `json:"expiresAt"`
+		ExpiresIn   float64    `json:"expiresIn"`
+		Environment string     `json:"environment"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(400)
+		return nil, err
+	}
+	if err := checkAppName(request.Name); err != nil {
+		w.WriteHeader(400)
+		return nil, err
+	}
+	app := NewApplication(request.Name)
+	app.MinHealthy = request.MinHealthy
+
+	// Apps are created in the environment of the client by default, which
+	// may not create them in another.
+	app.Environment = request.Environment
+	if env := RequestEnvironment(r); env != "" {
+		if app.Environment != "" && app.Environment != env {
+			w.WriteHeader(403)
+			return nil, fmt.Errorf("app %s environment %s is not the client one, %s", app.Name, app.Environment, env)
+		}
+		app.Environment = env
+	}
+	if app.ExpiresAt, err = expiryTime(request.ExpiresAt, request.ExpiresIn); err != nil {
+		w.WriteHeader(400)
+		return nil, err
+	}
+	return app, nil
+}
+
+// checkAppName and checkInstanceId return an error if the name or id holds
+// a ':' or '/': paths hold them as a segment, followed by suffixes such as
+// :restore, which they would clash with.
+func checkAppName(name string) error {
+	if strings.ContainsAny(name, ":/") {
+		return fmt.Errorf("app name %q must not hold ':' or '/'", name)
+	}
+	return nil
+}
+
+func checkInstanceId(id string) error {
+	if strings.ContainsAny(id, ":/") {
+		return fmt.Errorf("instance id %q must not hold ':' or '/'", id)
+	}
+	if reservedIds[id] {
+		return fmt.Errorf("instance id %q is reserved", id)
+	}
+	return nil
+}
+
+// reservedIds are the instance ids taken by the routes under an app, such
+// as /apps/{appName}/pick.
+var reservedIds = map[string]bool{"pick": true, "hashring": true}
+
+// viewAppHandler is the HTTP handler for /apps/{appName}.
+func (s *Server) viewAppHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if r.Method == "GET" {
+		// Show app details from the catalog snapshot
+		c := s.snapshot()
+		app := c.GetApplication(vars["appName"])
+		if app == nil {
+			w.WriteHeader(404)
+			return
+		}
+		s.setCacheControl(w, app)
+		viewApp(c, app, w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app := s.GetApplication(vars["appName"])
+	if app == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		// New app instance
+		inst, err := newInstance(w, r)
+		if err != nil {
+			log.Printf("%s", err)
+			return
+		}
+		if old := app.GetInstance(inst.Id); old != nil && old.static {
+			// Static instances are only replaced by the configuration.
+			w.WriteHeader(409)
+			return
+		}
+		if !s.checkDuplicate(app, inst) {
+			w.WriteHeader(409)
+			return
+		}
+
+		gen, err := app.nextGeneration(inst.Id, inst.Generation)
+		if err != nil {
+			log.Printf("%s", err)
+			w.WriteHeader(409)
+			return
+		}
+		inst.Generation = gen
+		if isDryRun(r) {
+			after := inst.view()
+			after.LeaseRemaining = s.States.RenewalTimeout.Seconds()
+			if old := app.GetInstance(inst.Id); old != nil {
+				writeDryRun(w, r, "replace", old.view(), after)
+			} else {
+				writeDryRun(w, r, "create", nil, after)
+			}
+			return
+		}
+		app.generations[inst.Id] = gen
+
+		// Registering an existing instance replaces it, revoking the lease
+		// held by the previous registrant (e.g. a process that crashed).
+		if old := app.GetInstance(inst.Id); old != nil {
+			app.removeInstance(old)
+			s.unschedule(old)
+			log.Printf("instance %s of app %s registered again, previous lease revoked", inst.Id, app.Name)
+		}
+
+		// Add instance
+		app.Instances = append(app.Instances, inst)
+		s.States.ApplyRegistration(app.Name, inst)
+		s.warmedUp(app, inst)
+		s.schedule(app, inst)
+		s.record(PutInstance, app, inst)
+		s.publish(app)
+
+		response := model.Lease{
+			Instance:      inst.view(),
+			LeaseId:       inst.LeaseId,
+			LeaseDuration: s.States.RenewalTimeout.Seconds(),
+		}
+		data, err := encodeJSON(response, isPretty(r))
+		w.Header().Set("Location", apiPath(r, "/apps/"+app.Name+"/"+inst.Id))
+		writeBody(w, 201, data, err)
+	case "PATCH":
+		// Update app settings
+		s.patchApp(app, w, r)
+	case "DELETE":
+		// Delete app, keeping a tombstone
+		if !checkFloor(app, app.healthy(), r) {
+			w.WriteHeader(409)
+			return
+		}
+		if isDryRun(r) {
+			writeDryRun(w, r, "delete", app.view(), nil)
+			return
+		}
+		s.deleteApp(app, w, r)
+	}
+}
+
+// viewApp writes the app details to w.
+func viewApp(c *catalog, app *Application, w http.ResponseWriter, r *http.Request) {
+	profile, ok := requestProfile(r)
+	if !ok {
+		w.WriteHeader(406)
+		return
+	}
+
+	group := r.URL.Query().Get("group")
+	data, err := c.encode("apps/"+app.Name+"?group="+group+"&profile="+string(profile), isPretty(r), func() interface{} {
+		return profile.app(app.inGroup(group).view())
+	})
+	writeBody(w, 200, data, err)
+}
+
+// newInstance return a new application instance from r.Body.
+func newInstance(w http.ResponseWriter, r *http.Request) (*Instance, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return nil, err
+	}
+
+	var request model.Registration
+	if err := json.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(400)
+		return nil, err
+	}
+	if err := request.Validate(); err != nil {
+		w.WriteHeader(400)
+		return nil, err
+	}
+	if err := checkInstanceId(request.Id); err != nil {
+		w.WriteHeader(400)
+		return nil, err
+	}
+	if request.Id == "" {
+		request.Id = newInstanceId()
+	}
+	if ip := net.ParseIP(request.Ip); ip != nil {
+		// e.g. ::ffff:10.0.0.1 is stored as 10.0.0.1
+		request.Ip = ip.String()
+	}
+
+	inst := NewInstance(request.Id, request.Ip, request.Port)
+	inst.Generation = request.Generation
+	inst.Metadata = request.Metadata
+	inst.DeploymentGroup = request.Group
+	if request.PlannedTermination != nil {
+		inst.PlannedTermination = *request.PlannedTermination
+	}
+	return inst, nil
+}
+
+// viewInstanceHandler is the HTTP handler for /apps/{appName}/{instanceId}.
+func (s *Server) viewInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	if r.Method == "GET" {
+		// Show instance details from the catalog snapshot
+		var inst *Instance
+		app := s.snapshot().GetApplication(vars["appName"])
+		if app != nil {
+			inst = app.GetInstance(vars["instanceId"])
+		}
+		if inst == nil {
+			w.WriteHeader(404)
+			return
+		}
+		s.setCacheControl(w, app)
+		viewInstance(inst, w, r)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app := s.GetApplication(vars["appName"])
+	if app == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	inst := app.GetInstance(vars["instanceId"])
+	if inst == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if inst.static {
+		// Static instances are managed in the configuration.
+		w.WriteHeader(409)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		// Renew instance heartbeat
+		if code := checkLease(inst, r, true); code != 0 {
+			log.Printf("cannot renew instance %s: invalid lease", inst.Id)
+			w.WriteHeader(code)
+			return
+		}
+		s.renewInstance(app, inst, w, r)
+	case "DELETE":
+		// Put instance out-of-service
+		if code := checkLease(inst, r, false); code != 0 {
+			log.Printf("cannot delete instance %s: invalid lease", inst.Id)
+			w.WriteHeader(code)
+			return
+		}
+		// Instances deregistering themselves present their lease, others
+		// are admin operations kept above the app MinHealthy.
+		if r.Header.Get(LeaseHeader) == "" && inst.Status == UP && !checkFloor(app, 1, r) {
+			w.WriteHeader(409)
+			return
+		}
+		if isDryRun(r) {
+			if inst.Status != OUTOFSERVICE && !s.States.Allowed(inst.Status, OUTOFSERVICE) {
+				w.WriteHeader(409)
+				return
+			}
+			after := inst.view()
+			after.Status = OUTOFSERVICE
+			writeDryRun(w, r, "delete", inst.view(), after)
+			return
+		}
+		s.deleteInstance(app, inst, w, r)
+	case "PATCH":
+		// Update instance metadata
+		s.patchInstance(app, inst, w, r)
+	}
+}
+
+// viewInstance writes the instance details to w.
+func viewInstance(inst *Instance, w http.ResponseWriter, r *http.Request) {
+	profile, ok := requestProfile(r)
+	if !ok {
+		w.WriteHeader(406)
+		return
+	}
+
+	w.Header().Set("ETag", inst.ETag())
+	data, err := encodeJSON(profile.instance(mux.Vars(r)["appName"], inst.view()), isPretty(r))
+	writeBody(w, 200, data, err)
+}
+
+// renewInstance updates the instance heartbeat.
+// It also changes the status to UP, and stores the vitals in r.Body if any.
+// The application is only published if the instance status changed:
+// catalog copies read the rest from the instance, so heartbeats do not copy
+// the application.
+func (s *Server) renewInstance(app *Application, inst *Instance, w http.ResponseWriter, r *http.Request) {
+	vitals, err := readVitals(r)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+
+	var sent time.Time
+	if v := r.Header.Get(ClockHeader); v != "" {
+		if sent, err = time.Parse(time.RFC3339Nano, v); err != nil {
+			w.WriteHeader(400)
+			return
+		}
+	}
+	if err := s.renew(app, inst, vitals, sent); err != nil {
+		log.Printf("cannot renew instance %s: %s", inst.Id, err)
+		w.WriteHeader(403)
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// renew renews the instance lease, storing its vitals if any, and its
+// clock skew if the time the renewal was sent is known.
+// It must be called with s.mu held.
+func (s *Server) renew(app *Application, inst *Instance, vitals *Vitals, sent time.Time) error {
+	status := inst.Status
+	if err := s.States.ApplyRenewal(app.Name, inst); err != nil {
+		return err
+	}
+	if vitals != nil {
+		inst.Vitals = vitals
+	}
+	if !sent.IsZero() {
+		s.measureSkew(app, inst, sent)
+	}
+	s.renewals.add(time.Now())
+	s.warmedUp(app, inst)
+	s.schedule(app, inst)
+	if inst.Status != status {
+		s.record(PutInstance, app, inst)
+		s.publish(app)
+	} else {
+		s.record(RenewInstance, app, inst)
+		inst.shareRenewal()
+	}
+	return nil
+}
+
+// deleteInstance put an instance out-of-order.
+// If an instance is out-of-service it cannot be restarted and may be deleted after a time.
+func (s *Server) deleteInstance(app *Application, inst *Instance, w http.ResponseWriter, r *http.Request) {
+	if err := s.States.ApplyDelete(app.Name, inst); err != nil {
+		log.Printf("cannot delete instance %s: %s", inst.Id, err)
+		w.WriteHeader(409)
+		return
+	}
+	s.schedule(app, inst)
+	s.record(PutInstance, app, inst)
+	s.publish(app)
+	w.WriteHeader(204)
+}
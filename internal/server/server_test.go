@@ -0,0 +1,73 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// The registry logs every change, which would bury the test output.
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// populate registers apps with UP instances each, as registrations and
+// their first renewal do, but publishing every app once. Instances are
+// named after their rank.
+func populate(s *Server, apps, instances int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for a := 0; a < apps; a++ {
+		app := NewApplication(fmt.Sprintf("app%d", a))
+		s.Applications = append(s.Applications, app)
+		for i := 0; i < instances; i++ {
+			inst := NewInstance(fmt.Sprintf("i-%d", i), fmt.Sprintf("10.0.%d.%d", i/250, i%250), 8080)
+			app.Instances = append(app.Instances, inst)
+			s.States.ApplyRegistration(app.Name, inst)
+			s.States.ApplyRenewal(app.Name, inst)
+			s.schedule(app, inst)
+		}
+		s.publish(app)
+	}
+}
+
+// do sends a request to h, path being relative to /registro/1.0 unless it
+// starts with /registro/, with the headers given as name and value pairs.
+func do(h http.Handler, method, path, body string, header ...string) *httptest.ResponseRecorder {
+	if !strings.HasPrefix(path, "/registro/") {
+		path = basePrefix + strings.TrimPrefix(path, "/")
+	}
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	for i := 0; i+1 < len(header); i += 2 {
+		r.Header.Set(header[i], header[i+1])
+	}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, r)
+	return rec
+}
+
+// expect fails the test if rec has not the status code.
+func expect(tb testing.TB, rec *httptest.ResponseRecorder, code int) {
+	tb.Helper()
+	if rec.Code != code {
+		tb.Fatalf("got status %d, want %d: %s", rec.Code, code, rec.Body)
+	}
+}
+
+func TestReservedIds(t *testing.T) {
+	s := NewServer("")
+	populate(s, 1, 0)
+	h := s.Handler()
+	for id := range reservedIds {
+		expect(t, do(h, "POST", "/apps/app0", `{"id": "`+id+`", "ip": "10.0.0.1", "port": 8080}`), 400)
+	}
+}
@@ -0,0 +1,481 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/numercfd/registro/model"
+)
+
+// ShardHeader marks the requests sent by the nodes of a sharded registry to
+// one another, which are served by the node receiving them rather than
+// routed again. It is only honored from the TrustedProxies.
+const ShardHeader = "Registro-Shard"
+
+// shardVars counts the requests routed to other nodes and the apps handed
+// off to them.
+var shardVars = expvar.NewMap("shards")
+
+// NewShards returns the Shards of the node self among nodes.
+func NewShards(self string, nodes []string) (*Shards, error) {
+	sh := &Shards{Self: strings.TrimSuffix(self, "/"), Client: &http.Client{Timeout: 30 * time.Second}}
+	if err := sh.SetNodes(nodes); err != nil {
+		return nil, err
+	}
+	return sh, nil
+}
+
+// Shards partitions the catalog across the nodes of a registry, for
+// catalogs too large for a single node: every app is owned by a single
+// node, chosen by rendezvous hashing of its name, and any node routes the
+// requests about an app to its owner. Listing the apps gathers them from
+// every node. When the nodes change, the apps whose owner changed are
+// handed off to the new one, with their instances and leases.
+type Shards struct {
+	// Self is the URL of this node, as listed in the nodes, e.g.
+	// http://10.0.0.1:8080.
+	Self string
+
+	// Token, if set, is presented by this node to the other ones, on
+	// handoffs and membership changes. It must grant AdminScope.
+	Token string
+
+	// Client sends the requests to the other nodes, other than the ones
+	// routed.
+	Client *http.Client
+
+	// mu protects nodes and proxies.
+	mu sync.RWMutex
+
+	// nodes holds the URL of every node, sorted.
+	nodes []string
+
+	// proxies routes the requests to every other node.
+	proxies map[string]*httputil.ReverseProxy
+
+	// moving serializes the rebalances.
+	moving sync.Mutex
+}
+
+// ShardMembership describes the nodes of a sharded registry.
+type ShardMembership struct {
+	// Self is the URL of the node answering.
+	Self string `json:"self,omitempty"`
+
+	// Nodes holds the URL of every node.
+	Nodes []string `json:"nodes"`
+}
+
+// Nodes returns the URL of every node.
+func (sh *Shards) Nodes() []string {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return append([]string(nil), sh.nodes...)
+}
+
+// SetNodes replaces the nodes, which must include Self. The apps are not
+// moved: see Server.rebalance.
+func (sh *Shards) SetNodes(nodes []string) error {
+	seen := make(map[string]bool)
+	list := make([]string, 0, len(nodes))
+	proxies := make(map[string]*httputil.ReverseProxy)
+	for _, n := range nodes {
+		n = strings.TrimSuffix(strings.TrimSpace(n), "/")
+		if n == "" || seen[n] {
+			continue
+		}
+		u, err := url.Parse(n)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid node URL %q", n)
+		}
+		seen[n] = true
+		list = append(list, n)
+		if n != sh.Self {
+			proxies[n] = sh.newProxy(u)
+		}
+	}
+	if !seen[sh.Self] {
+		return fmt.Errorf("node %s is not one of the nodes", sh.Self)
+	}
+	sort.Strings(list)
+
+	sh.mu.Lock()
+	sh.nodes = list
+	sh.proxies = proxies
+	sh.mu.Unlock()
+	return nil
+}
+
+// newProxy returns the reverse proxy routing requests to the node at u.
+// Responses are flushed as they come, for watches.
+func (sh *Shards) newProxy(u *url.URL) *httputil.ReverseProxy {
+	p := httputil.NewSingleHostReverseProxy(u)
+	director := p.Director
+	p.Director = func(r *http.Request) {
+		director(r)
+		r.Header.Set(ShardHeader, sh.Self)
+	}
+	p.FlushInterval = -1
+	p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		log.Printf("shard routing error: %s", err)
+		shardVars.Add("routingErrors", 1)
+		data, err := encodeJSON(errorBody{Error: "node " + u.String() + " is unavailable"}, false)
+		writeBody(w, 502, data, err)
+	}
+	return p
+}
+
+// Owner returns the URL of the node owning the app: the one with the
+// highest model.AffinityScore for its name, so a node joining or leaving
+// only moves its share of the apps.
+func (sh *Shards) Owner(app string) string {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	var owner string
+	var best uint64
+	for _, n := range sh.nodes {
+		if score := model.AffinityScore(app, n); owner == "" || score > best {
+			owner, best = n, score
+		}
+	}
+	return owner
+}
+
+// proxy returns the reverse proxy routing requests to the node, nil if it
+// is not one of the nodes.
+func (sh *Shards) proxy(node string) *httputil.ReverseProxy {
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	return sh.proxies[node]
+}
+
+// send sends a request to the node, with the ShardHeader and the Token.
+func (sh *Shards) send(method, node, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest(method, node+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ShardHeader, sh.Self)
+	if sh.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+sh.Token)
+	}
+	return sh.Client.Do(req)
+}
+
+// forwarded reports whether the request was sent by another node.
+func (s *Server) forwarded(r *http.Request) bool {
+	return r.Header.Get(ShardHeader) != "" && s.trusted(remoteIP(r))
+}
+
+// shardKey returns the name of the app the request is about, if it is
+// about a single one: the {appName} of its route, the app registered by
+// POST /apps, or the app watched by /watch.
+func shardKey(r *http.Request) (string, bool) {
+	if name, ok := mux.Vars(r)["appName"]; ok {
+		return name, true
+	}
+	switch RequestRoute(r).Path {
+	case "/registro/1.0/apps":
+		if r.Method != "POST" {
+			return "", false
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return "", false
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		var app struct {
+			Name string `json:"name"`
+		}
+		if json.Unmarshal(body, &app) != nil || app.Name == "" {
+			return "", false
+		}
+		return app.Name, true
+	case "/registro/1.0/watch":
+		if apps := r.URL.Query()["app"]; len(apps) == 1 {
+			return apps[0], true
+		}
+	}
+	return "", false
+}
+
+// routeShards is a Middleware routing the requests about an app owned by
+// another node to it, when the registry is sharded.
+func (s *Server) routeShards(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sh := s.Shards
+		if sh == nil || s.forwarded(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name, ok := shardKey(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if p := sh.proxy(sh.Owner(name)); p != nil {
+			shardVars.Add("routed", 1)
+			p.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listShardedApps writes the list of applications of every node to w,
+// ordered by name. The other nodes are asked for their own apps, and a node
+// failing to answer fails the listing with 502 rather than leaving its apps
+// out.
+func (s *Server) listShardedApps(c *catalog, w http.ResponseWriter, r *http.Request) {
+	profile, ok := requestProfile(r)
+	if !ok {
+		w.WriteHeader(406)
+		return
+	}
+
+	group := r.URL.Query().Get("group")
+	env := environmentOf(r)
+	apps := make([]*Application, 0, len(c.Applications))
+	for _, app := range c.Applications {
+		if !app.Archived && env.sees(app) {
+			apps = append(apps, app.inGroup(group))
+		}
+	}
+	list := appList(apps)
+
+	for _, node := range s.Shards.Nodes() {
+		if node == s.Shards.Self {
+			continue
+		}
+		remote, err := s.Shards.listApps(node, group, r)
+		if err != nil {
+			log.Printf("error listing the apps of node %s: %s", node, err)
+			data, err := encodeJSON(errorBody{Error: "node " + node + " is unavailable"}, false)
+			writeBody(w, 502, data, err)
+			return
+		}
+		list.Apps = append(list.Apps, remote.Apps...)
+	}
+	sort.Slice(list.Apps, func(i, j int) bool { return list.Apps[i].Name < list.Apps[j].Name })
+
+	data, err := encodeJSON(profile.list(list), isPretty(r))
+	writeBody(w, 200, data, err)
+}
+
+// listApps returns the apps of the node in group, as seen by the client of
+// r, whose credentials and environment are passed along.
+func (sh *Shards) listApps(node, group string, r *http.Request) (model.AppList, error) {
+	var list model.AppList
+	req, err := http.NewRequest("GET", node+"/registro/1.0/apps?profile=native&group="+url.QueryEscape(group), nil)
+	if err != nil {
+		return list, err
+	}
+	req = req.WithContext(r.Context())
+	req.Header.Set(ShardHeader, sh.Self)
+	if v := r.Header.Get("Authorization"); v != "" {
+		req.Header.Set("Authorization", v)
+	}
+	if e := environmentOf(r); e.Name != "" {
+		req.Header.Set(EnvironmentHeader, e.Name)
+	}
+	resp, err := sh.Client.Do(req)
+	if err != nil {
+		return list, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return list, fmt.Errorf("node answered %s", resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	return list, err
+}
+
+// shardsHandler is the HTTP handler for /registro/admin/shards. A change of
+// the nodes is sent on to every other node, old and new, and the apps are
+// then moved to their new owners.
+func (s *Server) shardsHandler(w http.ResponseWriter, r *http.Request) {
+	sh := s.Shards
+	if sh == nil {
+		data, err := encodeJSON(errorBody{Error: "the registry is not sharded"}, false)
+		writeBody(w, 404, data, err)
+		return
+	}
+	if r.Method == "GET" {
+		data, err := encodeJSON(ShardMembership{Self: sh.Self, Nodes: sh.Nodes()}, isPretty(r))
+		writeBody(w, 200, data, err)
+		return
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	var request ShardMembership
+	if err := json.Unmarshal(body, &request); err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	old := sh.Nodes()
+	if err := sh.SetNodes(request.Nodes); err != nil {
+		data, err := encodeJSON(errorBody{Error: err.Error()}, false)
+		writeBody(w, 400, data, err)
+		return
+	}
+	log.Printf("shard nodes are now %s", strings.Join(sh.Nodes(), ", "))
+
+	if !s.forwarded(r) {
+		data, _ := json.Marshal(ShardMembership{Nodes: sh.Nodes()})
+		for _, node := range union(old, sh.Nodes()) {
+			if node == sh.Self {
+				continue
+			}
+			resp, err := sh.send("PUT", node, "/registro/admin/shards", data)
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode >= 300 {
+					err = fmt.Errorf("node answered %s", resp.Status)
+				}
+			}
+			if err != nil {
+				log.Printf("error sending the shard nodes to %s: %s", node, err)
+			}
+		}
+	}
+	go s.rebalance()
+	w.WriteHeader(204)
+}
+
+// union returns the strings of a and b, once each.
+func union(a, b []string) []string {
+	seen := make(map[string]bool)
+	var all []string
+	for _, s := range append(append([]string(nil), a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			all = append(all, s)
+		}
+	}
+	return all
+}
+
+// rebalance hands the apps owned by other nodes off to them. It runs after
+// every membership change, and on every janitor tick so failed handoffs are
+// retried. Changes reaching this node about an app while it is handed off
+// are lost, as the app is then removed.
+func (s *Server) rebalance() {
+	sh := s.Shards
+	if sh == nil || s.ReadOnly().Enabled {
+		return
+	}
+	sh.moving.Lock()
+	defer sh.moving.Unlock()
+
+	type handoff struct {
+		app    *Application
+		owner  string
+		record appRecord
+	}
+	var moves []handoff
+	s.mu.Lock()
+	for _, app := range s.Applications {
+		if owner := sh.Owner(app.Name); owner != sh.Self {
+			moves = append(moves, handoff{app, owner, newAppRecord(app)})
+		}
+	}
+	s.mu.Unlock()
+
+	for _, m := range moves {
+		if err := sh.handOff(m.owner, m.record); err != nil {
+			log.Printf("error handing application %s off to %s: %s", m.app.Name, m.owner, err)
+			shardVars.Add("handoffErrors", 1)
+			continue
+		}
+
+		s.mu.Lock()
+		if s.GetApplication(m.app.Name) == m.app {
+			for _, inst := range m.app.Instances {
+				s.unschedule(inst)
+			}
+			s.removeApp(m.app)
+			s.States.emit(Event{Type: AppMoved, App: m.app.Name, Count: len(m.record.Instances)})
+		}
+		s.mu.Unlock()
+		shardVars.Add("handoffs", 1)
+	}
+}
+
+// handOff sends the app to its new owner.
+func (sh *Shards) handOff(node string, record appRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	resp, err := sh.send("POST", node, "/registro/admin/shards/handoff", data)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("node answered %s", resp.Status)
+	}
+	return nil
+}
+
+// handoffHandler is the HTTP handler for /registro/admin/shards/handoff,
+// receiving an app handed off by another node. Its instances keep their
+// leases, and are added to the ones which registered here meanwhile, if
+// the app already exists.
+func (s *Server) handoffHandler(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	var record appRecord
+	if err := json.Unmarshal(body, &record); err != nil || record.Name == "" {
+		w.WriteHeader(400)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	code := 200
+	app := s.GetApplication(record.Name)
+	if app == nil {
+		app = record.application()
+		s.Applications = append(s.Applications, app)
+		s.record(PutApplication, app, nil)
+		code = 201
+	}
+	for _, ir := range record.Instances {
+		if app.GetInstance(ir.Id) != nil {
+			continue
+		}
+		inst := ir.instance()
+		if inst.Generation > app.generations[inst.Id] {
+			app.generations[inst.Id] = inst.Generation
+		}
+		app.Instances = append(app.Instances, inst)
+		s.States.ApplyLoad(app.Name, inst)
+		s.schedule(app, inst)
+		s.record(PutInstance, app, inst)
+	}
+	s.publish(app)
+	log.Printf("application %s received from another node with %d instances", app.Name, len(record.Instances))
+	w.WriteHeader(code)
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// shed counts the requests rejected by load shedding, by class and route.
+var shed = expvar.NewMap("shed")
+
+// TrafficClass is the priority of a request under overload.
+type TrafficClass int
+
+const (
+	// ReadTraffic holds catalog reads, the first to be shed.
+	ReadTraffic TrafficClass = iota
+
+	// RegistrationTraffic holds registrations and other changes.
+	RegistrationTraffic
+
+	// RenewalTraffic holds instance renewals. Shedding them would make the
+	// registry evict healthy instances, so they are shed last.
+	RenewalTraffic
+)
+
+func (c TrafficClass) String() string {
+	switch c {
+	case RenewalTraffic:
+		return "renewal"
+	case RegistrationTraffic:
+		return "registration"
+	default:
+		return "read"
+	}
+}
+
+// classify returns the traffic class of the request.
+func classify(r *http.Request) TrafficClass {
+	switch {
+	case r.Method == "GET" || r.Method == "HEAD" || r.Method == "OPTIONS":
+		return ReadTraffic
+	case r.Method == "PUT" && RequestRoute(r).Path == "/registro/1.0/apps/{appName}/{instanceId}":
+		return RenewalTraffic
+	default:
+		return RegistrationTraffic
+	}
+}
+
+// NewLoadShedder returns a LoadShedder handling up to budgets[c] requests
+// of each class c at once, queueing up to queue more of each class for at
+// most timeout.
+func NewLoadShedder(budgets map[TrafficClass]int, queue int, timeout time.Duration) *LoadShedder {
+	l := &LoadShedder{
+		MaxQueue:     queue,
+		QueueTimeout: timeout,
+	}
+	for c := range l.slots {
+		l.slots[c] = make(chan struct{}, budgets[TrafficClass(c)])
+	}
+	return l
+}
+
+// LoadShedder limits the requests handled concurrently, so a burst of
+// requests cannot starve the others. Every TrafficClass has its own budget,
+// and requests may also take the free slots of the classes below theirs:
+// renewals win over registrations, which win over reads.
+//
+// Requests over the limit wait in a queue until a slot frees up, their
+// deadline or QueueTimeout expires, whichever comes first. Requests which
+// cannot be queued or time out are answered with 503, and counted in the
+// "shed" expvar map.
+type LoadShedder struct {
+	// MaxQueue is the number of requests of each class waiting for a slot.
+	MaxQueue int
+
+	// QueueTimeout is the longest time a request waits for a slot.
+	QueueTimeout time.Duration
+
+	// slots holds a token per request being handled, by class.
+	slots [RenewalTraffic + 1]chan struct{}
+
+	// queued is the number of requests waiting for a slot, by class.
+	queued [RenewalTraffic + 1]int64
+}
+
+// Middleware is the Middleware applying the limits.
+func (l *LoadShedder) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if RequestRoute(r).Stream {
+			// Streams would hold their slot for as long as they last.
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		class := classify(r)
+		slots := l.acquire(r.Context(), class)
+		if slots == nil {
+			shed.Add(class.String()+" "+RequestRoute(r).Path, 1)
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(503)
+			return
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// acquire takes a slot for a request of the class, waiting in the queue if
+// there is none free. It returns the slots the token was put in, or nil if
+// the request must be shed.
+func (l *LoadShedder) acquire(ctx context.Context, class TrafficClass) chan struct{} {
+	for c := class; c >= ReadTraffic; c-- {
+		select {
+		case l.slots[c] <- struct{}{}:
+			return l.slots[c]
+		default:
+		}
+	}
+
+	queued := &l.queued[class]
+	if atomic.AddInt64(queued, 1) > int64(l.MaxQueue) {
+		atomic.AddInt64(queued, -1)
+		return nil
+	}
+	defer atomic.AddInt64(queued, -1)
+
+	// Only the own budget is waited for, as slots of other classes are
+	// freed for their own queues.
+	timer := time.NewTimer(l.QueueTimeout)
+	defer timer.Stop()
+	select {
+	case l.slots[class] <- struct{}{}:
+		return l.slots[class]
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+// shedLoad is the Middleware applying the limits of the Shedder, if any.
+func (s *Server) shedLoad(next http.Handler) http.Handler {
+	if s.Shedder == nil {
+		return next
+	}
+	return s.Shedder.Middleware(next)
+}
+
+// withTimeout cuts off the requests to the route taking longer than its
+// Timeout, or the server RequestTimeout, answering 503. Their context is
+// canceled, so handlers waiting on it give up. Zero sets no deadline, nor
+// do streams. Streamed lists, which are never held in memory as a whole,
+// are only given the deadline.
+func (s *Server) withTimeout(rt route, next http.Handler) http.Handler {
+	timeout := rt.Timeout
+	if timeout == 0 {
+		timeout = s.RequestTimeout
+	}
+	if timeout <= 0 || rt.Stream {
+		return next
+	}
+	msg, _ := encodeJSON(errorBody{Error: "request timed out"}, false)
+	cutOff := http.TimeoutHandler(next, timeout, string(msg))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("stream") != "true" {
+			cutOff.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,43 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeout(t *testing.T) {
+	s := NewServer("")
+	s.RequestTimeout = 10 * time.Millisecond
+	canceled := make(chan bool, 1)
+	h := s.withTimeout(route{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			canceled <- true
+		case <-time.After(time.Second):
+			canceled <- false
+		}
+		w.WriteHeader(200)
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	expect(t, rec, 503)
+	if !<-canceled {
+		t.Error("the context of the request cut off was not canceled")
+	}
+}
+
+func TestShedBeforeAuthentication(t *testing.T) {
+	s := NewServer("")
+	s.Tokens = []Token{{Name: "admin", Secret: "secret", Scopes: []Scope{AdminScope}}}
+	s.Shedder = NewLoadShedder(nil, 0, time.Millisecond)
+	h := s.Handler()
+
+	rec := do(h, "GET", "/apps", "")
+	expect(t, rec, 503)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("shed request has no Retry-After")
+	}
+}
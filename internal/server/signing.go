@@ -0,0 +1,229 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"expvar"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// SignatureHeader is the response header carrying the signature of a
+// catalog response, a detached JWS (RFC 7515, appendix F): the JWS compact
+// serialization of the response body, without the payload.
+const SignatureHeader = "Registro-Signature"
+
+// signatureField is the field of the server-sent events of /watch
+// carrying the signature of their data. EventSource ignores it.
+const signatureField = "signature"
+
+// DefaultSignatureLifetime is the Lifetime of the signatures of a Signer
+// returned by NewSigner.
+const DefaultSignatureLifetime = 5 * time.Minute
+
+// signingVars counts the responses signed.
+var signingVars = expvar.NewMap("signing")
+
+// Signer signs the catalog responses, so clients reading them through
+// intermediaries (caches, agents) may verify they come untampered from the
+// registry. It is safe for concurrent use.
+type Signer struct {
+	// KeyID identifies the key, see model.JWK.
+	KeyID string
+
+	// Lifetime is how long signatures are valid, so a signed response
+	// cannot be replayed once stale. It should exceed the time responses
+	// may be cached for.
+	Lifetime time.Duration
+
+	key crypto.Signer
+	alg string
+}
+
+// NewSigner returns a Signer signing with key, an ECDSA P-256 key (ES256)
+// or an Ed25519 key (EdDSA). An empty keyID is derived from the public
+// key.
+func NewSigner(keyID string, key crypto.Signer) (*Signer, error) {
+	var alg string
+	switch k := key.(type) {
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, fmt.Errorf("unsupported signing key curve %s", k.Curve.Params().Name)
+		}
+		alg = "ES256"
+	case ed25519.PrivateKey:
+		alg = "EdDSA"
+	default:
+		return nil, fmt.Errorf("unsupported signing key %T", key)
+	}
+
+	if keyID == "" {
+		der, err := x509.MarshalPKIXPublicKey(key.Public())
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(der)
+		keyID = hex.EncodeToString(sum[:8])
+	}
+	return &Signer{KeyID: keyID, Lifetime: DefaultSignatureLifetime, key: key, alg: alg}, nil
+}
+
+// ParseSigningKey returns the private key of a PEM block, in PKCS #8 or
+// SEC 1 ("EC PRIVATE KEY") form.
+func ParseSigningKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM signing key")
+	}
+	if block.Type == "EC PRIVATE KEY" {
+		return x509.ParseECPrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported signing key %T", key)
+	}
+	return signer, nil
+}
+
+// Sign returns the detached JWS of payload, with the request and catalog
+// version of header in its protected header. The algorithm and key id of
+// header are set by the Signer, and its issue and expiry times unless set.
+func (s *Signer) Sign(payload []byte, header model.JWSHeader) (string, error) {
+	header.Alg, header.Kid = s.alg, s.KeyID
+	if header.IssuedAt == 0 {
+		now := time.Now()
+		header.IssuedAt, header.Expires = now.Unix(), now.Add(s.Lifetime).Unix()
+	}
+	protected, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	input := enc.EncodeToString(protected) + "." + enc.EncodeToString(payload)
+
+	var sig []byte
+	switch k := s.key.(type) {
+	case *ecdsa.PrivateKey:
+		digest := sha256.Sum256([]byte(input))
+		r, ss, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			return "", err
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		ss.FillBytes(sig[32:])
+	default:
+		sig, err = s.key.Sign(rand.Reader, []byte(input), crypto.Hash(0))
+		if err != nil {
+			return "", err
+		}
+	}
+	return enc.EncodeToString(protected) + ".." + enc.EncodeToString(sig), nil
+}
+
+// JWKS returns the public key of the signer.
+func (s *Signer) JWKS() model.JWKSet {
+	enc := base64.RawURLEncoding
+	jwk := model.JWK{Kid: s.KeyID, Alg: s.alg, Use: "sig"}
+	switch k := s.key.Public().(type) {
+	case *ecdsa.PublicKey:
+		jwk.Kty, jwk.Crv = "EC", "P-256"
+		jwk.X = enc.EncodeToString(fixedBytes(k.X))
+		jwk.Y = enc.EncodeToString(fixedBytes(k.Y))
+	case ed25519.PublicKey:
+		jwk.Kty, jwk.Crv = "OKP", "Ed25519"
+		jwk.X = enc.EncodeToString(k)
+	}
+	return model.JWKSet{Keys: []model.JWK{jwk}}
+}
+
+// fixedBytes returns a P-256 coordinate on 32 bytes.
+func fixedBytes(n *big.Int) []byte {
+	return n.FillBytes(make([]byte, 32))
+}
+
+// bufferedWriter holds a response back, until it is signed.
+type bufferedWriter struct {
+	http.ResponseWriter
+	code int
+	body bytes.Buffer
+}
+
+func (w *bufferedWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
+
+func (w *bufferedWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// signedRequest returns the header binding a signature to the request
+// answered with the catalog version.
+func signedRequest(r *http.Request, version uint64) model.JWSHeader {
+	return model.JWSHeader{Method: r.Method, Path: location(r, r.URL.RequestURI()), Version: version}
+}
+
+// signResponses is a Middleware signing the 200 responses to GET requests
+// of the Signed routes with the server Signer, if any, in the
+// Registro-Signature header. Streamed app lists are not signed.
+func (s *Server) signResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.Signer == nil || r.Method != "GET" || !RequestRoute(r).Signed || r.URL.Query().Get("stream") == "true" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// The handler answers with this version of the catalog, or a later
+		// one.
+		version := s.snapshot().Version
+		bw := &bufferedWriter{ResponseWriter: w}
+		next.ServeHTTP(bw, r)
+		if bw.code == 0 {
+			bw.code = 200
+		}
+		if bw.code == 200 {
+			sig, err := s.Signer.Sign(bw.body.Bytes(), signedRequest(r, version))
+			if err != nil {
+				log.Printf("error signing response: %s", err)
+				w.WriteHeader(500)
+				return
+			}
+			w.Header().Set(SignatureHeader, sig)
+			signingVars.Add("responses", 1)
+		}
+		w.WriteHeader(bw.code)
+		w.Write(bw.body.Bytes())
+	})
+}
+
+// keysHandler is the HTTP handler for /keys, listing the public keys of the
+// signatures.
+func (s *Server) keysHandler(w http.ResponseWriter, r *http.Request) {
+	keys := model.JWKSet{Keys: make([]model.JWK, 0)}
+	if s.Signer != nil {
+		keys = s.Signer.JWKS()
+	}
+	data, err := encodeJSON(keys, isPretty(r))
+	writeBody(w, 200, data, err)
+}
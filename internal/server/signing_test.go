@@ -0,0 +1,121 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/numercfd/registro/client"
+	"github.com/numercfd/registro/model"
+)
+
+func TestSignatureBindsRequest(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer("")
+	if s.Signer, err = NewSigner("", key); err != nil {
+		t.Fatal(err)
+	}
+	populate(s, 2, 1)
+	registry := httptest.NewServer(s.Handler())
+	defer registry.Close()
+
+	// The intermediary answers requests for app1 with the signed response
+	// of app0.
+	intermediary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = strings.Replace(r.URL.Path, "/apps/app1", "/apps/app0", 1)
+		resp, err := http.Get(registry.URL + r.URL.RequestURI())
+		if err != nil {
+			w.WriteHeader(502)
+			return
+		}
+		defer resp.Body.Close()
+		body, _ := ioutil.ReadAll(resp.Body)
+		w.Header().Set(SignatureHeader, resp.Header.Get(SignatureHeader))
+		w.WriteHeader(resp.StatusCode)
+		w.Write(body)
+	}))
+	defer intermediary.Close()
+
+	c := client.NewClient(intermediary.URL+"/registro", client.WithServerPublicKey(public))
+	if _, err := c.GetHashRing("app0"); err != nil {
+		t.Fatalf("signed response rejected: %s", err)
+	}
+	var serr *client.SignatureError
+	if _, err := c.GetHashRing("app1"); !errors.As(err, &serr) {
+		t.Fatalf("response for another path returned %v, want a SignatureError", err)
+	}
+
+	c = client.NewClient(registry.URL+"/registro", client.WithServerPublicKey(public))
+	watch, err := c.Watch()
+	if err != nil {
+		t.Fatalf("signed watch rejected: %s", err)
+	}
+	defer watch.Close()
+	expect(t, do(s.Handler(), "POST", "/apps", `{"name":"app2"}`), 201)
+	select {
+	case d, ok := <-watch.Deltas():
+		if !ok {
+			t.Fatalf("signed delta rejected: %s", watch.Err())
+		}
+		if d.Name != "app2" {
+			t.Errorf("got delta of %s, want app2", d.Name)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no delta received")
+	}
+}
+
+func TestSignatureAge(t *testing.T) {
+	public, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := NewSigner("", key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tests := []struct {
+		name            string
+		issued, expires time.Time
+		maxAge          time.Duration
+		ok              bool
+	}{
+		{"fresh", now, now.Add(signer.Lifetime), 0, true},
+		{"older than the max age", now.Add(-time.Hour), now.Add(time.Hour), 0, false},
+		{"within a longer max age", now.Add(-time.Hour), now.Add(time.Hour), 2 * time.Hour, true},
+		{"expired", now.Add(-3 * time.Minute), now.Add(-2 * time.Minute), 0, false},
+		{"issued in the future", now.Add(time.Hour), now.Add(2 * time.Hour), 0, false},
+	}
+	payload := []byte(`{"name":"app0"}`)
+	for _, tt := range tests {
+		sig, err := signer.Sign(payload, model.JWSHeader{Method: "GET", Path: "/registro/1.0/apps/app0",
+			IssuedAt: tt.issued.Unix(), Expires: tt.expires.Unix()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := client.NewClient("http://registry/registro", client.WithServerPublicKey(public)).Verifier
+		v.MaxAge = tt.maxAge
+		if err := v.Verify("GET", "/registro/1.0/apps/app0", 0, payload, sig); (err == nil) != tt.ok {
+			t.Errorf("%s: got %v", tt.name, err)
+		}
+	}
+
+	// Signatures made by the Signer last its Lifetime.
+	sig, err := signer.Sign(payload, model.JWSHeader{Method: "GET", Path: "/registro/1.0/apps/app0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.NewClient("http://registry/registro", client.WithServerPublicKey(public)).Verifier.Verify("GET", "/registro/1.0/apps/app0", 0, payload, sig); err != nil {
+		t.Errorf("fresh signature rejected: %s", err)
+	}
+}
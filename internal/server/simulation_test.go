@@ -0,0 +1,487 @@
+package server
+
+import (
+	"container/heap"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// maxViolations is the number of violations described in a
+// simulationReport. Further ones are only counted.
+const maxViolations = 100
+
+// The flags of TestSimulation, e.g. for a longer run:
+//
+//	go test -run TestSimulation ./internal/server -sim.duration 72h -v
+var (
+	simApps        = flag.Int("sim.apps", 10, "number of applications simulated")
+	simInstances   = flag.Int("sim.instances", 20, "number of instances per application simulated")
+	simDuration    = flag.Duration("sim.duration", time.Hour, "virtual time simulated")
+	simSeed        = flag.Int64("sim.seed", 1, "seed of the failures simulated and their timing")
+	simCrash       = flag.Float64("sim.crash-rate", 0.0005, "chance of every heartbeat that the instance crashes instead")
+	simPartition   = flag.Float64("sim.partition-rate", 0.001, "chance of every heartbeat that the instance cannot reach the registry")
+	simDeregister  = flag.Float64("sim.deregister-rate", 0.0005, "chance of every heartbeat that the instance deregisters instead")
+	simMaxHeap     = flag.Uint64("sim.max-heap", 0, "heap in MB above which a check of the simulation fails (0 disables)")
+	simVerboseLogs = flag.Bool("sim.log", false, "log the registry activity during the simulation")
+)
+
+func TestSimulation(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulation skipped in short mode")
+	}
+	if *simVerboseLogs {
+		log.SetOutput(os.Stderr)
+		defer log.SetOutput(ioutil.Discard)
+	}
+	s := NewServer("")
+	report, err := simulate(s, simulationConfig{
+		Apps:           *simApps,
+		Instances:      *simInstances,
+		Duration:       *simDuration,
+		Interval:       30 * time.Second,
+		Seed:           *simSeed,
+		CrashRate:      *simCrash,
+		PartitionRate:  *simPartition,
+		DeregisterRate: *simDeregister,
+		CheckInterval:  10 * time.Minute,
+		MaxHeap:        *simMaxHeap << 20,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Logf("simulated %s in %s, %d checks", report.Simulated, report.Elapsed.Round(time.Millisecond), report.Checks)
+	t.Logf("registrations: %d, renewals: %d, reregistrations: %d", report.Registrations, report.Renewals, report.Reregistrations)
+	t.Logf("crashes: %d, partitions: %d, deregistrations: %d", report.Crashes, report.Partitions, report.Deregistrations)
+	t.Logf("peak instances: %d, peak heap: %d MB", report.PeakInstances, report.PeakHeap>>20)
+	types := make([]string, 0, len(report.Events))
+	for t := range report.Events {
+		types = append(types, string(t))
+	}
+	sort.Strings(types)
+	for _, typ := range types {
+		t.Logf("%-28s %10d", typ, report.Events[EventType(typ)])
+	}
+
+	for _, v := range report.Violations {
+		t.Error(v)
+	}
+	if more := report.ViolationCount - len(report.Violations); more > 0 {
+		t.Errorf("%d more invariants violated", more)
+	}
+}
+
+// simulationConfig describes the fleet and the failures of a simulation,
+// see simulate.
+type simulationConfig struct {
+	// Apps is the number of applications.
+	Apps int
+
+	// Instances is the number of instances of every application.
+	Instances int
+
+	// Duration is the virtual time simulated, e.g. 72h.
+	Duration time.Duration
+
+	// Interval is the time between the heartbeats of every instance.
+	Interval time.Duration
+
+	// Seed seeds the failures and their timing, so runs with the same
+	// configuration are alike.
+	Seed int64
+
+	// CrashRate is the chance of every heartbeat that the instance crashes
+	// instead, to register again after up to twice the EvictionTimeout.
+	CrashRate float64
+
+	// PartitionRate is the chance of every heartbeat that the instance
+	// cannot reach the registry for up to twice the RenewalTimeout.
+	PartitionRate float64
+
+	// DeregisterRate is the chance of every heartbeat that the instance
+	// deregisters instead, to register again after up to twice the
+	// TombstoneTimeout.
+	DeregisterRate float64
+
+	// CheckInterval is the virtual time between checks of the invariants.
+	CheckInterval time.Duration
+
+	// MaxHeap, if set, is the heap in use after a garbage collection above
+	// which a check fails.
+	MaxHeap uint64
+}
+
+// simulationReport describes a simulation run: its activity, and the
+// invariants violated.
+type simulationReport struct {
+	// Simulated is the virtual time simulated.
+	Simulated time.Duration
+
+	// Elapsed is the wall time the simulation took.
+	Elapsed time.Duration
+
+	// Registrations, Renewals, Reregistrations, Crashes, Partitions and
+	// Deregistrations count the actions of the fleet. Reregistrations are
+	// the ones after a renewal answered 404.
+	Registrations   int
+	Renewals        int
+	Reregistrations int
+	Crashes         int
+	Partitions      int
+	Deregistrations int
+
+	// Events counts the events emitted by the registry, by type.
+	Events map[EventType]int
+
+	// Checks is the number of checks of the invariants.
+	Checks int
+
+	// PeakInstances is the largest number of instances registered at once.
+	PeakInstances int
+
+	// PeakHeap is the largest heap in use after a garbage collection, at
+	// the checks.
+	PeakHeap uint64
+
+	// Violations describes the first invariants violated, and
+	// ViolationCount counts all of them.
+	Violations     []string
+	ViolationCount int
+}
+
+// simulate runs a fleet of instances against the server on a virtual
+// clock, with the failures of the configuration, and checks the invariants
+// of the registry every CheckInterval:
+//
+//   - an instance renewed within its lease is never DOWN, and an UP
+//     instance never outlives its lease;
+//   - instances are evicted once they have not renewed for their eviction
+//     timeout, and every instance left is checked again, so none leaks;
+//   - the expiry queue and the event history stay bounded, and so does the
+//     heap if MaxHeap is set.
+//
+// The fleet goes through the REST API, and the expiries and the janitor
+// run as soon as they are due on the virtual clock, so days of activity
+// take seconds. The server must not be serving: simulate sets its clock
+// and drives it from the calling goroutine.
+func simulate(s *Server, cfg simulationConfig) (simulationReport, error) {
+	sim := &simulation{
+		cfg:     cfg,
+		server:  s,
+		handler: s.Handler(),
+		rand:    rand.New(rand.NewSource(cfg.Seed)),
+		now:     time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		fleet:   make(map[string]*simInstance),
+		report:  simulationReport{Events: make(map[EventType]int)},
+	}
+	s.States.Now = func() time.Time { return sim.now }
+	s.States.Listeners = append(s.States.Listeners, func(e Event) { sim.report.Events[e.Type]++ })
+
+	start := time.Now()
+	if err := sim.run(); err != nil {
+		return sim.report, err
+	}
+	sim.report.Elapsed = time.Since(start)
+	return sim.report, nil
+}
+
+// simulation is the state of a simulate run.
+type simulation struct {
+	cfg     simulationConfig
+	server  *Server
+	handler http.Handler
+	rand    *rand.Rand
+
+	// now is the virtual clock.
+	now time.Time
+
+	// fleet holds the instances by app and id, and queue the same ones
+	// ordered by their next action.
+	fleet map[string]*simInstance
+	queue simQueue
+
+	report simulationReport
+}
+
+// simInstance is an instance of the simulated fleet.
+type simInstance struct {
+	app, id string
+	ip      string
+	port    int
+
+	// next is the time of the next action of the instance.
+	next  time.Time
+	index int
+
+	// lease is the lease id of its registration, empty when it is not
+	// registered.
+	lease string
+
+	// renewedAt is when the registry last acknowledged a renewal of the
+	// current registration.
+	renewedAt time.Time
+
+	// crashed and deregistered are set while the instance is gone, until
+	// it registers again.
+	crashed      bool
+	deregistered bool
+}
+
+// simQueue is a min-heap of instances ordered by their next action. It
+// implements heap.Interface.
+type simQueue []*simInstance
+
+func (q simQueue) Len() int           { return len(q) }
+func (q simQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q simQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *simQueue) Push(x interface{}) {
+	i := x.(*simInstance)
+	i.index = len(*q)
+	*q = append(*q, i)
+}
+
+func (q *simQueue) Pop() interface{} {
+	old := *q
+	i := old[len(old)-1]
+	old[len(old)-1] = nil
+	*q = old[:len(old)-1]
+	return i
+}
+
+// run registers the fleet, then steps the virtual clock to the next action,
+// expiry, janitor sweep or check until the end of the simulation.
+func (sim *simulation) run() error {
+	cfg := sim.cfg
+	begin := sim.now
+	end := begin.Add(cfg.Duration)
+
+	for a := 0; a < cfg.Apps; a++ {
+		name := fmt.Sprintf("sim-app-%d", a)
+		if rec := sim.do("POST", "/apps", fmt.Sprintf(`{"name":%q}`, name), ""); rec.Code != 201 {
+			return fmt.Errorf("cannot register application %s: %d", name, rec.Code)
+		}
+		for i := 0; i < cfg.Instances; i++ {
+			inst := &simInstance{
+				app:  name,
+				id:   fmt.Sprintf("sim-%d-%d", a, i),
+				ip:   fmt.Sprintf("10.%d.%d.%d", a/256%256, a%256, i%256),
+				port: 8000 + i/256,
+			}
+			inst.next = begin.Add(time.Duration(sim.rand.Int63n(int64(cfg.Interval))))
+			sim.fleet[name+"/"+inst.id] = inst
+			heap.Push(&sim.queue, inst)
+		}
+	}
+
+	sweep := begin.Add(janitorInterval)
+	check := begin.Add(cfg.CheckInterval)
+	for {
+		s := sim.server
+		s.mu.Lock()
+		at := s.nextExpiry()
+		s.mu.Unlock()
+		if at.IsZero() || sweep.Before(at) {
+			at = sweep
+		}
+		if check.Before(at) {
+			at = check
+		}
+		if len(sim.queue) > 0 && sim.queue[0].next.Before(at) {
+			at = sim.queue[0].next
+		}
+		if at.After(end) {
+			break
+		}
+		if at.After(sim.now) {
+			sim.now = at
+		}
+
+		s.mu.Lock()
+		s.expireDue(sim.now)
+		s.mu.Unlock()
+		switch {
+		case !sweep.After(sim.now):
+			s.mu.Lock()
+			s.sweep(sim.now)
+			s.mu.Unlock()
+			sweep = sweep.Add(janitorInterval)
+		case !check.After(sim.now):
+			sim.check()
+			check = check.Add(cfg.CheckInterval)
+		case len(sim.queue) > 0 && !sim.queue[0].next.After(sim.now):
+			inst := sim.queue[0]
+			sim.act(inst)
+			heap.Fix(&sim.queue, inst.index)
+		}
+	}
+	sim.now = end
+	sim.server.mu.Lock()
+	sim.server.expireDue(sim.now)
+	sim.server.mu.Unlock()
+	sim.check()
+	sim.report.Simulated = end.Sub(begin)
+	return nil
+}
+
+// act runs the next action of the instance, and sets the time of the
+// following one.
+func (sim *simulation) act(inst *simInstance) {
+	cfg, states := sim.cfg, sim.server.States
+	inst.next = sim.now.Add(cfg.Interval)
+
+	if inst.crashed || inst.deregistered || inst.lease == "" {
+		inst.crashed, inst.deregistered = false, false
+		sim.register(inst)
+		return
+	}
+
+	p := sim.rand.Float64()
+	switch {
+	case p < cfg.CrashRate:
+		sim.report.Crashes++
+		inst.crashed, inst.lease = true, ""
+		inst.next = sim.now.Add(sim.upTo(2 * states.EvictionTimeout))
+	case p < cfg.CrashRate+cfg.PartitionRate:
+		sim.report.Partitions++
+		inst.next = sim.now.Add(sim.upTo(2 * states.RenewalTimeout))
+	case p < cfg.CrashRate+cfg.PartitionRate+cfg.DeregisterRate:
+		sim.report.Deregistrations++
+		if rec := sim.do("DELETE", "/apps/"+inst.app+"/"+inst.id, "", inst.lease); rec.Code != 204 {
+			sim.violate("deregistration of %s/%s answered %d", inst.app, inst.id, rec.Code)
+		}
+		inst.deregistered, inst.lease = true, ""
+		inst.next = sim.now.Add(sim.upTo(2 * states.TombstoneTimeout))
+	default:
+		sim.renew(inst)
+	}
+}
+
+// upTo returns a random duration up to max.
+func (sim *simulation) upTo(max time.Duration) time.Duration {
+	return time.Duration(sim.rand.Int63n(int64(max) + 1))
+}
+
+// register registers the instance, starting a new lease.
+func (sim *simulation) register(inst *simInstance) {
+	sim.report.Registrations++
+	body := fmt.Sprintf(`{"id":%q,"ip":%q,"port":%d}`, inst.id, inst.ip, inst.port)
+	rec := sim.do("POST", "/apps/"+inst.app, body, "")
+	if rec.Code != 201 {
+		sim.violate("registration of %s/%s answered %d", inst.app, inst.id, rec.Code)
+		return
+	}
+	var lease model.Lease
+	if err := json.Unmarshal(rec.Body.Bytes(), &lease); err != nil {
+		sim.violate("registration of %s/%s answered %s", inst.app, inst.id, err)
+		return
+	}
+	inst.lease, inst.renewedAt = lease.LeaseId, time.Time{}
+}
+
+// renew renews the lease of the instance, registering it again if the
+// registry forgot it, as clients do.
+func (sim *simulation) renew(inst *simInstance) {
+	sim.report.Renewals++
+	rec := sim.do("PUT", "/apps/"+inst.app+"/"+inst.id, "", inst.lease)
+	switch rec.Code {
+	case 204:
+		inst.renewedAt = sim.now
+	case 404:
+		sim.report.Reregistrations++
+		sim.register(inst)
+	default:
+		sim.violate("renewal of %s/%s answered %d", inst.app, inst.id, rec.Code)
+	}
+}
+
+// do sends a request to the API, path being relative to /registro/1.0,
+// presenting the lease if set.
+func (sim *simulation) do(method, path, body, lease string) *httptest.ResponseRecorder {
+	if lease == "" {
+		return do(sim.handler, method, path, body)
+	}
+	return do(sim.handler, method, path, body, LeaseHeader, lease)
+}
+
+// check verifies the invariants of the registry at the current virtual
+// time.
+func (sim *simulation) check() {
+	s, now := sim.server, sim.now
+	sim.report.Checks++
+
+	s.mu.Lock()
+	instances, scheduled := 0, 0
+	for _, app := range s.Applications {
+		for _, inst := range app.Instances {
+			instances++
+			name := app.Name + "/" + inst.Id
+			si := sim.fleet[name]
+			switch {
+			case si == nil:
+				sim.violate("%s is not an instance of the fleet", name)
+			case inst.LeaseId == si.lease && !si.renewedAt.IsZero() && now.Sub(si.renewedAt) < s.States.RenewalTimeout && inst.Status == DOWN:
+				sim.violate("%s is DOWN at %s, renewed at %s", name, now.Format(time.RFC3339), si.renewedAt.Format(time.RFC3339))
+			case inst.Status == UP && !now.Before(inst.leaseExpires):
+				sim.violate("%s is UP at %s, its lease expired at %s", name, now.Format(time.RFC3339), inst.leaseExpires.Format(time.RFC3339))
+			case now.Sub(inst.renewedAt) >= s.States.evictionTimeout(inst):
+				sim.violate("%s is %s at %s, not renewed since %s", name, inst.Status, now.Format(time.RFC3339), inst.renewedAt.Format(time.RFC3339))
+			case inst.expiry == nil:
+				sim.violate("%s is %s at %s, and never checked again", name, inst.Status, now.Format(time.RFC3339))
+			}
+			if inst.expiry != nil {
+				scheduled++
+			}
+		}
+	}
+	if len(s.expiries) != scheduled {
+		sim.violate("the expiry queue holds %d entries for %d instances at %s", len(s.expiries), scheduled, now.Format(time.RFC3339))
+	}
+	s.mu.Unlock()
+	if instances > sim.report.PeakInstances {
+		sim.report.PeakInstances = instances
+	}
+
+	s.history.mu.Lock()
+	events := len(s.history.events)
+	s.history.mu.Unlock()
+	if s.MaxEvents > 0 && events > s.MaxEvents {
+		sim.violate("the history holds %d events, above %d", events, s.MaxEvents)
+	}
+
+	var mem runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&mem)
+	if mem.HeapAlloc > sim.report.PeakHeap {
+		sim.report.PeakHeap = mem.HeapAlloc
+	}
+	if sim.cfg.MaxHeap > 0 && mem.HeapAlloc > sim.cfg.MaxHeap {
+		sim.violate("the heap holds %d bytes at %s, above %d", mem.HeapAlloc, now.Format(time.RFC3339), sim.cfg.MaxHeap)
+	}
+}
+
+// violate records an invariant violated.
+func (sim *simulation) violate(format string, args ...interface{}) {
+	sim.report.ViolationCount++
+	if len(sim.report.Violations) < maxViolations {
+		sim.report.Violations = append(sim.report.Violations, fmt.Sprintf(format, args...))
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"expvar"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// skewVars publishes the instances whose clock skew is above the server
+// MaxClockSkew, and the largest skew measured.
+var skewVars = expvar.NewMap("clockSkew")
+
+// SkewedInstance is an instance of a SkewReport.
+type SkewedInstance struct {
+	App      string `json:"app"`
+	Instance string `json:"instance"`
+
+	// ClockSkew holds the seconds the instance clock is ahead of the SR
+	// clock, negative if behind.
+	ClockSkew float64 `json:"clockSkew"`
+}
+
+// SkewReport lists the instances whose clock is too far from the SR one.
+// Leases are measured on the SR clock alone, but instances reasoning about
+// them (e.g. renewing right before they expire, or comparing their planned
+// termination time) with a skewed clock are wrong by as much.
+type SkewReport struct {
+	// MaxClockSkew is the skew above which instances are listed, in
+	// seconds.
+	MaxClockSkew float64 `json:"maxClockSkew"`
+
+	// Instances holds the skewed instances, the largest skews first.
+	Instances []SkewedInstance `json:"instances"`
+}
+
+// measureSkew records the clock skew of the instance from the time a
+// renewal was sent, logging when it goes above MaxClockSkew. It must be
+// called with s.mu held.
+func (s *Server) measureSkew(app *Application, inst *Instance, sent time.Time) {
+	skew := sent.Sub(time.Now())
+	was := inst.skewKnown && s.skewed(inst.ClockSkew)
+	inst.ClockSkew, inst.skewKnown = skew, true
+	if s.skewed(skew) && !was {
+		log.Printf("instance %s of app %s clock is %s off the registry clock", inst.Id, app.Name, skew.Round(time.Millisecond))
+	}
+}
+
+// skewed reports whether a clock skew is above MaxClockSkew.
+func (s *Server) skewed(skew time.Duration) bool {
+	return s.MaxClockSkew > 0 && (skew > s.MaxClockSkew || skew < -s.MaxClockSkew)
+}
+
+// skewReport returns the instances of the catalog whose clock skew is above
+// MaxClockSkew.
+func (s *Server) skewReport() SkewReport {
+	report := SkewReport{MaxClockSkew: s.MaxClockSkew.Seconds(), Instances: make([]SkewedInstance, 0)}
+	for _, app := range s.snapshot().Applications {
+		for _, inst := range app.Instances {
+			if r := inst.lastRenewal(); r.skewKnown && s.skewed(r.ClockSkew) {
+				report.Instances = append(report.Instances, SkewedInstance{App: app.Name, Instance: inst.Id, ClockSkew: r.ClockSkew.Seconds()})
+			}
+		}
+	}
+	sort.Slice(report.Instances, func(i, j int) bool {
+		return math.Abs(report.Instances[i].ClockSkew) > math.Abs(report.Instances[j].ClockSkew)
+	})
+	return report
+}
+
+// publishSkew publishes the clock skew of the instances in the "clockSkew"
+// expvar map.
+func (s *Server) publishSkew() {
+	skewVars.Set("skewed", expvar.Func(func() interface{} {
+		return len(s.skewReport().Instances)
+	}))
+	skewVars.Set("maxSeconds", expvar.Func(func() interface{} {
+		var max float64
+		for _, app := range s.snapshot().Applications {
+			for _, inst := range app.Instances {
+				max = math.Max(max, math.Abs(inst.lastRenewal().ClockSkew.Seconds()))
+			}
+		}
+		return max
+	}))
+}
+
+// clockSkewHandler is the HTTP handler for /admin/clock-skew.
+func (s *Server) clockSkewHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := encodeJSON(s.skewReport(), isPretty(r))
+	writeBody(w, 200, data, err)
+}
@@ -0,0 +1,383 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	// ErrOutOfService is returned when renewing an out-of-service instance.
+	ErrOutOfService = errors.New("instance is out-of-service")
+)
+
+// TransitionError is returned when a status change is not allowed.
+type TransitionError struct {
+	From, To StatusType
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("invalid status transition from %s to %s", e.From, e.To)
+}
+
+// EventType identifies the kind of change an Event represents.
+type EventType string
+
+const (
+	// InstanceRegistered is emitted when an instance is added to an app.
+	InstanceRegistered EventType = "instance-registered"
+
+	// StatusChanged is emitted when an instance changes status.
+	StatusChanged EventType = "instance-status-changed"
+
+	// InstanceEvicted is emitted when an instance is removed for not sending heartbeats.
+	InstanceEvicted EventType = "instance-evicted"
+
+	// InstanceDraining is emitted when an instance is DRAINING ahead of its
+	// planned termination, so consumers may move away from it.
+	InstanceDraining EventType = "instance-draining"
+
+	// AppBelowMinHealthy is emitted when an app has less UP instances than
+	// its MinHealthy.
+	AppBelowMinHealthy EventType = "app-below-min-healthy"
+
+	// AppHealthRestored is emitted when an app is back to its MinHealthy.
+	AppHealthRestored EventType = "app-health-restored"
+
+	// AppDown is emitted when no instance of an app is UP anymore, while
+	// some are DOWN. Instances deliberately out-of-service do not count.
+	AppDown EventType = "app-down"
+
+	// AppUp is emitted when an app which was down has an UP instance again.
+	AppUp EventType = "app-up"
+
+	// EvictionStorm is emitted when the instances evicted in the last minute
+	// reach the server EvictionStormThreshold, often a sign of a network
+	// partition rather than of failing instances.
+	EvictionStorm EventType = "eviction-storm"
+
+	// AppArchived is emitted when an app is archived for having no instances.
+	AppArchived EventType = "app-archived"
+
+	// AppPurged is emitted when an app is removed for having no instances.
+	AppPurged EventType = "app-purged"
+
+	// AppExpired is emitted when an app is removed at its ExpiresAt, with
+	// the number of its instances removed along.
+	AppExpired EventType = "app-expired"
+
+	// AppMoved is emitted when an app is handed off to the node owning it in
+	// a sharded registry, with the number of its instances moved along. See
+	// Shards.
+	AppMoved EventType = "app-moved"
+
+	// ClientBanned is emitted when a client is banned for failing to
+	// authenticate too often, see Lockout.
+	ClientBanned EventType = "client-banned"
+)
+
+// Event represents a change in the state of an instance.
+type Event struct {
+	// Type identifies the kind of change.
+	Type EventType `json:"type"`
+
+	// App is the name of the application the instance belongs to.
+	App string `json:"app"`
+
+	// Instance is the id of the instance that changed.
+	Instance string `json:"instance,omitempty"`
+
+	// Client identifies the client of security events, such as the
+	// address or token prefix banned by a ClientBanned.
+	Client string `json:"client,omitempty"`
+
+	// From is the status before the change.
+	From StatusType `json:"from,omitempty"`
+
+	// To is the status after the change.
+	To StatusType `json:"to,omitempty"`
+
+	// Count is the number of occurrences summarized by the event, such as
+	// the evictions of an EvictionStorm.
+	Count int `json:"count,omitempty"`
+
+	// Time is when the change happened.
+	Time time.Time `json:"time"`
+}
+
+// NewStateMachine returns a StateMachine with the default transitions.
+func NewStateMachine() *StateMachine {
+	return &StateMachine{
+		Transitions: map[StatusType][]StatusType{
+			STARTING:     {UP, DRAINING, OUTOFSERVICE},
+			UP:           {DOWN, DRAINING, OUTOFSERVICE},
+			DOWN:         {UP, DRAINING, OUTOFSERVICE},
+			DRAINING:     {DOWN, OUTOFSERVICE},
+			OUTOFSERVICE: {STARTING},
+		},
+		RenewalTimeout:   90 * time.Second,
+		EvictionTimeout:  10 * time.Minute,
+		TombstoneTimeout: 10 * time.Minute,
+		DrainLead:        2 * time.Minute,
+	}
+}
+
+// StateMachine holds the rules for instance status changes.
+// Every status change must go through it so the invariants are kept and
+// listeners are notified.
+type StateMachine struct {
+	// Transitions maps each status to the statuses it may change to.
+	Transitions map[StatusType][]StatusType
+
+	// RenewalTimeout is the time without heartbeats before an UP instance is DOWN.
+	RenewalTimeout time.Duration
+
+	// EvictionTimeout is the time without heartbeats before an instance is removed.
+	EvictionTimeout time.Duration
+
+	// TombstoneTimeout is the time a deleted (out-of-service) instance may
+	// be restored before it is removed.
+	TombstoneTimeout time.Duration
+
+	// DrainLead is the time before its planned termination when an
+	// instance is DRAINING.
+	DrainLead time.Duration
+
+	// Listeners are called for every event emitted.
+	Listeners []func(Event)
+
+	// Now, if set, returns the current time instead of time.Now, such as
+	// the virtual clock of a Simulation.
+	Now func() time.Time
+}
+
+// now returns the current time.
+func (m *StateMachine) now() time.Time {
+	if m.Now != nil {
+		return m.Now()
+	}
+	return time.Now()
+}
+
+// Allowed reports whether an instance may change from one status to another.
+func (m *StateMachine) Allowed(from, to StatusType) bool {
+	for _, s := range m.Transitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition changes the instance status to the one specified, keeping its
+// lifecycle timestamps. Changing to the current status is a no-op.
+func (m *StateMachine) Transition(app string, inst *Instance, to StatusType) error {
+	from := inst.Status
+	if from == to {
+		return nil
+	}
+	if !m.Allowed(from, to) {
+		return &TransitionError{From: from, To: to}
+	}
+
+	inst.Status = to
+	inst.StatusChangedAt = m.now()
+	if to == UP && inst.FirstUpAt.IsZero() {
+		inst.FirstUpAt = inst.StatusChangedAt
+	}
+	m.emit(Event{Type: StatusChanged, App: app, Instance: inst.Id, From: from, To: to})
+	return nil
+}
+
+// ApplyRegistration handles a newly registered instance.
+// A new lease is given to the instance, starting from now, and its
+// lifecycle timestamps start over.
+func (m *StateMachine) ApplyRegistration(app string, inst *Instance) {
+	inst.LeaseId = newLeaseId()
+	m.renew(inst)
+	inst.RegisteredAt = inst.renewedAt
+	inst.StatusChangedAt = inst.renewedAt
+	m.emit(Event{Type: InstanceRegistered, App: app, Instance: inst.Id, To: inst.Status})
+}
+
+// ApplyLoad handles an instance loaded from storage after a restart.
+// Its lease starts counting from now, as the time the server was down
+// must not count against the instance.
+func (m *StateMachine) ApplyLoad(app string, inst *Instance) {
+	inst.leaseExpires = inst.renewedAt.Add(m.RenewalTimeout)
+}
+
+// ApplyRenewal handles a heartbeat received from the instance.
+// The instance lease is renewed and its status changed to UP, or DRAINING
+// if its planned termination is near.
+func (m *StateMachine) ApplyRenewal(app string, inst *Instance) error {
+	if inst.Status == OUTOFSERVICE {
+		return ErrOutOfService
+	}
+	if m.drainDue(inst) {
+		m.renew(inst)
+		m.ApplyDrain(app, inst)
+		return nil
+	}
+	if err := m.Transition(app, inst, UP); err != nil {
+		return err
+	}
+	m.renew(inst)
+	return nil
+}
+
+// ApplyDelete puts the instance out-of-service.
+// Deleting an instance already out-of-service is a no-op.
+func (m *StateMachine) ApplyDelete(app string, inst *Instance) error {
+	if inst.Status == OUTOFSERVICE {
+		return nil
+	}
+	if err := m.Transition(app, inst, OUTOFSERVICE); err != nil {
+		return err
+	}
+	m.renew(inst)
+	return nil
+}
+
+// ApplyRestore brings a deleted instance back, as if it had just registered.
+// It fails if the instance is not out-of-service.
+func (m *StateMachine) ApplyRestore(app string, inst *Instance) error {
+	if inst.Status != OUTOFSERVICE {
+		return &TransitionError{From: inst.Status, To: STARTING}
+	}
+	if err := m.Transition(app, inst, STARTING); err != nil {
+		return err
+	}
+	m.renew(inst)
+	return nil
+}
+
+// ApplyDrain makes the instance DRAINING once its planned termination is
+// within DrainLead, emitting an InstanceDraining event. Instances DOWN
+// whose lease expired are left DOWN. It reports whether the instance is
+// DRAINING.
+func (m *StateMachine) ApplyDrain(app string, inst *Instance) bool {
+	if inst.Status == DRAINING {
+		return true
+	}
+	if !m.drainDue(inst) || (inst.Status == DOWN && !m.now().Before(inst.leaseExpires)) {
+		return false
+	}
+	if err := m.Transition(app, inst, DRAINING); err != nil {
+		return false
+	}
+	m.emit(Event{Type: InstanceDraining, App: app, Instance: inst.Id, To: DRAINING})
+	return true
+}
+
+// ApplyExpiration changes an UP or DRAINING instance to DOWN if it has not
+// sent heartbeats within RenewalTimeout.
+func (m *StateMachine) ApplyExpiration(app string, inst *Instance) {
+	if inst.Status != UP && inst.Status != DRAINING {
+		// Instance holds no lease. Nothing to update.
+		return
+	}
+
+	if !m.now().Before(inst.leaseExpires) {
+		m.Transition(app, inst, DOWN)
+	}
+}
+
+// ApplyEviction reports whether the instance should be removed for not
+// sending heartbeats within EvictionTimeout, or for being deleted for longer
+// than TombstoneTimeout. An event is emitted if so.
+func (m *StateMachine) ApplyEviction(app string, inst *Instance) bool {
+	if m.now().Sub(inst.renewedAt) < m.evictionTimeout(inst) {
+		return false
+	}
+
+	m.emit(Event{Type: InstanceEvicted, App: app, Instance: inst.Id, From: inst.Status})
+	return true
+}
+
+// NextDeadline returns when the instance must be checked next: the end of
+// its lease if it is UP or DRAINING, or its eviction otherwise, unless it is
+// to be drained before.
+func (m *StateMachine) NextDeadline(inst *Instance) time.Time {
+	at := inst.renewedAt.Add(m.evictionTimeout(inst))
+	if inst.Status == UP || inst.Status == DRAINING {
+		at = inst.leaseExpires
+	}
+	if drain := m.drainAt(inst); (inst.Status == UP || inst.Status == STARTING) && !drain.IsZero() && drain.Before(at) {
+		at = drain
+	}
+	return at
+}
+
+// drainAt returns when the instance must be DRAINING, zero if it has no
+// planned termination.
+func (m *StateMachine) drainAt(inst *Instance) time.Time {
+	if inst.PlannedTermination.IsZero() {
+		return time.Time{}
+	}
+	return inst.PlannedTermination.Add(-m.DrainLead)
+}
+
+// drainDue reports whether the instance must be DRAINING by now.
+func (m *StateMachine) drainDue(inst *Instance) bool {
+	at := m.drainAt(inst)
+	return !at.IsZero() && !m.now().Before(at)
+}
+
+// evictionTimeout returns the time without heartbeats before the instance
+// is removed.
+func (m *StateMachine) evictionTimeout(inst *Instance) time.Duration {
+	if inst.Status == OUTOFSERVICE {
+		return m.TombstoneTimeout
+	}
+	return m.EvictionTimeout
+}
+
+// renew touches the instance and starts a new lease.
+func (m *StateMachine) renew(inst *Instance) {
+	inst.touch(m.now())
+	inst.leaseExpires = inst.renewedAt.Add(m.RenewalTimeout)
+}
+
+// emit sends the event to every listener.
+func (m *StateMachine) emit(e Event) {
+	e.Time = m.now()
+	for _, l := range m.Listeners {
+		l(e)
+	}
+}
+
+// logEvent writes a log line describing the event.
+func logEvent(e Event) {
+	switch e.Type {
+	case InstanceRegistered:
+		log.Printf("instance %s added to app %s", e.Instance, e.App)
+	case StatusChanged:
+		log.Printf("instance %s of app %s is now %s", e.Instance, e.App, e.To)
+	case InstanceEvicted:
+		log.Printf("removed instance %s of app %s", e.Instance, e.App)
+	case InstanceDraining:
+		log.Printf("instance %s of app %s is draining ahead of its planned termination", e.Instance, e.App)
+	case AppBelowMinHealthy:
+		log.Printf("app %s is below its minimum of healthy instances", e.App)
+	case AppHealthRestored:
+		log.Printf("app %s is back to its minimum of healthy instances", e.App)
+	case AppDown:
+		log.Printf("app %s has no instance up", e.App)
+	case AppUp:
+		log.Printf("app %s is up again", e.App)
+	case EvictionStorm:
+		log.Printf("%d instances evicted in the last minute", e.Count)
+	case AppArchived:
+		log.Printf("application %s archived", e.App)
+	case AppPurged:
+		log.Printf("application %s purged", e.App)
+	case AppExpired:
+		log.Printf("application %s expired, %d instances removed", e.App, e.Count)
+	case AppMoved:
+		log.Printf("application %s handed off with %d instances", e.App, e.Count)
+	case ClientBanned:
+		log.Printf("client %s banned after %d authentication failures", e.Client, e.Count)
+	}
+}
@@ -0,0 +1,456 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+func TestStateMachineAllowed(t *testing.T) {
+	m := NewStateMachine()
+	statuses := []StatusType{STARTING, UP, DOWN, OUTOFSERVICE}
+	allowed := map[[2]StatusType]bool{
+		{STARTING, UP}: true, {STARTING, OUTOFSERVICE}: true,
+		{UP, DOWN}: true, {UP, OUTOFSERVICE}: true,
+		{DOWN, UP}: true, {DOWN, OUTOFSERVICE}: true,
+		{OUTOFSERVICE, STARTING}: true,
+	}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			if got := m.Allowed(from, to); got != allowed[[2]StatusType{from, to}] {
+				t.Errorf("Allowed(%s, %s) = %t", from, to, got)
+			}
+		}
+	}
+}
+
+func TestStateMachineOperations(t *testing.T) {
+	tests := []struct {
+		name   string
+		from   StatusType
+		apply  func(m *StateMachine, inst *Instance) error
+		to     StatusType
+		err    error
+		events []EventType
+	}{
+		{"renew starting", STARTING, renewOp, UP, nil, []EventType{StatusChanged}},
+		{"renew up", UP, renewOp, UP, nil, nil},
+		{"renew down", DOWN, renewOp, UP, nil, []EventType{StatusChanged}},
+		{"renew out-of-service", OUTOFSERVICE, renewOp, OUTOFSERVICE, ErrOutOfService, nil},
+		{"delete up", UP, deleteOp, OUTOFSERVICE, nil, []EventType{StatusChanged}},
+		{"delete out-of-service", OUTOFSERVICE, deleteOp, OUTOFSERVICE, nil, nil},
+		{"restore out-of-service", OUTOFSERVICE, restoreOp, STARTING, nil, []EventType{StatusChanged}},
+		{"restore up", UP, restoreOp, UP, &TransitionError{From: UP, To: STARTING}, nil},
+		{"expire up", UP, expireOp, DOWN, nil, []EventType{StatusChanged}},
+		{"expire starting", STARTING, expireOp, STARTING, nil, nil},
+		{"expire out-of-service", OUTOFSERVICE, expireOp, OUTOFSERVICE, nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewStateMachine()
+			inst := NewInstance("i-1", "10.0.0.1", 8080)
+			inst.Status = tt.from
+
+			// Every operation is applied once the lease has expired, but
+			// before the instance is evicted.
+			idle(m, inst, m.RenewalTimeout+time.Second)
+			var events []EventType
+			m.Listeners = append(m.Listeners, func(e Event) { events = append(events, e.Type) })
+
+			err := tt.apply(m, inst)
+			if !reflect.DeepEqual(err, tt.err) {
+				t.Errorf("got error %v, want %v", err, tt.err)
+			}
+			if inst.Status != tt.to {
+				t.Errorf("instance is %s, want %s", inst.Status, tt.to)
+			}
+			if !reflect.DeepEqual(events, tt.events) {
+				t.Errorf("got events %v, want %v", events, tt.events)
+			}
+		})
+	}
+}
+
+// idle moves the last renewal of the instance d back in time.
+func idle(m *StateMachine, inst *Instance, d time.Duration) {
+	inst.renewedAt = time.Now().Add(-d)
+	inst.leaseExpires = inst.renewedAt.Add(m.RenewalTimeout)
+}
+
+func renewOp(m *StateMachine, inst *Instance) error   { return m.ApplyRenewal("app", inst) }
+func deleteOp(m *StateMachine, inst *Instance) error  { return m.ApplyDelete("app", inst) }
+func restoreOp(m *StateMachine, inst *Instance) error { return m.ApplyRestore("app", inst) }
+func expireOp(m *StateMachine, inst *Instance) error  { m.ApplyExpiration("app", inst); return nil }
+
+func TestStateMachineEviction(t *testing.T) {
+	m := NewStateMachine()
+	var evicted []Event
+	m.Listeners = append(m.Listeners, func(e Event) {
+		if e.Type == InstanceEvicted {
+			evicted = append(evicted, e)
+		}
+	})
+
+	renewed := NewInstance("i-1", "10.0.0.1", 8080)
+	renewed.Status = DOWN
+	idle(m, renewed, m.RenewalTimeout+time.Second)
+	down := NewInstance("i-2", "10.0.0.2", 8080)
+	down.Status = DOWN
+	idle(m, down, m.EvictionTimeout+time.Second)
+
+	// Deleted instances are kept for the tombstone timeout instead.
+	m.TombstoneTimeout = 2 * m.EvictionTimeout
+	deleted := NewInstance("i-3", "10.0.0.3", 8080)
+	deleted.Status = OUTOFSERVICE
+	idle(m, deleted, m.EvictionTimeout+time.Second)
+
+	if m.ApplyEviction("app", renewed) {
+		t.Errorf("instance evicted before %s without renewals", m.EvictionTimeout)
+	}
+	if m.ApplyEviction("app", deleted) {
+		t.Errorf("deleted instance evicted before %s", m.TombstoneTimeout)
+	}
+	if !m.ApplyEviction("app", down) {
+		t.Errorf("instance kept after %s without renewals", m.EvictionTimeout)
+	}
+	if len(evicted) != 1 || evicted[0].Instance != "i-2" || evicted[0].From != DOWN {
+		t.Errorf("got events %+v, want i-2 evicted", evicted)
+	}
+}
+
+func TestStateMachineNewStatus(t *testing.T) {
+	// Statuses are added by their transitions, such as a quarantine
+	// instances are put in by operators and brought back from by hand.
+	const quarantined StatusType = "quarantined"
+	m := NewStateMachine()
+	m.Transitions[UP] = append(m.Transitions[UP], quarantined)
+	m.Transitions[quarantined] = []StatusType{UP, OUTOFSERVICE}
+
+	inst := NewInstance("i-1", "10.0.0.1", 8080)
+	if err := m.ApplyRenewal("app", inst); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Transition("app", inst, quarantined); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Transition("app", inst, DOWN); !reflect.DeepEqual(err, &TransitionError{From: quarantined, To: DOWN}) {
+		t.Errorf("change of a quarantined instance to DOWN returned %v", err)
+	}
+	idle(m, inst, m.RenewalTimeout+time.Second)
+	m.ApplyExpiration("app", inst)
+	if inst.Status != quarantined {
+		t.Errorf("quarantined instance is %s after its lease", inst.Status)
+	}
+	if err := m.ApplyDelete("app", inst); err != nil || inst.Status != OUTOFSERVICE {
+		t.Errorf("deletion of a quarantined instance returned %v, instance is %s", err, inst.Status)
+	}
+}
+
+// opKind is an operation applied to an instance by a lifecycle.
+type opKind int
+
+const (
+	opRegister opKind = iota
+	opRenew
+	opDelete
+	opRestore
+	opOverride
+	opAdvance
+	opKinds
+)
+
+// op is a step of a lifecycle.
+type op struct {
+	kind opKind
+
+	// d is the time opAdvance lets pass, and for opRegister the
+	// time to the planned termination of the instance, if positive.
+	d time.Duration
+
+	// to is the status set by opOverride.
+	to StatusType
+}
+
+func (o op) String() string {
+	switch o.kind {
+	case opRegister:
+		if o.d > 0 {
+			return fmt.Sprintf("register(terminating in %s)", o.d)
+		}
+		return "register"
+	case opRenew:
+		return "renew"
+	case opDelete:
+		return "delete"
+	case opRestore:
+		return "restore"
+	case opOverride:
+		return "override(" + string(o.to) + ")"
+	}
+	return "advance(" + o.d.String() + ")"
+}
+
+// overrides are the statuses set by operators. DOWN is left out, as an
+// instance marked DOWN by hand is down whatever its lease.
+var overrides = []StatusType{STARTING, UP, DRAINING, OUTOFSERVICE}
+
+// lifecycle is a sequence of operations on an instance, registered again
+// whenever it is evicted.
+type lifecycle []op
+
+// Generate implements quick.Generator. Time advances are mostly shorter
+// than the renewal timeout, as renewals are, so leases are both kept and
+// lost.
+func (lifecycle) Generate(r *rand.Rand, size int) reflect.Value {
+	l := lifecycle{{kind: opRegister}}
+	for i := 0; i < size; i++ {
+		o := op{kind: opKind(r.Intn(int(opKinds)))}
+		switch o.kind {
+		case opRegister:
+			if r.Intn(2) == 0 {
+				o.d = time.Duration(r.Int63n(int64(30 * time.Minute)))
+			}
+		case opOverride:
+			o.to = overrides[r.Intn(len(overrides))]
+		case opAdvance:
+			if r.Intn(4) == 0 {
+				o.d = time.Duration(r.Int63n(int64(30 * time.Minute)))
+			} else {
+				o.d = time.Duration(r.Int63n(int64(2 * time.Minute)))
+			}
+		}
+		l = append(l, o)
+	}
+	return reflect.ValueOf(l)
+}
+
+// lifecycleRun applies a lifecycle to an instance, as the registry does:
+// its handlers apply the operations, and the scheduler checks the instance
+// at every deadline. As the StateMachine reads the real clock, time passes
+// by moving the instance back in time. It keeps what the instance went
+// through, to check the invariants of the StateMachine.
+type lifecycleRun struct {
+	m    *StateMachine
+	inst *Instance
+
+	// status is the status of the instance as told by the events.
+	status StatusType
+
+	// renewed is when the instance last renewed its lease successfully,
+	// and touched when its lease or tombstone last started.
+	renewed, touched time.Time
+
+	// err is the first invariant the events violated.
+	err error
+}
+
+func newLifecycleRun() *lifecycleRun {
+	run := &lifecycleRun{m: NewStateMachine()}
+	run.m.Listeners = append(run.m.Listeners, run.observe)
+	return run
+}
+
+// observe checks the events emitted follow the transitions allowed, from
+// the status the instance had.
+func (run *lifecycleRun) observe(e Event) {
+	if run.err != nil {
+		return
+	}
+	switch e.Type {
+	case InstanceRegistered:
+		if e.To != STARTING {
+			run.err = fmt.Errorf("instance registered %s", e.To)
+		}
+		run.status = e.To
+	case StatusChanged:
+		if e.From != run.status {
+			run.err = fmt.Errorf("instance changed from %s, but was %s", e.From, run.status)
+		} else if !run.m.Allowed(e.From, e.To) {
+			run.err = fmt.Errorf("instance changed from %s to %s", e.From, e.To)
+		}
+		run.status = e.To
+	case InstanceDraining:
+		if e.To != DRAINING || run.status != DRAINING {
+			run.err = fmt.Errorf("instance draining while %s", run.status)
+		}
+	case InstanceEvicted:
+		if e.From != run.status {
+			run.err = fmt.Errorf("instance evicted from %s, but was %s", e.From, run.status)
+		}
+	}
+}
+
+// pass lets d pass for the instance, moving its timestamps and the ones
+// of the run d back.
+func (run *lifecycleRun) pass(d time.Duration) {
+	inst := run.inst
+	inst.renewedAt = inst.renewedAt.Add(-d)
+	inst.leaseExpires = inst.leaseExpires.Add(-d)
+	if !inst.PlannedTermination.IsZero() {
+		inst.PlannedTermination = inst.PlannedTermination.Add(-d)
+	}
+	run.touched = run.touched.Add(-d)
+	if !run.renewed.IsZero() {
+		run.renewed = run.renewed.Add(-d)
+	}
+}
+
+// apply applies the operation, then checks the instance until its next
+// deadline is in the future.
+func (run *lifecycleRun) apply(o op) error {
+	inst := run.inst
+	switch {
+	case o.kind == opRegister && inst == nil:
+		inst = NewInstance("i-1", "10.0.0.1", 8080)
+		if o.d > 0 {
+			inst.PlannedTermination = time.Now().Add(o.d)
+		}
+		run.m.ApplyRegistration("app", inst)
+		run.inst, run.touched, run.renewed = inst, inst.renewedAt, time.Time{}
+	case inst == nil:
+	case o.kind == opRenew:
+		draining := inst.Status == DRAINING && !run.m.drainDue(inst)
+		err := run.m.ApplyRenewal("app", inst)
+		switch {
+		case inst.Status == OUTOFSERVICE && err != ErrOutOfService:
+			return fmt.Errorf("renewal of an out-of-service instance returned %v", err)
+		case draining && err == nil:
+			return fmt.Errorf("renewal of an instance drained by hand succeeded")
+		case inst.Status != OUTOFSERVICE && !draining && err != nil:
+			return fmt.Errorf("renewal of a %s instance failed: %v", inst.Status, err)
+		case err == nil:
+			run.renewed, run.touched = inst.renewedAt, inst.renewedAt
+		}
+	case o.kind == opDelete:
+		status := inst.Status
+		if err := run.m.ApplyDelete("app", inst); err != nil {
+			return fmt.Errorf("deletion of a %s instance failed: %v", status, err)
+		}
+		if inst.Status != OUTOFSERVICE {
+			return fmt.Errorf("deleted instance is %s", inst.Status)
+		}
+		if status != OUTOFSERVICE {
+			// Deleting again does not extend the tombstone.
+			run.touched = inst.renewedAt
+		}
+	case o.kind == opRestore:
+		status := inst.Status
+		err := run.m.ApplyRestore("app", inst)
+		if (err == nil) != (status == OUTOFSERVICE) {
+			return fmt.Errorf("restore of a %s instance returned %v", status, err)
+		}
+		if err == nil {
+			run.touched = inst.renewedAt
+		}
+	case o.kind == opOverride:
+		from := inst.Status
+		err := run.m.Transition("app", inst, o.to)
+		if allowed := from == o.to || run.m.Allowed(from, o.to); (err == nil) != allowed {
+			return fmt.Errorf("change from %s to %s returned %v", from, o.to, err)
+		}
+	case o.kind == opAdvance:
+		d := o.d
+		for run.inst != nil {
+			wait := time.Until(run.m.NextDeadline(run.inst))
+			if wait > d {
+				run.pass(d)
+				break
+			}
+			if wait > 0 {
+				run.pass(wait)
+				d -= wait
+			}
+			if err := run.check(); err != nil {
+				return err
+			}
+		}
+	}
+	for run.inst != nil && !run.m.NextDeadline(run.inst).After(time.Now()) {
+		if err := run.check(); err != nil {
+			return err
+		}
+	}
+	return run.verify()
+}
+
+// check lets the time pass until the next deadline of the instance, and
+// checks it as the scheduler does.
+func (run *lifecycleRun) check() error {
+	inst := run.inst
+	if wait := time.Until(run.m.NextDeadline(inst)); wait > 0 {
+		run.pass(wait)
+	}
+	run.m.ApplyDrain("app", inst)
+	run.m.ApplyExpiration("app", inst)
+	if run.m.ApplyEviction("app", inst) {
+		if idle := time.Since(run.touched); idle < run.m.evictionTimeout(inst) {
+			return fmt.Errorf("%s instance evicted after %s without renewals", inst.Status, idle)
+		}
+		run.inst = nil
+		return nil
+	}
+	if !run.m.NextDeadline(inst).After(time.Now()) {
+		return fmt.Errorf("%s instance still due once checked", inst.Status)
+	}
+	return nil
+}
+
+// verify checks the invariants of the instance.
+func (run *lifecycleRun) verify() error {
+	if run.err != nil {
+		return run.err
+	}
+	inst := run.inst
+	if inst == nil {
+		return nil
+	}
+	now := time.Now()
+	if _, ok := run.m.Transitions[inst.Status]; !ok {
+		return fmt.Errorf("instance is %q", inst.Status)
+	}
+	if inst.Status != run.status {
+		return fmt.Errorf("instance is %s, but the events tell %s", inst.Status, run.status)
+	}
+	if inst.Status == DOWN && !run.renewed.IsZero() && now.Sub(run.renewed) < run.m.RenewalTimeout {
+		return fmt.Errorf("instance is DOWN %s after renewing its lease", now.Sub(run.renewed))
+	}
+	if (inst.Status == UP || inst.Status == DRAINING) && !now.Before(inst.leaseExpires) {
+		return fmt.Errorf("instance is %s %s after its lease expired", inst.Status, now.Sub(inst.leaseExpires))
+	}
+	if idle := now.Sub(inst.renewedAt); idle >= run.m.evictionTimeout(inst) {
+		return fmt.Errorf("%s instance kept %s without renewals", inst.Status, idle)
+	}
+	if !inst.renewedAt.Equal(run.touched) {
+		return fmt.Errorf("instance last renewed at %s, want %s", inst.renewedAt, run.touched)
+	}
+	if (inst.Status == UP || inst.Status == STARTING) && run.m.drainDue(inst) {
+		return fmt.Errorf("instance is %s past its drain time", inst.Status)
+	}
+	return nil
+}
+
+func TestStateMachineLifecycles(t *testing.T) {
+	property := func(l lifecycle) bool {
+		run := newLifecycleRun()
+		for i, o := range l {
+			if err := run.apply(o); err != nil {
+				t.Logf("after %v: %s", l[:i+1], err)
+				return false
+			}
+		}
+		return true
+	}
+	config := &quick.Config{MaxCount: 2000, Rand: rand.New(rand.NewSource(1))}
+	if testing.Short() {
+		config.MaxCount = 200
+	}
+	if err := quick.Check(property, config); err != nil {
+		if e, ok := err.(*quick.CheckError); ok {
+			err = fmt.Errorf("lifecycle #%d violates an invariant", e.Count)
+		}
+		t.Error(err)
+	}
+}
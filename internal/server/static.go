@@ -0,0 +1,103 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// StaticApp is an app whose instances are declared along with the server,
+// such as an external database or a third-party API, so the registry is
+// the single source of endpoints.
+//
+// Static instances are shown as external. They are UP from the start,
+// unless they have a Probe, and never expire: they are not checked by the
+// scheduler, nor saved in the Store, and they cannot be renewed, deleted or
+// registered again through the API.
+type StaticApp struct {
+	// Name is the name of the app. It may also have registered instances.
+	Name string
+
+	// Probe, if set, checks the instances without a Probe of their own.
+	Probe *Probe
+
+	// Instances holds the instances of the app.
+	Instances []StaticInstance
+}
+
+// StaticInstance is an instance of a StaticApp. Instances without an id
+// are identified by their address.
+type StaticInstance struct {
+	model.Registration
+
+	// Probe, if set, is the only source of the instance health.
+	Probe *Probe
+}
+
+// seed adds the Static apps and instances, replacing the instances saved
+// with the same ids. It must be called with s.mu held.
+func (s *Server) seed() error {
+	for _, sa := range s.Static {
+		if sa.Name == "" {
+			return fmt.Errorf("static app without a name")
+		}
+		if err := checkAppName(sa.Name); err != nil {
+			return err
+		}
+		app := s.GetApplication(sa.Name)
+		if app == nil {
+			app = NewApplication(sa.Name)
+			s.Applications = append(s.Applications, app)
+		}
+
+		for _, si := range sa.Instances {
+			reg := si.Registration
+			if err := reg.Validate(); err != nil {
+				return fmt.Errorf("static app %s: %s", sa.Name, err)
+			}
+			if err := checkInstanceId(reg.Id); err != nil {
+				return fmt.Errorf("static app %s: %s", sa.Name, err)
+			}
+			if reg.Id == "" {
+				// Never clashes with a path suffix, as the port is a number.
+				reg.Id = net.JoinHostPort(reg.Ip, strconv.Itoa(reg.Port))
+			}
+			if old := app.GetInstance(reg.Id); old != nil {
+				app.removeInstance(old)
+				s.unschedule(old)
+			}
+
+			inst := NewInstance(reg.Id, reg.Ip, reg.Port)
+			inst.Metadata = reg.Metadata
+			inst.DeploymentGroup = reg.Group
+			inst.Generation, _ = app.nextGeneration(inst.Id, 0)
+			inst.static = true
+			app.generations[inst.Id] = inst.Generation
+			app.Instances = append(app.Instances, inst)
+			s.States.ApplyRegistration(app.Name, inst)
+			// Static instances hold no lease.
+			inst.leaseExpires = time.Time{}
+
+			probe := si.Probe
+			if probe == nil {
+				probe = sa.Probe
+			}
+			if probe == nil {
+				s.States.Transition(app.Name, inst, UP)
+				continue
+			}
+			p, err := probe.withDefaults()
+			if err != nil {
+				return fmt.Errorf("static instance %s of app %s: %s", inst.Id, sa.Name, err)
+			}
+			go s.runProbe(app.Name, inst, p)
+		}
+		s.publish(app)
+		log.Printf("static app %s has %d instances", app.Name, len(sa.Instances))
+	}
+	return nil
+}
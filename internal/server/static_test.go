@@ -0,0 +1,45 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/numercfd/registro/model"
+)
+
+func TestSeedNames(t *testing.T) {
+	instance := func(id string) StaticInstance {
+		return StaticInstance{Registration: model.Registration{Id: id, Ip: "10.0.0.1", Port: 5432}}
+	}
+	tests := []struct {
+		app StaticApp
+		ok  bool
+	}{
+		{StaticApp{Name: "db", Instances: []StaticInstance{instance("")}}, true},
+		{StaticApp{Name: "db", Instances: []StaticInstance{instance("primary")}}, true},
+		{StaticApp{Name: "db:restore"}, false},
+		{StaticApp{Name: "db", Instances: []StaticInstance{instance("primary:restore")}}, false},
+		{StaticApp{Name: "db", Instances: []StaticInstance{instance("a/b")}}, false},
+	}
+	for _, tt := range tests {
+		s := NewServer("")
+		s.Static = []StaticApp{tt.app}
+		s.mu.Lock()
+		err := s.seed()
+		s.mu.Unlock()
+		if (err == nil) != tt.ok {
+			t.Errorf("seeding %+v returned %v", tt.app, err)
+		}
+	}
+
+	// Instances without an id are named after their address.
+	s := NewServer("")
+	s.Static = []StaticApp{{Name: "db", Instances: []StaticInstance{instance("")}}}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.seed(); err != nil {
+		t.Fatal(err)
+	}
+	if s.GetApplication("db").GetInstance("10.0.0.1:5432") == nil {
+		t.Error("static instance not named after its address")
+	}
+}
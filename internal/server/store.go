@@ -0,0 +1,379 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ChangeType identifies the kind of change written to a Store.
+type ChangeType int
+
+const (
+	// PutApplication creates an application.
+	PutApplication ChangeType = iota
+
+	// PutInstance creates or replaces an instance.
+	PutInstance
+
+	// RenewInstance replaces an instance whose only change was a renewal.
+	RenewInstance
+
+	// DeleteInstance removes an instance.
+	DeleteInstance
+
+	// DeleteApplication removes an application and its instances.
+	DeleteApplication
+)
+
+// Change is a single modification of the registry state.
+type Change struct {
+	// Type identifies the kind of change.
+	Type ChangeType
+
+	// App is the name of the application changed.
+	App string
+
+	// Instance holds a copy of the instance changed, if any.
+	Instance *Instance
+
+	// ActiveGroup holds the active deployment group of the application.
+	ActiveGroup string
+
+	// MinHealthy holds the minimum of healthy instances of the application.
+	MinHealthy int
+
+	// TTL holds the discovery TTL override of the application.
+	TTL time.Duration
+
+	// Archived holds whether the application is archived.
+	Archived bool
+
+	// Environment holds the environment of the application.
+	Environment string
+
+	// ExpiresAt holds when the application expires, if it does.
+	ExpiresAt time.Time
+}
+
+// key identifies the record a change applies to. Changes with the same key
+// may be coalesced, keeping only the latest.
+func (c Change) key() string {
+	if c.Instance == nil {
+		return c.App
+	}
+	return c.App + "/" + c.Instance.Id
+}
+
+// Store persists the registry state so it survives restarts.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Load returns the applications saved in the store.
+	Load() ([]*Application, error)
+
+	// Write applies a batch of changes to the store.
+	Write(batch []Change) error
+
+	// Close releases any resource held by the store.
+	Close() error
+}
+
+// NewFileStore returns a Store which keeps the registry in a JSON file.
+func NewFileStore(path string) *FileStore {
+	return &FileStore{
+		Path:     path,
+		apps:     make(map[string]map[string]instanceRecord),
+		settings: make(map[string]appRecord),
+	}
+}
+
+// FileStore is a Store which keeps the registry in a JSON file.
+// The whole file is rewritten atomically on every write, so it is meant to
+// be used with a write buffer coalescing renewals.
+type FileStore struct {
+	// Path is the location of the JSON file.
+	Path string
+
+	// Keys, if set, encrypts the files. Unencrypted files are still read,
+	// and encrypted on the next write.
+	Keys *Keyring
+
+	// mu protects apps, settings, events and the files.
+	mu sync.Mutex
+
+	// apps mirrors the content of the file.
+	apps map[string]map[string]instanceRecord
+
+	// settings holds the app level fields of every app, without instances.
+	settings map[string]appRecord
+
+	// events mirrors the content of the events file, next to the registry
+	// file.
+	events []Event
+}
+
+// instanceRecord is the persisted representation of an Instance.
+type instanceRecord struct {
+	Id          string            `json:"id"`
+	IPAddr      string            `json:"ip"`
+	Port        int               `json:"port"`
+	Status      StatusType        `json:"status"`
+	LastRenewal int64             `json:"lastRenewal"`
+	LeaseId     string            `json:"leaseId"`
+	Generation  uint64            `json:"generation"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Version     uint64            `json:"version"`
+	Group       string            `json:"deploymentGroup,omitempty"`
+	Terminates  *time.Time        `json:"plannedTerminationTime,omitempty"`
+	Registered  *time.Time        `json:"registeredAt,omitempty"`
+	FirstUp     *time.Time        `json:"firstUpAt,omitempty"`
+	Changed     *time.Time        `json:"lastStatusChangeAt,omitempty"`
+}
+
+// appRecord is the persisted representation of an Application.
+type appRecord struct {
+	Name        string           `json:"name"`
+	ActiveGroup string           `json:"activeGroup,omitempty"`
+	MinHealthy  int              `json:"minHealthyInstances,omitempty"`
+	TTL         float64          `json:"ttl,omitempty"`
+	Archived    bool             `json:"archived,omitempty"`
+	Environment string           `json:"environment,omitempty"`
+	ExpiresAt   *time.Time       `json:"expiresAt,omitempty"`
+	Instances   []instanceRecord `json:"instances"`
+}
+
+// newInstanceRecord returns the record of the instance.
+func newInstanceRecord(i *Instance) instanceRecord {
+	return instanceRecord{i.Id, i.IPAddr, i.Port, i.Status, i.LastRenewal, i.LeaseId, i.Generation, i.Metadata, i.Version, i.DeploymentGroup,
+		timeRef(i.PlannedTermination), timeRef(i.RegisteredAt), timeRef(i.FirstUpAt), timeRef(i.StatusChangedAt)}
+}
+
+// instance returns the Instance of the record.
+func (r instanceRecord) instance() *Instance {
+	inst := NewInstance(r.Id, r.IPAddr, r.Port)
+	inst.Status = r.Status
+	inst.LastRenewal = r.LastRenewal
+	inst.LeaseId = r.LeaseId
+	inst.Generation = r.Generation
+	inst.Metadata = r.Metadata
+	inst.Version = r.Version
+	inst.DeploymentGroup = r.Group
+	inst.PlannedTermination = timeOf(r.Terminates)
+	inst.RegisteredAt = timeOf(r.Registered)
+	inst.FirstUpAt = timeOf(r.FirstUp)
+	inst.StatusChangedAt = timeOf(r.Changed)
+	return inst
+}
+
+// newAppRecord returns the record of the app, with its instances.
+func newAppRecord(app *Application) appRecord {
+	a := appRecord{Name: app.Name, ActiveGroup: app.ActiveGroup, MinHealthy: app.MinHealthy, TTL: app.TTL.Seconds(), Archived: app.Archived,
+		Environment: app.Environment, ExpiresAt: timeRef(app.ExpiresAt), Instances: make([]instanceRecord, 0, len(app.Instances))}
+	for _, inst := range app.Instances {
+		a.Instances = append(a.Instances, newInstanceRecord(inst))
+	}
+	return a
+}
+
+// application returns the Application of the record, without its
+// instances.
+func (a appRecord) application() *Application {
+	app := NewApplication(a.Name)
+	app.ActiveGroup = a.ActiveGroup
+	app.MinHealthy = a.MinHealthy
+	app.TTL = time.Duration(a.TTL * float64(time.Second))
+	app.Archived = a.Archived
+	app.Environment = a.Environment
+	app.ExpiresAt = timeOf(a.ExpiresAt)
+	return app
+}
+
+// timeRef returns a reference to a copy of t, nil if it is zero, for the
+// optional times of records.
+func timeRef(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// timeOf returns the time referenced by t, zero if it is nil.
+func timeOf(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+// Load implements Store.
+// A missing file is handled as an empty registry, and a file saved with
+// another schema version as a *SchemaError: see Migrate.
+func (f *FileStore) Load() ([]*Application, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := f.readFile(f.Path)
+	if os.IsNotExist(err) {
+		return make([]*Application, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		SchemaVersion int         `json:"schemaVersion"`
+		Apps          []appRecord `json:"applications"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.SchemaVersion == 0 {
+		file.SchemaVersion = 1
+	}
+	if v := SchemaVersion(FileBackend); file.SchemaVersion != v {
+		return nil, &SchemaError{Backend: FileBackend, Found: file.SchemaVersion, Expected: v}
+	}
+
+	apps := make([]*Application, 0, len(file.Apps))
+	for _, a := range file.Apps {
+		app := a.application()
+		f.settings[a.Name] = appRecord{Name: a.Name, ActiveGroup: a.ActiveGroup, MinHealthy: a.MinHealthy, TTL: a.TTL, Archived: a.Archived,
+			Environment: a.Environment, ExpiresAt: a.ExpiresAt}
+		f.apps[a.Name] = make(map[string]instanceRecord)
+		for _, r := range a.Instances {
+			app.Instances = append(app.Instances, r.instance())
+			f.apps[a.Name][r.Id] = r
+		}
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+// Write implements Store.
+func (f *FileStore) Write(batch []Change) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, c := range batch {
+		if c.Type == DeleteApplication {
+			delete(f.apps, c.App)
+			delete(f.settings, c.App)
+			continue
+		}
+
+		insts, ok := f.apps[c.App]
+		if !ok && c.Type != PutApplication {
+			// The app was deleted, its instances must not bring it back.
+			continue
+		}
+		if !ok {
+			insts = make(map[string]instanceRecord)
+			f.apps[c.App] = insts
+		}
+
+		switch c.Type {
+		case PutApplication:
+			f.settings[c.App] = appRecord{Name: c.App, ActiveGroup: c.ActiveGroup, MinHealthy: c.MinHealthy, TTL: c.TTL.Seconds(), Archived: c.Archived,
+				Environment: c.Environment, ExpiresAt: timeRef(c.ExpiresAt)}
+		case PutInstance, RenewInstance:
+			insts[c.Instance.Id] = newInstanceRecord(c.Instance)
+		case DeleteInstance:
+			delete(insts, c.Instance.Id)
+		}
+	}
+	return f.save()
+}
+
+// Close implements Store.
+func (f *FileStore) Close() error {
+	return nil
+}
+
+// save writes the content of f.apps to the file.
+func (f *FileStore) save() error {
+	var file struct {
+		SchemaVersion int         `json:"schemaVersion"`
+		Apps          []appRecord `json:"applications"`
+	}
+	file.SchemaVersion = SchemaVersion(FileBackend)
+	file.Apps = make([]appRecord, 0, len(f.apps))
+	for name, insts := range f.apps {
+		a := f.settings[name]
+		a.Name = name
+		a.Instances = make([]instanceRecord, 0, len(insts))
+		for _, r := range insts {
+			a.Instances = append(a.Instances, r)
+		}
+		file.Apps = append(file.Apps, a)
+	}
+
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	return f.writeFile(f.Path, data)
+}
+
+// eventsPath returns the location of the file keeping the events.
+func (f *FileStore) eventsPath() string {
+	return f.Path + ".events"
+}
+
+// LoadEvents implements EventStore.
+// A missing file is handled as an empty history.
+func (f *FileStore) LoadEvents() ([]Event, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	data, err := f.readFile(f.eventsPath())
+	if os.IsNotExist(err) {
+		return make([]Event, 0), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.events); err != nil {
+		return nil, err
+	}
+	return append([]Event(nil), f.events...), nil
+}
+
+// WriteEvents implements EventStore.
+func (f *FileStore) WriteEvents(events []Event, since time.Time, max int) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.events = trimEvents(append(f.events, events...), since, max)
+
+	data, err := json.Marshal(f.events)
+	if err != nil {
+		return err
+	}
+	return f.writeFile(f.eventsPath(), data)
+}
+
+// writeFile replaces the file at path with data.
+// The file is replaced atomically, so a crash never leaves it half written.
+func writeFile(path string, data []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestFileStoreIgnoresInstancesOfUnknownApps(t *testing.T) {
+	f := NewFileStore(t.TempDir() + "/registry.json")
+	inst := NewInstance("i-1", "10.0.0.1", 8080)
+	batches := [][]Change{
+		{{Type: PutApplication, App: "app0"}, {Type: PutInstance, App: "app0", Instance: inst}},
+		{{Type: DeleteApplication, App: "app0"}},
+		{{Type: RenewInstance, App: "app0", Instance: inst}, {Type: PutInstance, App: "app1", Instance: inst}},
+	}
+	for _, batch := range batches {
+		if err := f.Write(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	apps, err := NewFileStore(f.Path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 0 {
+		t.Errorf("loaded %d apps, want none", len(apps))
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// streamFrame is a frame written to an agent stream.
+type streamFrame struct {
+	typ     model.FrameType
+	payload []byte
+}
+
+// streamHandler is the HTTP handler for /stream, the agent stream (see
+// model.FrameType). Frames are applied in order, and the ones failing are
+// answered with an ErrorFrame.
+func (s *Server) streamHandler(w http.ResponseWriter, r *http.Request) {
+	rc := http.NewResponseController(w)
+	// HTTP/1.1 needs it to read the request while writing the response,
+	// HTTP/2 streams are always full duplex.
+	rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", model.StreamContentType)
+	w.WriteHeader(200)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	out := make(chan streamFrame, 64)
+	watch := make(chan string, 16)
+	done := make(chan struct{})
+	go func() {
+		defer close(out)
+		br := bufio.NewReader(r.Body)
+		for {
+			typ, payload, err := model.ReadFrame(br)
+			if err != nil {
+				return
+			}
+			if typ == model.WatchFrame {
+				select {
+				case watch <- string(payload):
+				case <-done:
+				}
+				continue
+			}
+			if f, ok := s.applyFrame(typ, payload); !ok {
+				select {
+				case out <- f:
+				case <-done:
+				}
+			}
+		}
+	}()
+
+	// The reader stops once the handler returns, as the body is closed.
+	s.writeStream(w, rc, out, watch)
+	close(done)
+}
+
+// applyFrame applies a frame received on an agent stream. It returns the
+// ErrorFrame to send back and false if it failed.
+func (s *Server) applyFrame(typ model.FrameType, payload []byte) (streamFrame, bool) {
+	serr := model.StreamError{Frame: typ}
+	switch typ {
+	case model.HeartbeatFrame:
+		if h, err := model.ParseHeartbeat(payload); err == nil {
+			serr.App, serr.Id = h.App, h.Id
+		}
+		serr.Error = s.heartbeat(payload)
+	case model.StatusFrame:
+		var c model.StatusChange
+		if err := json.Unmarshal(payload, &c); err != nil {
+			serr.Error = err.Error()
+			break
+		}
+		serr.App, serr.Id = c.App, c.Id
+		if err := s.changeStatus(c); err != nil {
+			serr.Error = err.Error()
+		}
+	default:
+		serr.Error = fmt.Sprintf("unknown frame type %d", typ)
+	}
+	if serr.Error == "" {
+		return streamFrame{}, true
+	}
+
+	data, _ := json.Marshal(serr)
+	return streamFrame{typ: model.ErrorFrame, payload: data}, false
+}
+
+// changeStatus applies a StatusFrame: UP renews the instance, OUTOFSERVICE
+// deletes it.
+func (s *Server) changeStatus(c model.StatusChange) error {
+	if s.ReadOnly().Enabled {
+		return fmt.Errorf("registry is read-only")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app := s.GetApplication(c.App)
+	if app == nil {
+		return fmt.Errorf("unknown app %s", c.App)
+	}
+	inst := app.GetInstance(c.Id)
+	switch {
+	case inst == nil:
+		return fmt.Errorf("unknown instance %s", c.Id)
+	case c.LeaseId != inst.LeaseId:
+		return fmt.Errorf("invalid lease")
+	case c.Generation != 0 && c.Generation != inst.Generation:
+		return fmt.Errorf("stale generation")
+	}
+
+	switch c.Status {
+	case UP:
+		return s.renew(app, inst, nil, time.Time{})
+	case OUTOFSERVICE:
+		if err := s.States.ApplyDelete(app.Name, inst); err != nil {
+			return err
+		}
+		s.schedule(app, inst)
+		s.record(PutInstance, app, inst)
+		s.publish(app)
+		return nil
+	default:
+		return fmt.Errorf("status %s cannot be requested", c.Status)
+	}
+}
+
+// writeStream writes the frames sent to out to an agent stream, along with
+// the apps watched whenever they change, until out is closed, the agent is
+// gone or the server shuts down.
+func (s *Server) writeStream(w http.ResponseWriter, rc *http.ResponseController, out <-chan streamFrame, watch <-chan string) {
+	// wt is nil, and never ready, until the first watch.
+	var wt *watcher
+	var changes chan change
+	// watched holds the catalog version last sent of every app watched,
+	// older changes still queued are skipped.
+	watched := make(map[string]uint64)
+	defer func() {
+		if wt != nil {
+			s.watchers.unsubscribe(wt)
+		}
+	}()
+
+	write := func(f streamFrame) bool {
+		if err := model.WriteFrame(w, f.typ, f.payload); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+	sendApp := func(app *Application) bool {
+		if app == nil {
+			return true
+		}
+		data, err := json.Marshal(app.inGroup("").view())
+		if err != nil {
+			log.Printf("stream error: %s", err)
+			return true
+		}
+		return write(streamFrame{typ: model.AppFrame, payload: data})
+	}
+	// resync sends the current copy of every app watched, once subscribed
+	// again after being evicted for falling behind.
+	resync := func() bool {
+		names := make([]string, 0, len(watched))
+		for name := range watched {
+			names = append(names, name)
+		}
+		wt = s.watchers.subscribe(s.WatchQueue, false, names...)
+		changes = wt.C
+		c := s.snapshot()
+		for _, name := range names {
+			watched[name] = c.Version
+			if !sendApp(c.GetApplication(name)) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for {
+		ok := true
+		select {
+		case f, open := <-out:
+			if !open {
+				return
+			}
+			ok = write(f)
+		case name := <-watch:
+			if _, found := watched[name]; found {
+				break
+			}
+			watched[name] = 0
+			if wt == nil {
+				ok = resync()
+				break
+			}
+			s.watchers.watch(wt, name)
+			c := s.snapshot()
+			watched[name] = c.Version
+			ok = sendApp(c.GetApplication(name))
+		case c, open := <-changes:
+			if !open {
+				ok = resync()
+				break
+			}
+			if c.Version > watched[c.App] {
+				watched[c.App] = c.Version
+				ok = sendApp(c.Copy)
+			}
+		case <-s.closing:
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+}
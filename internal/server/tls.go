@@ -0,0 +1,29 @@
+package server
+
+import "crypto/tls"
+
+// DefaultTLSConfig returns the TLS configuration of the listeners serving
+// HTTPS when the server has no TLSConfig: TLS 1.2 or later, with forward
+// secret AEAD cipher suites only. The key exchange curves are the Go
+// defaults.
+func DefaultTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+	}
+}
+
+// tlsConfig returns a copy of the TLS configuration of the listeners.
+func (s *Server) tlsConfig() *tls.Config {
+	if s.TLSConfig == nil {
+		return DefaultTLSConfig()
+	}
+	return s.TLSConfig.Clone()
+}
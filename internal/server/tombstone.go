@@ -0,0 +1,149 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// deleteApp removes the application from the catalog, keeping it as a
+// tombstone which may be restored within the States.TombstoneTimeout.
+// It must be called with s.mu held.
+func (s *Server) deleteApp(app *Application, w http.ResponseWriter, r *http.Request) {
+	apps := make([]*Application, 0, len(s.Applications))
+	for _, a := range s.Applications {
+		if a != app {
+			apps = append(apps, a)
+		}
+	}
+	s.Applications = apps
+
+	// Instances of deleted apps are neither renewed nor evicted.
+	for _, inst := range app.Instances {
+		s.unschedule(inst)
+	}
+	app.deletedAt = time.Now()
+	s.tombstones = append(s.tombstones, app)
+	app.purgeTimer = time.AfterFunc(s.States.TombstoneTimeout, func() {
+		s.purge(app)
+	})
+
+	s.record(DeleteApplication, app, nil)
+	s.unpublish(app)
+	w.WriteHeader(204)
+	log.Printf("application %s deleted", app.Name)
+}
+
+// purge permanently removes a deleted application, unless it was restored.
+func (s *Server) purge(app *Application) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.removeTombstone(app) {
+		log.Printf("application %s purged", app.Name)
+	}
+}
+
+// removeTombstone removes the app from the tombstones list.
+// It returns false if the app is not there. It must be called with s.mu held.
+func (s *Server) removeTombstone(app *Application) bool {
+	for i, a := range s.tombstones {
+		if a == app {
+			s.tombstones = append(s.tombstones[:i], s.tombstones[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// getTombstone returns the most recently deleted application with the name.
+// It must be called with s.mu held.
+func (s *Server) getTombstone(name string) *Application {
+	for i := len(s.tombstones) - 1; i >= 0; i-- {
+		if s.tombstones[i].Name == name {
+			return s.tombstones[i]
+		}
+	}
+	return nil
+}
+
+// restoreAppHandler is the HTTP handler for /apps/{appName}:restore.
+func (s *Server) restoreAppHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := mux.Vars(r)["appName"]
+	app := s.getTombstone(name)
+	if app == nil {
+		w.WriteHeader(404)
+		return
+	}
+	if s.GetApplication(name) != nil {
+		// An app with the same name was created after the deletion.
+		w.WriteHeader(409)
+		return
+	}
+
+	s.removeTombstone(app)
+	app.purgeTimer.Stop()
+	app.deletedAt = time.Time{}
+	s.Applications = append(s.Applications, app)
+	s.record(PutApplication, app, nil)
+	for _, inst := range app.Instances {
+		// The time spent deleted does not count against the instances.
+		inst.touch(s.now())
+		s.States.ApplyLoad(app.Name, inst)
+		s.schedule(app, inst)
+		s.record(PutInstance, app, inst)
+	}
+	s.publish(app)
+	w.WriteHeader(204)
+	log.Printf("application %s restored", app.Name)
+}
+
+// restoreInstanceHandler is the HTTP handler for /apps/{appName}/{instanceId}:restore.
+// It brings an out-of-service instance back to STARTING.
+func (s *Server) restoreInstanceHandler(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars := mux.Vars(r)
+	app := s.GetApplication(vars["appName"])
+	if app == nil {
+		w.WriteHeader(404)
+		return
+	}
+	inst := app.GetInstance(vars["instanceId"])
+	if inst == nil {
+		w.WriteHeader(404)
+		return
+	}
+
+	if err := s.States.ApplyRestore(app.Name, inst); err != nil {
+		log.Printf("cannot restore instance %s: %s", inst.Id, err)
+		w.WriteHeader(409)
+		return
+	}
+	s.schedule(app, inst)
+	s.record(PutInstance, app, inst)
+	s.publish(app)
+	w.WriteHeader(204)
+}
+
+// listTombstones writes the list of deleted applications to w.
+func (s *Server) listTombstones(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	env := environmentOf(r)
+	apps := make([]*Application, 0, len(s.tombstones))
+	for _, app := range s.tombstones {
+		if env.sees(app) {
+			apps = append(apps, app.copy())
+		}
+	}
+	data, err := encodeJSON(appList(apps), isPretty(r))
+	writeBody(w, 200, data, err)
+}
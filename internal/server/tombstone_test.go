@@ -0,0 +1,73 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRestoreAppRenewsLeases(t *testing.T) {
+	s := NewServer("")
+	populate(s, 1, 3)
+	h := s.Handler()
+	app := s.GetApplication("app0")
+
+	expect(t, do(h, "DELETE", "/apps/app0", ""), 204)
+	// The app stays deleted for longer than its instances would be kept.
+	for _, inst := range app.Instances {
+		idle(s.States, inst, 2*s.States.EvictionTimeout)
+	}
+	expect(t, do(h, "POST", "/apps/app0:restore", ""), 204)
+
+	s.mu.Lock()
+	for _, inst := range app.Instances {
+		s.checkInstance(app, inst)
+	}
+	s.mu.Unlock()
+
+	app = s.snapshot().GetApplication("app0")
+	if app == nil {
+		t.Fatal("restored app is missing")
+	}
+	if len(app.Instances) != 3 {
+		t.Fatalf("restored app has %d instances, want 3", len(app.Instances))
+	}
+	for _, inst := range app.Instances {
+		if inst.Status != UP {
+			t.Errorf("instance %s is %s after the restore, want %s", inst.Id, inst.Status, UP)
+		}
+	}
+}
+
+func TestRestoreAppStopsPurge(t *testing.T) {
+	s := NewServer("")
+	s.States.TombstoneTimeout = time.Hour
+	populate(s, 1, 1)
+	h := s.Handler()
+	app := s.GetApplication("app0")
+
+	expect(t, do(h, "DELETE", "/apps/app0", ""), 204)
+	first := app.purgeTimer
+	expect(t, do(h, "POST", "/apps/app0:restore", ""), 204)
+	if first.Stop() {
+		t.Error("restored app still to be purged")
+	}
+
+	// Deleting it again purges it a whole timeout later.
+	expect(t, do(h, "DELETE", "/apps/app0", ""), 204)
+	if app.purgeTimer == first || !app.purgeTimer.Stop() {
+		t.Error("app deleted again is not to be purged")
+	}
+}
+
+func TestNamesWithSuffixes(t *testing.T) {
+	s := NewServer("")
+	populate(s, 1, 0)
+	h := s.Handler()
+	for _, name := range []string{"web:restore", "web/api"} {
+		expect(t, do(h, "POST", "/apps", `{"name": "`+name+`"}`), 400)
+	}
+	for _, id := range []string{"i-1:restore", "i-1/metadata"} {
+		expect(t, do(h, "POST", "/apps/app0", `{"id": "`+id+`", "ip": "10.0.0.1", "port": 8080}`), 400)
+	}
+	expect(t, do(h, "POST", "/apps", `{"name": "web"}`), 201)
+}
@@ -0,0 +1,31 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ttl returns how long discovery responses about the app may be reused.
+func (s *Server) ttl(app *Application) time.Duration {
+	if app.TTL > 0 {
+		return app.TTL
+	}
+	return s.DiscoveryTTL
+}
+
+// setCacheControl sets the Cache-Control header of a discovery response
+// about apps, so clients reuse it for the shortest of their TTLs.
+func (s *Server) setCacheControl(w http.ResponseWriter, apps ...*Application) {
+	ttl := s.DiscoveryTTL
+	for i, app := range apps {
+		if t := s.ttl(app); i == 0 || t < ttl {
+			ttl = t
+		}
+	}
+	if ttl <= 0 {
+		w.Header().Set("Cache-Control", "no-cache")
+		return
+	}
+	w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(ttl.Seconds())))
+}
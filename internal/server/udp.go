@@ -0,0 +1,83 @@
+package server
+
+import (
+	"expvar"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// heartbeatSkew is how far the time of a UDP heartbeat may be from the SR
+// clock. Older packets are dropped, so they cannot be replayed later.
+const heartbeatSkew = 30 * time.Second
+
+// heartbeats publishes the number of UDP heartbeats accepted and dropped,
+// and heartbeatDrops the ones dropped by reason.
+var (
+	heartbeats     = expvar.NewMap("udpHeartbeats")
+	heartbeatDrops = expvar.NewMap("udpHeartbeatsDropped")
+)
+
+// serveHeartbeats renews the instances sending UDP heartbeats to conn,
+// until it is closed. Packets are never answered: lost or dropped ones are
+// tolerated by the lease, like missed HTTP renewals. Drops are counted
+// rather than logged, as a flood of forged packets would flood the log.
+func (s *Server) serveHeartbeats(conn net.PacketConn) {
+	buf := make([]byte, 1024)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			// The connection is closed on shutdown.
+			return
+		}
+		if reason := s.heartbeat(buf[:n]); reason != "" {
+			heartbeats.Add("dropped", 1)
+			kind, _, _ := strings.Cut(reason, ":")
+			heartbeatDrops.Add(kind, 1)
+			continue
+		}
+		heartbeats.Add("accepted", 1)
+	}
+}
+
+// heartbeat renews the instance sending the packet. It returns why the
+// packet was dropped, if it was, followed by the details after a colon.
+func (s *Server) heartbeat(packet []byte) string {
+	h, err := model.ParseHeartbeat(packet)
+	if err != nil {
+		return "malformed packet: " + err.Error()
+	}
+	if skew := time.Since(time.UnixMilli(h.Time)); skew > heartbeatSkew || skew < -heartbeatSkew {
+		return "stale packet"
+	}
+	if s.ReadOnly().Enabled {
+		return "registry is read-only"
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	app := s.GetApplication(h.App)
+	if app == nil {
+		return "unknown app: " + h.App
+	}
+	inst := app.GetInstance(h.Id)
+	switch {
+	case inst == nil:
+		return "unknown instance: " + h.Id
+	case !model.VerifyHeartbeat(packet, inst.LeaseId):
+		return "invalid signature"
+	case h.Generation != inst.Generation:
+		return "stale generation"
+	case h.Time <= inst.heartbeatTime:
+		// Both times are told by the instance clock, unlike LastRenewal.
+		return "replayed packet"
+	}
+	if err := s.renew(app, inst, nil, time.UnixMilli(h.Time)); err != nil {
+		return "renewal failed: " + err.Error()
+	}
+	inst.heartbeatTime = h.Time
+	return ""
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"expvar"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+func TestHeartbeatReplay(t *testing.T) {
+	s := NewServer("")
+	populate(s, 1, 1)
+	inst := s.GetApplication("app0").GetInstance("i-0")
+
+	// The instance clock is 10s behind the registry one.
+	sent := time.Now().Add(-10 * time.Second).UnixMilli()
+	packet := func(at int64) []byte {
+		h := model.Heartbeat{App: "app0", Id: inst.Id, Generation: inst.Generation, Time: at}
+		b, err := h.Marshal(inst.LeaseId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	tests := []struct {
+		at     int64
+		reason string
+	}{
+		{sent, ""},
+		{sent, "replayed packet"},
+		{sent - 1, "replayed packet"},
+		{sent + 1, ""},
+		{sent + 2, ""},
+	}
+	for _, test := range tests {
+		if reason := s.heartbeat(packet(test.at)); reason != test.reason {
+			t.Errorf("heartbeat sent at %dms dropped with %q, want %q", test.at-sent, reason, test.reason)
+		}
+	}
+}
+
+func TestHeartbeatDrops(t *testing.T) {
+	s := NewServer("")
+	populate(s, 1, 1)
+	inst := s.GetApplication("app0").GetInstance("i-0")
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go s.serveHeartbeats(conn)
+
+	counter := func(m *expvar.Map, key string) int64 {
+		if v, ok := m.Get(key).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	dropped, malformed, replayed := counter(heartbeats, "dropped"), counter(heartbeatDrops, "malformed packet"), counter(heartbeatDrops, "replayed packet")
+
+	h := model.Heartbeat{App: "app0", Id: inst.Id, Generation: inst.Generation, Time: time.Now().UnixMilli()}
+	packet, err := h.Marshal(inst.LeaseId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, p := range [][]byte{[]byte("forged"), packet, packet} {
+		if _, err := client.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for counter(heartbeats, "dropped") < dropped+2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := counter(heartbeatDrops, "malformed packet") - malformed; n != 1 {
+		t.Errorf("%d malformed packets counted, want 1", n)
+	}
+	if n := counter(heartbeatDrops, "replayed packet") - replayed; n != 1 {
+		t.Errorf("%d replayed packets counted, want 1", n)
+	}
+}
@@ -0,0 +1,223 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// usageVars publishes the usage of the API by route and by client.
+var usageVars = expvar.NewMap("usage")
+
+// otherClients is the key of the clients accounted together once a Usage
+// holds MaxClients.
+const otherClients = "other"
+
+// UsageStats is the usage of the API by a route or a client.
+type UsageStats struct {
+	// Requests is the number of requests handled.
+	Requests int64 `json:"requests"`
+
+	// Errors is the number of requests answered with a 4xx or 5xx status.
+	Errors int64 `json:"errors"`
+
+	// BytesIn is the size of the request bodies read.
+	BytesIn int64 `json:"bytesIn"`
+
+	// BytesOut is the size of the response bodies written.
+	BytesOut int64 `json:"bytesOut"`
+}
+
+// UsageReport is the usage of the API since the server started.
+type UsageReport struct {
+	// Since holds when the accounting started.
+	Since time.Time `json:"since"`
+
+	// Routes holds the usage by method and route, e.g. "GET
+	// /registro/1.0/apps".
+	Routes map[string]UsageStats `json:"routes"`
+
+	// Clients holds the usage by client, as identified by the Usage Key.
+	Clients map[string]UsageStats `json:"clients"`
+}
+
+// NewUsage returns a Usage accounting requests to the clients returned by
+// key, or to their address if key is nil.
+func NewUsage(key func(r *http.Request) string) *Usage {
+	return &Usage{
+		Key:        key,
+		MaxClients: 1000,
+		since:      time.Now(),
+		routes:     make(map[string]*UsageStats),
+		clients:    make(map[string]*UsageStats),
+	}
+}
+
+// Usage accounts the requests and bytes transferred by route and by
+// client, for capacity planning and to find noisy clients. Streams are
+// accounted once they end. It is safe for concurrent use.
+type Usage struct {
+	// Key returns the client a request is accounted to, e.g. its API token
+	// or tenant. If nil, requests are accounted to the client address.
+	Key func(r *http.Request) string
+
+	// MaxClients is the number of clients accounted separately. Further
+	// clients are accounted together as "other".
+	MaxClients int
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	since   time.Time
+	routes  map[string]*UsageStats
+	clients map[string]*UsageStats
+}
+
+// HeaderKey returns a Usage Key identifying clients by the value of a
+// request header, e.g. X-Tenant. Authorization values are credentials, so
+// they are accounted by a fingerprint instead. Requests without the header
+// are accounted to their address.
+func HeaderKey(header string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		v := r.Header.Get(header)
+		switch {
+		case v == "":
+			return ClientIP(r)
+		case http.CanonicalHeaderKey(header) == "Authorization":
+			sum := sha256.Sum256([]byte(v))
+			return "token:" + hex.EncodeToString(sum[:6])
+		default:
+			return v
+		}
+	}
+}
+
+// add accounts a request.
+func (u *Usage) add(route, client string, code int, in, out int64) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.clients[client] == nil && len(u.clients) >= u.MaxClients {
+		client = otherClients
+	}
+	for _, st := range []*UsageStats{u.stats(u.routes, route), u.stats(u.clients, client)} {
+		st.Requests++
+		if code >= 400 {
+			st.Errors++
+		}
+		st.BytesIn += in
+		st.BytesOut += out
+	}
+}
+
+// stats returns the stats of key in m, adding them if needed. It must be
+// called with u.mu held.
+func (u *Usage) stats(m map[string]*UsageStats, key string) *UsageStats {
+	st := m[key]
+	if st == nil {
+		st = new(UsageStats)
+		m[key] = st
+	}
+	return st
+}
+
+// Report returns the usage accounted so far.
+func (u *Usage) Report() UsageReport {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	report := UsageReport{
+		Since:   u.since,
+		Routes:  make(map[string]UsageStats, len(u.routes)),
+		Clients: make(map[string]UsageStats, len(u.clients)),
+	}
+	for k, st := range u.routes {
+		report.Routes[k] = *st
+	}
+	for k, st := range u.clients {
+		report.Clients[k] = *st
+	}
+	return report
+}
+
+// countingReader counts the bytes read from a request body.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// countingWriter counts the bytes written to a response body.
+type countingWriter struct {
+	*statusWriter
+	n int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.statusWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// accountUsage is a Middleware accounting every request to the server
+// Usage, if any.
+func (s *Server) accountUsage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u := s.Usage
+		if u == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		body := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil && r.Body != http.NoBody {
+			r.Body = body
+		}
+		cw := &countingWriter{statusWriter: &statusWriter{ResponseWriter: w}}
+		next.ServeHTTP(cw, r)
+
+		u.add(r.Method+" "+RequestRoute(r).Path, s.clientKey(r), cw.code, body.n, cw.n)
+	})
+}
+
+// clientKey returns the client the request is from, as identified by the
+// Usage Key, or its address.
+func (s *Server) clientKey(r *http.Request) string {
+	if u := s.Usage; u != nil && u.Key != nil {
+		return u.Key(r)
+	}
+	return ClientIP(r)
+}
+
+// publishUsage publishes the usage of the server in the "usage" expvar
+// map.
+func (s *Server) publishUsage() {
+	usageVars.Set("routes", expvar.Func(func() interface{} {
+		if s.Usage == nil {
+			return nil
+		}
+		return s.Usage.Report().Routes
+	}))
+	usageVars.Set("clients", expvar.Func(func() interface{} {
+		if s.Usage == nil {
+			return nil
+		}
+		return s.Usage.Report().Clients
+	}))
+}
+
+// usageHandler is the HTTP handler for /admin/usage.
+func (s *Server) usageHandler(w http.ResponseWriter, r *http.Request) {
+	if s.Usage == nil {
+		w.WriteHeader(404)
+		return
+	}
+	data, err := encodeJSON(s.Usage.Report(), isPretty(r))
+	writeBody(w, 200, data, err)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// basePrefix is the path prefix of the versioned routes, as written in the
+// route table.
+const basePrefix = "/registro/1.0/"
+
+// apiVersion is a version of the REST API. Every versioned route is served
+// under the prefix of every version, by the same handlers: a version only
+// adapts the requests it receives and the responses it sends, so breaking
+// changes do not fork the handlers.
+type apiVersion struct {
+	// Name is the version, as in its prefix, e.g. /registro/2.0/.
+	Name string
+
+	// Request, if set, adapts the requests of the version before the
+	// middlewares and the handler see them.
+	Request func(r *http.Request) *http.Request
+
+	// Response, if set, adapts the responses of the version. It returns the
+	// ResponseWriter given to the middlewares and the handler, and the
+	// function called once they returned.
+	Response func(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func())
+}
+
+// apiVersions holds the versions of the REST API served, the oldest first.
+// Version negotiation of the format, such as the Accept profile of the
+// catalog, applies within every version.
+var apiVersions = []apiVersion{
+	{Name: "1.0"},
+
+	// 2.0 answers every error with a JSON error body, where 1.0 answers
+	// some with a status code only.
+	{Name: "2.0", Response: withErrorBodies},
+}
+
+// path returns the path of the route template p in the version. Paths
+// without basePrefix are not versioned, and returned as is.
+func (v apiVersion) path(p string) string {
+	if !strings.HasPrefix(p, basePrefix) {
+		return p
+	}
+	return "/registro/" + v.Name + "/" + strings.TrimPrefix(p, basePrefix)
+}
+
+// adapt wraps next with the adapters of the version.
+func (v apiVersion) adapt(next http.Handler) http.Handler {
+	if v.Request == nil && v.Response == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if v.Request != nil {
+			r = v.Request(r)
+		}
+		if v.Response != nil {
+			var done func()
+			w, done = v.Response(w, r)
+			defer done()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// apiPath returns the path of a resource of the API version of the request,
+// as seen by the client, path being relative to the version prefix, e.g.
+// /apps/foo.
+func apiPath(r *http.Request, path string) string {
+	version := RequestRoute(r).Version
+	if version == "" {
+		version = apiVersions[0].Name
+	}
+	return location(r, "/registro/"+version+path)
+}
+
+// withErrorBodies returns the ResponseWriter adding an errorBody with the
+// status text to the error responses written without a body.
+func withErrorBodies(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	ew := &errorBodyWriter{ResponseWriter: w}
+	return ew, ew.finish
+}
+
+// errorBodyWriter holds the status code of error responses back until a
+// body is written. See withErrorBodies.
+type errorBodyWriter struct {
+	http.ResponseWriter
+	code  int
+	wrote bool
+}
+
+func (w *errorBodyWriter) WriteHeader(code int) {
+	if w.wrote || w.code != 0 {
+		return
+	}
+	if code >= 400 {
+		w.code = code
+		return
+	}
+	w.wrote = true
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *errorBodyWriter) Write(b []byte) (int, error) {
+	w.commit()
+	return w.ResponseWriter.Write(b)
+}
+
+// commit writes the status code held back, if any.
+func (w *errorBodyWriter) commit() {
+	if w.wrote {
+		return
+	}
+	w.wrote = true
+	if w.code != 0 {
+		w.ResponseWriter.WriteHeader(w.code)
+	}
+}
+
+// Flush implements http.Flusher, so streamed responses keep working.
+func (w *errorBodyWriter) Flush() {
+	w.commit()
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the original ResponseWriter, for http.ResponseController.
+func (w *errorBodyWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// finish writes the errorBody of an error response without a body.
+func (w *errorBodyWriter) finish() {
+	if w.wrote || w.code == 0 {
+		return
+	}
+	w.wrote = true
+	data, err := encodeJSON(errorBody{Error: strings.ToLower(http.StatusText(w.code))}, false)
+	writeBody(w.ResponseWriter, w.code, data, err)
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// The Application and Instance types hold the runtime state of the server,
+// which is never encoded as is. Responses are built from their views, the
+// model types shared with the clients, so internal fields can change
+// without breaking the API, and new fields are only exposed on purpose.
+
+// view returns the representation of the instance in API responses.
+func (i *Instance) view() *model.Instance {
+	renewal := i.lastRenewal()
+	v := &model.Instance{
+		Id:                 i.Id,
+		IPAddr:             i.IPAddr,
+		Port:               i.Port,
+		Status:             i.Status,
+		Generation:         i.Generation,
+		Metadata:           copyMetadata(i.Metadata),
+		Version:            i.Version,
+		DeploymentGroup:    i.DeploymentGroup,
+		Vitals:             copyVitals(renewal.Vitals),
+		LastRenewal:        renewal.LastRenewal,
+		External:           i.static,
+		LeaseRemaining:     float64(i.LeaseRemaining().Milliseconds()) / 1000,
+		PlannedTermination: timeRef(i.PlannedTermination),
+		RegisteredAt:       timeRef(i.RegisteredAt),
+		FirstUpAt:          timeRef(i.FirstUpAt),
+		LastStatusChangeAt: timeRef(i.StatusChangedAt),
+	}
+	if i.Status == UP && !i.StatusChangedAt.IsZero() {
+		v.Uptime = float64(time.Since(i.StatusChangedAt).Milliseconds()) / 1000
+	}
+	if renewal.skewKnown {
+		skew := renewal.ClockSkew.Seconds()
+		v.ClockSkew = &skew
+	}
+	return v
+}
+
+// view returns the representation of the application in API responses.
+func (a *Application) view() *model.Application {
+	v := &model.Application{
+		Name:        a.Name,
+		Instances:   make([]*model.Instance, 0, len(a.Instances)),
+		ActiveGroup: a.ActiveGroup,
+		MinHealthy:  a.MinHealthy,
+		TTL:         a.TTL.Seconds(),
+		Archived:    a.Archived,
+		Environment: a.Environment,
+		ExpiresAt:   timeRef(a.ExpiresAt),
+		Rollout:     copyRollout(a.Rollout),
+		Maintenance: copyMaintenance(a.Maintenance),
+	}
+	for _, inst := range a.Instances {
+		v.Instances = append(v.Instances, inst.view())
+	}
+	return v
+}
+
+// Views copy the maps and pointers of the registry, which are shared by the
+// catalog snapshots: embedders may keep and modify the views they are given.
+
+func copyMetadata(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	cp := make(map[string]string, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	return cp
+}
+
+func copyVitals(v *model.Vitals) *model.Vitals {
+	if v == nil {
+		return nil
+	}
+	cp := *v
+	if v.Gauges != nil {
+		cp.Gauges = make(map[string]float64, len(v.Gauges))
+		for k, g := range v.Gauges {
+			cp.Gauges[k] = g
+		}
+	}
+	return &cp
+}
+
+func copyRollout(r *Rollout) *Rollout {
+	if r == nil {
+		return nil
+	}
+	cp := *r
+	cp.Steps = append([]float64(nil), r.Steps...)
+	return &cp
+}
+
+func copyMaintenance(windows []*Maintenance) []*Maintenance {
+	if windows == nil {
+		return nil
+	}
+	cp := make([]*Maintenance, len(windows))
+	for i, m := range windows {
+		w := *m
+		cp[i] = &w
+	}
+	return cp
+}
+
+// appList returns the response body listing apps.
+func appList(apps []*Application) model.AppList {
+	list := model.AppList{Apps: make([]*model.Application, 0, len(apps))}
+	for _, app := range apps {
+		list.Apps = append(list.Apps, app.view())
+	}
+	return list
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// Vitals holds runtime measurements reported by an instance on renewals.
+// They allow clients and dashboards to balance load across instances.
+type Vitals = model.Vitals
+
+// readVitals returns the vitals carried in the body of a renewal.
+// It returns nil if the body is empty.
+func readVitals(r *http.Request) (*Vitals, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil || len(body) == 0 {
+		return nil, err
+	}
+
+	v := new(Vitals)
+	if err := json.Unmarshal(body, v); err != nil {
+		return nil, err
+	}
+	v.ReportedAt = time.Now().Unix()
+	return v, nil
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"time"
+)
+
+// warmUp tracks the renewals expected after the server starts. Until they
+// arrive, the registry state is stale: restored instances look expired and
+// instances of a registry without storage have not registered again yet.
+type warmUp struct {
+	// until is when the warm-up ends, even if renewals are missing. It is
+	// the zero time once the warm-up is over.
+	until time.Time
+
+	// expected holds the restored instances (as app/id) yet to renew or
+	// register again.
+	expected map[string]bool
+
+	// total is the number of instances restored.
+	total int
+}
+
+// Readiness is the response body of /readyz.
+type Readiness struct {
+	// Ready is set once the warm-up is over.
+	Ready bool `json:"ready"`
+
+	// Expected is the number of instances restored from storage, which are
+	// expected to renew during the warm-up.
+	Expected int `json:"expected"`
+
+	// Renewed is the number of those which have renewed.
+	Renewed int `json:"renewed"`
+
+	// Until is when the warm-up ends at the latest, if not over.
+	Until *time.Time `json:"until,omitempty"`
+}
+
+// startWarmUp starts the warm-up period, expecting a renewal from every
+// instance restored. Without instances restored, nothing tells how many
+// will come back, so the whole period is waited. It must be called with
+// s.mu held.
+func (s *Server) startWarmUp() {
+	if s.WarmUp <= 0 {
+		return
+	}
+	s.warm = warmUp{until: s.now().Add(s.WarmUp), expected: make(map[string]bool)}
+	for _, app := range s.Applications {
+		for _, inst := range app.Instances {
+			if inst.Status != OUTOFSERVICE {
+				s.warm.expected[app.Name+"/"+inst.Id] = true
+			}
+		}
+	}
+	s.warm.total = len(s.warm.expected)
+	log.Printf("warming up for %s, expecting %d instances", s.WarmUp, s.warm.total)
+}
+
+// warmingUp reports whether the warm-up is still going on, ending it once
+// its time is up. It must be called with s.mu held.
+func (s *Server) warmingUp() bool {
+	if s.warm.until.IsZero() {
+		return false
+	}
+	if s.now().Before(s.warm.until) {
+		return true
+	}
+	s.endWarmUp()
+	return false
+}
+
+// warmedUp records a renewal or registration of the instance during the
+// warm-up, ending it once enough of the instances expected arrived. It must
+// be called with s.mu held.
+func (s *Server) warmedUp(app *Application, inst *Instance) {
+	if !s.warmingUp() || !s.warm.expected[app.Name+"/"+inst.Id] {
+		return
+	}
+	delete(s.warm.expected, app.Name+"/"+inst.Id)
+	renewed := s.warm.total - len(s.warm.expected)
+	if float64(renewed) >= s.WarmUpThreshold*float64(s.warm.total) {
+		s.endWarmUp()
+	}
+}
+
+// endWarmUp ends the warm-up, checking again the instances whose
+// expiration was held. It must be called with s.mu held.
+func (s *Server) endWarmUp() {
+	log.Printf("warm-up complete, %d of %d instances renewed", s.warm.total-len(s.warm.expected), s.warm.total)
+	s.warm.until = time.Time{}
+	for _, app := range s.Applications {
+		for _, inst := range app.Instances {
+			s.schedule(app, inst)
+		}
+	}
+}
+
+// readiness returns the readiness of the server.
+func (s *Server) readiness() Readiness {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r := Readiness{
+		Ready:    !s.warmingUp(),
+		Expected: s.warm.total,
+		Renewed:  s.warm.total - len(s.warm.expected),
+	}
+	if !r.Ready {
+		until := s.warm.until
+		r.Until = &until
+	}
+	return r
+}
+
+// readyHandler is the HTTP handler for /readyz. It answers 503 during the
+// warm-up, so load balancers and orchestrators wait for the registry state
+// to be rebuilt before sending it discovery traffic.
+func (s *Server) readyHandler(w http.ResponseWriter, r *http.Request) {
+	ready := s.readiness()
+	code := 200
+	if !ready.Ready {
+		code = 503
+	}
+	data, err := encodeJSON(ready, isPretty(r))
+	writeBody(w, code, data, err)
+}
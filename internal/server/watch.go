@@ -0,0 +1,138 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/numercfd/registro/model"
+)
+
+// watchKeepAlive is the time between comments sent to idle /watch
+// connections, so proxies keep them open and dead clients are noticed.
+const watchKeepAlive = 30 * time.Second
+
+// watchHandler is the HTTP handler for /watch, streaming the changes of the
+// apps selected with ?app= (every app if none is) as server-sent events:
+// "snapshot" with a model.Snapshot of the apps on connect, "delta" with a
+// model.Delta on every change after it, and "event" with every event about
+// the apps. Deltas carry their version as the event id, and every event
+// the signature of its data if the server has a Signer. With ?consumer= or
+// ?zone=, the instances are ordered by affinity, see model.SortByAffinity.
+//
+// Watchers falling behind are sent "evicted" and disconnected. Browsers
+// reconnect on their own, and receive a new snapshot.
+func (s *Server) watchHandler(w http.ResponseWriter, r *http.Request) {
+	apps := r.URL.Query()["app"]
+	wt := s.watchers.subscribe(s.WatchQueue, true, apps...)
+	defer s.watchers.unsubscribe(wt)
+	if c := s.Consumers; c != nil {
+		defer c.watch(apps, s.consumerOf(r))()
+	}
+
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(200)
+
+	send := func(event string, id uint64, v interface{}) bool {
+		data, err := json.Marshal(v)
+		if err != nil {
+			log.Printf("watch error: %s", err)
+			return true
+		}
+		if id != 0 {
+			if _, err := fmt.Fprintf(w, "id: %d\n", id); err != nil {
+				return false
+			}
+		}
+		if s.Signer != nil {
+			sig, err := s.Signer.Sign(data, signedRequest(r, id))
+			if err != nil {
+				log.Printf("watch error: %s", err)
+				return true
+			}
+			if _, err := fmt.Fprintf(w, "%s: %s\n", signatureField, sig); err != nil {
+				return false
+			}
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	// The snapshot is taken once subscribed, see hub.subscribe.
+	c := s.snapshot()
+	snapshot := model.Snapshot{Version: c.Version, Apps: make([]*model.Application, 0)}
+
+	// The instances are ordered by affinity for the consumer, if any, so it
+	// may stick to the first one.
+	consumer, zone := r.URL.Query().Get("consumer"), r.URL.Query().Get("zone")
+	view := func(app *Application) *model.Application {
+		v := app.inGroup("").view()
+		if consumer != "" || zone != "" {
+			model.SortByAffinity(v.Instances, consumer, zone)
+		}
+		return v
+	}
+
+	// seen holds the apps of the environment of the client sent, so the
+	// removal of the others and their events are not.
+	env := environmentOf(r)
+	seen := make(map[string]bool)
+	for _, app := range c.Applications {
+		if (wt.apps == nil || wt.apps[app.Name]) && env.sees(app) {
+			snapshot.Apps = append(snapshot.Apps, view(app))
+			seen[app.Name] = true
+		}
+	}
+	if !send("snapshot", c.Version, snapshot) {
+		return
+	}
+
+	ticker := time.NewTicker(watchKeepAlive)
+	defer ticker.Stop()
+	for {
+		ok := true
+		select {
+		case ch, open := <-wt.C:
+			switch {
+			case !open:
+				send("evicted", 0, struct{}{})
+				return
+			case ch.Event != nil:
+				if env.Name == "" || ch.Event.App == "" || seen[ch.Event.App] {
+					ok = send("event", 0, ch.Event)
+				}
+			case ch.Version > snapshot.Version:
+				visible := ch.Copy != nil && env.sees(ch.Copy)
+				if env.Name != "" && !visible && !seen[ch.App] {
+					break
+				}
+				if !visible {
+					// An app moved to another environment is removed.
+					ch.Copy = nil
+				}
+				seen[ch.App] = visible
+				d := model.Delta{Version: ch.Version, Name: ch.App}
+				if ch.Copy != nil {
+					d.App = view(ch.Copy)
+				}
+				ok = send("delta", ch.Version, d)
+			}
+		case <-ticker.C:
+			_, err := fmt.Fprint(w, ": keep-alive\n\n")
+			ok = err == nil && rc.Flush() == nil
+		case <-r.Context().Done():
+			return
+		case <-s.closing:
+			return
+		}
+		if !ok {
+			return
+		}
+	}
+}
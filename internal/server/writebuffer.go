@@ -0,0 +1,123 @@
+package server
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Durability controls when changes are written to the Store.
+type Durability string
+
+const (
+	// SyncDurability writes every change before the request returns.
+	SyncDurability Durability = "sync"
+
+	// BatchDurability writes registrations, status changes and deletions
+	// before the request returns. Renewals are coalesced per instance and
+	// written in batches, so a crash may lose the latest renewal timestamps.
+	BatchDurability Durability = "batch"
+
+	// AsyncDurability coalesces every change and writes them in batches.
+	// A crash may lose every change since the last flush.
+	AsyncDurability Durability = "async"
+)
+
+// newWriteBuffer returns a writeBuffer for store with the durability specified.
+func newWriteBuffer(store Store, durability Durability) *writeBuffer {
+	return &writeBuffer{
+		store:      store,
+		durability: durability,
+		pending:    make(map[string]Change),
+	}
+}
+
+// writeBuffer sits between the server and its Store. Depending on the
+// durability, changes are written through or kept in memory, where changes
+// to the same record are coalesced until the next flush.
+type writeBuffer struct {
+	store      Store
+	durability Durability
+
+	// mu protects pending and serializes writes to the store, so a flush
+	// never overwrites a newer change written through.
+	mu      sync.Mutex
+	pending map[string]Change
+}
+
+// Add writes the change to the store or buffers it until the next flush.
+func (b *writeBuffer) Add(c Change) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if c.Type == DeleteApplication {
+		// The pending changes of its instances would bring it back.
+		b.dropInstances(c.App)
+	}
+	if b.durability == AsyncDurability || (b.durability == BatchDurability && c.Type == RenewInstance) {
+		if prev, ok := b.pending[c.key()]; ok && prev.Type == PutInstance && c.Type == RenewInstance {
+			// Keep the record a full write, it might not have been stored yet.
+			c.Type = PutInstance
+		}
+		b.pending[c.key()] = c
+		return nil
+	}
+
+	// The change carries the latest state of the record.
+	delete(b.pending, c.key())
+	if err := b.store.Write([]Change{c}); err != nil {
+		// It is written with the next flush instead.
+		b.pending[c.key()] = c
+		return err
+	}
+	return nil
+}
+
+// dropInstances removes the pending changes of the instances of app.
+func (b *writeBuffer) dropInstances(app string) {
+	for key := range b.pending {
+		if strings.HasPrefix(key, app+"/") {
+			delete(b.pending, key)
+		}
+	}
+}
+
+// Flush writes every buffered change to the store in a single batch,
+// the changes of applications before the ones of their instances.
+// On failure the changes are kept for the next flush.
+func (b *writeBuffer) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.pending) == 0 {
+		return nil
+	}
+	batch := make([]Change, 0, len(b.pending))
+	for _, c := range b.pending {
+		batch = append(batch, c)
+	}
+	sort.Slice(batch, func(i, j int) bool { return batch[i].key() < batch[j].key() })
+	if err := b.store.Write(batch); err != nil {
+		return err
+	}
+	b.pending = make(map[string]Change)
+	return nil
+}
+
+// run flushes the buffer every interval until stop is closed. Errors are
+// given to onError.
+func (b *writeBuffer) run(interval time.Duration, stop chan struct{}, onError func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := b.Flush(); err != nil {
+				onError(err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
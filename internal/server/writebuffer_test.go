@@ -0,0 +1,68 @@
+package server
+
+import (
+	"errors"
+	"testing"
+)
+
+// recordStore is a Store recording the batches written, failing with err
+// if set.
+type recordStore struct {
+	batches [][]Change
+	err     error
+}
+
+func (s *recordStore) Load() ([]*Application, error) { return nil, nil }
+func (s *recordStore) Close() error                  { return nil }
+
+func (s *recordStore) Write(batch []Change) error {
+	if s.err != nil {
+		return s.err
+	}
+	s.batches = append(s.batches, batch)
+	return nil
+}
+
+func TestWriteBufferDropsInstancesOfDeletedApps(t *testing.T) {
+	for _, durability := range []Durability{SyncDurability, BatchDurability, AsyncDurability} {
+		store := new(recordStore)
+		b := newWriteBuffer(store, durability)
+		inst := NewInstance("i-1", "10.0.0.1", 8080)
+		b.Add(Change{Type: PutApplication, App: "app0"})
+		b.Add(Change{Type: PutInstance, App: "app0", Instance: inst})
+		b.Add(Change{Type: RenewInstance, App: "app0", Instance: inst})
+		b.Add(Change{Type: RenewInstance, App: "app1", Instance: inst})
+		b.Add(Change{Type: DeleteApplication, App: "app0"})
+		if err := b.Flush(); err != nil {
+			t.Fatal(err)
+		}
+
+		var last []Change
+		for _, batch := range store.batches {
+			for _, c := range batch {
+				if c.App == "app0" {
+					last = append(last, c)
+				}
+			}
+		}
+		if len(last) == 0 || last[len(last)-1].Type != DeleteApplication {
+			t.Errorf("%s: app0 changes written %v, want the deletion last", durability, last)
+		}
+	}
+}
+
+func TestWriteBufferKeepsFailedWrites(t *testing.T) {
+	store := &recordStore{err: errors.New("disk full")}
+	b := newWriteBuffer(store, SyncDurability)
+	if err := b.Add(Change{Type: PutApplication, App: "app0"}); err == nil {
+		t.Fatal("failed write returned no error")
+	}
+
+	store.err = nil
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.batches) != 1 || len(store.batches[0]) != 1 || store.batches[0][0].App != "app0" {
+		t.Errorf("flush wrote %v, want the failed change", store.batches)
+	}
+}
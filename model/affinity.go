@@ -0,0 +1,37 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+)
+
+// AffinityScore returns the score of an instance for a consumer, in the
+// rendezvous (highest random weight) hashing of sticky assignments: a
+// consumer sticks to the instance with the highest score, so instances
+// joining or leaving only move their share of the consumers. The SR and its
+// clients compute it alike.
+func AffinityScore(consumer, id string) uint64 {
+	sum := sha256.Sum256([]byte(consumer + "\x00" + id))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// SortByAffinity orders the instances for the consumer: the ones whose
+// zone metadata is zone first, if set, then by decreasing AffinityScore.
+// The first instance is the one the consumer sticks to, and the next ones
+// its fallbacks, in order.
+func SortByAffinity(instances []*Instance, consumer, zone string) {
+	scores := make(map[*Instance]uint64, len(instances))
+	for _, inst := range instances {
+		scores[inst] = AffinityScore(consumer, inst.Id)
+	}
+	sort.SliceStable(instances, func(i, j int) bool {
+		a, b := instances[i], instances[j]
+		if zone != "" {
+			if za, zb := a.Metadata["zone"] == zone, b.Metadata["zone"] == zone; za != zb {
+				return za
+			}
+		}
+		return scores[a] > scores[b]
+	})
+}
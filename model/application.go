@@ -0,0 +1,94 @@
+// Package model holds the types exchanged between the Service Registry
+// server and its clients, as encoded in the REST API. Both sides import
+// them, so the schema is defined once.
+package model
+
+import "time"
+
+// AllGroups selects the instances of every deployment group.
+const AllGroups = "*"
+
+// NewApplication return a new Application object the specified name.
+func NewApplication(name string) *Application {
+	return &Application{
+		Name:      name,
+		Instances: make([]*Instance, 0),
+	}
+}
+
+// Application represents an app registered to the server.
+type Application struct {
+	// Name specifies a name to diferentiate apps.
+	Name string `json:"name"`
+
+	// Instances holds a list of instances running this app.
+	Instances []*Instance `json:"instances,omitempty"`
+
+	// ActiveGroup is the deployment group served by discovery. Empty
+	// serves every instance.
+	ActiveGroup string `json:"activeGroup,omitempty"`
+
+	// MinHealthy is the number of UP instances the app must keep.
+	MinHealthy int `json:"minHealthyInstances,omitempty"`
+
+	// TTL overrides the seconds discovery responses about the app may be
+	// reused. Zero uses the SR default, sent in the Cache-Control header.
+	TTL float64 `json:"ttl,omitempty"`
+
+	// Archived is set for apps hidden from the default listing for having
+	// no instances for a while.
+	Archived bool `json:"archived,omitempty"`
+
+	// Environment is the environment of the app, e.g. staging or prod.
+	Environment string `json:"environment,omitempty"`
+
+	// ExpiresAt, if set, is when the SR removes the app and its instances.
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+
+	// Rollout holds the last rollout between deployment groups, if any.
+	Rollout *Rollout `json:"rollout,omitempty"`
+
+	// Maintenance holds the maintenance windows declared for the app.
+	Maintenance []*Maintenance `json:"maintenance,omitempty"`
+}
+
+// GetInstance return the instance with the specified id.
+func (a *Application) GetInstance(id string) *Instance {
+	for _, inst := range a.Instances {
+		if inst.Id == id {
+			return inst
+		}
+	}
+	return nil
+}
+
+// GetAvailableInstances returns all instances with status UP.
+func (a *Application) GetAvailableInstances() []*Instance {
+	instances := make([]*Instance, 0)
+	for _, inst := range a.Instances {
+		if inst.Status == UP {
+			instances = append(instances, inst)
+		}
+	}
+	return instances
+}
+
+// AppList is the response body listing applications.
+type AppList struct {
+	Apps []*Application `json:"applications"`
+}
+
+// Conflict is an address shared by more than one instance.
+type Conflict struct {
+	// Address is the ip:port shared by the instances.
+	Address string `json:"address"`
+
+	// Instances holds the instances registered with the address.
+	Instances []ConflictInstance `json:"instances"`
+}
+
+// ConflictInstance identifies an instance in a Conflict.
+type ConflictInstance struct {
+	App string `json:"app"`
+	Id  string `json:"id"`
+}
@@ -0,0 +1,18 @@
+package model
+
+// DryRun is the response to a change requested with ?dryRun=true. The
+// request is validated as any other, but nothing is changed: the response
+// shows the resource before and after the change instead.
+type DryRun struct {
+	// Action is what the request would do: "create", "replace", "update"
+	// or "delete".
+	Action string `json:"action"`
+
+	// Before holds the resource before the change, unset if it would be
+	// created.
+	Before interface{} `json:"before,omitempty"`
+
+	// After holds the resource after the change, unset if it would be
+	// removed.
+	After interface{} `json:"after,omitempty"`
+}
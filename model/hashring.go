@@ -0,0 +1,89 @@
+package model
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points of every instance on a
+// HashRing, unless specified otherwise.
+const DefaultVirtualNodes = 100
+
+// RingPoint is a point of a HashRing, owned by an instance.
+type RingPoint struct {
+	// Token is the position of the point on the ring.
+	Token uint64 `json:"token"`
+
+	// Id is the id of the instance owning the point.
+	Id string `json:"id"`
+}
+
+// HashRing maps keys to the UP instances of an app by consistent hashing:
+// every instance owns VirtualNodes points of the ring, and a key goes to
+// the owner of the first point at or after its hash. Instances joining or
+// leaving only move the keys of their points, and clients building or
+// fetching the ring of the same instances agree on where every key goes.
+type HashRing struct {
+	// App is the name of the application.
+	App string `json:"app"`
+
+	// VirtualNodes is the number of points of every instance.
+	VirtualNodes int `json:"virtualNodes"`
+
+	// Instances holds the instances of the ring.
+	Instances []*Instance `json:"instances"`
+
+	// Points holds the points of the ring, ordered by Token.
+	Points []RingPoint `json:"points"`
+}
+
+// RingHash returns the position of a key, or of a virtual node, on a
+// HashRing.
+func RingHash(key string) uint64 {
+	sum := sha256.Sum256([]byte(key))
+	return binary.BigEndian.Uint64(sum[:8])
+}
+
+// NewHashRing returns the ring of the UP instances of the app, with
+// vnodes points each (DefaultVirtualNodes if zero or less). The point n of
+// an instance is at the RingHash of "<id>#<n>".
+func NewHashRing(app *Application, vnodes int) *HashRing {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	r := &HashRing{App: app.Name, VirtualNodes: vnodes, Instances: app.GetAvailableInstances()}
+	r.Points = make([]RingPoint, 0, len(r.Instances)*vnodes)
+	for _, inst := range r.Instances {
+		for n := 0; n < vnodes; n++ {
+			r.Points = append(r.Points, RingPoint{Token: RingHash(inst.Id + "#" + strconv.Itoa(n)), Id: inst.Id})
+		}
+	}
+	sort.Slice(r.Points, func(i, j int) bool {
+		a, b := r.Points[i], r.Points[j]
+		// Ids break the (unlikely) ties, so every ring is alike.
+		return a.Token < b.Token || a.Token == b.Token && a.Id < b.Id
+	})
+	return r
+}
+
+// PickForKey returns the instance the key goes to, nil if the ring is
+// empty.
+func (r *HashRing) PickForKey(key string) *Instance {
+	if len(r.Points) == 0 {
+		return nil
+	}
+	h := RingHash(key)
+	i := sort.Search(len(r.Points), func(i int) bool { return r.Points[i].Token >= h })
+	if i == len(r.Points) {
+		i = 0
+	}
+	id := r.Points[i].Id
+	for _, inst := range r.Instances {
+		if inst.Id == id {
+			return inst
+		}
+	}
+	return nil
+}
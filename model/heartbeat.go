@@ -0,0 +1,97 @@
+package model
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// HeartbeatVersion is the version of the heartbeat packet format.
+const HeartbeatVersion = 1
+
+// heartbeatMACSize is the size of the truncated HMAC-SHA256 signing a
+// heartbeat packet.
+const heartbeatMACSize = 16
+
+// ErrBadHeartbeat is returned when parsing a malformed heartbeat packet.
+var ErrBadHeartbeat = errors.New("malformed heartbeat packet")
+
+// Heartbeat is a renewal sent over UDP instead of HTTP. Packets are
+// compact and signed with the instance lease, which only the registrant
+// and the SR know:
+//
+//	version (1 byte)
+//	app length (1 byte) | app
+//	id length (1 byte) | id
+//	generation (8 bytes, big endian)
+//	time (8 bytes, big endian unix milliseconds)
+//	HMAC-SHA256 of the above keyed by the lease id, truncated to 16 bytes
+type Heartbeat struct {
+	App        string
+	Id         string
+	Generation uint64
+
+	// Time is when the heartbeat was sent, in unix milliseconds. The SR
+	// drops stale packets, and ones not sent after the last accepted, so
+	// they cannot be replayed.
+	Time int64
+}
+
+// Marshal returns the heartbeat packet signed with the lease.
+func (h *Heartbeat) Marshal(lease string) ([]byte, error) {
+	if len(h.App) > 255 || len(h.Id) > 255 {
+		return nil, errors.New("app and id must be at most 255 bytes")
+	}
+
+	b := make([]byte, 0, 3+len(h.App)+len(h.Id)+16+heartbeatMACSize)
+	b = append(b, HeartbeatVersion)
+	b = append(b, byte(len(h.App)))
+	b = append(b, h.App...)
+	b = append(b, byte(len(h.Id)))
+	b = append(b, h.Id...)
+	b = binary.BigEndian.AppendUint64(b, h.Generation)
+	b = binary.BigEndian.AppendUint64(b, uint64(h.Time))
+	return append(b, heartbeatMAC(b, lease)...), nil
+}
+
+// ParseHeartbeat parses a heartbeat packet. The signature must then be
+// checked with Verify, once the lease of the instance is known.
+func ParseHeartbeat(b []byte) (*Heartbeat, error) {
+	if len(b) < 3 || b[0] != HeartbeatVersion {
+		return nil, ErrBadHeartbeat
+	}
+	var h Heartbeat
+	rest := b[1:]
+	for _, field := range []*string{&h.App, &h.Id} {
+		if len(rest) < 1 || len(rest) < 1+int(rest[0]) {
+			return nil, ErrBadHeartbeat
+		}
+		n := 1 + int(rest[0])
+		*field = string(rest[1:n])
+		rest = rest[n:]
+	}
+	if len(rest) != 16+heartbeatMACSize {
+		return nil, ErrBadHeartbeat
+	}
+	h.Generation = binary.BigEndian.Uint64(rest)
+	h.Time = int64(binary.BigEndian.Uint64(rest[8:]))
+	return &h, nil
+}
+
+// VerifyHeartbeat reports whether the heartbeat packet is signed with the
+// lease.
+func VerifyHeartbeat(b []byte, lease string) bool {
+	if len(b) < heartbeatMACSize {
+		return false
+	}
+	n := len(b) - heartbeatMACSize
+	return hmac.Equal(b[n:], heartbeatMAC(b[:n], lease))
+}
+
+// heartbeatMAC returns the signature of the packet data.
+func heartbeatMAC(data []byte, lease string) []byte {
+	mac := hmac.New(sha256.New, []byte(lease))
+	mac.Write(data)
+	return mac.Sum(nil)[:heartbeatMACSize]
+}
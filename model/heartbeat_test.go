@@ -0,0 +1,44 @@
+package model
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzParseHeartbeat(f *testing.F) {
+	for _, h := range []Heartbeat{
+		{App: "web", Id: "i-1", Generation: 1, Time: 1700000000},
+		{App: "", Id: "", Generation: 0, Time: -1},
+		{App: string(make([]byte, 255)), Id: "i-2", Generation: 1 << 63, Time: 1 << 62},
+	} {
+		b, err := h.Marshal("lease")
+		if err != nil {
+			f.Fatal(err)
+		}
+		f.Add(b)
+	}
+	f.Add([]byte{HeartbeatVersion, 255})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		h, err := ParseHeartbeat(b)
+		if err != nil {
+			if h != nil {
+				t.Fatalf("got heartbeat %+v with error %v", h, err)
+			}
+			return
+		}
+
+		// Every packet parsed is the one its heartbeat marshals to, but
+		// for the signature.
+		m, err := h.Marshal("lease")
+		if err != nil {
+			t.Fatalf("cannot marshal heartbeat %+v parsed: %v", h, err)
+		}
+		if n := len(b) - heartbeatMACSize; !bytes.Equal(m[:n], b[:n]) {
+			t.Fatalf("heartbeat %+v marshals to %x, parsed from %x", h, m, b)
+		}
+		if VerifyHeartbeat(b, "lease") != bytes.Equal(m, b) {
+			t.Fatalf("verification of %x disagrees with its signature", b)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package model
+
+import (
+	"fmt"
+	"time"
+)
+
+// NewInstance return a new Instance object with the specified data.
+func NewInstance(id, ip string, port int) *Instance {
+	return &Instance{
+		Id:          id,
+		IPAddr:      ip,
+		Port:        port,
+		Status:      STARTING,
+		LastRenewal: time.Now().Unix(),
+	}
+}
+
+// Instance represents a service running an application.
+type Instance struct {
+	// Id is a unique identifier for an Instance.
+	Id string `json:"id"`
+
+	// IPAddr is the newowrk address where the instance is located.
+	IPAddr string `json:"ip"`
+
+	// Port is the network port where the instance is located.
+	Port int `json:"port"`
+
+	// Status provide information of the operational status of the instance.
+	Status StatusType `json:"status"`
+
+	// Generation is incremented every time the instance id is registered.
+	Generation uint64 `json:"generation"`
+
+	// Metadata holds arbitrary key/value pairs describing the instance.
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// Version is incremented every time the instance metadata changes.
+	Version uint64 `json:"version"`
+
+	// DeploymentGroup labels the deployment the instance belongs to (e.g.
+	// blue or green).
+	DeploymentGroup string `json:"deploymentGroup,omitempty"`
+
+	// Vitals holds the runtime measurements last reported by the instance.
+	Vitals *Vitals `json:"vitals,omitempty"`
+
+	// LastRenewal holds the timestamp when the instance last contacted the SR.
+	LastRenewal int64 `json:"lastRenewal"`
+
+	// RegisteredAt holds when the instance was registered.
+	RegisteredAt *time.Time `json:"registeredAt,omitempty"`
+
+	// FirstUpAt holds when the instance was first UP after its
+	// registration, unset until then.
+	FirstUpAt *time.Time `json:"firstUpAt,omitempty"`
+
+	// LastStatusChangeAt holds when the instance status last changed.
+	LastStatusChangeAt *time.Time `json:"lastStatusChangeAt,omitempty"`
+
+	// Uptime holds the seconds the instance has been UP without
+	// interruption, unset if it is not UP.
+	Uptime float64 `json:"uptime,omitempty"`
+
+	// PlannedTermination, if set, is when the instance is expected to stop,
+	// such as a spot instance or a preemptible VM. The SR makes it DRAINING
+	// shortly before.
+	PlannedTermination *time.Time `json:"plannedTerminationTime,omitempty"`
+
+	// External is set for instances declared in the SR configuration, such
+	// as external databases, rather than registered. They send no
+	// heartbeats: their status is only known through probes, if any.
+	External bool `json:"external,omitempty"`
+
+	// LeaseRemaining holds the seconds left before the instance lease expires.
+	LeaseRemaining float64 `json:"leaseRemaining"`
+
+	// ClockSkew holds the seconds the instance clock was ahead of the SR
+	// clock on its last renewal, negative if behind, network latency
+	// included. It is unset until a renewal tells the instance time.
+	ClockSkew *float64 `json:"clockSkew,omitempty"`
+
+	// LeaseId identifies the registration holding the instance.
+	// It is given by the SR on registration and sent on renewals.
+	LeaseId string `json:"-"`
+
+	// LeaseDuration holds the seconds a renewal keeps the instance UP.
+	LeaseDuration float64 `json:"-"`
+}
+
+// StatusType represents an instance status
+type StatusType string
+
+const (
+	// UP represents an instance receiving requests.
+	UP StatusType = "up"
+
+	// DOWN representes an instance that has not sent heartbeats after some time.
+	DOWN StatusType = "down"
+
+	// STARTING represents an instance that has registered, but has not yet send any heartbeats.
+	STARTING StatusType = "starting"
+
+	// OUTOFSERVICE represents an instance that has been deliberately deleted.
+	// It may be down for maintainance or shutting down.
+	OUTOFSERVICE StatusType = "out-of-service"
+
+	// MAINTENANCE represents an instance under a maintenance window. It is
+	// only shown in discovery responses, the instance keeps its own status.
+	MAINTENANCE StatusType = "maintenance"
+
+	// DRAINING represents an instance about to reach its planned
+	// termination. It keeps renewing, but no longer receives new requests.
+	DRAINING StatusType = "draining"
+)
+
+// Vitals holds runtime measurements reported by an instance on renewals.
+// They allow clients and dashboards to balance load across instances.
+type Vitals struct {
+	// CPU is the fraction of CPU in use, from 0 to 1.
+	CPU float64 `json:"cpu,omitempty"`
+
+	// Memory is the memory in use, in bytes.
+	Memory uint64 `json:"memory,omitempty"`
+
+	// InFlight is the number of requests being handled.
+	InFlight int `json:"inFlight,omitempty"`
+
+	// Gauges holds custom measurements.
+	Gauges map[string]float64 `json:"gauges,omitempty"`
+
+	// ReportedAt holds the timestamp when the SR received the vitals.
+	ReportedAt int64 `json:"reportedAt,omitempty"`
+}
+
+// Registration is the request body of an instance registration.
+type Registration struct {
+	// Id is the instance id. If empty, the SR generates one.
+	Id string `json:"id,omitempty"`
+
+	Ip   string `json:"ip"`
+	Port int    `json:"port"`
+
+	// Generation is the generation requested, if any.
+	Generation uint64 `json:"generation,omitempty"`
+
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Group    string            `json:"deploymentGroup,omitempty"`
+
+	// PlannedTermination is when the instance is expected to stop, if known.
+	PlannedTermination *time.Time `json:"plannedTerminationTime,omitempty"`
+}
+
+// NewRegistration returns the Registration of the instance.
+func NewRegistration(inst *Instance) *Registration {
+	return &Registration{
+		Id:         inst.Id,
+		Ip:         inst.IPAddr,
+		Port:       inst.Port,
+		Generation: inst.Generation,
+		Metadata:   inst.Metadata,
+		Group:      inst.DeploymentGroup,
+
+		PlannedTermination: inst.PlannedTermination,
+	}
+}
+
+// Validate checks every required field is set.
+func (r *Registration) Validate() error {
+	if r.Ip == "" {
+		return fmt.Errorf("ip is required")
+	}
+	if r.Port <= 0 || r.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", r.Port)
+	}
+	return nil
+}
+
+// Lease is the response body of an instance registration: the instance
+// as registered by the SR (with its generated id, normalized address and
+// generation) and the lease holding it.
+type Lease struct {
+	*Instance
+
+	LeaseId       string  `json:"leaseId"`
+	LeaseDuration float64 `json:"leaseDuration"`
+}
@@ -0,0 +1,48 @@
+package model
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func FuzzRegistration(f *testing.F) {
+	f.Add([]byte(`{"id": "i-1", "ip": "10.0.0.1", "port": 8080}`))
+	f.Add([]byte(`{"ip": "::ffff:10.0.0.1", "port": 65535, "generation": 18446744073709551615}`))
+	f.Add([]byte(`{"ip": "10.0.0.1", "port": 1, "metadata": {"zone": "a"}, "deploymentGroup": "blue", "plannedTerminationTime": "2026-01-01T12:00:00Z"}`))
+	f.Add([]byte(`{"ip": "", "port": -1}`))
+	f.Add([]byte(`{"ip": "10.0.0.1", "port": 1e9}`))
+	f.Add([]byte(`null`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var r Registration
+		if err := json.Unmarshal(data, &r); err != nil {
+			return
+		}
+		if err := r.Validate(); err != nil {
+			return
+		}
+		if r.Ip == "" || r.Port <= 0 || r.Port > 65535 {
+			t.Fatalf("registration %+v is valid", r)
+		}
+
+		// Registrations sent by clients are decoded as they were.
+		b, err := json.Marshal(&r)
+		if err != nil {
+			t.Fatalf("cannot marshal registration %+v: %v", r, err)
+		}
+		var again Registration
+		if err := json.Unmarshal(b, &again); err != nil {
+			t.Fatalf("cannot decode registration %s: %v", b, err)
+		}
+		if r.PlannedTermination != nil && again.PlannedTermination != nil && r.PlannedTermination.Equal(*again.PlannedTermination) {
+			again.PlannedTermination = r.PlannedTermination
+		}
+		if len(r.Metadata) == 0 && len(again.Metadata) == 0 {
+			again.Metadata = r.Metadata
+		}
+		if !reflect.DeepEqual(r, again) {
+			t.Fatalf("registration %+v decoded as %+v", r, again)
+		}
+	})
+}
@@ -0,0 +1,61 @@
+package model
+
+// JWK is a public key signing the catalog responses, as a JSON Web Key
+// (RFC 7517). Keys are either ECDSA P-256 keys (ES256) or Ed25519 keys
+// (EdDSA).
+type JWK struct {
+	// Kty is the key type: "EC" or "OKP".
+	Kty string `json:"kty"`
+
+	// Crv is the curve: "P-256" or "Ed25519".
+	Crv string `json:"crv"`
+
+	// X and Y are the base64url encoded coordinates of the public key. Y
+	// is only set for EC keys.
+	X string `json:"x"`
+	Y string `json:"y,omitempty"`
+
+	// Kid identifies the key in the signatures.
+	Kid string `json:"kid"`
+
+	// Alg is the signature algorithm: "ES256" or "EdDSA".
+	Alg string `json:"alg"`
+
+	// Use is always "sig".
+	Use string `json:"use"`
+}
+
+// JWKSet is the set of keys signing the catalog responses, served at
+// /registro/1.0/keys.
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWSHeader is the protected header of the signatures of the catalog
+// responses. Besides the key, it binds the signature to the request
+// answered, the catalog version and a validity period, so a signed body
+// cannot be replayed as the answer to another request, nor once stale.
+type JWSHeader struct {
+	// Alg is the signature algorithm: "ES256" or "EdDSA".
+	Alg string `json:"alg"`
+
+	// Kid identifies the key, see JWK.
+	Kid string `json:"kid"`
+
+	// Method is the method of the request answered.
+	Method string `json:"method"`
+
+	// Path is the path of the request answered, with its query, as sent by
+	// the client.
+	Path string `json:"path"`
+
+	// Version is the catalog version answered: the one of the watch events,
+	// at least the one of the catalog when the request was received
+	// otherwise.
+	Version uint64 `json:"version"`
+
+	// IssuedAt and Expires are when the signature was made and when it
+	// expires, in unix seconds, as the JWT iat and exp claims.
+	IssuedAt int64 `json:"iat"`
+	Expires  int64 `json:"exp"`
+}
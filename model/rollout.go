@@ -0,0 +1,130 @@
+package model
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RolloutState represents the progress of a Rollout.
+type RolloutState string
+
+const (
+	// RolloutRunning is a rollout shifting traffic at every interval.
+	RolloutRunning RolloutState = "running"
+
+	// RolloutPaused is a rollout kept at its current weight.
+	RolloutPaused RolloutState = "paused"
+
+	// RolloutCompleted is a rollout which reached 100%. Its target group
+	// became the app active group.
+	RolloutCompleted RolloutState = "completed"
+
+	// RolloutAborted is a rollout stopped by an operator. Traffic is back
+	// to the original group.
+	RolloutAborted RolloutState = "aborted"
+)
+
+// Rollout gradually shifts traffic from a deployment group to another.
+type Rollout struct {
+	// From is the deployment group traffic is shifted from.
+	From string `json:"from"`
+
+	// To is the deployment group traffic is shifted to.
+	To string `json:"to"`
+
+	// Steps holds the percentages of traffic sent to To, in order.
+	// The last step is always 100.
+	Steps []float64 `json:"steps"`
+
+	// Interval is the time between steps, in seconds.
+	Interval float64 `json:"interval"`
+
+	// MaxCPU holds the rollout while the average CPU reported by the To
+	// instances is above it. Zero disables the check.
+	MaxCPU float64 `json:"maxCpu,omitempty"`
+
+	// Step is the index of the current step.
+	Step int `json:"step"`
+
+	// Weight is the percentage of traffic currently sent to To.
+	Weight float64 `json:"weight"`
+
+	// State is the progress of the rollout.
+	State RolloutState `json:"state"`
+
+	// Reason describes why the rollout is being held, if it is.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Active reports whether the rollout splits traffic between its groups.
+func (r *Rollout) Active() bool {
+	return r != nil && (r.State == RolloutRunning || r.State == RolloutPaused)
+}
+
+// PickGroup returns the group a single request is sent to, according to
+// the current weight.
+func (r *Rollout) PickGroup() string {
+	if rand.Float64()*100 < r.Weight {
+		return r.To
+	}
+	return r.From
+}
+
+// Validate checks the rollout requested, adding the final 100% step if
+// missing.
+func (r *Rollout) Validate() error {
+	if r.From == "" || r.To == "" || r.From == r.To {
+		return fmt.Errorf("from and to must be distinct groups")
+	}
+	if r.Interval <= 0 {
+		return fmt.Errorf("interval must be positive")
+	}
+	last := 0.0
+	for _, w := range r.Steps {
+		if w <= last || w > 100 {
+			return fmt.Errorf("steps must increase from 0 to 100")
+		}
+		last = w
+	}
+	if last < 100 {
+		r.Steps = append(r.Steps, 100)
+	}
+	return nil
+}
+
+// Maintenance is a window of time where an application (or a single
+// instance) is expected to be unavailable.
+type Maintenance struct {
+	// Instance is the id of the instance under maintenance.
+	// Empty means every instance of the application.
+	Instance string `json:"instance,omitempty"`
+
+	// Start is when the window begins.
+	Start time.Time `json:"start"`
+
+	// End is when the window ends.
+	End time.Time `json:"end"`
+
+	// Reason describes why the maintenance is happening.
+	Reason string `json:"reason,omitempty"`
+}
+
+// Covers reports whether the window applies to the instance id at time t.
+func (m *Maintenance) Covers(id string, t time.Time) bool {
+	if m.Instance != "" && m.Instance != id {
+		return false
+	}
+	return !t.Before(m.Start) && t.Before(m.End)
+}
+
+// Validate checks the window requested, starting it now if Start is unset.
+func (m *Maintenance) Validate() error {
+	if m.Start.IsZero() {
+		m.Start = time.Now()
+	}
+	if !m.End.After(m.Start) || !m.End.After(time.Now()) {
+		return fmt.Errorf("end must be after start and now")
+	}
+	return nil
+}
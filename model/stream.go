@@ -0,0 +1,100 @@
+package model
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// StreamContentType is the content type of the request and response
+// bodies of the agent stream.
+const StreamContentType = "application/vnd.registro.stream"
+
+// MaxFrameSize is the largest payload of a stream frame.
+const MaxFrameSize = 1 << 20
+
+// FrameType identifies the content of a frame of the agent stream.
+//
+// The agent stream is a single long lived HTTP/2 request to the SR, whose
+// request and response bodies are sequences of frames: the frame type (1
+// byte), the payload length (uvarint) and the payload. It multiplexes the
+// renewals, status changes and watch updates of every instance of a host,
+// instead of one HTTP request each.
+type FrameType byte
+
+const (
+	// HeartbeatFrame renews an instance. Its payload is a Heartbeat packet.
+	HeartbeatFrame FrameType = 1
+
+	// StatusFrame changes the status of an instance. Its payload is a
+	// StatusChange, in JSON.
+	StatusFrame FrameType = 2
+
+	// WatchFrame subscribes to the changes of an app. Its payload is the
+	// app name.
+	WatchFrame FrameType = 3
+
+	// AppFrame is sent by the SR with an app watched, in JSON, when the
+	// watch starts and whenever the app changes.
+	AppFrame FrameType = 4
+
+	// ErrorFrame is sent by the SR when a frame cannot be applied. Its
+	// payload is a StreamError, in JSON.
+	ErrorFrame FrameType = 5
+)
+
+// ErrFrameTooLarge is returned when reading a frame above MaxFrameSize.
+var ErrFrameTooLarge = errors.New("stream frame too large")
+
+// StatusChange is the payload of a StatusFrame. Only UP (a renewal) and
+// OUTOFSERVICE (a deregistration) may be requested.
+type StatusChange struct {
+	App        string     `json:"app"`
+	Id         string     `json:"id"`
+	LeaseId    string     `json:"leaseId"`
+	Generation uint64     `json:"generation,omitempty"`
+	Status     StatusType `json:"status"`
+}
+
+// StreamError is the payload of an ErrorFrame.
+type StreamError struct {
+	// Frame is the type of the frame which failed.
+	Frame FrameType `json:"frame"`
+
+	// App and Id identify the instance of the frame, if known.
+	App string `json:"app,omitempty"`
+	Id  string `json:"id,omitempty"`
+
+	// Error describes why the frame failed.
+	Error string `json:"error"`
+}
+
+// WriteFrame writes a frame to w.
+func WriteFrame(w io.Writer, t FrameType, payload []byte) error {
+	b := make([]byte, 0, 1+binary.MaxVarintLen32+len(payload))
+	b = append(b, byte(t))
+	b = binary.AppendUvarint(b, uint64(len(payload)))
+	_, err := w.Write(append(b, payload...))
+	return err
+}
+
+// ReadFrame reads a frame from r.
+func ReadFrame(r *bufio.Reader) (FrameType, []byte, error) {
+	t, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > MaxFrameSize {
+		return 0, nil, ErrFrameTooLarge
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return FrameType(t), payload, nil
+}
@@ -0,0 +1,45 @@
+package model
+
+// Snapshot is the first message of a watch: the apps watched as of a
+// catalog version. The Deltas following it start right after Version,
+// without gaps, so a cache built from the snapshot stays consistent by
+// applying them in order.
+type Snapshot struct {
+	// Version is the catalog version of the snapshot.
+	Version uint64 `json:"version"`
+
+	// Apps holds the apps watched.
+	Apps []*Application `json:"applications"`
+}
+
+// Delta is a change of an app watched, sent after the Snapshot.
+type Delta struct {
+	// Version is the catalog version after the change. Versions always
+	// increase, and are consecutive when every app is watched.
+	Version uint64 `json:"version"`
+
+	// Name is the name of the app changed.
+	Name string `json:"name"`
+
+	// App is the app after the change, nil if it was removed.
+	App *Application `json:"application,omitempty"`
+}
+
+// Apply applies the delta to the apps of a snapshot, returning the apps
+// updated.
+func (d *Delta) Apply(apps []*Application) []*Application {
+	for i, app := range apps {
+		if app.Name != d.Name {
+			continue
+		}
+		if d.App == nil {
+			return append(apps[:i:i], apps[i+1:]...)
+		}
+		apps[i] = d.App
+		return apps
+	}
+	if d.App != nil {
+		apps = append(apps, d.App)
+	}
+	return apps
+}
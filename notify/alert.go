@@ -0,0 +1,176 @@
+package notify
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/numercfd/registro/internal/server"
+)
+
+// resolvedBy holds the event type ending the condition started by another.
+// Alerts fired by other events (e.g. EvictionStorm) are never resolved by
+// the registry, and fire again on the next event.
+var resolvedBy = map[server.EventType]server.EventType{
+	server.AppDown:            server.AppUp,
+	server.AppBelowMinHealthy: server.AppHealthRestored,
+}
+
+// AlertRule fires an alert when a condition, started by an event, lasts
+// longer than For. The alert is resolved when the condition ends.
+type AlertRule struct {
+	// Name identifies the rule in the alert deduplication keys.
+	Name string
+
+	// Apps holds the patterns of the apps watched, as in Rule.
+	Apps []string
+
+	// Event is the type of the event starting the condition, such as
+	// AppDown (resolved by AppUp) or AppBelowMinHealthy (resolved by
+	// AppHealthRestored).
+	Event server.EventType
+
+	// For is the time the condition must last before the alert fires.
+	For time.Duration
+}
+
+// Alert is an alert fired by a rule for an app.
+type Alert struct {
+	// Rule is the name of the rule which fired.
+	Rule string
+
+	// App is the app the alert is about, empty for registry wide alerts.
+	App string
+
+	// Key deduplicates the alert in the sinks. It is the same for every
+	// alert of the rule about the app, so a sink holds a single incident.
+	Key string
+
+	// Summary describes the alert, for humans.
+	Summary string
+
+	// Since is when the condition started.
+	Since time.Time
+}
+
+// AlertSink opens and resolves incidents in an alerting service.
+type AlertSink interface {
+	// Trigger opens an incident for the alert.
+	Trigger(a Alert) error
+
+	// Resolve closes the incident of the alert.
+	Resolve(a Alert) error
+}
+
+// NewAlerter returns an Alerter applying rules and sending the alerts to
+// sinks.
+func NewAlerter(rules []AlertRule, sinks ...AlertSink) *Alerter {
+	return &Alerter{
+		Rules:  rules,
+		Sinks:  sinks,
+		alerts: make(map[string]*pendingAlert),
+		queue:  newQueue(),
+	}
+}
+
+// Alerter applies alert rules to the registry events.
+type Alerter struct {
+	// Rules holds the alert rules applied.
+	Rules []AlertRule
+
+	// Sinks holds the services receiving the alerts.
+	Sinks []AlertSink
+
+	// mu protects alerts.
+	mu sync.Mutex
+
+	// alerts holds the conditions started, by alert key.
+	alerts map[string]*pendingAlert
+
+	queue queue
+}
+
+// pendingAlert is a condition started, which fires once its timer expires.
+type pendingAlert struct {
+	Alert
+	timer *time.Timer
+	fired bool
+}
+
+// Listen applies the rules to the event. It is a StateMachine listener.
+func (a *Alerter) Listen(e server.Event) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, r := range a.Rules {
+		rule := Rule{Apps: r.Apps, Events: []server.EventType{r.Event}}
+		switch {
+		case rule.Match(e):
+			a.start(r, e)
+		case resolvedBy[r.Event] == e.Type && rule.Match(server.Event{Type: r.Event, App: e.App}):
+			a.end(r, e)
+		}
+	}
+}
+
+// start starts the condition of the rule, unless it already started. It
+// must be called with a.mu held.
+func (a *Alerter) start(r AlertRule, e server.Event) {
+	key := alertKey(r, e.App)
+	if _, ok := a.alerts[key]; ok {
+		return
+	}
+
+	p := &pendingAlert{Alert: Alert{Rule: r.Name, App: e.App, Key: key, Summary: Message(e), Since: e.Time}}
+	a.alerts[key] = p
+	p.timer = time.AfterFunc(r.For, func() {
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if a.alerts[key] != p {
+			// The condition ended meanwhile.
+			return
+		}
+		p.fired = true
+		if _, ok := resolvedBy[r.Event]; !ok {
+			delete(a.alerts, key)
+		}
+		log.Printf("alert %s fired: %s", key, p.Summary)
+		a.send(e, p.Alert, AlertSink.Trigger)
+	})
+}
+
+// end ends the condition of the rule, resolving its alert if it fired. It
+// must be called with a.mu held.
+func (a *Alerter) end(r AlertRule, e server.Event) {
+	key := alertKey(r, e.App)
+	p, ok := a.alerts[key]
+	if !ok {
+		return
+	}
+	delete(a.alerts, key)
+	p.timer.Stop()
+	if p.fired {
+		log.Printf("alert %s resolved", key)
+		a.send(e, p.Alert, AlertSink.Resolve)
+	}
+}
+
+// alertKey returns the deduplication key of the alerts of the rule about
+// app.
+func alertKey(r AlertRule, app string) string {
+	if app == "" {
+		return "registro/" + r.Name
+	}
+	return "registro/" + r.Name + "/" + app
+}
+
+// send queues the delivery of the alert to every sink with op.
+func (a *Alerter) send(e server.Event, alert Alert, op func(AlertSink, Alert) error) {
+	a.queue.push(e.Type, func() {
+		for _, sink := range a.Sinks {
+			if err := op(sink, alert); err != nil {
+				log.Printf("alert %s delivery error: %s", alert.Key, err)
+			}
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/numercfd/registro/internal/server"
+)
+
+// ChatRoute sends the events selected by its rule to a Slack or Mattermost
+// incoming webhook.
+type ChatRoute struct {
+	Rule
+
+	// URL is the incoming webhook URL.
+	URL string `json:"url"`
+
+	// Channel overrides the channel of the webhook, if set.
+	Channel string `json:"channel,omitempty"`
+}
+
+// NewChat returns a Chat notifier posting to routes.
+func NewChat(routes []ChatRoute) *Chat {
+	c := &Chat{
+		Routes: routes,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+	c.queue = newQueue()
+	return c
+}
+
+// Chat posts formatted messages to chat webhooks. Every route matching an
+// event gets a message, so events may be sent to several channels.
+type Chat struct {
+	// Routes holds the webhooks notified.
+	Routes []ChatRoute
+
+	// Client is the HTTP client posting the messages.
+	Client *http.Client
+
+	queue queue
+}
+
+// Listen queues the event for delivery. It is a StateMachine listener.
+func (c *Chat) Listen(e server.Event) {
+	for _, r := range c.Routes {
+		if r.Match(e) {
+			c.queue.push(e.Type, func() { c.deliver(e) })
+			return
+		}
+	}
+}
+
+// deliver posts the event to every route matching it.
+func (c *Chat) deliver(e server.Event) {
+	for _, r := range c.Routes {
+		if !r.Match(e) {
+			continue
+		}
+		if err := c.post(r, e); err != nil {
+			log.Printf("chat notification error: %s", err)
+		}
+	}
+}
+
+// post sends the event message to the route webhook. Slack and Mattermost
+// accept the same payload.
+func (c *Chat) post(r ChatRoute, e server.Event) error {
+	body, err := json.Marshal(struct {
+		Text    string `json:"text"`
+		Channel string `json:"channel,omitempty"`
+	}{Message(e), r.Channel})
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Client.Post(r.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/smtp"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// DefaultSubject and DefaultBody are the templates of the alert emails.
+// They are executed with an EmailData.
+const (
+	DefaultSubject = `[registro] {{if .Resolved}}Resolved{{else}}Firing{{end}}: {{.Summary}}`
+
+	DefaultBody = `{{if .Resolved}}The alert below is resolved.{{else}}An alert fired in the service registry.{{end}}
+
+Rule:    {{.Rule}}
+{{- if .App}}
+App:     {{.App}}
+{{- end}}
+Summary: {{.Summary}}
+Since:   {{.Since.Format "2006-01-02 15:04:05 MST"}}
+`
+)
+
+// EmailData is the data given to the email templates.
+type EmailData struct {
+	Alert
+
+	// Resolved is set in the emails resolving the alert.
+	Resolved bool
+}
+
+// EmailRoute selects the recipients of the alerts about some apps.
+type EmailRoute struct {
+	// Apps holds the patterns of the apps, as in Rule. Empty matches every
+	// app. Alerts about the whole registry match every route.
+	Apps []string `json:"apps,omitempty"`
+
+	// To holds the recipient addresses.
+	To []string `json:"to"`
+}
+
+// NewEmail returns an Email sink sending through the SMTP server at addr
+// (host:port) with the default templates.
+func NewEmail(addr, from string, routes []EmailRoute) *Email {
+	return &Email{
+		Addr:    addr,
+		From:    from,
+		Routes:  routes,
+		Subject: template.Must(template.New("subject").Parse(DefaultSubject)),
+		Body:    template.Must(template.New("body").Parse(DefaultBody)),
+	}
+}
+
+// Email is an AlertSink sending emails, for setups without an alerting
+// service. Every alert is sent to the recipients of the routes matching its
+// app, when it fires and when it is resolved.
+type Email struct {
+	// Addr is the host:port of the SMTP server.
+	Addr string
+
+	// Auth authenticates to the SMTP server, if set.
+	Auth smtp.Auth
+
+	// From is the sender address.
+	From string
+
+	// Routes holds the recipients by app.
+	Routes []EmailRoute
+
+	// Subject and Body are the templates of the emails, executed with an
+	// EmailData.
+	Subject *template.Template
+	Body    *template.Template
+}
+
+// Trigger implements AlertSink.
+func (m *Email) Trigger(a Alert) error {
+	return m.send(EmailData{Alert: a})
+}
+
+// Resolve implements AlertSink.
+func (m *Email) Resolve(a Alert) error {
+	return m.send(EmailData{Alert: a, Resolved: true})
+}
+
+// recipients returns the addresses of the routes matching app.
+func (m *Email) recipients(app string) []string {
+	var to []string
+	seen := make(map[string]bool)
+	for _, r := range m.Routes {
+		if !matchApp(r.Apps, app) {
+			continue
+		}
+		for _, addr := range r.To {
+			if !seen[addr] {
+				seen[addr] = true
+				to = append(to, addr)
+			}
+		}
+	}
+	return to
+}
+
+// send sends an email rendering data to the recipients of its app.
+func (m *Email) send(data EmailData) error {
+	to := m.recipients(data.App)
+	if len(to) == 0 {
+		return nil
+	}
+
+	var subject, body bytes.Buffer
+	if err := m.Subject.Execute(&subject, data); err != nil {
+		return err
+	}
+	if err := m.Body.Execute(&body, data); err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.ReplaceAll(subject.String(), "\n", " "))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(body.String(), "\n", "\r\n"))
+	return smtp.SendMail(m.Addr, m.Auth, m.From, to, msg.Bytes())
+}
+
+// PlainAuth returns the PLAIN authentication for the SMTP server at addr.
+func PlainAuth(addr, username, password string) smtp.Auth {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return smtp.PlainAuth("", username, password, host)
+}
+
+// matchApp reports whether app matches one of the patterns. Empty patterns
+// and registry wide events (without app) match.
+func matchApp(patterns []string, app string) bool {
+	if len(patterns) == 0 || app == "" {
+		return true
+	}
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, app); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+// Package notify delivers registry events to external services, such as
+// chat webhooks, so operators learn about outages without watching the
+// registry.
+//
+// Notifiers are StateMachine listeners:
+//
+//	chat := notify.NewChat(routes)
+//	s.States.Listeners = append(s.States.Listeners, chat.Listen)
+package notify
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/numercfd/registro/internal/server"
+)
+
+// queueSize is the number of deliveries a notifier holds while running
+// previous ones. Deliveries are dropped when it is full, so a slow service
+// never blocks the registry.
+const queueSize = 256
+
+// DefaultEvents holds the event types notified by rules without Events:
+// the ones telling an app is unavailable, or back.
+var DefaultEvents = []server.EventType{
+	server.AppDown,
+	server.AppUp,
+	server.AppBelowMinHealthy,
+	server.AppHealthRestored,
+	server.EvictionStorm,
+}
+
+// Rule selects the events sent to a destination.
+type Rule struct {
+	// Apps holds the patterns (as in path.Match, e.g. payments-*) of the
+	// apps notified. Empty matches every app. Events about the whole
+	// registry, such as EvictionStorm, match every rule.
+	Apps []string `json:"apps,omitempty"`
+
+	// Events holds the types of the events notified. Empty notifies
+	// DefaultEvents.
+	Events []server.EventType `json:"events,omitempty"`
+}
+
+// Match reports whether the event is selected by the rule.
+func (r Rule) Match(e server.Event) bool {
+	events := r.Events
+	if len(events) == 0 {
+		events = DefaultEvents
+	}
+	found := false
+	for _, t := range events {
+		found = found || t == e.Type
+	}
+	if !found {
+		return false
+	}
+
+	return matchApp(r.Apps, e.App)
+}
+
+// Message returns a one line description of the event, for humans.
+func Message(e server.Event) string {
+	switch e.Type {
+	case server.AppDown:
+		return fmt.Sprintf("App %s is down: no instance is up", e.App)
+	case server.AppUp:
+		return fmt.Sprintf("App %s is up again", e.App)
+	case server.AppBelowMinHealthy:
+		return fmt.Sprintf("App %s is below its minimum of healthy instances", e.App)
+	case server.AppHealthRestored:
+		return fmt.Sprintf("App %s is back to its minimum of healthy instances", e.App)
+	case server.EvictionStorm:
+		return fmt.Sprintf("Eviction storm: %d instances evicted in the last minute", e.Count)
+	case server.InstanceRegistered:
+		return fmt.Sprintf("Instance %s registered to app %s", e.Instance, e.App)
+	case server.StatusChanged:
+		return fmt.Sprintf("Instance %s of app %s is now %s", e.Instance, e.App, e.To)
+	case server.InstanceEvicted:
+		return fmt.Sprintf("Instance %s of app %s evicted", e.Instance, e.App)
+	default:
+		if e.Instance != "" {
+			return fmt.Sprintf("%s: instance %s of app %s", e.Type, e.Instance, e.App)
+		}
+		return fmt.Sprintf("%s: app %s", e.Type, e.App)
+	}
+}
+
+// queue runs the deliveries pushed, one at a time, in its own goroutine.
+type queue chan func()
+
+// newQueue returns a running queue.
+func newQueue() queue {
+	q := make(queue, queueSize)
+	go func() {
+		for deliver := range q {
+			deliver()
+		}
+	}()
+	return q
+}
+
+// push queues a delivery of an event of type t, dropping it if the queue
+// is full.
+func (q queue) push(t server.EventType, deliver func()) {
+	select {
+	case q <- deliver:
+	default:
+		log.Printf("notification queue full, %s event dropped", t)
+	}
+}
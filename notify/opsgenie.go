@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// opsgenieURL is the Opsgenie API endpoint. EU accounts use
+// https://api.eu.opsgenie.com instead.
+const opsgenieURL = "https://api.opsgenie.com"
+
+// NewOpsgenie returns an Opsgenie sink using the API key of an API
+// integration.
+func NewOpsgenie(apiKey string) *Opsgenie {
+	return &Opsgenie{
+		APIKey:   apiKey,
+		Priority: "P1",
+		URL:      opsgenieURL,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Opsgenie is an AlertSink creating Opsgenie alerts. The alert key is the
+// Opsgenie alias, which deduplicates open alerts and closes them.
+type Opsgenie struct {
+	// APIKey is the key of the API integration.
+	APIKey string
+
+	// Priority is one of P1 (critical) to P5.
+	Priority string
+
+	// URL is the API endpoint.
+	URL string
+
+	// Client is the HTTP client calling the API.
+	Client *http.Client
+}
+
+// Trigger implements AlertSink.
+func (o *Opsgenie) Trigger(a Alert) error {
+	body := struct {
+		Message     string   `json:"message"`
+		Alias       string   `json:"alias"`
+		Description string   `json:"description"`
+		Priority    string   `json:"priority"`
+		Source      string   `json:"source"`
+		Tags        []string `json:"tags,omitempty"`
+	}{
+		Message:     a.Summary,
+		Alias:       a.Key,
+		Description: fmt.Sprintf("Alert rule %s fired, the condition started at %s.", a.Rule, a.Since.Format(time.RFC3339)),
+		Priority:    o.Priority,
+		Source:      "registro",
+	}
+	if a.App != "" {
+		body.Tags = []string{a.App}
+	}
+	return o.post("/v2/alerts", body)
+}
+
+// Resolve implements AlertSink.
+func (o *Opsgenie) Resolve(a Alert) error {
+	return o.post("/v2/alerts/"+url.PathEscape(a.Key)+"/close?identifierType=alias", struct {
+		Source string `json:"source"`
+	}{"registro"})
+}
+
+// post sends a request to the API. Requests are processed asynchronously
+// by Opsgenie, which answers 202.
+func (o *Opsgenie) post(path string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", o.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "GenieKey "+o.APIKey)
+	resp, err := o.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("opsgenie answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// pagerDutyURL is the PagerDuty Events API v2 endpoint. EU accounts use
+// https://events.eu.pagerduty.com/v2/enqueue instead.
+const pagerDutyURL = "https://events.pagerduty.com/v2/enqueue"
+
+// NewPagerDuty returns a PagerDuty sink sending to the service of the
+// routing key (the integration key of an Events API v2 integration).
+func NewPagerDuty(routingKey string) *PagerDuty {
+	return &PagerDuty{
+		RoutingKey: routingKey,
+		Severity:   "critical",
+		URL:        pagerDutyURL,
+		Client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// PagerDuty is an AlertSink opening PagerDuty incidents. The alert key is
+// the incident dedup_key, so an alert firing again updates its incident.
+type PagerDuty struct {
+	// RoutingKey is the integration key of the service.
+	RoutingKey string
+
+	// Severity is one of critical, error, warning or info.
+	Severity string
+
+	// URL is the Events API endpoint.
+	URL string
+
+	// Client is the HTTP client sending the events.
+	Client *http.Client
+}
+
+// Trigger implements AlertSink.
+func (p *PagerDuty) Trigger(a Alert) error {
+	return p.send("trigger", a)
+}
+
+// Resolve implements AlertSink.
+func (p *PagerDuty) Resolve(a Alert) error {
+	return p.send("resolve", a)
+}
+
+// pagerDutyEvent is the request body of the Events API.
+type pagerDutyEvent struct {
+	RoutingKey  string            `json:"routing_key"`
+	EventAction string            `json:"event_action"`
+	DedupKey    string            `json:"dedup_key"`
+	Payload     *pagerDutyPayload `json:"payload,omitempty"`
+}
+
+// pagerDutyPayload describes a triggered event.
+type pagerDutyPayload struct {
+	Summary   string    `json:"summary"`
+	Source    string    `json:"source"`
+	Severity  string    `json:"severity"`
+	Timestamp time.Time `json:"timestamp"`
+	Group     string    `json:"group,omitempty"`
+}
+
+// send sends an event with the action for the alert.
+func (p *PagerDuty) send(action string, a Alert) error {
+	event := pagerDutyEvent{RoutingKey: p.RoutingKey, EventAction: action, DedupKey: a.Key}
+	if action == "trigger" {
+		event.Payload = &pagerDutyPayload{
+			Summary:   a.Summary,
+			Source:    "registro",
+			Severity:  p.Severity,
+			Timestamp: a.Since,
+			Group:     a.App,
+		}
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.Client.Post(p.URL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("pagerduty answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/numercfd/registro/internal/server"
+)
+
+// SIEMFormat is the format of the security events exported to a SIEM.
+type SIEMFormat string
+
+const (
+	// CEFFormat formats the events in the ArcSight Common Event Format.
+	CEFFormat SIEMFormat = "cef"
+
+	// JSONFormat formats the events as JSON objects, see
+	// server.SecurityEvent.
+	JSONFormat SIEMFormat = "json"
+)
+
+// securityNames holds the CEF names of the security events, by type.
+var securityNames = map[server.EventType]string{
+	server.AuthFailed:   "Authentication failed",
+	server.TokenMisused: "Token lacks the scope of the operation",
+	server.PolicyDenied: "Request denied by policy",
+	server.AdminAction:  "Admin action",
+	server.ClientBanned: "Client banned",
+}
+
+// NewSIEM returns a SIEM exporter formatting the events in format.
+func NewSIEM(format SIEMFormat) *SIEM {
+	hostname, _ := os.Hostname()
+	s := &SIEM{
+		Format:   format,
+		Version:  "dev",
+		Hostname: hostname,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+	}
+	s.queue = newQueue()
+	return s
+}
+
+// SIEM exports the security events to a SIEM, over syslog, HTTP, or both.
+// It is a server SecurityListener:
+//
+//	siem := notify.NewSIEM(notify.CEFFormat)
+//	siem.Syslog = "udp://siem.example.com:514"
+//	s.SecurityListeners = append(s.SecurityListeners, siem.Listen)
+type SIEM struct {
+	// Format is the format of the events, CEFFormat or JSONFormat.
+	Format SIEMFormat
+
+	// Version is the registro version, in the CEF header.
+	Version string
+
+	// Syslog, if set, is the address of the syslog receiver, as
+	// udp://host:514 or tcp://host:601. The events are sent as RFC 5424
+	// messages of the security facility, one per line over TCP.
+	Syslog string
+
+	// Hostname identifies the registry in the syslog messages.
+	Hostname string
+
+	// URL, if set, receives the events, one per POST request.
+	URL string
+
+	// Headers holds the headers of the POST requests, such as
+	// Authorization.
+	Headers map[string]string
+
+	// Client is the HTTP client posting the events.
+	Client *http.Client
+
+	// conn is the syslog connection, dialed on the first event. It is only
+	// used by the queue goroutine.
+	conn net.Conn
+
+	queue queue
+}
+
+// Listen queues the event for delivery. It is a server SecurityListener.
+func (s *SIEM) Listen(e server.SecurityEvent) {
+	s.queue.push(e.Type, func() { s.deliver(e) })
+}
+
+// deliver sends the event to the syslog receiver and the URL.
+func (s *SIEM) deliver(e server.SecurityEvent) {
+	msg, err := s.format(e)
+	if err != nil {
+		log.Printf("siem export error: %s", err)
+		return
+	}
+	if s.Syslog != "" {
+		if err := s.sendSyslog(e, msg); err != nil {
+			log.Printf("siem syslog error: %s", err)
+		}
+	}
+	if s.URL != "" {
+		if err := s.post(msg); err != nil {
+			log.Printf("siem export error: %s", err)
+		}
+	}
+}
+
+// format returns the event in the SIEM Format.
+func (s *SIEM) format(e server.SecurityEvent) ([]byte, error) {
+	switch s.Format {
+	case CEFFormat:
+		return []byte(s.cef(e)), nil
+	case JSONFormat, "":
+		return json.Marshal(e)
+	default:
+		return nil, fmt.Errorf("unknown format %q", s.Format)
+	}
+}
+
+// cef returns the CEF line of the event.
+func (s *SIEM) cef(e server.SecurityEvent) string {
+	name := securityNames[e.Type]
+	if name == "" {
+		name = string(e.Type)
+	}
+	header := []string{"CEF:0", "registro", "registro", s.Version, string(e.Type), name, strconv.Itoa(e.Severity)}
+	for i := range header[1:] {
+		header[i+1] = cefHeaderEscaper.Replace(header[i+1])
+	}
+
+	var ext []string
+	add := func(key, value string) {
+		if value != "" {
+			ext = append(ext, key+"="+cefValueEscaper.Replace(value))
+		}
+	}
+	add("rt", strconv.FormatInt(e.Time.UnixNano()/int64(time.Millisecond), 10))
+	add("src", e.Address)
+	add("suser", e.Token)
+	add("requestMethod", e.Method)
+	add("request", e.Path)
+	add("outcome", strconv.Itoa(e.Status))
+	add("reason", e.Reason)
+	if e.Client != "" {
+		add("cs1Label", "client")
+		add("cs1", e.Client)
+	}
+	return strings.Join(header, "|") + "|" + strings.Join(ext, " ")
+}
+
+var (
+	// cefHeaderEscaper escapes the CEF header fields.
+	cefHeaderEscaper = strings.NewReplacer(`\`, `\\`, `|`, `\|`, "\n", " ", "\r", " ")
+
+	// cefValueEscaper escapes the CEF extension values.
+	cefValueEscaper = strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\n", `\n`, "\r", `\r`)
+)
+
+// sendSyslog sends msg to the syslog receiver, dialing it again once if
+// the connection was lost.
+func (s *SIEM) sendSyslog(e server.SecurityEvent, msg []byte) error {
+	// The security/authorization facility is 4, and the syslog severity
+	// decreases as the CEF one increases.
+	severity := 5
+	switch {
+	case e.Severity >= 8:
+		severity = 3
+	case e.Severity >= 5:
+		severity = 4
+	}
+	hostname := s.Hostname
+	if hostname == "" {
+		hostname = "-"
+	}
+	line := fmt.Sprintf("<%d>1 %s %s registro %d %s - %s\n",
+		4*8+severity, e.Time.UTC().Format(time.RFC3339Nano), hostname, os.Getpid(), e.Type, msg)
+
+	for retry := 0; ; retry++ {
+		if s.conn == nil {
+			u, err := url.Parse(s.Syslog)
+			if err != nil {
+				return err
+			}
+			if u.Scheme != "udp" && u.Scheme != "tcp" {
+				return fmt.Errorf("unsupported syslog address %q", s.Syslog)
+			}
+			if s.conn, err = net.DialTimeout(u.Scheme, u.Host, 10*time.Second); err != nil {
+				return err
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+		_, err := s.conn.Write([]byte(line))
+		if err == nil || retry > 0 {
+			return err
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// post sends msg to the URL.
+func (s *SIEM) post(msg []byte) error {
+	req, err := http.NewRequest(http.MethodPost, s.URL, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.Format == CEFFormat {
+		req.Header.Set("Content-Type", "text/plain")
+	}
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s answered %s", s.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,414 @@
+// Package registro embeds a registry in Go programs.
+//
+// It is the API of the registry kept compatible across releases: NewServer
+// and its options, the Store interface and the types they refer to. The
+// registry itself is implemented in an internal package.
+//
+//	srv, err := registro.NewServer(
+//		registro.WithAddr(":8080"),
+//		registro.WithStore(registro.NewFileStore("/var/lib/registro/registry.json")),
+//	)
+//	if err != nil {
+//		log.Fatal(err)
+//	}
+//	log.Fatal(srv.Serve())
+//
+// Programs with their own http.Server call Start, then serve Handler.
+package registro
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/numercfd/registro/internal/server"
+	"github.com/numercfd/registro/model"
+)
+
+// Application is an application of the registry, and its instances.
+type Application = model.Application
+
+// Instance is an instance of an application.
+type Instance = model.Instance
+
+// Token is an API token and the scopes it grants.
+type Token struct {
+	// Name identifies the token in logs and policies, never its secret.
+	Name string
+
+	// Secret is the value sent by clients, as "Authorization: Bearer
+	// <secret>".
+	Secret string
+
+	// Scopes holds the scopes granted. AdminScope grants every scope, and
+	// RegisterScope grants DiscoverScope too.
+	Scopes []Scope
+
+	// Environment, if set, restricts the token to the apps of an
+	// environment.
+	Environment string
+}
+
+// Scope is the permission required by an operation.
+type Scope string
+
+// The scopes granted by Tokens.
+const (
+	DiscoverScope = Scope(server.DiscoverScope)
+	RegisterScope = Scope(server.RegisterScope)
+	AdminScope    = Scope(server.AdminScope)
+)
+
+// EventType identifies the kind of an Event or SecurityEvent.
+type EventType string
+
+// The types of the Events.
+const (
+	InstanceRegistered = EventType(server.InstanceRegistered)
+	StatusChanged      = EventType(server.StatusChanged)
+	InstanceEvicted    = EventType(server.InstanceEvicted)
+	InstanceDraining   = EventType(server.InstanceDraining)
+	AppBelowMinHealthy = EventType(server.AppBelowMinHealthy)
+	AppHealthRestored  = EventType(server.AppHealthRestored)
+	AppDown            = EventType(server.AppDown)
+	AppUp              = EventType(server.AppUp)
+	EvictionStorm      = EventType(server.EvictionStorm)
+	AppArchived        = EventType(server.AppArchived)
+	AppPurged          = EventType(server.AppPurged)
+	AppExpired         = EventType(server.AppExpired)
+	AppMoved           = EventType(server.AppMoved)
+)
+
+// The types of the SecurityEvents.
+const (
+	AuthFailed   = EventType(server.AuthFailed)
+	TokenMisused = EventType(server.TokenMisused)
+	PolicyDenied = EventType(server.PolicyDenied)
+	AdminAction  = EventType(server.AdminAction)
+	ClientBanned = EventType(server.ClientBanned)
+)
+
+// Event represents a change in the state of an instance or application.
+type Event struct {
+	Type EventType `json:"type"`
+
+	// App is the name of the application changed.
+	App string `json:"app"`
+
+	// Instance is the id of the instance changed, if any.
+	Instance string `json:"instance,omitempty"`
+
+	// Client identifies the client banned by a ClientBanned.
+	Client string `json:"client,omitempty"`
+
+	// From and To are the statuses before and after the change.
+	From model.StatusType `json:"from,omitempty"`
+	To   model.StatusType `json:"to,omitempty"`
+
+	// Count is the number of occurrences summarized by the event, such as
+	// the evictions of an EvictionStorm.
+	Count int `json:"count,omitempty"`
+
+	// Time is when the change happened.
+	Time time.Time `json:"time"`
+}
+
+// Middleware wraps the handler of every route.
+type Middleware func(next http.Handler) http.Handler
+
+// RouteInfo describes the route a request was matched to.
+type RouteInfo struct {
+	// Path is the path template of the route, as in version 1.0 of the API
+	// whatever the version requested, e.g. /registro/1.0/apps/{appName}.
+	Path string
+
+	// Version is the version of the API requested, empty for the routes
+	// which are not versioned, such as /registro/admin.
+	Version string
+
+	// Scope is the permission required by the operation requested.
+	Scope Scope
+
+	// Stream is set for long lived requests, such as the agent stream.
+	Stream bool
+
+	// Signed is set for the catalog routes, whose responses are signed.
+	Signed bool
+
+	// Public is set for the routes served without a token.
+	Public bool
+}
+
+// RequestRoute returns the route the request was matched to, for
+// Middlewares applying per route policies.
+func RequestRoute(r *http.Request) RouteInfo {
+	info := server.RequestRoute(r)
+	return RouteInfo{Path: info.Path, Version: info.Version, Scope: Scope(info.Scope), Stream: info.Stream,
+		Signed: info.Signed, Public: info.Public}
+}
+
+// ClientIP returns the address of the client which sent the request, as
+// reported by the trusted proxies if it went through one.
+func ClientIP(r *http.Request) string {
+	return server.ClientIP(r)
+}
+
+// Policy decides whether requests are allowed.
+type Policy interface {
+	Decide(ctx context.Context, input *PolicyInput) (Decision, error)
+}
+
+// PolicyInput describes a request to a Policy.
+type PolicyInput struct {
+	// Client identifies the client: its address, or the value of the usage
+	// header.
+	Client string `json:"client"`
+
+	// Token is the name of the token the request was authenticated with,
+	// if any.
+	Token string `json:"token,omitempty"`
+
+	// Environment is the environment of the client, if any.
+	Environment string `json:"environment,omitempty"`
+
+	// Address is the client address.
+	Address string `json:"address"`
+
+	// Method is the request method.
+	Method string `json:"method"`
+
+	// Route is the path template of the route, e.g.
+	// /registro/1.0/apps/{appName}.
+	Route string `json:"route"`
+
+	// Scope is the permission the operation requires.
+	Scope Scope `json:"scope"`
+
+	// Params holds the path parameters, e.g. appName.
+	Params map[string]string `json:"params"`
+
+	// Query holds the query parameters.
+	Query map[string][]string `json:"query,omitempty"`
+
+	// Body holds the request body, if it is JSON.
+	Body json.RawMessage `json:"body,omitempty"`
+}
+
+// Decision is the answer of a Policy.
+type Decision struct {
+	// Allow is set if the request may proceed.
+	Allow bool `json:"allow"`
+
+	// Reason tells why the request was denied, if it was.
+	Reason string `json:"reason,omitempty"`
+}
+
+// serverPolicy adapts a Policy to the server.
+type serverPolicy struct {
+	policy Policy
+}
+
+func (p serverPolicy) Decide(ctx context.Context, in *server.PolicyInput) (server.Decision, error) {
+	d, err := p.policy.Decide(ctx, &PolicyInput{Client: in.Client, Token: in.Token, Environment: in.Environment,
+		Address: in.Address, Method: in.Method, Route: in.Route, Scope: Scope(in.Scope), Params: in.Params,
+		Query: in.Query, Body: in.Body})
+	return server.Decision(d), err
+}
+
+// ErrorReporter receives the panics recovered while handling requests.
+type ErrorReporter interface {
+	ReportPanic(r *http.Request, value interface{}, stack []byte)
+}
+
+// SecurityEvent is an authentication failure, an admin action or another
+// event of interest to security monitoring.
+type SecurityEvent struct {
+	Type EventType `json:"type"`
+
+	// Severity ranks the event from 0 (lowest) to 10, as in CEF.
+	Severity int `json:"severity"`
+
+	// Address is the client address.
+	Address string `json:"address"`
+
+	// Client identifies the client banned by a ClientBanned.
+	Client string `json:"client,omitempty"`
+
+	// Token is the name of the token presented, if valid.
+	Token string `json:"token,omitempty"`
+
+	// Method and Path describe the request.
+	Method string `json:"method"`
+	Path   string `json:"path"`
+
+	// Status is the response status code.
+	Status int `json:"status"`
+
+	// Reason tells why the request was refused, if it was.
+	Reason string `json:"reason,omitempty"`
+
+	// Time is when the event happened.
+	Time time.Time `json:"time"`
+}
+
+// Option configures a Server.
+type Option func(*Server) error
+
+// WithAddr sets the address the Server listens to, ":8080" unless set. It
+// may be the path of a unix domain socket, prefixed with "unix://".
+func WithAddr(addr string) Option {
+	return func(s *Server) error {
+		s.srv.ListenAddr = addr
+		return nil
+	}
+}
+
+// WithStore persists the registry in store. Without a Store, the registry
+// is only kept in memory and lost when the Server stops.
+func WithStore(store Store) Option {
+	return func(s *Server) error {
+		if store == nil {
+			return errors.New("nil store")
+		}
+		s.srv.Store = newServerStore(store)
+		return nil
+	}
+}
+
+// WithTimeouts sets the time without heartbeats before an instance is
+// down, and before it is removed.
+func WithTimeouts(renewal, eviction time.Duration) Option {
+	return func(s *Server) error {
+		if renewal <= 0 || eviction <= renewal {
+			return errors.New("the eviction timeout must be greater than the renewal timeout")
+		}
+		s.srv.States.RenewalTimeout = renewal
+		s.srv.States.EvictionTimeout = eviction
+		return nil
+	}
+}
+
+// WithTokens sets the API tokens accepted: every request must then present
+// one granting the scope of its operation.
+func WithTokens(tokens ...Token) Option {
+	return func(s *Server) error {
+		for _, t := range tokens {
+			scopes := make([]server.Scope, 0, len(t.Scopes))
+			for _, scope := range t.Scopes {
+				scopes = append(scopes, server.Scope(scope))
+			}
+			s.srv.Tokens = append(s.srv.Tokens, server.Token{Name: t.Name, Secret: t.Secret, Scopes: scopes, Environment: t.Environment})
+		}
+		return nil
+	}
+}
+
+// WithMiddleware wraps every route with the middlewares, the first being
+// the outermost, within the ones of the registry: the requests reaching
+// them are authenticated.
+func WithMiddleware(mws ...Middleware) Option {
+	return func(s *Server) error {
+		for _, mw := range mws {
+			s.srv.Middleware = append(s.srv.Middleware, server.Middleware(mw))
+		}
+		return nil
+	}
+}
+
+// WithEventListener calls fn for every event emitted. It is called with the
+// registry locked, so it must not block nor call the Server.
+func WithEventListener(fn func(Event)) Option {
+	return func(s *Server) error {
+		s.srv.States.Listeners = append(s.srv.States.Listeners, func(e server.Event) {
+			fn(Event{Type: EventType(e.Type), App: e.App, Instance: e.Instance, Client: e.Client, From: e.From, To: e.To,
+				Count: e.Count, Time: e.Time})
+		})
+		return nil
+	}
+}
+
+// WithPolicy decides whether requests are allowed with the policy. Requests
+// the policy fails to decide are answered with 503.
+func WithPolicy(policy Policy) Option {
+	return func(s *Server) error {
+		s.srv.Policy = nil
+		if policy != nil {
+			s.srv.Policy = serverPolicy{policy}
+		}
+		return nil
+	}
+}
+
+// WithReporter sends the panics recovered while handling requests to the
+// reporter.
+func WithReporter(reporter ErrorReporter) Option {
+	return func(s *Server) error {
+		s.srv.Reporter = reporter
+		return nil
+	}
+}
+
+// WithSecurityListener calls fn for every SecurityEvent.
+func WithSecurityListener(fn func(SecurityEvent)) Option {
+	return func(s *Server) error {
+		s.srv.SecurityListeners = append(s.srv.SecurityListeners, func(e server.SecurityEvent) {
+			fn(SecurityEvent{Type: EventType(e.Type), Severity: e.Severity, Address: e.Address, Client: e.Client,
+				Token: e.Token, Method: e.Method, Path: e.Path, Status: e.Status, Reason: e.Reason, Time: e.Time})
+		})
+		return nil
+	}
+}
+
+// NewServer returns a Server configured by the options.
+func NewServer(opts ...Option) (*Server, error) {
+	s := &Server{srv: server.NewServer(":8080")}
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Server is a registry embedded in a program. It is safe for concurrent
+// use.
+type Server struct {
+	srv *server.Server
+}
+
+// Start restores the Store, and starts expiring and evicting instances.
+// Serve calls it: it is only needed before serving Handler with another
+// http.Server. Further calls return the result of the first one.
+func (s *Server) Start() error {
+	return s.srv.Start()
+}
+
+// Handler returns the handler of the registry REST API.
+func (s *Server) Handler() http.Handler {
+	return s.srv.Handler()
+}
+
+// Serve starts the Server and serves the REST API until Shutdown, when it
+// returns http.ErrServerClosed.
+func (s *Server) Serve() error {
+	return s.srv.Serve()
+}
+
+// Shutdown gracefully stops the Server, writing any buffered change to the
+// Store.
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.srv.Shutdown(ctx)
+}
+
+// Apps returns the registered applications. They are copies, which may be
+// kept and modified.
+func (s *Server) Apps() []*Application {
+	return s.srv.Apps()
+}
+
+// App returns the application, nil if it is not registered.
+func (s *Server) App(name string) *Application {
+	return s.srv.App(name)
+}
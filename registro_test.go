@@ -0,0 +1,230 @@
+package registro
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore is a Store keeping the registry in memory.
+type memStore struct {
+	mu      sync.Mutex
+	apps    map[string]*StoredApplication
+	changes []Change
+}
+
+func newMemStore() *memStore {
+	return &memStore{apps: make(map[string]*StoredApplication)}
+}
+
+func (m *memStore) Load() ([]*StoredApplication, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	apps := make([]*StoredApplication, 0, len(m.apps))
+	for _, app := range m.apps {
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+func (m *memStore) Write(batch []Change) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, c := range batch {
+		m.changes = append(m.changes, c)
+		app := m.apps[c.App]
+		if app == nil {
+			app = &StoredApplication{Name: c.App}
+			m.apps[c.App] = app
+		}
+		switch c.Type {
+		case PutInstance, RenewInstance:
+			for i, inst := range app.Instances {
+				if inst.Id == c.Instance.Id {
+					app.Instances = append(app.Instances[:i], app.Instances[i+1:]...)
+					break
+				}
+			}
+			app.Instances = append(app.Instances, c.Instance)
+		case DeleteApplication:
+			delete(m.apps, c.App)
+		}
+	}
+	return nil
+}
+
+func (m *memStore) Close() error { return nil }
+
+// request sends a request to the handler of s, failing the test unless it
+// answers with code.
+func request(t *testing.T, s *Server, method, path, body string, code int) {
+	t.Helper()
+	r := httptest.NewRequest(method, "/registro/1.0"+path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, r)
+	if rec.Code != code {
+		t.Fatalf("%s %s: got status %d, want %d: %s", method, path, rec.Code, code, rec.Body)
+	}
+}
+
+// start starts a Server with the options, stopped at the end of the test.
+func start(t *testing.T, opts ...Option) *Server {
+	t.Helper()
+	s, err := NewServer(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWithTimeouts(t *testing.T) {
+	tests := []struct {
+		renewal, eviction time.Duration
+		ok                bool
+	}{
+		{90 * time.Second, 10 * time.Minute, true},
+		{time.Minute, time.Minute, false},
+		{time.Minute, time.Second, false},
+		{0, time.Minute, false},
+	}
+	for _, tt := range tests {
+		if _, err := NewServer(WithTimeouts(tt.renewal, tt.eviction)); (err == nil) != tt.ok {
+			t.Errorf("WithTimeouts(%s, %s) returned %v", tt.renewal, tt.eviction, err)
+		}
+	}
+}
+
+func TestStore(t *testing.T) {
+	store := newMemStore()
+	s := start(t, WithStore(store))
+	request(t, s, "POST", "/apps", `{"name": "web", "minHealthyInstances": 1}`, 201)
+	request(t, s, "POST", "/apps/web", `{"id": "i-1", "ip": "10.0.0.1", "port": 8080, "metadata": {"zone": "a"}}`, 201)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var put *Change
+	for i, c := range store.changes {
+		if c.Type == PutInstance {
+			put = &store.changes[i]
+		}
+	}
+	if put == nil || put.App != "web" || put.MinHealthy != 1 || put.Instance.Id != "i-1" || put.Instance.Metadata["zone"] != "a" {
+		t.Fatalf("instance registered written as %+v", put)
+	}
+
+	s = start(t, WithStore(store))
+	defer s.Shutdown(context.Background())
+	app := s.App("web")
+	if app == nil || len(app.Instances) != 1 || app.Instances[0].IPAddr != "10.0.0.1" {
+		t.Fatalf("loaded app %+v, want web with i-1", app)
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registry.json")
+
+	store := NewFileStore(path)
+	inst := &StoredInstance{Id: "i-1", IPAddr: "10.0.0.1", Port: 8080, Status: "UP", Generation: 2, LastRenewal: 1000}
+	if err := store.Write([]Change{{Type: PutApplication, App: "web"}, {Type: PutInstance, App: "web", Instance: inst}}); err != nil {
+		t.Fatal(err)
+	}
+	apps, err := NewFileStore(path).Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 1 || len(apps[0].Instances) != 1 || !reflect.DeepEqual(apps[0].Instances[0], inst) {
+		t.Fatalf("loaded %+v, want web with %+v", apps, inst)
+	}
+}
+
+func TestAppsCopies(t *testing.T) {
+	s := start(t)
+	defer s.Shutdown(context.Background())
+	request(t, s, "POST", "/apps", `{"name": "web"}`, 201)
+	request(t, s, "POST", "/apps/web", `{"id": "i-1", "ip": "10.0.0.1", "port": 8080, "metadata": {"zone": "a"}}`, 201)
+
+	s.App("web").Instances[0].Metadata["zone"] = "b"
+	s.Apps()[0].Instances[0].Metadata["zone"] = "c"
+	if zone := s.App("web").Instances[0].Metadata["zone"]; zone != "a" {
+		t.Errorf("zone changed to %q through a copy", zone)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	var events []Event
+	var security []SecurityEvent
+	s := start(t,
+		WithTokens(Token{Name: "deployer", Secret: "secret", Scopes: []Scope{RegisterScope}}),
+		WithEventListener(func(e Event) { events = append(events, e) }),
+		WithSecurityListener(func(e SecurityEvent) { security = append(security, e) }),
+	)
+	defer s.Shutdown(context.Background())
+
+	request(t, s, "POST", "/apps", `{"name": "web"}`, 401)
+	if len(security) != 1 || security[0].Type != AuthFailed {
+		t.Errorf("got security events %+v, want %s", security, AuthFailed)
+	}
+
+	r := httptest.NewRequest("POST", "/registro/1.0/apps", strings.NewReader(`{"name": "web"}`))
+	r.Header.Set("Authorization", "Bearer secret")
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, r)
+	if rec.Code != 201 {
+		t.Fatalf("got status %d with the token, want 201", rec.Code)
+	}
+	r = httptest.NewRequest("POST", "/registro/1.0/apps/web", strings.NewReader(`{"id": "i-1", "ip": "10.0.0.1", "port": 8080}`))
+	r.Header.Set("Authorization", "Bearer secret")
+	s.Handler().ServeHTTP(httptest.NewRecorder(), r)
+	if len(events) == 0 || events[0].Type != InstanceRegistered || events[0].App != "web" || events[0].Instance != "i-1" {
+		t.Errorf("got events %+v, want %s", events, InstanceRegistered)
+	}
+}
+
+// denyAll is a Policy denying every request.
+type denyAll struct {
+	inputs []*PolicyInput
+}
+
+func (p *denyAll) Decide(ctx context.Context, input *PolicyInput) (Decision, error) {
+	p.inputs = append(p.inputs, input)
+	return Decision{Reason: "denied"}, nil
+}
+
+func TestPolicy(t *testing.T) {
+	policy := &denyAll{}
+	s := start(t,
+		WithPolicy(policy),
+		WithMiddleware(func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if route := RequestRoute(r); route.Scope != RegisterScope {
+					t.Errorf("%s %s requires %q, want %q", r.Method, route.Path, route.Scope, RegisterScope)
+				}
+				next.ServeHTTP(w, r)
+			})
+		}),
+	)
+	defer s.Shutdown(context.Background())
+
+	request(t, s, "POST", "/apps", `{"name": "web"}`, 403)
+	if len(policy.inputs) != 1 || policy.inputs[0].Scope != RegisterScope || policy.inputs[0].Route != "/registro/1.0/apps" {
+		t.Errorf("policy decided %+v", policy.inputs)
+	}
+}
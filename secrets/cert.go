@@ -0,0 +1,90 @@
+package secrets
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Certificate is a TLS certificate read from a secret, refreshed so that
+// rotated certificates are served without a restart. It is safe for
+// concurrent use.
+type Certificate struct {
+	// Resolver fetches the secret.
+	Resolver *Resolver
+
+	// Ref references the secret, whose CertField and KeyField fields hold
+	// the certificate chain and private key in PEM.
+	Ref Ref
+
+	// CertField and KeyField are the fields of the certificate chain and
+	// private key, "certificate" and "private_key" by default, as issued
+	// by the Vault PKI engine.
+	CertField, KeyField string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+// NewCertificate returns the Certificate held by the secret referenced by
+// ref, fetching it once.
+func NewCertificate(ctx context.Context, r *Resolver, ref string) (*Certificate, error) {
+	parsed, ok := r.Parse(ref)
+	if !ok {
+		return nil, fmt.Errorf("invalid certificate secret reference %q", ref)
+	}
+	c := &Certificate{
+		Resolver:  r,
+		Ref:       parsed,
+		CertField: "certificate",
+		KeyField:  "private_key",
+	}
+	if err := c.Refresh(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Refresh fetches the certificate again. The previous one is kept on
+// errors.
+func (c *Certificate) Refresh(ctx context.Context) error {
+	fields, err := c.Resolver.Secret(ctx, c.Ref)
+	if err != nil {
+		return err
+	}
+	cert, err := tls.X509KeyPair([]byte(fields[c.CertField]), []byte(fields[c.KeyField]))
+	if err != nil {
+		return fmt.Errorf("secret %s: %s", c.Ref, err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the certificate every interval until ctx is done.
+func (c *Certificate) Run(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return
+		}
+		if err := c.Refresh(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("error refreshing certificate, the previous one is kept: %s", err)
+		}
+	}
+}
+
+// GetCertificate returns the certificate, for tls.Config.
+func (c *Certificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
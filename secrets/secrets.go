@@ -0,0 +1,124 @@
+// Package secrets fetches the secrets of the registry, such as TLS
+// certificates and notification keys, from secret stores like HashiCorp
+// Vault instead of flat files.
+//
+// Configuration values may be secret references, resolved when the server
+// starts:
+//
+//	vault:secret/data/registro#pagerduty
+//	env:PAGERDUTY_KEY
+//
+// A reference names the provider, the path of the secret and the field
+// read. Values without the scheme of a known provider are used as is.
+package secrets
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Provider fetches secrets from a secret store.
+type Provider interface {
+	// Secret returns the fields of the secret at path.
+	Secret(ctx context.Context, path string) (map[string]string, error)
+}
+
+// Resolver resolves secret references through the providers of their
+// scheme.
+type Resolver struct {
+	// Providers holds the providers by scheme, e.g. "vault".
+	Providers map[string]Provider
+}
+
+// NewResolver returns a Resolver with the Env provider, as "env".
+func NewResolver() *Resolver {
+	return &Resolver{Providers: map[string]Provider{"env": Env{}}}
+}
+
+// Ref is a parsed secret reference, <scheme>:<path>#<field>.
+type Ref struct {
+	Scheme string
+	Path   string
+	Field  string
+}
+
+// String returns the reference in its configuration form.
+func (r Ref) String() string {
+	s := r.Scheme + ":" + r.Path
+	if r.Field != "" {
+		s += "#" + r.Field
+	}
+	return s
+}
+
+// Parse returns the reference held by value. It returns false if value
+// doesn't start with the scheme of a known provider.
+func (r *Resolver) Parse(value string) (Ref, bool) {
+	i := strings.Index(value, ":")
+	if i <= 0 || r.Providers[value[:i]] == nil {
+		return Ref{}, false
+	}
+	ref := Ref{Scheme: value[:i], Path: value[i+1:]}
+	if j := strings.LastIndex(ref.Path, "#"); j >= 0 {
+		ref.Path, ref.Field = ref.Path[:j], ref.Path[j+1:]
+	}
+	return ref, true
+}
+
+// Secret returns the fields of the secret referenced by ref.
+func (r *Resolver) Secret(ctx context.Context, ref Ref) (map[string]string, error) {
+	p := r.Providers[ref.Scheme]
+	if p == nil {
+		return nil, fmt.Errorf("unknown secret provider %q", ref.Scheme)
+	}
+	fields, err := p.Secret(ctx, ref.Path)
+	if err != nil {
+		return nil, fmt.Errorf("secret %s: %s", ref, err)
+	}
+	return fields, nil
+}
+
+// Resolve returns the secret referenced by value, or value itself if it is
+// not a reference.
+func (r *Resolver) Resolve(ctx context.Context, value string) (string, error) {
+	ref, ok := r.Parse(value)
+	if !ok {
+		return value, nil
+	}
+	fields, err := r.Secret(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	v, ok := fields[ref.Field]
+	if !ok {
+		return "", fmt.Errorf("secret %s: no field %q", ref, ref.Field)
+	}
+	return v, nil
+}
+
+// ResolveAll replaces every reference in values by its secret.
+func (r *Resolver) ResolveAll(ctx context.Context, values ...*string) error {
+	for _, v := range values {
+		s, err := r.Resolve(ctx, *v)
+		if err != nil {
+			return err
+		}
+		*v = s
+	}
+	return nil
+}
+
+// Env is a Provider reading environment variables. The path is the
+// variable name, and its value the unnamed field: env:NAME.
+type Env struct{}
+
+// Secret implements Provider.
+func (Env) Secret(ctx context.Context, path string) (map[string]string, error) {
+	v, ok := os.LookupEnv(path)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %s is not set", path)
+	}
+	return map[string]string{"": v}, nil
+}
@@ -0,0 +1,169 @@
+package secrets
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// NewVault returns a Vault provider for the server at addr, authenticated
+// with token. Empty values are read from VAULT_ADDR and VAULT_TOKEN.
+func NewVault(addr, token string) *Vault {
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	return &Vault{
+		Addr:   strings.TrimSuffix(addr, "/"),
+		Token:  token,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Vault is a Provider reading the secrets of a HashiCorp Vault server
+// through its HTTP API. Paths are API paths without the /v1 prefix, e.g.
+// secret/data/registro for the registro secret of a KV version 2 engine
+// mounted at secret/.
+type Vault struct {
+	// Addr is the URL of the server, e.g. https://vault:8200.
+	Addr string
+
+	// Token is the Vault token used, see KeepTokenAlive.
+	Token string
+
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string
+
+	// Client is the HTTP client used.
+	Client *http.Client
+}
+
+// vaultResponse is the body of the Vault API responses.
+type vaultResponse struct {
+	Data map[string]interface{} `json:"data"`
+	Auth *struct {
+		LeaseDuration int  `json:"lease_duration"`
+		Renewable     bool `json:"renewable"`
+	} `json:"auth"`
+	Errors []string `json:"errors"`
+}
+
+// do sends a request to the Vault API.
+func (v *Vault) do(ctx context.Context, method, path string) (*vaultResponse, error) {
+	if v.Addr == "" {
+		return nil, fmt.Errorf("no Vault address")
+	}
+	req, err := http.NewRequest(method, v.Addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", v.Token)
+	if v.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", v.Namespace)
+	}
+	resp, err := v.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return nil, fmt.Errorf("not found in Vault")
+	}
+	var body vaultResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("Vault answered %d: %s", resp.StatusCode, err)
+	}
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Vault answered %d: %s", resp.StatusCode, strings.Join(body.Errors, ", "))
+	}
+	return &body, nil
+}
+
+// Secret implements Provider. Secrets of KV version 2 engines are
+// unwrapped from their metadata, and values other than strings are
+// returned in JSON.
+func (v *Vault) Secret(ctx context.Context, path string) (map[string]string, error) {
+	resp, err := v.do(ctx, "GET", path)
+	if err != nil {
+		return nil, err
+	}
+	data := resp.Data
+	if inner, ok := data["data"].(map[string]interface{}); ok {
+		if _, ok := data["metadata"]; ok {
+			data = inner
+		}
+	}
+
+	fields := make(map[string]string, len(data))
+	for k, v := range data {
+		switch v := v.(type) {
+		case string:
+			fields[k] = v
+		default:
+			b, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			fields[k] = string(b)
+		}
+	}
+	return fields, nil
+}
+
+// RenewToken renews the lease of the token, returning its new TTL and
+// whether it may be renewed again.
+func (v *Vault) RenewToken(ctx context.Context) (time.Duration, bool, error) {
+	resp, err := v.do(ctx, "POST", "auth/token/renew-self")
+	if err != nil {
+		return 0, false, err
+	}
+	if resp.Auth == nil {
+		return 0, false, fmt.Errorf("no token lease in Vault response")
+	}
+	return time.Duration(resp.Auth.LeaseDuration) * time.Second, resp.Auth.Renewable, nil
+}
+
+// KeepTokenAlive renews the token when half of its TTL elapsed, until ctx
+// is done. It returns at once if the token cannot be renewed, e.g. a root
+// token which never expires. Failed renewals are retried every minute.
+func (v *Vault) KeepTokenAlive(ctx context.Context) {
+	resp, err := v.do(ctx, "GET", "auth/token/lookup-self")
+	if err != nil {
+		log.Printf("error looking up Vault token: %s", err)
+		return
+	}
+	if renewable, _ := resp.Data["renewable"].(bool); !renewable {
+		return
+	}
+	ttl, _ := resp.Data["ttl"].(float64)
+	wait := time.Duration(ttl) * time.Second / 2
+
+	for {
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return
+		}
+
+		ttl, renewable, err := v.RenewToken(ctx)
+		wait = ttl / 2
+		switch {
+		case ctx.Err() != nil:
+			return
+		case err != nil:
+			log.Printf("error renewing Vault token: %s", err)
+			wait = time.Minute
+		case !renewable:
+			log.Printf("Vault token is no longer renewable, it expires in %s", ttl)
+			return
+		}
+	}
+}
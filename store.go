@@ -0,0 +1,228 @@
+package registro
+
+import (
+	"time"
+
+	"github.com/numercfd/registro/internal/server"
+	"github.com/numercfd/registro/model"
+)
+
+// Store persists the registry state so it survives restarts.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Load returns the applications saved in the store.
+	Load() ([]*StoredApplication, error)
+
+	// Write applies a batch of changes to the store.
+	Write(batch []Change) error
+
+	// Close releases any resource held by the store.
+	Close() error
+}
+
+// StoredApplication is an application as saved in a Store, with its
+// instances.
+type StoredApplication struct {
+	Name        string
+	ActiveGroup string
+	MinHealthy  int
+	TTL         time.Duration
+	Archived    bool
+	Environment string
+	ExpiresAt   time.Time
+	Instances   []*StoredInstance
+}
+
+// StoredInstance is an instance as saved in a Store.
+type StoredInstance struct {
+	Id                 string
+	IPAddr             string
+	Port               int
+	Status             model.StatusType
+	Generation         uint64
+	Metadata           map[string]string
+	Version            uint64
+	DeploymentGroup    string
+	LeaseId            string
+	PlannedTermination time.Time
+	RegisteredAt       time.Time
+	FirstUpAt          time.Time
+	StatusChangedAt    time.Time
+
+	// LastRenewal is when the instance last renewed its lease, in unix
+	// seconds.
+	LastRenewal int64
+}
+
+// ChangeType identifies the kind of change written to a Store.
+type ChangeType int
+
+const (
+	// PutApplication creates an application, or updates its settings.
+	PutApplication ChangeType = iota
+
+	// PutInstance creates or replaces an instance.
+	PutInstance
+
+	// RenewInstance replaces an instance whose only change was a renewal.
+	RenewInstance
+
+	// DeleteInstance removes an instance.
+	DeleteInstance
+
+	// DeleteApplication removes an application and its instances.
+	DeleteApplication
+)
+
+// Change is a single modification of the registry state, written to a
+// Store. The settings of the application are set on every change.
+type Change struct {
+	Type ChangeType
+
+	// App is the name of the application changed.
+	App string
+
+	// Instance holds the instance changed, if any.
+	Instance *StoredInstance
+
+	ActiveGroup string
+	MinHealthy  int
+	TTL         time.Duration
+	Archived    bool
+	Environment string
+	ExpiresAt   time.Time
+}
+
+// NewFileStore returns a Store which keeps the registry in a JSON file.
+func NewFileStore(path string) Store {
+	return fileStore{server.NewFileStore(path)}
+}
+
+// fileStore is the Store of NewFileStore. Servers use the server.Store it
+// wraps directly.
+type fileStore struct {
+	store server.Store
+}
+
+func (f fileStore) Load() ([]*StoredApplication, error) {
+	apps, err := f.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	stored := make([]*StoredApplication, 0, len(apps))
+	for _, app := range apps {
+		sa := &StoredApplication{Name: app.Name, ActiveGroup: app.ActiveGroup, MinHealthy: app.MinHealthy, TTL: app.TTL,
+			Archived: app.Archived, Environment: app.Environment, ExpiresAt: app.ExpiresAt}
+		for _, inst := range app.Instances {
+			sa.Instances = append(sa.Instances, storedInstance(inst))
+		}
+		stored = append(stored, sa)
+	}
+	return stored, nil
+}
+
+func (f fileStore) Write(batch []Change) error {
+	changes := make([]server.Change, 0, len(batch))
+	for _, c := range batch {
+		sc := server.Change{Type: server.ChangeType(c.Type), App: c.App, ActiveGroup: c.ActiveGroup, MinHealthy: c.MinHealthy,
+			TTL: c.TTL, Archived: c.Archived, Environment: c.Environment, ExpiresAt: c.ExpiresAt}
+		if c.Instance != nil {
+			sc.Instance = c.Instance.instance()
+		}
+		changes = append(changes, sc)
+	}
+	return f.store.Write(changes)
+}
+
+func (f fileStore) Close() error {
+	return f.store.Close()
+}
+
+// serverStore adapts a Store to the server.
+type serverStore struct {
+	store Store
+}
+
+// newServerStore returns the server.Store writing to store.
+func newServerStore(store Store) server.Store {
+	if f, ok := store.(fileStore); ok {
+		return f.store
+	}
+	return serverStore{store}
+}
+
+func (s serverStore) Load() ([]*server.Application, error) {
+	stored, err := s.store.Load()
+	if err != nil {
+		return nil, err
+	}
+	apps := make([]*server.Application, 0, len(stored))
+	for _, sa := range stored {
+		app := server.NewApplication(sa.Name)
+		app.ActiveGroup = sa.ActiveGroup
+		app.MinHealthy = sa.MinHealthy
+		app.TTL = sa.TTL
+		app.Archived = sa.Archived
+		app.Environment = sa.Environment
+		app.ExpiresAt = sa.ExpiresAt
+		for _, si := range sa.Instances {
+			app.Instances = append(app.Instances, si.instance())
+		}
+		apps = append(apps, app)
+	}
+	return apps, nil
+}
+
+func (s serverStore) Write(batch []server.Change) error {
+	changes := make([]Change, 0, len(batch))
+	for _, sc := range batch {
+		c := Change{Type: ChangeType(sc.Type), App: sc.App, ActiveGroup: sc.ActiveGroup, MinHealthy: sc.MinHealthy,
+			TTL: sc.TTL, Archived: sc.Archived, Environment: sc.Environment, ExpiresAt: sc.ExpiresAt}
+		if sc.Instance != nil {
+			c.Instance = storedInstance(sc.Instance)
+		}
+		changes = append(changes, c)
+	}
+	return s.store.Write(changes)
+}
+
+func (s serverStore) Close() error {
+	return s.store.Close()
+}
+
+// storedInstance returns the StoredInstance of inst.
+func storedInstance(inst *server.Instance) *StoredInstance {
+	return &StoredInstance{
+		Id:                 inst.Id,
+		IPAddr:             inst.IPAddr,
+		Port:               inst.Port,
+		Status:             inst.Status,
+		Generation:         inst.Generation,
+		Metadata:           inst.Metadata,
+		Version:            inst.Version,
+		DeploymentGroup:    inst.DeploymentGroup,
+		LeaseId:            inst.LeaseId,
+		PlannedTermination: inst.PlannedTermination,
+		RegisteredAt:       inst.RegisteredAt,
+		FirstUpAt:          inst.FirstUpAt,
+		StatusChangedAt:    inst.StatusChangedAt,
+		LastRenewal:        inst.LastRenewal,
+	}
+}
+
+// instance returns the server instance of si.
+func (si *StoredInstance) instance() *server.Instance {
+	inst := server.NewInstance(si.Id, si.IPAddr, si.Port)
+	inst.Status = si.Status
+	inst.Generation = si.Generation
+	inst.Metadata = si.Metadata
+	inst.Version = si.Version
+	inst.DeploymentGroup = si.DeploymentGroup
+	inst.LeaseId = si.LeaseId
+	inst.PlannedTermination = si.PlannedTermination
+	inst.RegisteredAt = si.RegisteredAt
+	inst.FirstUpAt = si.FirstUpAt
+	inst.StatusChangedAt = si.StatusChangedAt
+	inst.LastRenewal = si.LastRenewal
+	return inst
+}
@@ -0,0 +1,63 @@
+// Package systemd implements the sd_notify protocol used by services started
+// by systemd with Type=notify and WatchdogSec.
+//
+// All functions are no-ops when the process is not running under systemd.
+package systemd
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Notify sends state to the systemd notification socket.
+// It returns false if NOTIFY_SOCKET is not set.
+func Notify(state string) (bool, error) {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return false, nil
+	}
+	if name[0] == '@' {
+		// Abstract namespace socket.
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Ready tells systemd the service finished starting up.
+func Ready() error {
+	_, err := Notify("READY=1")
+	return err
+}
+
+// Watchdog feeds the systemd watchdog.
+func Watchdog() error {
+	_, err := Notify("WATCHDOG=1")
+	return err
+}
+
+// WatchdogInterval returns the watchdog timeout configured by systemd.
+// It returns zero if the watchdog is not enabled for this process.
+func WatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+
+	// WATCHDOG_PID is optional, but when set it must match this process.
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}